@@ -7,14 +7,16 @@ import (
    "fmt"
    "io"
    "os"
+   "path/filepath"
 
    "github.com/pkg/errors"
 
    "github.com/eriq-augustine/elfs/cipherio"
+   "github.com/eriq-augustine/elfs/util"
 )
 
 func main() {
-   key, iv, path, err := parseArgs();
+   key, iv, path, isMetadata, isLegacy, err := parseArgs();
    if (err != nil) {
       flag.Usage();
       panic(fmt.Sprintf("Error parsing args: %+v\n", err));
@@ -35,7 +37,30 @@ func main() {
       panic(fmt.Sprintf("Failed to stat file: %+v\n", err));
    }
 
-   reader, err := cipherio.NewCipherReader(file, blockCipher, iv, fileStat.Size());
+   // Files and metadata are stored under their id, which is also the id of their stream.
+   var streamId string = filepath.Base(path);
+
+   var reader util.ReadSeekCloser;
+   if (isMetadata) {
+      // The IV is only needed for legacy metadata, the envelope carries its own.
+      reader, err = cipherio.NewMetadataReader(file, blockCipher, iv, streamId, fileStat.Size());
+   } else {
+      var version int = cipherio.CURRENT_CIPHER_VERSION;
+      if (isLegacy) {
+         version = cipherio.CIPHER_VERSION_LEGACY;
+      }
+
+      // Files that have had chunks rewritten (see cipherio.ChunkEditor) also need the chunk IVs from the FAT,
+      // so only files that have always been written whole can be decrypted here.
+      var params cipherio.StreamParams = cipherio.StreamParams{
+         BlockCipher: blockCipher,
+         IV: iv,
+         StreamId: streamId,
+         Version: version,
+      };
+      reader, err = cipherio.NewCipherReader(file, params, fileStat.Size());
+   }
+
    if (err != nil) {
       panic(fmt.Sprintf("Failed to create cipher reader: %+v\n", err));
    }
@@ -47,34 +72,39 @@ func main() {
    }
 }
 
-// Returns: (key, iv, path).
-func parseArgs() ([]byte, []byte, string, error) {
+// Returns: (key, iv, path, is metadata, is legacy).
+func parseArgs() ([]byte, []byte, string, bool, bool, error) {
    var hexKey *string = flag.String("key", "", "the encryption key in hex");
-   var hexIV *string = flag.String("iv", "", "the IV in hex");
+   var hexIV *string = flag.String("iv", "", "the IV in hex (only needed for legacy metadata when using -metadata)");
    var path *string = flag.String("path", "", "the path to the ciphertext file");
+   var isMetadata *bool = flag.Bool("metadata", false, "the file is a metadata file (has an envelope header)");
+   var isLegacy *bool = flag.Bool("legacy", false, "the file was written before chunks were authenticated (see the dirent's CipherVersion)");
    flag.Parse();
 
    if (hexKey == nil || *hexKey == "") {
-      return nil, nil, "", errors.New("Error: Key required.");
+      return nil, nil, "", false, false, errors.New("Error: Key required.");
    }
 
-   if (hexIV == nil || *hexIV == "") {
-      return nil, nil, "", errors.New("Error: IV required.");
+   if (!*isMetadata && (hexIV == nil || *hexIV == "")) {
+      return nil, nil, "", false, false, errors.New("Error: IV required.");
    }
 
    if (path == nil || *path == "") {
-      return nil, nil, "", errors.New("Error: Path required.");
+      return nil, nil, "", false, false, errors.New("Error: Path required.");
    }
 
    key, err := hex.DecodeString(*hexKey);
    if (err != nil) {
-      return nil, nil, "", errors.Wrap(err, "Could not decode hex key.");
+      return nil, nil, "", false, false, errors.Wrap(err, "Could not decode hex key.");
    }
 
-   iv, err := hex.DecodeString(*hexIV);
-   if (err != nil) {
-      return nil, nil, "", errors.Wrap(err, "Could not decode hex iv.");
+   var iv []byte = nil;
+   if (*hexIV != "") {
+      iv, err = hex.DecodeString(*hexIV);
+      if (err != nil) {
+         return nil, nil, "", false, false, errors.Wrap(err, "Could not decode hex iv.");
+      }
    }
 
-   return key, iv, *path, nil;
+   return key, iv, *path, *isMetadata, *isLegacy, nil;
 }
@@ -1,6 +1,7 @@
 package main;
 
 import (
+    "encoding/hex"
     "fmt"
     "io"
     "io/ioutil"
@@ -9,13 +10,16 @@ import (
     "sort"
     "strconv"
     "strings"
+    "time"
 
     "github.com/pkg/errors"
 
     "github.com/eriq-augustine/elfs/cipherio"
+    "github.com/eriq-augustine/elfs/connector/s3"
     "github.com/eriq-augustine/elfs/dirent"
     "github.com/eriq-augustine/elfs/driver"
     "github.com/eriq-augustine/elfs/identity"
+    "github.com/eriq-augustine/elfs/metadata"
     "github.com/eriq-augustine/elfs/util"
 )
 
@@ -32,7 +36,7 @@ func init() {
         Name: "cat",
         Function: cat,
         Args: []commandArg{
-            commandArg{"file", false},
+            commandArg{"file id|path", false},
         },
         Variatic: true,
     };
@@ -41,7 +45,7 @@ func init() {
         Name: "export",
         Function: export,
         Args: []commandArg{
-            commandArg{"file", false},
+            commandArg{"file id|path", false},
             commandArg{"external path", false},
         },
         Variatic: false,
@@ -104,7 +108,7 @@ func init() {
         Function: importFile,
         Args: []commandArg{
             commandArg{"external file", false},
-            commandArg{"parent id", true},
+            commandArg{"parent id|path", true},
         },
         Variatic: false,
     };
@@ -113,7 +117,7 @@ func init() {
         Name: "ls",
         Function: ls,
         Args: []commandArg{
-            commandArg{"dir id", true},
+            commandArg{"dir id|path", true},
         },
         Variatic: false,
     };
@@ -123,7 +127,7 @@ func init() {
         Function: mkdir,
         Args: []commandArg{
             commandArg{"dir name", false},
-            commandArg{"parent id", true},
+            commandArg{"parent id|path", true},
         },
         Variatic: false,
     };
@@ -132,8 +136,8 @@ func init() {
         Name: "mv",
         Function: move,
         Args: []commandArg{
-            commandArg{"target id", false},
-            commandArg{"new parent id", false},
+            commandArg{"target id|path", false},
+            commandArg{"new parent id|path", false},
         },
         Variatic: false,
     };
@@ -152,7 +156,7 @@ func init() {
         Name: "rename",
         Function: rename,
         Args: []commandArg{
-            commandArg{"target id", false},
+            commandArg{"target id|path", false},
             commandArg{"new name", false},
         },
         Variatic: false,
@@ -163,11 +167,53 @@ func init() {
         Function: remove,
         Args: []commandArg{
             commandArg{"-r", true},
-            commandArg{"dirent id", false},
+            commandArg{"dirent id|path", false},
         },
         Variatic: false,
     };
 
+    commands["resync"] = commandInfo{
+        Name: "resync",
+        Function: resync,
+        Args: []commandArg{},
+        Variatic: false,
+    };
+
+    commands["rotate-key"] = commandInfo{
+        Name: "rotate-key",
+        Function: rotateKey,
+        Args: []commandArg{
+            commandArg{"new key (hex)", false},
+        },
+        Variatic: false,
+    };
+
+    commands["storage-class"] = commandInfo{
+        Name: "storage-class",
+        Function: storageClass,
+        Args: []commandArg{
+            commandArg{"dir id|path", false},
+            commandArg{"S3 storage class (empty to use the parent's)", true},
+        },
+        Variatic: false,
+    };
+
+    commands["sweep-uploads"] = commandInfo{
+        Name: "sweep-uploads",
+        Function: sweepUploads,
+        Args: []commandArg{
+            commandArg{"min age (e.g. 24h)", true},
+        },
+        Variatic: false,
+    };
+
+    commands["upgrade-metadata"] = commandInfo{
+        Name: "upgrade-metadata",
+        Function: upgradeMetadata,
+        Args: []commandArg{},
+        Variatic: false,
+    };
+
     commands["useradd"] = commandInfo{
         Name: "useradd",
         Function: useradd,
@@ -201,7 +247,7 @@ func init() {
             commandArg{"-r", true},
             commandArg{"owner id", false},
             commandArg{"group id", false},
-            commandArg{"dirent id", false},
+            commandArg{"dirent id|path", false},
         },
         Variatic: false,
     };
@@ -212,7 +258,7 @@ func init() {
         Args: []commandArg{
             commandArg{"-r", true},
             commandArg{"UNIX permissions", false},
-            commandArg{"dirent id", false},
+            commandArg{"dirent id|path", false},
         },
         Variatic: false,
     };
@@ -227,7 +273,12 @@ func cat(fsDriver *driver.Driver, activeUser *identity.User, args []string) (err
         // Reset the buffer from the last read.
         buffer = buffer[0:cap(buffer)];
 
-        reader, err := fsDriver.Read(activeUser.Id, dirent.Id(arg));
+        fileId, err := resolveDirentArg(fsDriver, activeUser, arg);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+
+        reader, err := fsDriver.Read(activeUser.Id, fileId);
         if (err != nil) {
             return errors.Wrap(err, "Failed to open fs file for reading: " + arg);
         }
@@ -237,6 +288,7 @@ func cat(fsDriver *driver.Driver, activeUser *identity.User, args []string) (err
             readSize, err := reader.Read(buffer);
             if (err != nil) {
                 if (err != io.EOF) {
+                    reader.Close();
                     return errors.Wrap(err, "Failed to read fs file: " + arg);
                 }
 
@@ -256,7 +308,11 @@ func cat(fsDriver *driver.Driver, activeUser *identity.User, args []string) (err
 }
 
 func export(fsDriver *driver.Driver, activeUser *identity.User, args []string) (error) {
-    var source dirent.Id = dirent.Id(args[0]);
+    source, err := resolveDirentArg(fsDriver, activeUser, args[0]);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
     var dest string = args[1];
 
     fileInfo, err := fsDriver.GetDirent(activeUser.Id, source);
@@ -332,7 +388,11 @@ func importFile(fsDriver *driver.Driver, activeUser *identity.User, args []strin
 
     var parent dirent.Id = dirent.ROOT_ID;
     if (len(args) == 2) {
-        parent = dirent.Id(args[1]);
+        var err error;
+        parent, err = resolveDirentArg(fsDriver, activeUser, args[1]);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
     }
 
     return errors.WithStack(recursiveImport(fsDriver, activeUser, localPath, parent));
@@ -341,7 +401,11 @@ func importFile(fsDriver *driver.Driver, activeUser *identity.User, args []strin
 func ls(fsDriver *driver.Driver, activeUser *identity.User, args []string) (error) {
     var id dirent.Id = dirent.ROOT_ID;
     if (len(args) == 1) {
-        id = dirent.Id(args[0]);
+        var err error;
+        id, err = resolveDirentArg(fsDriver, activeUser, args[0]);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
     }
 
     entries, err := fsDriver.List(activeUser.Id, id);
@@ -357,7 +421,7 @@ func ls(fsDriver *driver.Driver, activeUser *identity.User, args []string) (erro
             direntType = "-";
         }
 
-        parts = append(parts, (direntType + entry.Permissions.String()), string(entry.Owner), string(entry.Group),
+        parts = append(parts, (direntType + entry.Permissions.String()), fmt.Sprintf("%d", int(entry.Owner)), fmt.Sprintf("%d", int(entry.Group)),
                 fmt.Sprintf("%d", entry.Size), fmt.Sprintf("%d", entry.ModTimestamp), entry.Md5,
                 string(entry.Id), entry.Name);
 
@@ -372,7 +436,11 @@ func mkdir(fsDriver *driver.Driver, activeUser *identity.User, args []string) (e
 
     var parent dirent.Id = dirent.ROOT_ID;
     if (len(args) == 2) {
-        parent = dirent.Id(args[1]);
+        var err error;
+        parent, err = resolveDirentArg(fsDriver, activeUser, args[1]);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
     }
 
     id, err := fsDriver.MakeDir(activeUser.Id, name, parent);
@@ -386,14 +454,29 @@ func mkdir(fsDriver *driver.Driver, activeUser *identity.User, args []string) (e
 }
 
 func move(fsDriver *driver.Driver, activeUser *identity.User, args []string) (error) {
-    var targetId dirent.Id = dirent.Id(args[0]);
-    var newParentId dirent.Id = dirent.Id(args[1]);
+    // Full paths get full mv semantics (moving into a directory or renaming).
+    if (strings.HasPrefix(args[0], dirent.FILE_SEPARATOR) && strings.HasPrefix(args[1], dirent.FILE_SEPARATOR)) {
+        return errors.WithStack(fsDriver.MovePath(activeUser.Id, args[0], args[1]));
+    }
+
+    targetId, err := resolveDirentArg(fsDriver, activeUser, args[0]);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    newParentId, err := resolveDirentArg(fsDriver, activeUser, args[1]);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
 
     return errors.WithStack(fsDriver.Move(activeUser.Id, targetId, newParentId));
 }
 
 func rename(fsDriver *driver.Driver, activeUser *identity.User, args []string) (error) {
-    var targetId dirent.Id = dirent.Id(args[0]);
+    targetId, err := resolveDirentArg(fsDriver, activeUser, args[0]);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
 
     return errors.WithStack(fsDriver.Rename(activeUser.Id, targetId, args[1]));
 }
@@ -409,9 +492,11 @@ func remove(fsDriver *driver.Driver, activeUser *identity.User, args []string) (
         args = args[1:];
     }
 
-    var direntId dirent.Id = dirent.Id(args[0]);
+    direntId, err := resolveDirentArg(fsDriver, activeUser, args[0]);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
 
-    var err error = nil;
     if (isFile) {
         err = fsDriver.RemoveFile(activeUser.Id, direntId);
     } else {
@@ -528,6 +613,91 @@ func promote(fsDriver *driver.Driver, activeUser *identity.User, args []string)
     return errors.WithStack(fsDriver.PromoteUser(activeUser.Id, identity.UserId(userId), identity.GroupId(groupId)));
 }
 
+func rotateKey(fsDriver *driver.Driver, activeUser *identity.User, args []string) (error) {
+    newKey, err := hex.DecodeString(args[0]);
+    if (err != nil) {
+        return errors.Wrap(err, "Could not decode hex key.");
+    }
+
+    err = fsDriver.RotateKey(activeUser.Id, newKey);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    fmt.Println("Master key changed, the new key must be used from now on.");
+    return nil;
+}
+
+func storageClass(fsDriver *driver.Driver, activeUser *identity.User, args []string) (error) {
+    dirId, err := resolveDirentArg(fsDriver, activeUser, args[0]);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    var class string = "";
+    if (len(args) == 2) {
+        class = strings.ToUpper(args[1]);
+        if (!s3.ValidStorageClass(class)) {
+            return errors.Errorf("Unknown storage class: '%s'.", args[1]);
+        }
+
+        if (!s3.ValidOverrideStorageClass(class)) {
+            return errors.Errorf("Dirs cannot use storage class '%s', files in it cannot be read.", args[1]);
+        }
+    }
+
+    return errors.WithStack(fsDriver.SetStorageClass(activeUser.Id, dirId, class));
+}
+
+func sweepUploads(fsDriver *driver.Driver, activeUser *identity.User, args []string) (error) {
+    var minAge time.Duration = s3.DEFAULT_STALE_UPLOAD_AGE;
+    if (len(args) == 1) {
+        var err error;
+        minAge, err = time.ParseDuration(args[0]);
+        if (err != nil) {
+            return errors.Wrap(err, args[0]);
+        }
+
+        // Sweeping younger uploads could abort ones that are still going.
+        if (minAge < s3.MIN_STALE_UPLOAD_AGE) {
+            return errors.Errorf("The min age must be at least %s (not %s).", s3.MIN_STALE_UPLOAD_AGE, minAge);
+        }
+    }
+
+    report, err := fsDriver.SweepStaleUploads(activeUser.Id, minAge);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    fmt.Printf("Aborted %d stale uploads (%d bytes reclaimed), skipped %d newer than %s.\n",
+            report.Aborted, report.BytesReclaimed, report.Skipped, minAge);
+    return nil;
+}
+
+func resync(fsDriver *driver.Driver, activeUser *identity.User, args []string) (error) {
+    report, err := fsDriver.Resync(activeUser.Id);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    for _, resyncErr := range(report.Errors) {
+        fmt.Printf("%v\n", resyncErr);
+    }
+
+    fmt.Printf("Checked %d objects, copied %d, removed %d, failed %d.\n", report.Checked, report.Copied, report.Removed, report.Failed);
+    return nil;
+}
+
+func upgradeMetadata(fsDriver *driver.Driver, activeUser *identity.User, args []string) (error) {
+    err := fsDriver.UpgradeMetadata(activeUser.Id);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    fmt.Printf("All metadata is now in format %d.\n", metadata.FORMAT_VERSION);
+    return nil;
+}
+
 func chown(fsDriver *driver.Driver, activeUser *identity.User, args []string) (error) {
     if (len(args) == 4 && args[0] != "-r") {
         return errors.New(fmt.Sprintf("Unexpected arg (%s), expecting -r", args[0]));
@@ -549,7 +719,12 @@ func chown(fsDriver *driver.Driver, activeUser *identity.User, args []string) (e
         return errors.Wrap(err, args[1]);
     }
 
-    direntInfo, err := fsDriver.GetDirent(activeUser.Id, dirent.Id(args[2]));
+    direntId, err := resolveDirentArg(fsDriver, activeUser, args[2]);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    direntInfo, err := fsDriver.GetDirent(activeUser.Id, direntId);
     if (err != nil) {
         return errors.Wrap(err, args[2]);
     }
@@ -573,7 +748,12 @@ func chmod(fsDriver *driver.Driver, activeUser *identity.User, args []string) (e
         return errors.Wrap(err, args[0]);
     }
 
-    direntInfo, err := fsDriver.GetDirent(activeUser.Id, dirent.Id(args[1]));
+    direntId, err := resolveDirentArg(fsDriver, activeUser, args[1]);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    direntInfo, err := fsDriver.GetDirent(activeUser.Id, direntId);
     if (err != nil) {
         return errors.Wrap(err, args[1]);
     }
@@ -583,6 +763,20 @@ func chmod(fsDriver *driver.Driver, activeUser *identity.User, args []string) (e
 
 // Helpers
 
+// Dirents can be referenced either by id or by absolute path (anything starting with a '/').
+func resolveDirentArg(fsDriver *driver.Driver, activeUser *identity.User, arg string) (dirent.Id, error) {
+    if (!strings.HasPrefix(arg, dirent.FILE_SEPARATOR)) {
+        return dirent.Id(arg), nil;
+    }
+
+    direntInfo, err := fsDriver.ResolvePath(activeUser.Id, arg);
+    if (err != nil) {
+        return dirent.EMPTY_ID, errors.WithStack(err);
+    }
+
+    return direntInfo.Id, nil;
+}
+
 func chownHelper(fsDriver *driver.Driver, activeUser *identity.User, direntInfo *dirent.Dirent, userId identity.UserId, groupId identity.GroupId, recurse bool) error {
     err := fsDriver.ChangeOwner(activeUser.Id, direntInfo.Id, userId);
     if (err != nil) {
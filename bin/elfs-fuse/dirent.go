@@ -13,3 +13,16 @@ type fuseDirent struct {
     driver *driver.Driver
     user *identity.User
 }
+
+// Get the current version of this dirent from the driver.
+// The driver only gives out copies, so the dirent we hold may be stale
+// (eg if the file has been written since it was looked up).
+// If the dirent can no longer be fetched, the copy we hold is returned.
+func (this fuseDirent) current() *dirent.Dirent {
+    direntInfo, err := this.driver.GetDirent(this.user.Id, this.dirent.Id);
+    if (err != nil) {
+        return this.dirent;
+    }
+
+    return direntInfo;
+}
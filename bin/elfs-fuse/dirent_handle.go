@@ -11,9 +11,9 @@ package main
 //  - fs.HandleWriter
 
 import (
-    "bytes"
     "fmt"
     "io"
+    "io/ioutil"
     "syscall"
 
     "bazil.org/fuse"
@@ -57,24 +57,20 @@ func (this fuseDirent) ReadAll(ctx context.Context) ([]byte, error) {
         return nil, fuse.Errno(syscall.EISDIR);
     }
 
-    var buffer []byte = make([]byte, this.dirent.Size);
-
     reader, err := this.driver.Read(this.user.Id, this.dirent.Id);
     if (err != nil) {
         return nil, errors.Wrap(err, "Failed to open fs file for reading: " + string(this.dirent.Id));
     }
     defer reader.Close();
 
-    readSize, err := reader.Read(buffer);
-    if (err != nil && err != io.EOF) {
+    // The file may have changed since this dirent was fetched,
+    // so just read until the end instead of trusting the size.
+    data, err := ioutil.ReadAll(reader);
+    if (err != nil) {
         return nil, errors.Wrap(err, "Failed to read fs file: " + string(this.dirent.Id));
     }
 
-    if (uint64(readSize) != this.dirent.Size) {
-        return nil, errors.New(fmt.Sprintf("Short read on '%s'. Expected %d, got %d.", this.dirent.Id, this.dirent.Size, readSize));
-    }
-
-    return buffer, nil;
+    return data, nil;
 }
 
 func (this fuseDirent) Read(ctx context.Context, request *fuse.ReadRequest, response *fuse.ReadResponse) error {
@@ -115,25 +111,14 @@ func (this fuseDirent) Flush(ctx context.Context, request *fuse.FlushRequest) er
 }
 
 func (this fuseDirent) Write(ctx context.Context, request *fuse.WriteRequest, response *fuse.WriteResponse) error {
-    // Although it would be possible to handle writes in the middle of files,
-    // we are just keeping it simple and re-writing the entire file.
     // Like Read() we will ignore all flags and locks.
-
-    data, err := this.ReadAll(ctx);
-    if (err != nil) {
-        return errors.Wrap(err, "Failed to read old data for write: " + string(this.dirent.Id));
-    }
-
-    // Just reslice to remove the data after the offset, and append.
-    data = data[:request.Offset];
-    data = append(data, request.Data...);
-
-    _, err = this.driver.Put(this.user.Id, this.dirent.Name, bytes.NewReader(data), this.dirent.Parent);
+    // Only the chunks of the file that are touched by the write get rewritten.
+    writeSize, err := this.driver.WriteAt(this.user.Id, this.dirent.Id, request.Data, request.Offset);
     if (err != nil) {
         return errors.Wrap(err, "Failed to write data for write: " + string(this.dirent.Id));
     }
 
-    response.Size = len(request.Data);
+    response.Size = writeSize;
 
     return nil;
 }
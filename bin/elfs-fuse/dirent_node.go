@@ -55,25 +55,27 @@ func (this fuseDirent) Access(ctx context.Context, request *fuse.AccessRequest)
         return nil;
     }
 
-    group, ok := this.driver.GetGroups()[this.dirent.Group];
-    if (!ok) {
-        return errors.Errorf("Unable to find the group (%d) for dirent (%s).", int(this.dirent.Group), string(this.dirent.Id));
+    var direntInfo *dirent.Dirent = this.current();
+
+    group, err := this.driver.GetGroup(direntInfo.Group);
+    if (err != nil) {
+        return errors.Wrapf(err, "Unable to find the group (%d) for dirent (%s).", int(direntInfo.Group), string(direntInfo.Id));
     }
 
     if (request.Mask & ACCESS_R_OK != 0) {
-        if (!this.dirent.CanRead(this.user, group)) {
+        if (!direntInfo.CanRead(this.user, group)) {
             return fuse.EPERM;
         }
     }
 
     if (request.Mask & ACCESS_W_OK != 0) {
-        if (!this.dirent.CanWrite(this.user, group)) {
+        if (!direntInfo.CanWrite(this.user, group)) {
             return fuse.EPERM;
         }
     }
 
     if (request.Mask & ACCESS_X_OK != 0) {
-        if (!this.dirent.CanExecute(this.user, group)) {
+        if (!direntInfo.CanExecute(this.user, group)) {
             return fuse.EPERM;
         }
     }
@@ -82,22 +84,24 @@ func (this fuseDirent) Access(ctx context.Context, request *fuse.AccessRequest)
 }
 
 func (this fuseDirent) Attr(ctx context.Context, attr *fuse.Attr) error {
+    var direntInfo *dirent.Dirent = this.current();
+
     attr.Inode = 0;  // Dynamic.
-    attr.Size = this.dirent.Size;
-    attr.Blocks = util.CeilUint64(float64(this.dirent.Size) / FUSE_BLOCKSIZE);
-    attr.Atime = time.Unix(this.dirent.AccessTimestamp, 0);
-    attr.Mtime = time.Unix(this.dirent.ModTimestamp, 0);
-    attr.Ctime = time.Unix(this.dirent.CreateTimestamp, 0);
-    attr.Crtime = time.Unix(this.dirent.CreateTimestamp, 0);
+    attr.Size = direntInfo.Size;
+    attr.Blocks = util.CeilUint64(float64(direntInfo.Size) / FUSE_BLOCKSIZE);
+    attr.Atime = time.Unix(direntInfo.AccessTimestamp, 0);
+    attr.Mtime = time.Unix(direntInfo.ModTimestamp, 0);
+    attr.Ctime = time.Unix(direntInfo.CreateTimestamp, 0);
+    attr.Crtime = time.Unix(direntInfo.CreateTimestamp, 0);
     attr.Nlink = 1;
-    attr.Uid = uint32(this.dirent.Owner);
-    attr.Gid = uint32(this.dirent.Group);
+    attr.Uid = uint32(direntInfo.Owner);
+    attr.Gid = uint32(direntInfo.Group);
     // attr.Rdev
     // attr.Flags
     attr.BlockSize = cipherio.IO_BLOCK_SIZE;
 
-    var mode os.FileMode = os.FileMode(this.dirent.Permissions);
-    if (!this.dirent.IsFile) {
+    var mode os.FileMode = os.FileMode(direntInfo.Permissions);
+    if (!direntInfo.IsFile) {
         mode |= os.ModeDir;
     }
     attr.Mode = mode;
@@ -263,8 +267,13 @@ func (this fuseDirent) Setattr(ctx context.Context, request *fuse.SetattrRequest
     }
 
     if (request.Valid & fuse.SetattrSize != 0) {
-        // Size.
-        // Ignore, we only want to change size through writes.
+        // Size (truncate).
+        err = this.driver.Truncate(this.user.Id, this.dirent.Id, request.Size);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+
+        response.Attr.Size = request.Size;
     }
 
     if (request.Valid & fuse.SetattrAtime != 0) {
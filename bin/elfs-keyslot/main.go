@@ -0,0 +1,261 @@
+package main;
+
+// Manage the key slots in a filesystem's key header (see keyring).
+// Usage: elfs-keyslot <connector args> <command> [slot id]
+// Commands:
+//    list - Show the slots.
+//    add - Add a slot with a new passphrase.
+//          If the filesystem does not have a key header yet, one is made from --key and --iv.
+//    remove <slot id> - Remove a slot (using the passphrase of a different slot).
+//    passwd <slot id> - Give a slot a new passphrase.
+//    rotate - Change the master key (see driver.RotateKey()).
+//             Only the slot for the given passphrase is kept, and root must log in.
+
+import (
+   "fmt"
+   "os"
+   "strconv"
+
+   "github.com/pkg/errors"
+   "github.com/spf13/pflag"
+
+   "github.com/eriq-augustine/elfs/connector"
+   "github.com/eriq-augustine/elfs/driver"
+   "github.com/eriq-augustine/elfs/identity"
+   "github.com/eriq-augustine/elfs/keyring"
+   "github.com/eriq-augustine/elfs/util"
+)
+
+func main() {
+   var newKeyFile *string = pflag.String("new-key-file", "", "File holding the new passphrase (prompts if not given)");
+   fsConnector, args := driver.GetConnectorFromArgs();
+
+   var commandArgs []string = pflag.Args();
+   if (len(commandArgs) == 0) {
+      fsConnector.Close();
+      fmt.Println("Usage: elfs-keyslot <connector args> list|add|remove <slot id>|passwd <slot id>|rotate");
+      os.Exit(1);
+   }
+
+   var err error;
+   switch commandArgs[0] {
+      case "list":
+         err = list(fsConnector);
+      case "add":
+         err = add(fsConnector, args, *newKeyFile);
+      case "remove":
+         err = remove(fsConnector, args, commandArgs[1:]);
+      case "passwd":
+         err = passwd(fsConnector, args, *newKeyFile, commandArgs[1:]);
+      case "rotate":
+         // The driver takes over the connector.
+         err = rotate(fsConnector, args, *newKeyFile);
+         if (err != nil) {
+            fmt.Printf("%+v\n", err);
+            os.Exit(3);
+         }
+         return;
+      default:
+         err = errors.Errorf("Unknown command: %s.", commandArgs[0]);
+   }
+
+   fsConnector.Close();
+
+   if (err != nil) {
+      fmt.Printf("%+v\n", err);
+      os.Exit(2);
+   }
+}
+
+func list(fsConnector connector.Connector) error {
+   header, err := keyring.Read(fsConnector);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   for _, slot := range(header.Slots) {
+      fmt.Printf("Slot %d: scrypt (N: %d, r: %d, p: %d)\n", slot.Id, slot.N, slot.R, slot.P);
+   }
+
+   for _, slot := range(header.PendingSlots) {
+      fmt.Printf("Pending slot %d (from an unfinished rotation): scrypt (N: %d, r: %d, p: %d)\n", slot.Id, slot.N, slot.R, slot.P);
+   }
+
+   return nil;
+}
+
+func add(fsConnector connector.Connector, args *driver.Args, newKeyFile string) error {
+   hasHeader, err := keyring.Exists(fsConnector);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   var header *keyring.KeyHeader = nil;
+   var masterKey []byte = nil;
+
+   if (hasHeader) {
+      header, masterKey, _, err = unlock(fsConnector, args);
+      if (err != nil) {
+         return errors.WithStack(err);
+      }
+   } else if (args.Key == nil) {
+      return errors.New("The filesystem has no key header yet, --key and --iv are needed to make one.");
+   }
+
+   passphrase, err := keyring.GetPassphrase(newKeyFile, "New passphrase", true);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   var slotId int = 0;
+   if (header == nil) {
+      header, err = keyring.NewKeyHeader(args.Key, args.IV, passphrase);
+   } else {
+      slotId, err = header.AddSlot(masterKey, passphrase);
+   }
+
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   err = header.Write(fsConnector);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   fmt.Printf("Added slot %d.\n", slotId);
+   return nil;
+}
+
+func remove(fsConnector connector.Connector, args *driver.Args, commandArgs []string) error {
+   slotId, err := parseSlotId(commandArgs);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   header, _, unlockedSlot, err := unlock(fsConnector, args);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   // Make sure that there is still a known passphrase after the removal.
+   if (unlockedSlot == slotId) {
+      return errors.New("Give the passphrase of a slot that will remain.");
+   }
+
+   err = header.RemoveSlot(slotId);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   err = header.Write(fsConnector);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   fmt.Printf("Removed slot %d.\n", slotId);
+   return nil;
+}
+
+func passwd(fsConnector connector.Connector, args *driver.Args, newKeyFile string, commandArgs []string) error {
+   slotId, err := parseSlotId(commandArgs);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   header, masterKey, _, err := unlock(fsConnector, args);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   passphrase, err := keyring.GetPassphrase(newKeyFile, "New passphrase", true);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   err = header.ChangePassphrase(slotId, masterKey, passphrase);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   err = header.Write(fsConnector);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   fmt.Printf("Changed the passphrase of slot %d.\n", slotId);
+   return nil;
+}
+
+func rotate(fsConnector connector.Connector, args *driver.Args, newKeyFile string) error {
+   header, masterKey, _, err := unlock(fsConnector, args);
+   if (err != nil) {
+      fsConnector.Close();
+      return errors.WithStack(err);
+   }
+
+   fsDriver, err := driver.NewDriverWithConnector(masterKey, header.IV, fsConnector);
+   if (err != nil) {
+      fsConnector.Close();
+      return errors.WithStack(err);
+   }
+   defer fsDriver.Close();
+
+   user, err := fsDriver.UserAuth(args.User, util.Weakhash(args.User, args.Pass));
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   if (user.Id != identity.ROOT_USER_ID) {
+      return errors.New("Only root can rotate the master key.");
+   }
+
+   // The other slots' passphrases are not known, so only a single slot is kept.
+   passphrase, err := keyring.GetPassphrase(newKeyFile, "Passphrase for the new key", true);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   var newKey []byte = util.GenAESKey();
+
+   newHeader, err := keyring.NewKeyHeader(newKey, header.IV, passphrase);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   err = fsDriver.RotateKeyWithHeader(user.Id, newKey, newHeader);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   fmt.Printf("Rotated the master key, the new header has a single slot (%d slots were removed).\n", len(header.Slots) - 1);
+   return nil;
+}
+
+// Returns: (header, master key, unlocked slot id, error).
+func unlock(fsConnector connector.Connector, args *driver.Args) (*keyring.KeyHeader, []byte, int, error) {
+   passphrase, err := keyring.GetPassphrase(args.KeyFile, "Passphrase", false);
+   if (err != nil) {
+      return nil, nil, -1, errors.WithStack(err);
+   }
+
+   header, masterKey, slotId, err := driver.UnlockKeyHeader(fsConnector, passphrase);
+   if (err != nil) {
+      return nil, nil, -1, errors.WithStack(err);
+   }
+
+   return header, masterKey, slotId, nil;
+}
+
+func parseSlotId(commandArgs []string) (int, error) {
+   if (len(commandArgs) != 1) {
+      return -1, errors.New("Expecting exactly one slot id.");
+   }
+
+   slotId, err := strconv.Atoi(commandArgs[0]);
+   if (err != nil) {
+      return -1, errors.Wrap(err, commandArgs[0]);
+   }
+
+   return slotId, nil;
+}
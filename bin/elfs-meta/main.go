@@ -0,0 +1,577 @@
+package main;
+
+// Look at the metadata of a filesystem directly (see driver.MetadataInspector), for debugging.
+// The filesystem should not be mounted while this runs.
+//
+// Commands (after the usual connector and key args):
+//    generations                 List the generations, root pointer, and journal in storage.
+//    show [source]               Print the tables from a source (default: current).
+//    diff <source> <source>      Print what is different between the tables from two sources.
+//    import <dump file>          Replace all the metadata with an (edited) dump from 'show --format json'. Root only.
+// Sources are 'current' (what mounting would read), 'previous' (the generation before the current one),
+// 'shadow', 'cache' (the local cache file), or a generation number (see 'generations').
+//
+// Exit status: 0 on success (and no differences for diff), 1 if diff found differences, 2+ on errors.
+
+import (
+   "encoding/json"
+   "fmt"
+   "io/ioutil"
+   "os"
+   "reflect"
+   "sort"
+   "strings"
+
+   "github.com/pkg/errors"
+   "github.com/spf13/pflag"
+
+   "github.com/eriq-augustine/elfs/connector"
+   "github.com/eriq-augustine/elfs/dirent"
+   "github.com/eriq-augustine/elfs/driver"
+   "github.com/eriq-augustine/elfs/identity"
+   "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+   COMMAND_GENERATIONS = "generations"
+   COMMAND_SHOW = "show"
+   COMMAND_DIFF = "diff"
+   COMMAND_IMPORT = "import"
+
+   FORMAT_JSON = "json"
+   FORMAT_TREE = "tree"
+
+   INDENT = "   "
+)
+
+func main() {
+   var format *string = pflag.String("format", FORMAT_TREE, "How to show metadata ('tree' or 'json')");
+   fsConnector, args := driver.GetConnectorFromArgs();
+   var command []string = pflag.Args();
+
+   if (*format != FORMAT_JSON && *format != FORMAT_TREE) {
+      fsConnector.Close();
+      fmt.Printf("Unknown format: [%s]\n", *format);
+      os.Exit(2);
+   }
+
+   if (len(command) == 0) {
+      fsConnector.Close();
+      fmt.Printf("Expecting a command: '%s', '%s', '%s', or '%s'.\n", COMMAND_GENERATIONS, COMMAND_SHOW, COMMAND_DIFF, COMMAND_IMPORT);
+      os.Exit(2);
+   }
+
+   // Import goes through a loaded filesystem, everything else just looks at what is in storage.
+   if (command[0] == COMMAND_IMPORT) {
+      importDump(fsConnector, args, command[1:]);
+      return;
+   }
+
+   inspector, err := getInspector(fsConnector, args);
+   if (err != nil) {
+      fmt.Printf("%+v\n", err);
+      os.Exit(3);
+   }
+   defer inspector.Close();
+
+   var status int = 0;
+
+   if (command[0] == COMMAND_GENERATIONS) {
+      err = showGenerations(inspector);
+   } else if (command[0] == COMMAND_SHOW) {
+      var source string = driver.METADATA_SOURCE_CURRENT;
+      if (len(command) > 1) {
+         source = command[1];
+      }
+
+      err = show(inspector, source, *format);
+   } else if (command[0] == COMMAND_DIFF && len(command) == 3) {
+      status, err = diff(inspector, command[1], command[2]);
+   } else if (command[0] == COMMAND_DIFF) {
+      err = errors.New("diff needs two sources.");
+   } else {
+      err = errors.Errorf("Unknown command: [%s].", command[0]);
+   }
+
+   if (err != nil) {
+      inspector.Close();
+      fmt.Fprintf(os.Stderr, "%+v\n", err);
+      os.Exit(4);
+   }
+
+   if (status != 0) {
+      inspector.Close();
+      os.Exit(status);
+   }
+}
+
+func getInspector(fsConnector connector.Connector, args *driver.Args) (*driver.MetadataInspector, error) {
+   key, iv, err := driver.GetKeyFromArgs(args, fsConnector);
+   if (err != nil) {
+      fsConnector.Close();
+      return nil, errors.Wrap(err, "Failed to get the master key");
+   }
+
+   inspector, err := driver.NewMetadataInspector(key, iv, fsConnector);
+   if (err != nil) {
+      fsConnector.Close();
+      return nil, errors.Wrap(err, "Failed to open the metadata");
+   }
+
+   return inspector, nil;
+}
+
+func showGenerations(inspector *driver.MetadataInspector) error {
+   generations, err := inspector.Generations();
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   if (generations.RootError != nil) {
+      fmt.Printf("Root: could not be read: %v\n", generations.RootError);
+   } else if (generations.Current == driver.NO_GENERATION) {
+      fmt.Println("Root: none (only legacy metadata, if any)");
+   } else {
+      fmt.Printf("Root: generation %d (journal %d), previous generation %d (journal %d)\n",
+            generations.Current, generations.CurrentSequence, generations.Previous, generations.PreviousSequence);
+   }
+
+   fmt.Printf("Generations in storage: %s\n", joinInts(generations.Stored));
+   fmt.Printf("Journal segments in storage: %s\n", joinInts(generations.Journal));
+
+   return nil;
+}
+
+func show(inspector *driver.MetadataInspector, source string, format string) error {
+   dump, err := getDump(inspector, source);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   if (format == FORMAT_JSON) {
+      data, err := json.MarshalIndent(dump, "", INDENT);
+      if (err != nil) {
+         return errors.WithStack(err);
+      }
+
+      fmt.Println(string(data));
+      return nil;
+   }
+
+   printTree(dump);
+   return nil;
+}
+
+// Warnings go to stderr, so a JSON dump can be redirected into a file.
+func getDump(inspector *driver.MetadataInspector, source string) (*driver.MetadataDump, error) {
+   dump, err := inspector.Dump(source);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   if (source == driver.METADATA_SOURCE_CURRENT && inspector.MetadataFallback() != nil) {
+      fmt.Fprintf(os.Stderr, "WARNING: The current metadata could not be read: %v\n", inspector.MetadataFallback());
+   }
+
+   return dump, nil;
+}
+
+func printTree(dump *driver.MetadataDump) {
+   fmt.Printf("Source: %s (fat: %d, users: %d, groups: %d)\n", dump.Source, dump.FatVersion, dump.UsersVersion, dump.GroupsVersion);
+
+   var children map[dirent.Id][]*dirent.Dirent = make(map[dirent.Id][]*dirent.Dirent);
+   var removed []string = make([]string, 0);
+
+   for id, entry := range(dump.Fat) {
+      if (entry == nil) {
+         removed = append(removed, "[" + string(id) + "]");
+      } else if (id != dirent.ROOT_ID) {
+         children[entry.Parent] = append(children[entry.Parent], entry);
+      }
+   }
+
+   fmt.Println("\nFAT:");
+
+   var seen map[dirent.Id]bool = make(map[dirent.Id]bool);
+   root, ok := dump.Fat[dirent.ROOT_ID];
+   if (ok && root != nil) {
+      printDirent(root, children, seen, 1);
+   }
+
+   // Anything that cannot be reached from root (eg changes in the cache, or orphans).
+   var unreachable []*dirent.Dirent = make([]*dirent.Dirent, 0);
+   for id, entry := range(dump.Fat) {
+      if (entry != nil && !seen[id]) {
+         unreachable = append(unreachable, entry);
+      }
+   }
+
+   if (len(unreachable) > 0) {
+      sortDirents(unreachable);
+
+      fmt.Println("\nNot under the root directory:");
+      for _, entry := range(unreachable) {
+         fmt.Printf("%sparent [%s]: %s\n", INDENT, string(entry.Parent), describeDirent(entry));
+      }
+   }
+
+   fmt.Println("\nUsers:");
+   for _, id := range(sortedUserIds(dump.Users)) {
+      var user *identity.User = dump.Users[id];
+      if (user == nil) {
+         removed = append(removed, fmt.Sprintf("user %d", id));
+         continue;
+      }
+
+      fmt.Printf("%s%d %s (usergroup: %d)\n", INDENT, user.Id, user.Name, user.Usergroup);
+   }
+
+   fmt.Println("\nGroups:");
+   for _, id := range(sortedGroupIds(dump.Groups)) {
+      var group *identity.Group = dump.Groups[id];
+      if (group == nil) {
+         removed = append(removed, fmt.Sprintf("group %d", id));
+         continue;
+      }
+
+      var members []int = make([]int, 0, len(group.Members));
+      for member, isMember := range(group.Members) {
+         if (isMember) {
+            members = append(members, int(member));
+         }
+      }
+      sort.Ints(members);
+
+      var usergroup string = "";
+      if (group.IsUsergroup) {
+         usergroup = ", usergroup";
+      }
+
+      fmt.Printf("%s%d %s (owner: %d%s, members: %s)\n", INDENT, group.Id, group.Name, group.Owner, usergroup, joinInts(members));
+   }
+
+   if (len(removed) > 0) {
+      sort.Strings(removed);
+
+      fmt.Println("\nRemoved:");
+      for _, entry := range(removed) {
+         fmt.Printf("%s%s\n", INDENT, entry);
+      }
+   }
+}
+
+func printDirent(entry *dirent.Dirent, children map[dirent.Id][]*dirent.Dirent, seen map[dirent.Id]bool, depth int) {
+   seen[entry.Id] = true;
+   fmt.Printf("%s%s\n", strings.Repeat(INDENT, depth), describeDirent(entry));
+
+   var entryChildren []*dirent.Dirent = children[entry.Id];
+   sortDirents(entryChildren);
+
+   for _, child := range(entryChildren) {
+      // A cycle (fsck can fix it).
+      if (seen[child.Id]) {
+         continue;
+      }
+
+      printDirent(child, children, seen, depth + 1);
+   }
+}
+
+func describeDirent(entry *dirent.Dirent) string {
+   var name string = entry.Name;
+   if (entry.Id == dirent.ROOT_ID) {
+      name = dirent.FILE_SEPARATOR;
+   } else if (!entry.IsFile) {
+      name += dirent.FILE_SEPARATOR;
+   }
+
+   var size string = "";
+   if (entry.IsFile) {
+      size = fmt.Sprintf(", %d bytes", entry.Size);
+   }
+
+   return fmt.Sprintf("%s [%s] (%s, owner: %d, group: %d%s)", name, string(entry.Id), entry.Permissions.String(), entry.Owner, entry.Group, size);
+}
+
+func sortDirents(entries []*dirent.Dirent) {
+   sort.Slice(entries, func(i int, j int) bool {
+      if (entries[i].Name != entries[j].Name) {
+         return entries[i].Name < entries[j].Name;
+      }
+
+      return entries[i].Id < entries[j].Id;
+   });
+}
+
+// Returns 1 if there are any differences.
+func diff(inspector *driver.MetadataInspector, sourceA string, sourceB string) (int, error) {
+   dumpA, err := getDump(inspector, sourceA);
+   if (err != nil) {
+      return 0, errors.Wrap(err, sourceA);
+   }
+
+   dumpB, err := getDump(inspector, sourceB);
+   if (err != nil) {
+      return 0, errors.Wrap(err, sourceB);
+   }
+
+   fmt.Printf("--- %s (fat: %d, users: %d, groups: %d)\n", dumpA.Source, dumpA.FatVersion, dumpA.UsersVersion, dumpA.GroupsVersion);
+   fmt.Printf("+++ %s (fat: %d, users: %d, groups: %d)\n", dumpB.Source, dumpB.FatVersion, dumpB.UsersVersion, dumpB.GroupsVersion);
+
+   var differences int = 0;
+
+   var fatIds map[string]bool = make(map[string]bool);
+   for id, _ := range(dumpA.Fat) {
+      fatIds[string(id)] = true;
+   }
+   for id, _ := range(dumpB.Fat) {
+      fatIds[string(id)] = true;
+   }
+
+   for _, id := range(sortedKeys(fatIds)) {
+      a, inA := dumpA.Fat[dirent.Id(id)];
+      b, inB := dumpB.Fat[dirent.Id(id)];
+      differences += diffEntry(fmt.Sprintf("dirent [%s] %s", id, direntName(a, b)), a, inA, b, inB);
+   }
+
+   for _, id := range(sortedUserIds(mergeUsers(dumpA.Users, dumpB.Users))) {
+      a, inA := dumpA.Users[id];
+      b, inB := dumpB.Users[id];
+      differences += diffEntry(fmt.Sprintf("user %d %s", id, userName(a, b)), a, inA, b, inB);
+   }
+
+   for _, id := range(sortedGroupIds(mergeGroups(dumpA.Groups, dumpB.Groups))) {
+      a, inA := dumpA.Groups[id];
+      b, inB := dumpB.Groups[id];
+      differences += diffEntry(fmt.Sprintf("group %d %s", id, groupName(a, b)), a, inA, b, inB);
+   }
+
+   if (differences == 0) {
+      fmt.Println("No differences.");
+      return 0, nil;
+   }
+
+   return 1, nil;
+}
+
+// The names to go along with ids in a diff (from whichever side has the entry).
+func direntName(a *dirent.Dirent, b *dirent.Dirent) string {
+   if (b != nil) {
+      return b.Name;
+   } else if (a != nil) {
+      return a.Name;
+   }
+
+   return "";
+}
+
+func userName(a *identity.User, b *identity.User) string {
+   if (b != nil) {
+      return b.Name;
+   } else if (a != nil) {
+      return a.Name;
+   }
+
+   return "";
+}
+
+func groupName(a *identity.Group, b *identity.Group) string {
+   if (b != nil) {
+      return b.Name;
+   } else if (a != nil) {
+      return a.Name;
+   }
+
+   return "";
+}
+
+// Print how an entry differs between two dumps (field by field if it is in both).
+// Returns 1 if there is a difference.
+func diffEntry(name string, a interface{}, inA bool, b interface{}, inB bool) int {
+   if (inA && !inB) {
+      fmt.Printf("- %s\n", name);
+      return 1;
+   }
+
+   if (!inA && inB) {
+      fmt.Printf("+ %s\n", name);
+      return 1;
+   }
+
+   fieldsA := toFields(a);
+   fieldsB := toFields(b);
+   if (reflect.DeepEqual(fieldsA, fieldsB)) {
+      return 0;
+   }
+
+   fmt.Printf("~ %s\n", name);
+
+   var fields map[string]bool = make(map[string]bool);
+   for field, _ := range(fieldsA) {
+      fields[field] = true;
+   }
+   for field, _ := range(fieldsB) {
+      fields[field] = true;
+   }
+
+   for _, field := range(sortedKeys(fields)) {
+      if (reflect.DeepEqual(fieldsA[field], fieldsB[field])) {
+         continue;
+      }
+
+      fmt.Printf("%s%s: %s -> %s\n", INDENT, field, toJSON(fieldsA[field]), toJSON(fieldsB[field]));
+   }
+
+   return 1;
+}
+
+// Get the JSON fields of an entry (empty for a nil entry, eg a delete in the cache).
+func toFields(entry interface{}) map[string]interface{} {
+   var fields map[string]interface{} = make(map[string]interface{});
+
+   data, err := json.Marshal(entry);
+   if (err == nil) {
+      json.Unmarshal(data, &fields);
+   }
+
+   return fields;
+}
+
+func toJSON(value interface{}) string {
+   if (value == nil) {
+      return "(none)";
+   }
+
+   data, err := json.Marshal(value);
+   if (err != nil) {
+      return fmt.Sprintf("%v", value);
+   }
+
+   return string(data);
+}
+
+// Import runs against a loaded filesystem (as root), so the import goes through the journal like any other change.
+func importDump(fsConnector connector.Connector, args *driver.Args, command []string) {
+   if (len(command) != 1) {
+      fsConnector.Close();
+      fmt.Printf("Usage: %s <dump file>\n", COMMAND_IMPORT);
+      os.Exit(2);
+   }
+
+   key, iv, err := driver.GetKeyFromArgs(args, fsConnector);
+   if (err != nil) {
+      fsConnector.Close();
+      fmt.Printf("%+v\n", errors.Wrap(err, "Failed to get the master key"));
+      os.Exit(3);
+   }
+
+   fsDriver, err := driver.NewDriverWithEncoding(key, iv, fsConnector, args.MetadataEncoding);
+   if (err != nil) {
+      fsConnector.Close();
+      fmt.Printf("%+v\n", errors.Wrap(err, "Failed to get driver"));
+      os.Exit(3);
+   }
+   defer fsDriver.Close();
+
+   user, err := fsDriver.UserAuth(args.User, util.Weakhash(args.User, args.Pass));
+   if (err != nil) {
+      fmt.Printf("Failed to authenticate user: %+v\n", err);
+      fsDriver.Close();
+      os.Exit(3);
+   }
+
+   data, err := ioutil.ReadFile(command[0]);
+   if (err != nil) {
+      fmt.Printf("%+v\n", errors.Wrap(err, "Failed to read dump"));
+      fsDriver.Close();
+      os.Exit(4);
+   }
+
+   var dump driver.MetadataDump;
+   err = json.Unmarshal(data, &dump);
+   if (err != nil) {
+      fmt.Printf("%+v\n", errors.Wrap(err, "Failed to parse dump"));
+      fsDriver.Close();
+      os.Exit(4);
+   }
+
+   changes, err := fsDriver.ImportMetadata(user.Id, &dump);
+   if (err != nil) {
+      fmt.Printf("Failed to import metadata (%d entries were changed): %+v\n", changes, err);
+      fsDriver.Close();
+      os.Exit(4);
+   }
+
+   fmt.Printf("Imported the metadata from %s (%d entries changed).\n", dump.Source, changes);
+}
+
+func joinInts(values []int) string {
+   if (len(values) == 0) {
+      return "none";
+   }
+
+   var parts []string = make([]string, 0, len(values));
+   for _, value := range(values) {
+      parts = append(parts, fmt.Sprintf("%d", value));
+   }
+
+   return strings.Join(parts, ", ");
+}
+
+func sortedKeys(values map[string]bool) []string {
+   var keys []string = make([]string, 0, len(values));
+   for key, _ := range(values) {
+      keys = append(keys, key);
+   }
+
+   sort.Strings(keys);
+   return keys;
+}
+
+func sortedUserIds(users map[identity.UserId]*identity.User) []identity.UserId {
+   var ids []identity.UserId = make([]identity.UserId, 0, len(users));
+   for id, _ := range(users) {
+      ids = append(ids, id);
+   }
+
+   sort.Slice(ids, func(i int, j int) bool {
+      return ids[i] < ids[j];
+   });
+   return ids;
+}
+
+func sortedGroupIds(groups map[identity.GroupId]*identity.Group) []identity.GroupId {
+   var ids []identity.GroupId = make([]identity.GroupId, 0, len(groups));
+   for id, _ := range(groups) {
+      ids = append(ids, id);
+   }
+
+   sort.Slice(ids, func(i int, j int) bool {
+      return ids[i] < ids[j];
+   });
+   return ids;
+}
+
+func mergeUsers(a map[identity.UserId]*identity.User, b map[identity.UserId]*identity.User) map[identity.UserId]*identity.User {
+   var merged map[identity.UserId]*identity.User = make(map[identity.UserId]*identity.User, len(a) + len(b));
+   for id, entry := range(a) {
+      merged[id] = entry;
+   }
+   for id, entry := range(b) {
+      merged[id] = entry;
+   }
+
+   return merged;
+}
+
+func mergeGroups(a map[identity.GroupId]*identity.Group, b map[identity.GroupId]*identity.Group) map[identity.GroupId]*identity.Group {
+   var merged map[identity.GroupId]*identity.Group = make(map[identity.GroupId]*identity.Group, len(a) + len(b));
+   for id, entry := range(a) {
+      merged[id] = entry;
+   }
+   for id, entry := range(b) {
+      merged[id] = entry;
+   }
+
+   return merged;
+}
@@ -0,0 +1,166 @@
+package main;
+
+// Re-encrypt an entire filesystem under a new master key (see driver.Rekey()).
+// The filesystem must not be mounted while this runs.
+// If this is interrupted, just run it again with the same args (and the same new passphrase/key).
+//
+// Filesystems with a key header get a new header with a single slot for the new passphrase (--new-key-file or a prompt).
+// Until the rekey is done, the new header is kept to the side so that an interrupted rekey can get the new key back.
+// Filesystems without a key header must give the new key with --new-key.
+
+import (
+   "bytes"
+   "encoding/hex"
+   "fmt"
+   "os"
+
+   "github.com/pkg/errors"
+   "github.com/spf13/pflag"
+
+   "github.com/eriq-augustine/elfs/connector"
+   "github.com/eriq-augustine/elfs/driver"
+   "github.com/eriq-augustine/elfs/keyring"
+   "github.com/eriq-augustine/elfs/util"
+)
+
+func main() {
+   var hexNewKey *string = pflag.String("new-key", "", "New encryption key in hex (required for filesystems without a key header)");
+   var newKeyFile *string = pflag.String("new-key-file", "", "File holding the passphrase for the new key (prompts if not given)");
+   fsConnector, args := driver.GetConnectorFromArgs();
+
+   var newKey []byte = nil;
+   if (*hexNewKey != "") {
+      var err error;
+      newKey, err = hex.DecodeString(*hexNewKey);
+      if (err != nil) {
+         fsConnector.Close();
+         fmt.Printf("%+v\n", errors.Wrap(err, "Bad new key"));
+         os.Exit(1);
+      }
+   }
+
+   oldKey, iv, newKey, newHeader, err := getKeys(fsConnector, args, newKey, *newKeyFile);
+   if (err != nil) {
+      fsConnector.Close();
+      fmt.Printf("%+v\n", err);
+      os.Exit(2);
+   }
+
+   // Rekey() takes the connector (and removes the pending header when done).
+   report, err := driver.Rekey(fsConnector, oldKey, iv, newKey, newHeader);
+   if (err != nil) {
+      fmt.Printf("%+v\n", errors.Wrap(err, "Rekey failed, run again with the same args to resume"));
+      os.Exit(3);
+   }
+
+   fmt.Printf("Rekey finished. Files copied: %d, Files resumed: %d.\n", report.FilesCopied, report.FilesResumed);
+}
+
+// Returns: (old key, iv, new key, new key header (nil if the filesystem does not use one), error).
+// Once a rekey has been committed, the old key is no longer needed (and may be nil).
+func getKeys(fsConnector connector.Connector, args *driver.Args,
+      newKey []byte, newKeyFile string) ([]byte, []byte, []byte, *keyring.KeyHeader, error) {
+   hasHeader, err := keyring.Exists(fsConnector);
+   if (err != nil) {
+      return nil, nil, nil, nil, errors.WithStack(err);
+   }
+
+   if (!hasHeader) {
+      if (newKey == nil) {
+         return nil, nil, nil, nil, errors.New("The filesystem has no key header, --new-key is required.");
+      }
+
+      oldKey, iv, err := driver.GetKeyFromArgs(args, fsConnector);
+      if (err != nil) {
+         return nil, nil, nil, nil, errors.WithStack(err);
+      }
+
+      return oldKey, iv, newKey, nil, nil;
+   }
+
+   hasPending, err := keyring.ObjectExists(fsConnector, keyring.PENDING_KEY_HEADER_ID);
+   if (err != nil) {
+      return nil, nil, nil, nil, errors.WithStack(err);
+   }
+
+   if (!hasPending) {
+      return startRekey(fsConnector, args, newKey, newKeyFile);
+   }
+
+   // Resuming, the new key comes from the pending header.
+   newHeader, err := keyring.ReadObject(fsConnector, keyring.PENDING_KEY_HEADER_ID);
+   if (err != nil) {
+      return nil, nil, nil, nil, errors.WithStack(err);
+   }
+
+   passphrase, err := keyring.GetPassphrase(newKeyFile, "Passphrase for the new key", false);
+   if (err != nil) {
+      return nil, nil, nil, nil, errors.WithStack(err);
+   }
+
+   newKey, _, err = newHeader.Unlock(passphrase);
+   if (err != nil) {
+      return nil, nil, nil, nil, errors.Wrap(err, "Failed to unlock the pending key header from an earlier rekey");
+   }
+
+   // If the pending header was already put in place, then the rekey was committed and the old key is not needed.
+   committed, err := sameHeader(fsConnector);
+   if (err != nil) {
+      return nil, nil, nil, nil, errors.WithStack(err);
+   }
+
+   if (committed) {
+      return nil, newHeader.IV, newKey, newHeader, nil;
+   }
+
+   oldKey, iv, err := driver.GetKeyFromArgs(args, fsConnector);
+   if (err != nil) {
+      return nil, nil, nil, nil, errors.WithStack(err);
+   }
+
+   return oldKey, iv, newKey, newHeader, nil;
+}
+
+// Make the pending header for a new rekey.
+func startRekey(fsConnector connector.Connector, args *driver.Args,
+      newKey []byte, newKeyFile string) ([]byte, []byte, []byte, *keyring.KeyHeader, error) {
+   oldKey, iv, err := driver.GetKeyFromArgs(args, fsConnector);
+   if (err != nil) {
+      return nil, nil, nil, nil, errors.WithStack(err);
+   }
+
+   if (newKey == nil) {
+      newKey = util.GenAESKey();
+   }
+
+   passphrase, err := keyring.GetPassphrase(newKeyFile, "Passphrase for the new key", true);
+   if (err != nil) {
+      return nil, nil, nil, nil, errors.WithStack(err);
+   }
+
+   newHeader, err := keyring.NewKeyHeader(newKey, iv, passphrase);
+   if (err != nil) {
+      return nil, nil, nil, nil, errors.WithStack(err);
+   }
+
+   err = newHeader.WriteObject(fsConnector, keyring.PENDING_KEY_HEADER_ID);
+   if (err != nil) {
+      return nil, nil, nil, nil, errors.WithStack(err);
+   }
+
+   return oldKey, iv, newKey, newHeader, nil;
+}
+
+func sameHeader(fsConnector connector.Connector) (bool, error) {
+   current, err := fsConnector.ReadAdminObject(keyring.KEY_HEADER_ID);
+   if (err != nil) {
+      return false, errors.WithStack(err);
+   }
+
+   pending, err := fsConnector.ReadAdminObject(keyring.PENDING_KEY_HEADER_ID);
+   if (err != nil) {
+      return false, errors.WithStack(err);
+   }
+
+   return bytes.Equal(current, pending), nil;
+}
@@ -0,0 +1,56 @@
+package main;
+
+// Run an in-memory stand-in for S3 (see connector/s3/fakes3).
+// Point a connector at it with: --type s3 --aws-endpoint <printed endpoint> --aws-creds <--credentials path>.
+// Everything is lost when this exits.
+
+import (
+   "fmt"
+   "os"
+   "os/signal"
+   "syscall"
+
+   "github.com/spf13/pflag"
+
+   "github.com/eriq-augustine/elfs/connector/s3/fakes3"
+   "github.com/eriq-augustine/elfs/driver"
+)
+
+const (
+   DEFAULT_ADDRESS = "127.0.0.1:9000"
+)
+
+func main() {
+   var address *string = pflag.StringP("address", "a", DEFAULT_ADDRESS, "Address to listen on (use port 0 for any free port)");
+   var buckets *[]string = pflag.StringSliceP("bucket", "b", []string{}, "Bucket to create on startup (may be repeated)");
+   var credentialsPath *string = pflag.StringP("credentials", "c", "", "If set, write an AWS credentials file that works with this server here");
+   var profile *string = pflag.StringP("aws-profile", "l", driver.DEFAULT_AWS_PROFILE, "AWS profile to put in the credentials file");
+   pflag.Parse();
+
+   var server *fakes3.Server = fakes3.NewServer();
+   for _, bucket := range(*buckets) {
+      server.CreateBucket(bucket);
+   }
+
+   if (*credentialsPath != "") {
+      err := fakes3.WriteCredentials(*credentialsPath, *profile);
+      if (err != nil) {
+         fmt.Printf("Failed to write credentials: %+v\n", err);
+         os.Exit(1);
+      }
+   }
+
+   endpoint, err := server.Start(*address);
+   if (err != nil) {
+      fmt.Printf("Failed to start server: %+v\n", err);
+      os.Exit(2);
+   }
+
+   fmt.Printf("Serving fake S3 at %s\n", endpoint);
+
+   var signals chan os.Signal = make(chan os.Signal, 1);
+   signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM);
+   <-signals;
+
+   server.Close();
+}
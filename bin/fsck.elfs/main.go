@@ -0,0 +1,59 @@
+package main;
+
+// Check a filesystem for consistency (see driver.Fsck()).
+// The filesystem must not be mounted while this runs, and the user must be root.
+// Exit status: 0 if no problems were left, 1 if there are problems left, 2+ if the check could not run.
+
+import (
+   "fmt"
+   "os"
+
+   "github.com/spf13/pflag"
+
+   "github.com/eriq-augustine/elfs/driver"
+   "github.com/eriq-augustine/elfs/util"
+)
+
+func main() {
+   var repair *bool = pflag.Bool("repair", false, "Fix the problems that can be fixed (orphans go into /lost+found)");
+   var skipData *bool = pflag.Bool("skip-data", false, "Do not re-read files to check their size and md5");
+   var deleteUnreferenced *bool = pflag.Bool("delete-unreferenced", false, "When repairing, remove unreferenced data objects instead of quarantining them");
+   fsDriver, args := driver.GetDriverFromArgs();
+   defer fsDriver.Close();
+
+   user, err := fsDriver.UserAuth(args.User, util.Weakhash(args.User, args.Pass));
+   if (err != nil) {
+      fmt.Printf("Failed to authenticate user: %+v\n", err);
+      fsDriver.Close();
+      os.Exit(2);
+   }
+
+   var options driver.FsckOptions = driver.FsckOptions{
+      VerifyData: !*skipData,
+      Repair: *repair,
+      DeleteUnreferenced: *deleteUnreferenced,
+   };
+
+   report, err := fsDriver.Fsck(user.Id, options);
+   if (err != nil) {
+      fmt.Printf("Failed to check filesystem: %+v\n", err);
+      fsDriver.Close();
+      os.Exit(3);
+   }
+
+   for _, problem := range(report.Problems) {
+      var status string = "";
+      if (problem.Repaired) {
+         status = " (repaired)";
+      }
+
+      fmt.Printf("%s %s: %s%s\n", problem.Type, string(problem.Id), problem.Message, status);
+   }
+
+   fmt.Printf("Files read: %d, Problems: %d, Unrepaired: %d.\n", report.FilesChecked, len(report.Problems), report.Unrepaired());
+
+   if (report.Unrepaired() > 0) {
+      fsDriver.Close();
+      os.Exit(1);
+   }
+}
@@ -4,23 +4,70 @@ import (
    "fmt"
    "os"
 
+   "github.com/pkg/errors"
+
+   "github.com/eriq-augustine/elfs/connector"
    "github.com/eriq-augustine/elfs/driver"
    "github.com/eriq-augustine/elfs/identity"
+   "github.com/eriq-augustine/elfs/keyring"
    "github.com/eriq-augustine/elfs/util"
 )
 
 func main() {
-    fsDriver, args := driver.GetDriverFromArgs();
-    defer fsDriver.Close();
+    fsConnector, args := driver.GetConnectorFromArgs();
 
     if (args.User != identity.ROOT_NAME) {
+        fsConnector.Close();
         fmt.Printf("User must be '%s' for mkfs.", identity.ROOT_NAME);
         os.Exit(1);
     }
 
-    err := fsDriver.CreateFilesystem(util.Weakhash(identity.ROOT_NAME, args.Pass));
+    var key []byte = args.Key;
+    var iv []byte = args.IV;
+
+    // Without a key, make a new master key and keep it in a key header (unlocked by a passphrase).
+    if (key == nil) {
+        key = util.GenAESKey();
+        iv = util.GenIV();
+
+        err := createKeyHeader(fsConnector, key, iv, args.KeyFile);
+        if (err != nil) {
+            fsConnector.Close();
+            fmt.Printf("Failed to create key header: %+v\n", err);
+            os.Exit(3);
+        }
+    }
+
+    fsDriver, err := driver.NewDriverWithEncoding(key, iv, fsConnector, args.MetadataEncoding);
+    if (err != nil) {
+        fsConnector.Close();
+        fmt.Printf("Failed to get driver: %+v\n", err);
+        os.Exit(4);
+    }
+    defer fsDriver.Close();
+
+    err = fsDriver.CreateFilesystem(util.Weakhash(identity.ROOT_NAME, args.Pass));
     if (err != nil) {
         fmt.Printf("Failed to create filesystem: %+v\n", err);
         os.Exit(2);
     }
 }
+
+func createKeyHeader(fsConnector connector.Connector, key []byte, iv []byte, keyFile string) error {
+    passphrase, err := keyring.GetPassphrase(keyFile, "New passphrase", true);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    header, err := keyring.NewKeyHeader(key, iv, passphrase);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    err = fsConnector.PrepareStorage();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    return errors.WithStack(header.Write(fsConnector));
+}
@@ -24,6 +24,9 @@ import (
     "github.com/eriq-augustine/elfs/util"
 )
 
+// The cache is not stored by a connector, so it just needs an id for its encrypted stream.
+const CACHE_METADATA_ID = "cache"
+
 // There should only be one cache for each connector.
 var activeCaches map[string]bool;
 var activeCachesLock *sync.Mutex;
@@ -39,22 +42,28 @@ type MetadataCache struct {
     cachePath string
     lock *sync.Mutex
     blockCipher cipher.Block
-    iv []byte
+    // Only used to read a cache written before the metadata envelope.
+    legacyIV []byte
+    // How the cache is written (any encoding can be read).
+    encoding metadata.Encoding
     // Nil values represents delete.
     fat map[dirent.Id]*dirent.Dirent
     users map[identity.UserId]*identity.User
     groups map[identity.GroupId]*identity.Group
+    // Bumped on every change, so that someone who has written out everything up to
+    // some point knows if it is safe to clear the cache.
+    generation uint64
 }
 
-// IV should not have to be transformed to use.
+// The cache is written with a fresh IV each time (see cipherio.NewMetadataWriter).
+// The legacy IV should not have to be transformed to use.
 func NewMetadataCache(connector connector.Connector, blockCipher cipher.Block,
-        iv []byte) (*MetadataCache, error) {
+        legacyIV []byte) (*MetadataCache, error) {
     activeCachesLock.Lock();
     defer activeCachesLock.Unlock();
 
     var connectorId string = util.SHA256Hex(connector.GetId());
-    _, ok := activeCaches[connectorId];
-    if (ok) {
+    if (activeCaches[connectorId]) {
         return nil, errors.New("Cannot create two caches on the same connector.");
     }
 
@@ -65,10 +74,12 @@ func NewMetadataCache(connector connector.Connector, blockCipher cipher.Block,
         cachePath: cachePath,
         lock: &sync.Mutex{},
         blockCipher: blockCipher,
-        iv: iv,
+        legacyIV: legacyIV,
+        encoding: metadata.DEFAULT_ENCODING,
         fat: make(map[dirent.Id]*dirent.Dirent),
         users: make(map[identity.UserId]*identity.User),
         groups: make(map[identity.GroupId]*identity.Group),
+        generation: 0,
     };
 
     err := metadataCache.init();
@@ -76,6 +87,7 @@ func NewMetadataCache(connector connector.Connector, blockCipher cipher.Block,
         return nil, errors.Wrap(err, "Failed to init cache.");
     }
 
+    activeCaches[connectorId] = true;
     return metadataCache, nil;
 }
 
@@ -83,13 +95,97 @@ func (this *MetadataCache) Clear() {
     this.lock.Lock();
     defer this.lock.Unlock();
 
-    this.fat =  make(map[dirent.Id]*dirent.Dirent);
+    this.fat = make(map[dirent.Id]*dirent.Dirent);
     this.users = make(map[identity.UserId]*identity.User);
     this.groups = make(map[identity.GroupId]*identity.Group);
 
     os.Remove(this.cachePath);
 }
 
+// Clear the cache, but only if nothing has changed since |generation|.
+// Returns true if the cache was cleared.
+func (this *MetadataCache) ClearGeneration(generation uint64) bool {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    if (generation != this.generation) {
+        return false;
+    }
+
+    this.fat = make(map[dirent.Id]*dirent.Dirent);
+    this.users = make(map[identity.UserId]*identity.User);
+    this.groups = make(map[identity.GroupId]*identity.Group);
+
+    os.Remove(this.cachePath);
+
+    return true;
+}
+
+// Start using a new cipher (eg after the master key was changed).
+// Anything already in the cache gets rewritten with the new cipher.
+func (this *MetadataCache) SetBlockCipher(blockCipher cipher.Block) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    this.blockCipher = blockCipher;
+
+    if (len(this.fat) == 0 && len(this.users) == 0 && len(this.groups) == 0) {
+        return nil;
+    }
+
+    return errors.WithStack(this.write());
+}
+
+// Write the cache in a different encoding from now on.
+func (this *MetadataCache) SetEncoding(encoding metadata.Encoding) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    this.encoding = encoding;
+}
+
+// The ids of everything in the cache (everything that changed since the cache was last cleared).
+type ChangedIds struct {
+    Fat []dirent.Id
+    Users []identity.UserId
+    Groups []identity.GroupId
+    // The cache's generation when the ids were taken.
+    Generation uint64
+}
+
+func (this *MetadataCache) GetChangedIds() *ChangedIds {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    var changes ChangedIds = ChangedIds{
+        Fat: make([]dirent.Id, 0, len(this.fat)),
+        Users: make([]identity.UserId, 0, len(this.users)),
+        Groups: make([]identity.GroupId, 0, len(this.groups)),
+        Generation: this.generation,
+    };
+
+    for id, _ := range(this.fat) {
+        changes.Fat = append(changes.Fat, id);
+    }
+
+    for id, _ := range(this.users) {
+        changes.Users = append(changes.Users, id);
+    }
+
+    for id, _ := range(this.groups) {
+        changes.Groups = append(changes.Groups, id);
+    }
+
+    return &changes;
+}
+
+func (this *MetadataCache) GetGeneration() uint64 {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    return this.generation;
+}
+
 func (this *MetadataCache) IsEmpty() bool {
     this.lock.Lock();
     defer this.lock.Unlock();
@@ -124,6 +220,7 @@ func (this *MetadataCache) CacheDirentPut(info *dirent.Dirent) error {
     defer this.lock.Unlock();
 
     this.fat[info.Id] = info;
+    this.generation++;
     return errors.WithStack(this.write());
 }
 
@@ -132,6 +229,7 @@ func (this *MetadataCache) CacheDirentDelete(info *dirent.Dirent) error {
     defer this.lock.Unlock();
 
     this.fat[info.Id] = nil;
+    this.generation++;
     return errors.WithStack(this.write());
 }
 
@@ -140,6 +238,7 @@ func (this *MetadataCache) CacheUserPut(info *identity.User) error {
     defer this.lock.Unlock();
 
     this.users[info.Id] = info;
+    this.generation++;
     return errors.WithStack(this.write());
 }
 
@@ -148,6 +247,7 @@ func (this *MetadataCache) CacheUserDelete(info *identity.User) error {
     defer this.lock.Unlock();
 
     this.users[info.Id] = nil;
+    this.generation++;
     return errors.WithStack(this.write());
 }
 
@@ -156,6 +256,7 @@ func (this *MetadataCache) CacheGroupPut(info *identity.Group) error {
     defer this.lock.Unlock();
 
     this.groups[info.Id] = info;
+    this.generation++;
     return errors.WithStack(this.write());
 }
 
@@ -164,6 +265,7 @@ func (this *MetadataCache) CacheGroupDelete(info *identity.Group) error {
     defer this.lock.Unlock();
 
     this.groups[info.Id] = nil;
+    this.generation++;
     return errors.WithStack(this.write());
 }
 
@@ -174,7 +276,7 @@ func (this *MetadataCache) Close() error {
     activeCachesLock.Lock();
     defer activeCachesLock.Unlock();
 
-    activeCaches[this.connectorId] = false;
+    delete(activeCaches, this.connectorId);
     return nil;
 }
 
@@ -201,29 +303,29 @@ func (this *MetadataCache) read() error {
         return errors.WithStack(err);
     }
 
-    reader, err := cipherio.NewCipherReader(file, this.blockCipher, this.iv, fileStat.Size());
+    reader, err := cipherio.NewMetadataReader(file, this.blockCipher, this.legacyIV, CACHE_METADATA_ID, fileStat.Size());
     if (err != nil) {
         return errors.WithStack(err);
     }
 
-    var scanner *bufio.Scanner = bufio.NewScanner(reader);
+    var bufferedReader *bufio.Reader = metadata.NewReader(reader);
 
     // Clear the structures before reading.
     this.fat = make(map[dirent.Id]*dirent.Dirent);
     this.users = make(map[identity.UserId]*identity.User);
     this.groups = make(map[identity.GroupId]*identity.Group);
 
-    _, err = metadata.ReadFatWithScanner(this.fat, scanner);
+    _, err = metadata.ReadFatWithReader(this.fat, bufferedReader);
     if (err != nil) {
         return errors.WithStack(err);
     }
 
-    _, err = metadata.ReadUsersWithScanner(this.users, scanner);
+    _, err = metadata.ReadUsersWithReader(this.users, bufferedReader);
     if (err != nil) {
         return errors.WithStack(err);
     }
 
-    _, err = metadata.ReadGroupsWithScanner(this.groups, scanner);
+    _, err = metadata.ReadGroupsWithReader(this.groups, bufferedReader);
     if (err != nil) {
         return errors.WithStack(err);
     }
@@ -238,22 +340,22 @@ func (this *MetadataCache) write() error {
     }
     defer file.Close();
 
-    writer, err := cipherio.NewCipherWriter(file, this.blockCipher, this.iv);
+    writer, err := cipherio.NewMetadataWriter(file, this.blockCipher, CACHE_METADATA_ID);
     if (err != nil) {
         return errors.WithStack(err);
     }
 
-    err = metadata.WriteFat(this.fat, 0, writer);
+    err = metadata.WriteFat(this.fat, 0, this.encoding, writer);
     if (err != nil) {
         return errors.WithStack(err);
     }
 
-    err = metadata.WriteUsers(this.users, 0, writer);
+    err = metadata.WriteUsers(this.users, 0, this.encoding, writer);
     if (err != nil) {
         return errors.WithStack(err);
     }
 
-    err = metadata.WriteGroups(this.groups, 0, writer);
+    err = metadata.WriteGroups(this.groups, 0, this.encoding, writer);
     if (err != nil) {
         return errors.WithStack(err);
     }
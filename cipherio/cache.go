@@ -0,0 +1,38 @@
+package cipherio;
+
+// Decrypted chunks can be shared between readers of the same stream (see NewCachedCipherReader()).
+
+import (
+   "crypto/cipher"
+
+   "github.com/pkg/errors"
+)
+
+// A cache of the decrypted chunks of a single stream.
+// Readers of the same stream may share a cache at the same time.
+type ChunkCache interface {
+   // Get the cleartext of a chunk, or false if it is not cached.
+   // The cleartext must not be modified.
+   GetChunk(index int64) ([]byte, bool)
+   // Offer the cleartext of a chunk to the cache.
+   // The cleartext buffer may be reused after this returns, so the cache must copy anything it keeps.
+   PutChunk(index int64, cleartext []byte)
+}
+
+// Decrypt a single chunk of a stream (outside of a reader).
+// |last| is if this is the final chunk of the stream.
+func DecryptChunk(params StreamParams, index int64, last bool, ciphertext []byte) ([]byte, error) {
+   gcm, err := cipher.NewGCM(params.BlockCipher);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   var iv []byte = ChunkIV(params.IV, params.ChunkIVs, index);
+
+   cleartext, err := gcm.Open(nil, iv, ciphertext, params.additionalData(index, last));
+   if (err != nil) {
+      return nil, errors.Wrapf(err, "Failed to decrypt chunk %d", index);
+   }
+
+   return cleartext, nil;
+}
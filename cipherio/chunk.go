@@ -0,0 +1,267 @@
+package cipherio;
+
+// Random-access writes for encrypted files.
+// Files are encrypted in independent chunks of IO_BLOCK_SIZE cleartext bytes,
+// so a write only needs to re-encrypt the chunks that it touches.
+// A chunk is normally encrypted with the file's IV incremented by the chunk's index.
+// Any chunk that gets rewritten is encrypted with a fresh random IV instead (so a nonce is never reused),
+// and that IV is recorded in the file's chunk IVs.
+
+import (
+   "crypto/cipher"
+   "io"
+
+   "github.com/pkg/errors"
+
+   "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+   // The overhead that GCM adds to every chunk.
+   CIPHER_OVERHEAD = 16
+   // The size of a full chunk of ciphertext.
+   CIPHER_BLOCK_SIZE = IO_BLOCK_SIZE + CIPHER_OVERHEAD
+)
+
+// Storage for whole chunks of ciphertext.
+// Supplied by connectors for random-access writes.
+// Changes must not be visible until Close() is called, and then must all become visible at once
+// (the new chunks have new IVs, so the old and new chunks can not be mixed).
+type ChunkWriter interface {
+   // Write the ciphertext for a chunk, replacing any existing chunk at that index.
+   // The ciphertext buffer may be reused after this returns.
+   WriteChunk(index int64, ciphertext []byte) error
+   // Cut off the ciphertext at |size| bytes.
+   Truncate(size int64) error
+   Close() error
+   // Give up on the changes, leaving the object as it was.
+   Abort() error
+}
+
+// Get the IV for a chunk.
+// Rewritten chunks will have their own IV, all others use the base IV incremented by the index.
+func ChunkIV(baseIV []byte, chunkIVs map[int64][]byte, index int64) []byte {
+   chunkIV, ok := chunkIVs[index];
+   if (ok) {
+      return append([]byte(nil), chunkIV...);
+   }
+
+   var iv []byte = append([]byte(nil), baseIV...);
+   util.IncrementBytesByCount(iv, int(index));
+   return iv;
+}
+
+// Edits an existing encrypted file one chunk at a time.
+// An editor is only good for a single operation (WriteAt() or Truncate()),
+// since the reader will not see the rewritten chunks.
+// The stream keeps its version, so legacy streams stay legacy until they are written whole again.
+type ChunkEditor struct {
+   gcm cipher.AEAD
+   params StreamParams
+   chunkIVs map[int64][]byte
+   // A reader for the existing cleartext.
+   reader io.ReadSeeker
+   writer ChunkWriter
+   size int64
+}
+
+// Caller gives up control of the writer, but not the reader.
+// |params.ChunkIVs| will not be modified, see GetChunkIVs() for the IVs after the edit.
+func NewChunkEditor(reader io.ReadSeeker, writer ChunkWriter,
+      params StreamParams, cleartextSize int64) (*ChunkEditor, error) {
+   gcm, err := cipher.NewGCM(params.BlockCipher);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   var chunkIVsCopy map[int64][]byte = make(map[int64][]byte, len(params.ChunkIVs));
+   for index, iv := range(params.ChunkIVs) {
+      chunkIVsCopy[index] = iv;
+   }
+
+   var rtn ChunkEditor = ChunkEditor{
+      gcm: gcm,
+      params: params,
+      chunkIVs: chunkIVsCopy,
+      reader: reader,
+      writer: writer,
+      size: cleartextSize,
+   };
+
+   return &rtn, nil;
+}
+
+// The cleartext size of the file after the edit.
+func (this *ChunkEditor) GetFileSize() uint64 {
+   return uint64(this.size);
+}
+
+func (this *ChunkEditor) GetChunkIVs() map[int64][]byte {
+   return this.chunkIVs;
+}
+
+// Write |data| at |offset|.
+// Writing past the end of the file will fill the gap with zeros.
+func (this *ChunkEditor) WriteAt(data []byte, offset int64) (int, error) {
+   if (offset < 0) {
+      return 0, errors.Errorf("Negative write offset: %d.", offset);
+   }
+
+   if (len(data) == 0) {
+      return 0, nil;
+   }
+
+   var oldSize int64 = this.size;
+   var newSize int64 = util.MaxInt64(oldSize, offset + int64(len(data)));
+
+   // If we are writing past the end, then the gap (starting in the old last chunk) gets filled too.
+   var startIndex int64 = util.MinInt64(offset, oldSize) / IO_BLOCK_SIZE;
+   var endIndex int64 = (offset + int64(len(data)) - 1) / IO_BLOCK_SIZE;
+
+   if (newSize > oldSize) {
+      startIndex = util.MinInt64(startIndex, this.firstGrownChunk(oldSize));
+   }
+
+   err := this.rewriteChunks(startIndex, endIndex, oldSize, newSize, data, offset);
+   if (err != nil) {
+      return 0, errors.WithStack(err);
+   }
+
+   this.size = newSize;
+   return len(data), nil;
+}
+
+// Change the size of the file.
+// Growing the file will fill it with zeros.
+func (this *ChunkEditor) Truncate(newSize int64) error {
+   if (newSize < 0) {
+      return errors.Errorf("Negative truncate size: %d.", newSize);
+   }
+
+   var oldSize int64 = this.size;
+
+   if (newSize == oldSize) {
+      return nil;
+   }
+
+   var numChunks int64 = NumChunks(this.params.Version, newSize);
+
+   if (newSize > oldSize) {
+      err := this.rewriteChunks(this.firstGrownChunk(oldSize), numChunks - 1, oldSize, newSize, nil, 0);
+      if (err != nil) {
+         return errors.WithStack(err);
+      }
+   } else {
+      // The new last chunk needs to be rewritten if it got cut (or needs to be marked as the last chunk).
+      if (newSize % IO_BLOCK_SIZE != 0 || this.params.Version != CIPHER_VERSION_LEGACY) {
+         err := this.rewriteChunks(numChunks - 1, numChunks - 1, oldSize, newSize, nil, 0);
+         if (err != nil) {
+            return errors.WithStack(err);
+         }
+      }
+
+      err := this.writer.Truncate(CiphertextSize(this.params.Version, newSize));
+      if (err != nil) {
+         return errors.WithStack(err);
+      }
+
+      for index, _ := range(this.chunkIVs) {
+         if (index >= numChunks) {
+            delete(this.chunkIVs, index);
+         }
+      }
+   }
+
+   this.size = newSize;
+   return nil;
+}
+
+// Commit the changes.
+func (this *ChunkEditor) Close() error {
+   return errors.WithStack(this.writer.Close());
+}
+
+func (this *ChunkEditor) Abort() error {
+   return errors.WithStack(this.writer.Abort());
+}
+
+// Get the first chunk that changes when a file of |oldSize| grows.
+// In authenticated streams, the old last chunk will no longer be last (even if it was full).
+func (this *ChunkEditor) firstGrownChunk(oldSize int64) int64 {
+   if (this.params.Version == CIPHER_VERSION_LEGACY) {
+      return oldSize / IO_BLOCK_SIZE;
+   }
+
+   return NumChunks(this.params.Version, oldSize) - 1;
+}
+
+// Re-encrypt chunks [startIndex, endIndex].
+// Each chunk gets the old content (cut or zero-padded to fit the new size),
+// with any part of |data| (which starts at |dataOffset| in the file) laid over it.
+// All the old content that is needed is read before anything is written.
+func (this *ChunkEditor) rewriteChunks(startIndex int64, endIndex int64,
+      oldSize int64, newSize int64,
+      data []byte, dataOffset int64) error {
+   var dataEnd int64 = dataOffset + int64(len(data));
+
+   // Only chunks that have old content and are not completely covered by the new data need to be read.
+   // This is at most the first and last chunk.
+   var oldChunks map[int64][]byte = make(map[int64][]byte);
+   for _, index := range([]int64{startIndex, endIndex}) {
+      var chunkStart int64 = index * IO_BLOCK_SIZE;
+      var chunkEnd int64 = util.MinInt64(chunkStart + IO_BLOCK_SIZE, newSize);
+
+      _, alreadyRead := oldChunks[index];
+      if (alreadyRead || chunkStart >= oldSize || (dataOffset <= chunkStart && dataEnd >= chunkEnd)) {
+         continue;
+      }
+
+      _, err := this.reader.Seek(chunkStart, io.SeekStart);
+      if (err != nil) {
+         return errors.Wrapf(err, "Failed to seek to chunk %d", index);
+      }
+
+      var oldChunk []byte = make([]byte, util.MinInt64(IO_BLOCK_SIZE, oldSize - chunkStart));
+      _, err = io.ReadFull(this.reader, oldChunk);
+      if (err != nil) {
+         return errors.Wrapf(err, "Failed to read chunk %d", index);
+      }
+
+      oldChunks[index] = oldChunk;
+   }
+
+   var chunk []byte = make([]byte, 0, IO_BLOCK_SIZE);
+   var ciphertext []byte = make([]byte, 0, CIPHER_BLOCK_SIZE);
+   var lastIndex int64 = NumChunks(this.params.Version, newSize) - 1;
+
+   for index := startIndex; index <= endIndex; index++ {
+      var chunkStart int64 = index * IO_BLOCK_SIZE;
+      var chunkSize int64 = util.MinInt64(IO_BLOCK_SIZE, newSize - chunkStart);
+
+      // Start with zeros and fill in the old content.
+      chunk = chunk[0:chunkSize];
+      for i := range(chunk) {
+         chunk[i] = 0;
+      }
+      copy(chunk, oldChunks[index]);
+
+      // Lay the new data on top.
+      var overlapStart int64 = util.MaxInt64(chunkStart, dataOffset);
+      var overlapEnd int64 = util.MinInt64(chunkStart + chunkSize, dataEnd);
+      if (overlapStart < overlapEnd) {
+         copy(chunk[overlapStart - chunkStart:overlapEnd - chunkStart], data[overlapStart - dataOffset:overlapEnd - dataOffset]);
+      }
+
+      var iv []byte = util.GenIV();
+      ciphertext = this.gcm.Seal(ciphertext[:0], iv, chunk, this.params.additionalData(index, index == lastIndex));
+
+      err := this.writer.WriteChunk(index, ciphertext);
+      if (err != nil) {
+         return errors.Wrapf(err, "Failed to write chunk %d", index);
+      }
+
+      this.chunkIVs[index] = iv;
+   }
+
+   return nil;
+}
@@ -0,0 +1,167 @@
+package cipherio;
+
+// Metadata tables are rewritten many times with the same key.
+// To avoid ever reusing a nonce, every metadata write generates a fresh random IV
+// and stores it in a small cleartext header in front of the ciphertext:
+//    METADATA_MAGIC | envelope version (1 byte) | IV (util.IV_LENGTH bytes)
+// Metadata written before the envelope existed has no header,
+// and will be read using the legacy IV supplied by the caller.
+// Envelope version 1 holds a legacy stream,
+// version 2 holds an authenticated stream (see stream.go) that uses the metadata id as the stream id.
+
+import (
+   "bytes"
+   "crypto/cipher"
+   "io"
+
+   "github.com/pkg/errors"
+
+   "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+   METADATA_MAGIC = "ELFSMETA"
+   METADATA_ENVELOPE_VERSION_LEGACY_STREAM = 1
+   METADATA_ENVELOPE_VERSION = 2
+   METADATA_HEADER_SIZE = len(METADATA_MAGIC) + 1 + util.IV_LENGTH
+)
+
+// A reader for a metadata object.
+// Behaves exactly like a CipherReader, but also knows if the object was in the legacy (headerless) format.
+type MetadataReader struct {
+   reader util.ReadSeekCloser
+   legacy bool
+}
+
+// Caller gives up control of the reader.
+// The legacy IV is only used if the object does not have an envelope header.
+func NewMetadataReader(reader util.ReadSeekCloser,
+      blockCipher cipher.Block, legacyIV []byte, metadataId string,
+      size int64) (*MetadataReader, error) {
+   var header []byte = make([]byte, METADATA_HEADER_SIZE);
+
+   if (size >= int64(METADATA_HEADER_SIZE)) {
+      _, err := io.ReadFull(reader, header);
+      if (err != nil) {
+         return nil, errors.Wrap(err, "Failed to read metadata header");
+      }
+
+      if (bytes.Equal(header[0:len(METADATA_MAGIC)], []byte(METADATA_MAGIC))) {
+         var params StreamParams = StreamParams{
+            BlockCipher: blockCipher,
+            IV: header[len(METADATA_MAGIC) + 1:],
+            StreamId: metadataId,
+         };
+
+         var version int = int(header[len(METADATA_MAGIC)]);
+         switch version {
+            case METADATA_ENVELOPE_VERSION_LEGACY_STREAM:
+               params.Version = CIPHER_VERSION_LEGACY;
+            case METADATA_ENVELOPE_VERSION:
+               params.Version = CIPHER_VERSION_AUTHENTICATED;
+            default:
+               return nil, errors.Errorf("Unknown metadata envelope version. Expected: %d, Found: %d.", METADATA_ENVELOPE_VERSION, version);
+         }
+
+         var bodyReader util.ReadSeekCloser = &offsetReader{reader, int64(METADATA_HEADER_SIZE)};
+
+         cipherReader, err := NewCipherReader(bodyReader, params, size - int64(METADATA_HEADER_SIZE));
+         if (err != nil) {
+            return nil, errors.WithStack(err);
+         }
+
+         // Legacy streams should be rewritten too.
+         return &MetadataReader{cipherReader, params.Version == CIPHER_VERSION_LEGACY}, nil;
+      }
+
+      // No header, rewind and read it as legacy.
+      _, err = reader.Seek(0, io.SeekStart);
+      if (err != nil) {
+         return nil, errors.WithStack(err);
+      }
+   }
+
+   if (legacyIV == nil) {
+      return nil, errors.New("Metadata has no envelope header and no legacy IV was supplied.");
+   }
+
+   var params StreamParams = StreamParams{
+      BlockCipher: blockCipher,
+      IV: legacyIV,
+      Version: CIPHER_VERSION_LEGACY,
+   };
+
+   cipherReader, err := NewCipherReader(reader, params, size);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   return &MetadataReader{cipherReader, true}, nil;
+}
+
+// Was this metadata written in an older format
+// (and should therefore be rewritten).
+func (this *MetadataReader) IsLegacy() bool {
+   return this.legacy;
+}
+
+func (this *MetadataReader) Read(outBuffer []byte) (int, error) {
+   return this.reader.Read(outBuffer);
+}
+
+func (this *MetadataReader) Seek(offset int64, whence int) (int64, error) {
+   return this.reader.Seek(offset, whence);
+}
+
+func (this *MetadataReader) Close() error {
+   return this.reader.Close();
+}
+
+// Write a fresh envelope header to the writer and get a CipherWriter
+// that will encrypt with the header's IV.
+// Caller gives up control of the writer.
+func NewMetadataWriter(writer io.WriteCloser, blockCipher cipher.Block, metadataId string) (*CipherWriter, error) {
+   var iv []byte = util.GenIV();
+
+   var header []byte = make([]byte, 0, METADATA_HEADER_SIZE);
+   header = append(header, []byte(METADATA_MAGIC)...);
+   header = append(header, byte(METADATA_ENVELOPE_VERSION));
+   header = append(header, iv...);
+
+   _, err := writer.Write(header);
+   if (err != nil) {
+      return nil, errors.Wrap(err, "Failed to write metadata header");
+   }
+
+   var params StreamParams = StreamParams{
+      BlockCipher: blockCipher,
+      IV: iv,
+      StreamId: metadataId,
+      Version: CIPHER_VERSION_AUTHENTICATED,
+   };
+
+   return NewCipherWriter(writer, params);
+}
+
+// A ReadSeekCloser that hides the first |offset| bytes of another reader.
+type offsetReader struct {
+   reader util.ReadSeekCloser
+   offset int64
+}
+
+func (this *offsetReader) Read(outBuffer []byte) (int, error) {
+   return this.reader.Read(outBuffer);
+}
+
+func (this *offsetReader) Seek(offset int64, whence int) (int64, error) {
+   if (whence == io.SeekStart) {
+      offset += this.offset;
+   }
+
+   absoluteOffset, err := this.reader.Seek(offset, whence);
+   return absoluteOffset - this.offset, err;
+}
+
+func (this *offsetReader) Close() error {
+   return this.reader.Close();
+}
@@ -0,0 +1,143 @@
+package cipherio;
+
+import (
+   "bytes"
+   "crypto/aes"
+   "crypto/cipher"
+   "io/ioutil"
+   "testing"
+
+   "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+   TEST_METADATA_ID = "fat_000000000001"
+)
+
+func newTestBlockCipher(t *testing.T) cipher.Block {
+   blockCipher, err := aes.NewCipher(util.GenAESKey());
+   if (err != nil) {
+      t.Fatalf("Failed to make cipher: %+v", err);
+   }
+
+   return blockCipher;
+}
+
+func writeTestMetadata(t *testing.T, blockCipher cipher.Block, metadataId string, cleartext []byte) []byte {
+   var buffer closingBuffer;
+
+   writer, err := NewMetadataWriter(&buffer, blockCipher, metadataId);
+   if (err != nil) {
+      t.Fatalf("Failed to make metadata writer: %+v", err);
+   }
+
+   _, err = writer.Write(cleartext);
+   if (err == nil) {
+      err = writer.Close();
+   }
+
+   if (err != nil) {
+      t.Fatalf("Failed to write metadata: %+v", err);
+   }
+
+   return buffer.Bytes();
+}
+
+// Gives back the cleartext and if the object was legacy.
+func readTestMetadata(blockCipher cipher.Block, legacyIV []byte, metadataId string, data []byte) ([]byte, bool, error) {
+   reader, err := NewMetadataReader(bytesReadSeekCloser{bytes.NewReader(data)}, blockCipher, legacyIV, metadataId, int64(len(data)));
+   if (err != nil) {
+      return nil, false, err;
+   }
+   defer reader.Close();
+
+   cleartext, err := ioutil.ReadAll(reader);
+   return cleartext, reader.IsLegacy(), err;
+}
+
+// Metadata always gets an envelope with a fresh IV, and reads back (without a legacy IV).
+func TestMetadataEnvelope(t *testing.T) {
+   var blockCipher cipher.Block = newTestBlockCipher(t);
+
+   for _, size := range([]int{0, 1, IO_BLOCK_SIZE, TEST_STREAM_SIZE}) {
+      var cleartext []byte = testCleartext(size);
+
+      var first []byte = writeTestMetadata(t, blockCipher, TEST_METADATA_ID, cleartext);
+      var second []byte = writeTestMetadata(t, blockCipher, TEST_METADATA_ID, cleartext);
+
+      for _, data := range([][]byte{first, second}) {
+         if (!bytes.HasPrefix(data, []byte(METADATA_MAGIC)) || int(data[len(METADATA_MAGIC)]) != METADATA_ENVELOPE_VERSION) {
+            t.Fatalf("Size %d: bad envelope header.", size);
+         }
+
+         readData, legacy, err := readTestMetadata(blockCipher, nil, TEST_METADATA_ID, data);
+         if (err != nil || legacy || !bytes.Equal(readData, cleartext)) {
+            t.Fatalf("Size %d: failed round trip (legacy: %v): %+v", size, legacy, err);
+         }
+      }
+
+      if (bytes.Equal(first[0:METADATA_HEADER_SIZE], second[0:METADATA_HEADER_SIZE])) {
+         t.Fatalf("Size %d: two writes used the same IV.", size);
+      }
+
+      // Bound to its id.
+      _, _, err := readTestMetadata(blockCipher, nil, TEST_METADATA_ID + "-other", first);
+      if (err == nil) {
+         t.Fatalf("Size %d: metadata read under another id.", size);
+      }
+   }
+}
+
+// Metadata from before the envelope has no header, and is read with the fixed IV from its table.
+func TestLegacyMetadata(t *testing.T) {
+   var blockCipher cipher.Block = newTestBlockCipher(t);
+
+   // Down to less than a header.
+   for _, size := range([]int{0, 1, IO_BLOCK_SIZE, TEST_STREAM_SIZE}) {
+      var params StreamParams = StreamParams{
+         BlockCipher: blockCipher,
+         IV: util.GenIV(),
+         Version: CIPHER_VERSION_LEGACY,
+      };
+
+      var cleartext []byte = testCleartext(size);
+      var data []byte = writeTestStream(t, params, cleartext);
+
+      readData, legacy, err := readTestMetadata(blockCipher, params.IV, TEST_METADATA_ID, data);
+      if (err != nil || !legacy || !bytes.Equal(readData, cleartext)) {
+         t.Fatalf("Size %d: failed to read legacy metadata (legacy: %v): %+v", size, legacy, err);
+      }
+
+      _, _, err = readTestMetadata(blockCipher, nil, TEST_METADATA_ID, data);
+      if (err == nil) {
+         t.Fatalf("Size %d: read legacy metadata without a legacy IV.", size);
+      }
+   }
+}
+
+// Envelopes from before authenticated streams still read (and are legacy), and unknown envelopes do not.
+func TestEnvelopeVersions(t *testing.T) {
+   var blockCipher cipher.Block = newTestBlockCipher(t);
+   var cleartext []byte = util.RandomBytes(TEST_STREAM_SIZE);
+
+   var params StreamParams = StreamParams{
+      BlockCipher: blockCipher,
+      IV: util.GenIV(),
+      Version: CIPHER_VERSION_LEGACY,
+   };
+
+   var header []byte = append([]byte(METADATA_MAGIC), byte(METADATA_ENVELOPE_VERSION_LEGACY_STREAM));
+   header = append(header, params.IV...);
+   var data []byte = append(header, writeTestStream(t, params, cleartext)...);
+
+   readData, legacy, err := readTestMetadata(blockCipher, nil, TEST_METADATA_ID, data);
+   if (err != nil || !legacy || !bytes.Equal(readData, cleartext)) {
+      t.Fatalf("Failed to read a legacy stream envelope (legacy: %v): %+v", legacy, err);
+   }
+
+   data[len(METADATA_MAGIC)] = byte(METADATA_ENVELOPE_VERSION + 1);
+   _, _, err = readTestMetadata(blockCipher, nil, TEST_METADATA_ID, data);
+   if (err == nil) {
+      t.Fatalf("Read an unknown envelope version.");
+   }
+}
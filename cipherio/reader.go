@@ -29,9 +29,8 @@ type CipherReader struct {
    // We will be reslicing the cleartextBuffer as the cleartext is requested.
    originalCleartextBuffer []byte
 
-   // Since we may seek, we need to keep around the original IV.
-   iv []byte
-   originalIV []byte
+   // Each chunk's IV and additional data is figured out from these.
+   params StreamParams
 
    reader util.ReadSeekCloser
 
@@ -46,15 +45,25 @@ type CipherReader struct {
    cleartextOffset int64
 
    cleartextSize int64
+   numChunks int64
 
    cipherBlockSize int64
+
+   // May be nil.
+   cache ChunkCache
 }
 
 // Caller gives up control of the reader.
-func NewCipherReader(reader util.ReadSeekCloser,
-      blockCipher cipher.Block, rawIV []byte,
-      ciphertextSize int64) (util.ReadSeekCloser, error) {
-   gcm, err := cipher.NewGCM(blockCipher);
+// For authenticated streams, a stream that has been cut short will fail when the (new) last chunk is read.
+func NewCipherReader(reader util.ReadSeekCloser, params StreamParams, ciphertextSize int64) (util.ReadSeekCloser, error) {
+   return NewCachedCipherReader(reader, params, ciphertextSize, nil);
+}
+
+// Same as NewCipherReader(), but chunks are looked for in |cache| before they are read,
+// and any chunk that is read and decrypted is put in |cache|.
+// The cache must only be used for this stream (with these params).
+func NewCachedCipherReader(reader util.ReadSeekCloser, params StreamParams, ciphertextSize int64, cache ChunkCache) (util.ReadSeekCloser, error) {
+   gcm, err := cipher.NewGCM(params.BlockCipher);
    if err != nil {
       return nil, errors.WithStack(err);
    }
@@ -62,9 +71,7 @@ func NewCipherReader(reader util.ReadSeekCloser,
    var cleartextBuffer []byte = make([]byte, 0, IO_BLOCK_SIZE);
 
    var cipherBlockSize int64 = int64(IO_BLOCK_SIZE + gcm.Overhead());
-   // Note that this is exact since we can't write partial blocks.
-   var numBlocks int64 = ciphertextSize / cipherBlockSize;
-   var cleartextSize int64 = int64(numBlocks * IO_BLOCK_SIZE) + (ciphertextSize - (numBlocks * cipherBlockSize) - int64(gcm.Overhead()));
+   var cleartextSize int64 = CleartextSize(ciphertextSize);
 
    var rtn CipherReader = CipherReader{
       gcm: gcm,
@@ -72,16 +79,31 @@ func NewCipherReader(reader util.ReadSeekCloser,
       ciphertextBuffer: make([]byte, 0, IO_BLOCK_SIZE + gcm.Overhead()),
       cleartextBuffer: cleartextBuffer,
       originalCleartextBuffer: cleartextBuffer,
-      // Make a copy of the IV since we will be incrementing it for each chunk.
-      iv: append([]byte(nil), rawIV...),
-      originalIV: append([]byte(nil), rawIV...),
+      params: params,
       reader: reader,
       ciphertextOffset: 0,
       cleartextOffset: 0,
       cleartextSize: cleartextSize,
+      numChunks: NumCiphertextChunks(ciphertextSize),
       cipherBlockSize: cipherBlockSize,
+      cache: cache,
    };
 
+   if (params.Version != CIPHER_VERSION_LEGACY) {
+      // Every authenticated stream has a final chunk.
+      if (rtn.numChunks == 0) {
+         return nil, errors.New("Authenticated stream has no chunks, it has been truncated.");
+      }
+
+      // An empty stream would never get read, so verify the final chunk now.
+      if (cleartextSize == 0) {
+         err = rtn.readChunk();
+         if (err != nil) {
+            return nil, errors.WithStack(err);
+         }
+      }
+   }
+
    return &rtn, nil;
 }
 
@@ -149,6 +171,18 @@ func (this *CipherReader) readChunk() error {
       return errors.New("Cleartext buffer is not empty.");
    }
 
+   // Chunks are always read whole, so we know which chunk this is.
+   var index int64 = this.ciphertextOffset / this.cipherBlockSize;
+   var iv []byte = ChunkIV(this.params.IV, this.params.ChunkIVs, index);
+   var additionalData []byte = this.params.additionalData(index, index == this.numChunks - 1);
+
+   if (this.cache != nil) {
+      cleartext, ok := this.cache.GetChunk(index);
+      if (ok) {
+         return errors.WithStack(this.useCachedChunk(cleartext));
+      }
+   }
+
    // Resize the buffer (without allocating) to ensure we only read exactly what we want.
    this.ciphertextBuffer = this.ciphertextBuffer[0:IO_BLOCK_SIZE + this.gcm.Overhead()];
 
@@ -170,13 +204,30 @@ func (this *CipherReader) readChunk() error {
    // Reset the cleartext buffer.
    this.cleartextBuffer = this.originalCleartextBuffer;
 
-   this.cleartextBuffer, err = this.gcm.Open(this.cleartextBuffer, this.iv, this.ciphertextBuffer[0:readSize], nil);
+   this.cleartextBuffer, err = this.gcm.Open(this.cleartextBuffer, iv, this.ciphertextBuffer[0:readSize], additionalData);
    if (err != nil) {
       return errors.Wrap(err, "Failed to decrypt chunk");
    }
 
-   // Prepare the IV for the next decrypt.
-   util.IncrementBytes(this.iv);
+   if (this.cache != nil) {
+      this.cache.PutChunk(index, this.cleartextBuffer);
+   }
+
+   return nil;
+}
+
+// Use a cached chunk as if it was just read.
+// The underlying reader is moved past the chunk, just like a real read.
+func (this *CipherReader) useCachedChunk(cleartext []byte) error {
+   this.ciphertextOffset += int64(len(cleartext) + this.gcm.Overhead());
+
+   _, err := this.reader.Seek(this.ciphertextOffset, io.SeekStart);
+   if (err != nil) {
+      return errors.Wrap(err, "Failed to seek past cached chunk");
+   }
+
+   // The reader never modifies the cleartext buffer, only reslices it.
+   this.cleartextBuffer = cleartext;
 
    return nil;
 }
@@ -197,14 +248,12 @@ func (this *CipherReader) Seek(offset int64, whence int) (int64, error) {
    // but it is easier to just treat all casses the same.
    this.cleartextBuffer = this.originalCleartextBuffer;
    this.ciphertextBuffer = this.ciphertextBuffer[0:IO_BLOCK_SIZE + this.gcm.Overhead()];
-   this.iv = append([]byte(nil), this.originalIV...);
    this.ciphertextOffset = 0;
    this.cleartextOffset = 0;
    this.reader.Seek(0, io.SeekStart);
 
    // Skip the required number of blocks.
    var skipBlocks int64 = absoluteOffset / IO_BLOCK_SIZE;
-   util.IncrementBytesByCount(this.iv, int(skipBlocks));
    this.ciphertextOffset = skipBlocks * this.cipherBlockSize;
    this.reader.Seek(this.ciphertextOffset, io.SeekStart);
 
@@ -251,7 +300,7 @@ func (this *CipherReader) Close() error {
    this.ciphertextBuffer = nil;
    this.cleartextBuffer = nil;
    this.originalCleartextBuffer = nil;
-   this.iv = nil;
+   this.params = StreamParams{};
 
    err := this.reader.Close();
    this.reader = nil;
@@ -0,0 +1,78 @@
+package cipherio;
+
+// The format of an encrypted stream.
+// A stream is a series of chunks, each chunk is IO_BLOCK_SIZE bytes of cleartext (the last may be shorter)
+// sealed on its own with AES-GCM.
+//
+// In authenticated streams (CIPHER_VERSION_AUTHENTICATED), every chunk is also bound to its position with
+// additional data (like STREAM/age):
+//    stream id | chunk index (8 bytes, big endian) | last chunk flag (1 byte)
+// So chunks cannot be moved between streams, reordered, or cut off the end.
+// An empty stream is a single empty (final) chunk, so the entire stream cannot be cut off either.
+//
+// Legacy streams (CIPHER_VERSION_LEGACY) have no additional data, and an empty stream has no chunks.
+
+import (
+   "crypto/cipher"
+   "encoding/binary"
+)
+
+const (
+   CIPHER_VERSION_LEGACY = 0
+   CIPHER_VERSION_AUTHENTICATED = 1
+   CURRENT_CIPHER_VERSION = CIPHER_VERSION_AUTHENTICATED
+)
+
+// Everything needed to encrypt or decrypt a stream.
+type StreamParams struct {
+   BlockCipher cipher.Block
+   // The IV for the first chunk, every following chunk increments it (see ChunkIV()).
+   IV []byte
+   // The IVs of any chunks that have been rewritten (may be nil).
+   ChunkIVs map[int64][]byte
+   // Identifies the stream (eg the dirent id), only used in authenticated streams.
+   StreamId string
+   Version int
+}
+
+// The additional data for a chunk.
+// Legacy streams do not have any.
+func (this StreamParams) additionalData(index int64, last bool) []byte {
+   if (this.Version == CIPHER_VERSION_LEGACY) {
+      return nil;
+   }
+
+   var data []byte = make([]byte, len(this.StreamId) + 8 + 1);
+   copy(data, this.StreamId);
+   binary.BigEndian.PutUint64(data[len(this.StreamId):], uint64(index));
+   if (last) {
+      data[len(data) - 1] = 1;
+   }
+
+   return data;
+}
+
+// The number of chunks used to hold some amount of cleartext.
+func NumChunks(version int, cleartextSize int64) int64 {
+   var numChunks int64 = (cleartextSize + IO_BLOCK_SIZE - 1) / IO_BLOCK_SIZE;
+
+   // Authenticated streams always have a final chunk.
+   if (version != CIPHER_VERSION_LEGACY && numChunks == 0) {
+      numChunks = 1;
+   }
+
+   return numChunks;
+}
+
+func CiphertextSize(version int, cleartextSize int64) int64 {
+   return cleartextSize + (NumChunks(version, cleartextSize) * CIPHER_OVERHEAD);
+}
+
+func CleartextSize(ciphertextSize int64) int64 {
+   return ciphertextSize - (NumCiphertextChunks(ciphertextSize) * CIPHER_OVERHEAD);
+}
+
+// The number of chunks in a stream with |ciphertextSize| bytes.
+func NumCiphertextChunks(ciphertextSize int64) int64 {
+   return (ciphertextSize + CIPHER_BLOCK_SIZE - 1) / CIPHER_BLOCK_SIZE;
+}
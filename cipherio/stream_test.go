@@ -0,0 +1,219 @@
+package cipherio;
+
+import (
+   "bytes"
+   "crypto/aes"
+   "crypto/cipher"
+   "io/ioutil"
+   "testing"
+
+   "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+   TEST_STREAM_ID = "stream-under-test"
+   // Three full chunks and a partial one.
+   TEST_STREAM_SIZE = 3 * IO_BLOCK_SIZE + 100
+)
+
+type bytesReadSeekCloser struct {
+   *bytes.Reader
+}
+
+func (this bytesReadSeekCloser) Close() error {
+   return nil;
+}
+
+func newTestParams(t *testing.T, version int) StreamParams {
+   blockCipher, err := aes.NewCipher(util.GenAESKey());
+   if (err != nil) {
+      t.Fatalf("Failed to make cipher: %+v", err);
+   }
+
+   return StreamParams{
+      BlockCipher: blockCipher,
+      IV: util.GenIV(),
+      StreamId: TEST_STREAM_ID,
+      Version: version,
+   };
+}
+
+type closingBuffer struct {
+   bytes.Buffer
+}
+
+func (this *closingBuffer) Close() error {
+   return nil;
+}
+
+func testCleartext(size int) []byte {
+   if (size == 0) {
+      return []byte{};
+   }
+
+   return util.RandomBytes(size);
+}
+
+func writeTestStream(t *testing.T, params StreamParams, cleartext []byte) []byte {
+   var buffer closingBuffer;
+
+   writer, err := NewCipherWriter(&buffer, params);
+   if (err != nil) {
+      t.Fatalf("Failed to make writer: %+v", err);
+   }
+
+   _, err = writer.Write(cleartext);
+   if (err == nil) {
+      err = writer.Close();
+   }
+
+   if (err != nil) {
+      t.Fatalf("Failed to write stream: %+v", err);
+   }
+
+   return buffer.Bytes();
+}
+
+func readTestStream(params StreamParams, ciphertext []byte) ([]byte, error) {
+   reader, err := NewCipherReader(bytesReadSeekCloser{bytes.NewReader(ciphertext)}, params, int64(len(ciphertext)));
+   if (err != nil) {
+      return nil, err;
+   }
+   defer reader.Close();
+
+   return ioutil.ReadAll(reader);
+}
+
+// Seal a single chunk of an authenticated stream, with any last flag.
+func sealTestChunk(t *testing.T, params StreamParams, index int64, last bool, cleartext []byte) []byte {
+   gcm, err := cipher.NewGCM(params.BlockCipher);
+   if (err != nil) {
+      t.Fatalf("Failed to make GCM: %+v", err);
+   }
+
+   return gcm.Seal(nil, ChunkIV(params.IV, nil, index), cleartext, params.additionalData(index, last));
+}
+
+func chunk(ciphertext []byte, index int) []byte {
+   var end int = util.MinInt((index + 1) * CIPHER_BLOCK_SIZE, len(ciphertext));
+   return ciphertext[index * CIPHER_BLOCK_SIZE : end];
+}
+
+func joinChunks(chunks ...[]byte) []byte {
+   return bytes.Join(chunks, nil);
+}
+
+func TestRoundTrip(t *testing.T) {
+   var sizes []int = []int{0, 1, IO_BLOCK_SIZE, IO_BLOCK_SIZE + 1, TEST_STREAM_SIZE};
+
+   for _, version := range([]int{CIPHER_VERSION_LEGACY, CIPHER_VERSION_AUTHENTICATED}) {
+      for _, size := range(sizes) {
+         var params StreamParams = newTestParams(t, version);
+         var cleartext []byte = testCleartext(size);
+
+         var ciphertext []byte = writeTestStream(t, params, cleartext);
+         if (int64(len(ciphertext)) != CiphertextSize(version, int64(size))) {
+            t.Fatalf("Version %d, size %d: ciphertext is %d bytes, expected %d.", version, size, len(ciphertext), CiphertextSize(version, int64(size)));
+         }
+
+         readData, err := readTestStream(params, ciphertext);
+         if (err != nil || !bytes.Equal(readData, cleartext)) {
+            t.Fatalf("Version %d, size %d: failed round trip: %+v", version, size, err);
+         }
+      }
+   }
+}
+
+// Every way of tampering with an authenticated stream fails the read (instead of giving back short or wrong data).
+func TestTamperedStreams(t *testing.T) {
+   var params StreamParams = newTestParams(t, CIPHER_VERSION_AUTHENTICATED);
+   var cleartext []byte = util.RandomBytes(TEST_STREAM_SIZE);
+   var ciphertext []byte = writeTestStream(t, params, cleartext);
+
+   var otherParams StreamParams = params;
+   otherParams.StreamId = TEST_STREAM_ID + "-other";
+   var otherCiphertext []byte = writeTestStream(t, otherParams, cleartext);
+
+   var fullChunk []byte = cleartext[0:IO_BLOCK_SIZE];
+
+   var cases map[string][]byte = map[string][]byte{
+      "drop final chunk": joinChunks(chunk(ciphertext, 0), chunk(ciphertext, 1), chunk(ciphertext, 2)),
+      "cut at first chunk boundary": chunk(ciphertext, 0),
+      "cut mid chunk": ciphertext[0:len(ciphertext) - 10],
+      "no chunks": []byte{},
+      "swap chunks": joinChunks(chunk(ciphertext, 1), chunk(ciphertext, 0), chunk(ciphertext, 2), chunk(ciphertext, 3)),
+      "chunk from another stream": joinChunks(chunk(ciphertext, 0), chunk(otherCiphertext, 1), chunk(ciphertext, 2), chunk(ciphertext, 3)),
+      "final chunk from another stream": joinChunks(chunk(ciphertext, 0), chunk(ciphertext, 1), chunk(ciphertext, 2), chunk(otherCiphertext, 3)),
+      "final chunk not marked last": joinChunks(chunk(ciphertext, 0), chunk(ciphertext, 1), sealTestChunk(t, params, 2, false, fullChunk)),
+      "middle chunk marked last": joinChunks(chunk(ciphertext, 0), sealTestChunk(t, params, 1, true, fullChunk), chunk(ciphertext, 2), chunk(ciphertext, 3)),
+      "chunk after the final chunk": joinChunks(ciphertext, sealTestChunk(t, params, 4, true, []byte("extra"))),
+   };
+
+   for name, tampered := range(cases) {
+      readData, err := readTestStream(params, tampered);
+      if (err == nil) {
+         t.Errorf("%s: read %d bytes without an error.", name, len(readData));
+      }
+   }
+
+   // The untampered stream still reads.
+   readData, err := readTestStream(params, ciphertext);
+   if (err != nil || !bytes.Equal(readData, cleartext)) {
+      t.Fatalf("Failed to read the untampered stream: %+v", err);
+   }
+}
+
+// An empty authenticated stream cannot be cut down to nothing, or replaced by a chunk that is not marked last.
+func TestTamperedEmptyStream(t *testing.T) {
+   var params StreamParams = newTestParams(t, CIPHER_VERSION_AUTHENTICATED);
+
+   var cases map[string][]byte = map[string][]byte{
+      "no chunks": []byte{},
+      "empty chunk not marked last": sealTestChunk(t, params, 0, false, []byte{}),
+   };
+
+   for name, tampered := range(cases) {
+      _, err := readTestStream(params, tampered);
+      if (err == nil) {
+         t.Errorf("%s: read without an error.", name);
+      }
+   }
+}
+
+// Streams written before authentication (no additional data, and no chunk for an empty stream) still read.
+// They are sealed by hand here, just like older versions wrote them.
+func TestLegacyStream(t *testing.T) {
+   for _, size := range([]int{0, 1, IO_BLOCK_SIZE, TEST_STREAM_SIZE}) {
+      var params StreamParams = newTestParams(t, CIPHER_VERSION_LEGACY);
+      var cleartext []byte = testCleartext(size);
+
+      gcm, err := cipher.NewGCM(params.BlockCipher);
+      if (err != nil) {
+         t.Fatalf("Failed to make GCM: %+v", err);
+      }
+
+      var iv []byte = append([]byte(nil), params.IV...);
+      var ciphertext []byte = make([]byte, 0);
+      for start := 0; start < size; start += IO_BLOCK_SIZE {
+         var end int = util.MinInt(start + IO_BLOCK_SIZE, size);
+         ciphertext = gcm.Seal(ciphertext, iv, cleartext[start:end], nil);
+         util.IncrementBytes(iv);
+      }
+
+      readData, err := readTestStream(params, ciphertext);
+      if (err != nil || !bytes.Equal(readData, cleartext)) {
+         t.Fatalf("Size %d: failed to read legacy stream: %+v", size, err);
+      }
+
+      // The same bytes are not a valid authenticated stream.
+      if (size > 0) {
+         var authenticatedParams StreamParams = params;
+         authenticatedParams.Version = CIPHER_VERSION_AUTHENTICATED;
+
+         _, err = readTestStream(authenticatedParams, ciphertext);
+         if (err == nil) {
+            t.Fatalf("Size %d: legacy stream read as an authenticated stream.", size);
+         }
+      }
+   }
+}
@@ -0,0 +1,88 @@
+package cipherio;
+
+// Writing the same cleartext to several CipherWriters (eg one for each copy of a file).
+// Every writer does its own encryption, so each may have its own stream params.
+// A tee fails as soon as any of its writers does.
+
+import (
+   "crypto/md5"
+
+   "github.com/pkg/errors"
+)
+
+// Called when a tee is closed, with the number of writers (from the first) that were closed (and so committed),
+// and the error that stopped the rest (nil if every writer was closed).
+// Whatever the hook returns is what the tee's Close() returns.
+type TeeCloseHook func(closed int, err error) error
+
+// The tee takes ownership of |writers|.
+func NewTeeCipherWriter(writers []*CipherWriter) *CipherWriter {
+   return NewTeeCipherWriterWithHook(writers, nil);
+}
+
+// Same as NewTeeCipherWriter(), but |hook| (if not nil) is called when the tee is closed.
+func NewTeeCipherWriterWithHook(writers []*CipherWriter, hook TeeCloseHook) *CipherWriter {
+   var rtn CipherWriter = CipherWriter{
+      done: false,
+      fileSize: 0,
+      md5Hash: md5.New(),
+      tee: writers,
+      teeHook: hook,
+   };
+
+   return &rtn;
+}
+
+func (this *CipherWriter) teeWrite(data []byte) (int, error) {
+   for _, writer := range(this.tee) {
+      _, err := writer.Write(data);
+      if (err != nil) {
+         return 0, errors.WithStack(err);
+      }
+   }
+
+   this.fileSize += uint64(len(data));
+   this.md5Hash.Write(data);
+
+   return len(data), nil;
+}
+
+// If any writer fails to close, then the ones that are not closed yet are aborted.
+func (this *CipherWriter) teeClose() error {
+   var closed int = 0;
+   var err error = nil;
+
+   for _, writer := range(this.tee) {
+      err = writer.Close();
+      if (err != nil) {
+         for _, rest := range(this.tee[closed + 1:]) {
+            rest.Abort();
+         }
+
+         err = errors.WithStack(err);
+         break;
+      }
+
+      closed++;
+   }
+
+   if (this.teeHook != nil) {
+      err = this.teeHook(closed, err);
+   }
+
+   return err;
+}
+
+// Abort every writer, even if some fail.
+func (this *CipherWriter) teeAbort() error {
+   var firstErr error = nil;
+
+   for _, writer := range(this.tee) {
+      err := writer.Abort();
+      if (err != nil && firstErr == nil) {
+         firstErr = err;
+      }
+   }
+
+   return errors.WithStack(firstErr);
+}
@@ -24,6 +24,8 @@ import (
 // to be streamed in smaller (closer to IO_BLOCK_SIZE) chunks.
 // Close() MUST BE CALLED after all reading is finished.
 // Without the Close() call, the final chunk will not get writen.
+// Note that since the final chunk is marked (in authenticated streams),
+// a full chunk will be held until more data comes or the writer is closed.
 // The file size (cleartext) and md5 will be available after the writer is closed.
 type CipherWriter struct {
    gcm cipher.AEAD
@@ -34,16 +36,29 @@ type CipherWriter struct {
    originalCleartextBuffer []byte
    cleartextBuffer []byte
    ciphertextBuffer []byte
-   iv []byte
+   params StreamParams
+   // The index of the next chunk to write.
+   chunkIndex int64
    writer io.WriteCloser
    done bool
    fileSize uint64
    md5Hash hash.Hash
+   // Set for writers that just pass the cleartext on to other writers (see NewTeeCipherWriter()).
+   tee []*CipherWriter
+   // Optional, only for tees.
+   teeHook TeeCloseHook
 }
 
-func NewCipherWriter(writer io.WriteCloser,
-      blockCipher cipher.Block, rawIV []byte) (*CipherWriter, error) {
-   gcm, err := cipher.NewGCM(blockCipher);
+// Writers that can throw away everything written to them (like an S3 multipart upload).
+type abortableWriter interface {
+   Abort() error
+}
+
+// New streams should not have any |params.ChunkIVs|.
+// They are only for writing out an exact copy of a stream that has been edited,
+// since reusing a chunk's IV for different cleartext would break the encryption.
+func NewCipherWriter(writer io.WriteCloser, params StreamParams) (*CipherWriter, error) {
+   gcm, err := cipher.NewGCM(params.BlockCipher);
    if err != nil {
       return nil, err;
    }
@@ -56,12 +71,13 @@ func NewCipherWriter(writer io.WriteCloser,
       cleartextBuffer: cleartextBuffer,
       // Allocate enough room for the ciphertext.
       ciphertextBuffer: make([]byte, 0, IO_BLOCK_SIZE + gcm.Overhead()),
-      // Make a copy of the IV since we will be incrementing it for each chunk.
-      iv: append([]byte(nil), rawIV...),
+      params: params,
+      chunkIndex: 0,
       writer: writer,
       done: false,
       fileSize: 0,
       md5Hash: md5.New(),
+      tee: nil,
    };
 
    return &rtn, nil;
@@ -85,6 +101,10 @@ func (this *CipherWriter) GetHash() string {
 }
 
 func (this *CipherWriter) Write(data []byte) (int, error) {
+   if (this.tee != nil) {
+      return this.teeWrite(data);
+   }
+
    // Grow our local cleartext buffer
    this.cleartextBuffer = append(this.cleartextBuffer, data...);
 
@@ -100,32 +120,32 @@ func (this *CipherWriter) Write(data []byte) (int, error) {
 
 func (this *CipherWriter) writeChunks() error {
    // We don't have enough to write yet.
-   if (len(this.cleartextBuffer) < IO_BLOCK_SIZE && !this.done) {
+   // Until we are done, we can't know if a full chunk is the final one.
+   if (len(this.cleartextBuffer) <= IO_BLOCK_SIZE && !this.done) {
       return nil;
    }
 
    // Keep writing as many chunks as we have data for.
    // If we are done, then write the final chunk.
-   for (len(this.cleartextBuffer) >= IO_BLOCK_SIZE || (this.done && len(this.cleartextBuffer) > 0)) {
+   for (len(this.cleartextBuffer) > IO_BLOCK_SIZE || (this.done && len(this.cleartextBuffer) > 0)) {
       var writeSize = util.MinInt(IO_BLOCK_SIZE, len(this.cleartextBuffer));
       var data []byte = this.cleartextBuffer[0:writeSize];
 
       // Resise the clear text buffer so we "consume" what we are currently writing.
       this.cleartextBuffer = this.cleartextBuffer[writeSize:];
 
-      this.fileSize += uint64(writeSize);
-      this.md5Hash.Write(data);
-
-      // Use the shared buffer's memory.
-      cipherText := this.gcm.Seal(this.ciphertextBuffer, this.iv, data, nil);
-
-      _, err := this.writer.Write(cipherText);
+      err := this.writeChunk(data, this.done && len(this.cleartextBuffer) == 0);
       if (err != nil) {
-         return errors.Wrap(err, "Failed to write file block");
+         return errors.WithStack(err);
       }
+   }
 
-      // Prepare the IV for the next encrypt.
-      util.IncrementBytes(this.iv);
+   // An empty authenticated stream still gets a final chunk.
+   if (this.done && this.chunkIndex == 0 && this.params.Version != CIPHER_VERSION_LEGACY) {
+      err := this.writeChunk(this.cleartextBuffer[0:0], true);
+      if (err != nil) {
+         return errors.WithStack(err);
+      }
    }
 
    // No need to copy.
@@ -149,8 +169,32 @@ func (this *CipherWriter) writeChunks() error {
    return nil;
 }
 
+func (this *CipherWriter) writeChunk(data []byte, last bool) error {
+   this.fileSize += uint64(len(data));
+   this.md5Hash.Write(data);
+
+   var iv []byte = ChunkIV(this.params.IV, this.params.ChunkIVs, this.chunkIndex);
+   var additionalData []byte = this.params.additionalData(this.chunkIndex, last);
+
+   // Use the shared buffer's memory.
+   cipherText := this.gcm.Seal(this.ciphertextBuffer, iv, data, additionalData);
+
+   _, err := this.writer.Write(cipherText);
+   if (err != nil) {
+      return errors.Wrap(err, "Failed to write file block");
+   }
+
+   this.chunkIndex++;
+
+   return nil;
+}
+
 func (this *CipherWriter) Close() error {
    this.done = true;
+   if (this.tee != nil) {
+      return errors.WithStack(this.teeClose());
+   }
+
    err := this.writeChunks();
    if (err != nil) {
       return errors.WithStack(err);
@@ -158,3 +202,21 @@ func (this *CipherWriter) Close() error {
 
    return errors.WithStack(this.writer.Close());
 }
+
+// Give up on the stream without writing the final chunk.
+// If the underlying writer can abort, then nothing that was written will be kept.
+// Otherwise, the underlying writer is just closed (and will hold an incomplete stream).
+func (this *CipherWriter) Abort() error {
+   this.done = true;
+   if (this.tee != nil) {
+      return errors.WithStack(this.teeAbort());
+   }
+
+
+   abortable, ok := this.writer.(abortableWriter);
+   if (ok) {
+      return errors.WithStack(abortable.Abort());
+   }
+
+   return errors.WithStack(this.writer.Close());
+}
@@ -5,6 +5,7 @@ package connector;
 
 import (
    "crypto/cipher"
+   "time"
 
    "github.com/eriq-augustine/elfs/cipherio"
    "github.com/eriq-augustine/elfs/dirent"
@@ -13,10 +14,14 @@ import (
 
 const (
    CONNECTOR_TYPE_LOCAL = "local"
+   CONNECTOR_TYPE_MEMORY = "memory"
+   CONNECTOR_TYPE_MIRROR = "mirror"
    CONNECTOR_TYPE_S3 = "s3"
 
    FS_SYS_DIR_ADMIN = "admin"
    FS_SYS_DIR_DATA = "data"
+   // Data objects that were pulled out of the filesystem (see Auditable).
+   FS_SYS_DIR_QUARANTINE = "quarantine"
    DATA_GROUP_PREFIX_LEN = 1
 )
 
@@ -27,12 +32,96 @@ type Connector interface {
    // Prepare the backend storage for initialization.
    PrepareStorage() error
    // Get a reader that transparently handles all decryption.
+   // |blockCipher| is for the file's own (unwrapped) data key, not the master key.
    GetCipherReader(fileInfo *dirent.Dirent, blockCipher cipher.Block) (util.ReadSeekCloser, error)
    // Metadata may be stored in a different way than normal files.
-   GetMetadataReader(metadataId string, blockCipher cipher.Block, iv []byte) (util.ReadSeekCloser, error)
+   // Metadata is wrapped in an envelope (see cipherio.NewMetadataReader),
+   // the legacy IV is only used for metadata written before the envelope existed.
+   GetMetadataReader(metadataId string, blockCipher cipher.Block, legacyIV []byte) (*cipherio.MetadataReader, error)
    GetCipherWriter(fileInfo *dirent.Dirent, blockCipher cipher.Block) (*cipherio.CipherWriter, error)
-   GetMetadataWriter(metadataId string, blockCipher cipher.Block, iv []byte) (*cipherio.CipherWriter, error)
+   // Get a writer that can replace individual chunks of an existing file's ciphertext
+   // (see cipherio.ChunkEditor).
+   GetChunkWriter(fileInfo *dirent.Dirent) (cipherio.ChunkWriter, error)
+   // Every metadata write will get a fresh IV.
+   GetMetadataWriter(metadataId string, blockCipher cipher.Block) (*cipherio.CipherWriter, error)
    RemoveMetadataFile(metadataId string) error
+   // Small unencrypted objects kept with the metadata (eg the key header).
+   // These are read and written whole, and a write replaces the old object all at once.
+   // Reading an object that does not exist gives an error with an os.ErrNotExist cause.
+   ReadAdminObject(objectId string) ([]byte, error)
+   WriteAdminObject(objectId string, data []byte) error
    RemoveFile(file *dirent.Dirent) error
+   // Get the ids of all the data objects whose id starts with |prefix| (which may be empty).
+   // This includes objects that no dirent refers to.
+   ListData(prefix string) ([]dirent.Id, error)
+   // Get the ids of all the metadata (and admin) objects.
+   ListMetadata() ([]string, error)
+   // Stat a data object.
+   // Stating an object that does not exist gives an error with an os.ErrNotExist cause.
+   Stat(id dirent.Id) (*ObjectInfo, error)
    Close() error
 }
+
+// Optional operations for connectors that can be repaired (see driver.Fsck()).
+type Auditable interface {
+   // Move a data object out of the data area (so it is no longer listed), without destroying it.
+   QuarantineData(id dirent.Id) error
+}
+
+// Optional operations for connectors that can leave unfinished writes in their storage
+// (like an S3 multipart upload that was never completed or aborted because the process died).
+type Sweepable interface {
+   // Throw away unfinished writes that were started at least |minAge| ago.
+   // Writes that are still going should be younger than |minAge|, or they will be broken.
+   SweepStaleUploads(minAge time.Duration) (*SweepReport, error)
+}
+
+type SweepReport struct {
+   // Unfinished writes that were thrown away.
+   Aborted int
+   // Unfinished writes that were too new to throw away.
+   Skipped int
+   // The storage held by the writes that were thrown away.
+   BytesReclaimed int64
+}
+
+// Optional operations for connectors that keep several copies (replicas) of the storage (see connector/mirror).
+// Resyncing copies objects to any replica that is missing them or has them out of sync.
+type Resyncable interface {
+   // Bring the metadata (and admin) objects in every replica in sync.
+   ResyncMetadata() (*ResyncReport, error)
+   // Copy a file's data to any replica that is missing it or has it out of sync.
+   // The data is decrypted and encrypted again, so it needs the file's key.
+   ResyncData(fileInfo *dirent.Dirent, blockCipher cipher.Block) (*ResyncReport, error)
+}
+
+type ResyncReport struct {
+   // Objects that were looked for in every replica.
+   Checked int
+   // Copies that were made (an object missing from two replicas is copied twice).
+   Copied int
+   // Out of sync copies of objects that were removed from the other replicas, that were removed.
+   Removed int
+   // Copies (or removals) that could not be made.
+   Failed int
+   // Why copies could not be made.
+   Errors []error
+}
+
+func (this *ResyncReport) Add(other *ResyncReport) {
+   this.Checked += other.Checked;
+   this.Copied += other.Copied;
+   this.Removed += other.Removed;
+   this.Failed += other.Failed;
+   this.Errors = append(this.Errors, other.Errors...);
+}
+
+// What the backend knows about a stored object.
+type ObjectInfo struct {
+   // The size of the stored (encrypted) object.
+   CiphertextSize int64
+   ModTime time.Time
+   // Changes whenever the object is rewritten.
+   // For S3 this is the object's ETag, other backends may make up their own.
+   ETag string
+}
@@ -0,0 +1,179 @@
+package connectortest;
+
+// A shared battery of tests that every connector.Connector should pass.
+// A connector's own tests just need to supply a Factory:
+//
+//    func TestConnector(t *testing.T) {
+//        connectortest.Run(t, myFactory);
+//    }
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "math/rand"
+    "testing"
+
+    "github.com/eriq-augustine/elfs/cipherio"
+    "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/dirent"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+// Makes connectors for the tests.
+// Every test uses its own storage, named by the test.
+type Factory interface {
+    // Connect to the storage called |name|, creating it if it does not exist.
+    // |force| should be passed on to the connector (see local.NewLocalConnector()).
+    Open(name string, force bool) (connector.Connector, error)
+    // Throw away the storage called |name|.
+    // All of its connections will have been closed.
+    Destroy(name string) error
+}
+
+type testCase struct {
+    name string
+    run func(*testing.T, Factory, string)
+}
+
+var testCases []testCase = []testCase{
+    testCase{"GetIdStable", testGetIdStable},
+    testCase{"DataRoundTrip", testDataRoundTrip},
+    testCase{"RewriteAbort", testRewriteAbort},
+    testCase{"MetadataRoundTrip", testMetadataRoundTrip},
+    testCase{"AdminObjects", testAdminObjects},
+    testCase{"SeekChunkBoundaries", testSeekChunkBoundaries},
+    testCase{"ChunkEdit", testChunkEdit},
+    testCase{"ChunkEditAbort", testChunkEditAbort},
+    testCase{"RemoveMissing", testRemoveMissing},
+    testCase{"ListAndStat", testListAndStat},
+    testCase{"Lock", testLock},
+    testCase{"ForceLock", testForceLock},
+};
+
+// Run all the tests against the connectors from |factory|.
+func Run(t *testing.T, factory Factory) {
+    for _, test := range(testCases) {
+        var test testCase = test;
+        t.Run(test.name, func(t *testing.T) {
+            var name string = fmt.Sprintf("connectortest-%s-%s", test.name, util.RandomString(8));
+
+            defer func() {
+                err := factory.Destroy(name);
+                if (err != nil) {
+                    t.Errorf("Failed to destroy storage (%s): %+v", name, err);
+                }
+            }();
+
+            test.run(t, factory, name);
+        });
+    }
+}
+
+// Open a connection (and prepare its storage) or fail the test.
+func open(t *testing.T, factory Factory, name string) connector.Connector {
+    fsConnector, err := factory.Open(name, false);
+    if (err != nil) {
+        t.Fatalf("Failed to open connector (%s): %+v", name, err);
+    }
+
+    err = fsConnector.PrepareStorage();
+    if (err != nil) {
+        fsConnector.Close();
+        t.Fatalf("Failed to prepare storage (%s): %+v", name, err);
+    }
+
+    return fsConnector;
+}
+
+func closeConnector(t *testing.T, fsConnector connector.Connector) {
+    err := fsConnector.Close();
+    if (err != nil) {
+        t.Errorf("Failed to close connector: %+v", err);
+    }
+}
+
+func newBlockCipher(t *testing.T) cipher.Block {
+    blockCipher, err := aes.NewCipher(util.GenAESKey());
+    if (err != nil) {
+        t.Fatalf("Failed to make cipher: %+v", err);
+    }
+
+    return blockCipher;
+}
+
+func newFile() *dirent.Dirent {
+    var fileInfo dirent.Dirent = dirent.Dirent{
+        Id: dirent.NewId(),
+        IsFile: true,
+        IV: util.GenIV(),
+        CipherVersion: cipherio.CURRENT_CIPHER_VERSION,
+    };
+
+    return &fileInfo;
+}
+
+// Deterministic (per size) data, so failures can be reproduced.
+func testData(size int) []byte {
+    var data []byte = make([]byte, size);
+    rand.New(rand.NewSource(int64(size))).Read(data);
+    return data;
+}
+
+func writeFile(t *testing.T, fsConnector connector.Connector, fileInfo *dirent.Dirent,
+        blockCipher cipher.Block, data []byte) {
+    size, _, err := connector.Write(fsConnector, fileInfo, blockCipher, bytes.NewReader(data));
+    if (err != nil) {
+        t.Fatalf("Failed to write file (%s): %+v", string(fileInfo.Id), err);
+    }
+
+    if (size != uint64(len(data))) {
+        t.Fatalf("Wrong size written for file (%s). Expected: %d, Found: %d.", string(fileInfo.Id), len(data), size);
+    }
+
+    fileInfo.Size = size;
+}
+
+func readFile(t *testing.T, fsConnector connector.Connector, fileInfo *dirent.Dirent, blockCipher cipher.Block) []byte {
+    reader, err := fsConnector.GetCipherReader(fileInfo, blockCipher);
+    if (err != nil) {
+        t.Fatalf("Failed to get reader for file (%s): %+v", string(fileInfo.Id), err);
+    }
+    defer reader.Close();
+
+    data, err := ioutil.ReadAll(reader);
+    if (err != nil) {
+        t.Fatalf("Failed to read file (%s): %+v", string(fileInfo.Id), err);
+    }
+
+    return data;
+}
+
+func checkBytes(t *testing.T, what string, expected []byte, actual []byte) {
+    if (bytes.Equal(expected, actual)) {
+        return;
+    }
+
+    var firstDiff int = 0;
+    for (firstDiff < len(expected) && firstDiff < len(actual) && expected[firstDiff] == actual[firstDiff]) {
+        firstDiff++;
+    }
+
+    t.Errorf("%s: content differs. Expected length: %d, Found length: %d, First difference at: %d.",
+            what, len(expected), len(actual), firstDiff);
+}
+
+// Read exactly |length| bytes (or until EOF).
+func readAtMost(reader io.Reader, length int) ([]byte, error) {
+    var buffer []byte = make([]byte, length);
+
+    count, err := io.ReadFull(reader, buffer);
+    if (err == io.ErrUnexpectedEOF || err == io.EOF) {
+        err = nil;
+    }
+
+    return buffer[0:count], err;
+}
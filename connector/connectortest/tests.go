@@ -0,0 +1,556 @@
+package connectortest;
+
+import (
+    "bytes"
+    "crypto/md5"
+    "encoding/hex"
+    "io"
+    "io/ioutil"
+    "os"
+    "sort"
+    "testing"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/cipherio"
+    "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/dirent"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+// Sizes around the chunk boundaries.
+var roundTripSizes []int = []int{
+    0,
+    1,
+    cipherio.IO_BLOCK_SIZE - 1,
+    cipherio.IO_BLOCK_SIZE,
+    cipherio.IO_BLOCK_SIZE + 1,
+    3 * cipherio.IO_BLOCK_SIZE + 17,
+};
+
+func testGetIdStable(t *testing.T, factory Factory, name string) {
+    var fsConnector connector.Connector = open(t, factory, name);
+
+    var id string = fsConnector.GetId();
+    if (id == "") {
+        t.Errorf("Empty connector id.");
+    }
+
+    if (fsConnector.GetId() != id) {
+        t.Errorf("Connector id changed between calls. First: %s, Then: %s.", id, fsConnector.GetId());
+    }
+
+    closeConnector(t, fsConnector);
+
+    // The same storage should always have the same id.
+    fsConnector = open(t, factory, name);
+    if (fsConnector.GetId() != id) {
+        t.Errorf("Connector id changed after reconnecting. First: %s, Then: %s.", id, fsConnector.GetId());
+    }
+    closeConnector(t, fsConnector);
+
+    // Other storage should not.
+    var otherName string = name + "-other";
+    defer factory.Destroy(otherName);
+
+    otherConnector := open(t, factory, otherName);
+    if (otherConnector.GetId() == id) {
+        t.Errorf("Different storage has the same connector id: %s.", id);
+    }
+    closeConnector(t, otherConnector);
+}
+
+func testDataRoundTrip(t *testing.T, factory Factory, name string) {
+    var fsConnector connector.Connector = open(t, factory, name);
+    defer closeConnector(t, fsConnector);
+
+    var blockCipher = newBlockCipher(t);
+
+    for _, size := range(roundTripSizes) {
+        var data []byte = testData(size);
+        var fileInfo *dirent.Dirent = newFile();
+
+        size, md5String, err := connector.Write(fsConnector, fileInfo, blockCipher, bytes.NewReader(data));
+        if (err != nil) {
+            t.Fatalf("Failed to write file of size %d: %+v", len(data), err);
+        }
+
+        if (size != uint64(len(data))) {
+            t.Errorf("Wrong size written. Expected: %d, Found: %d.", len(data), size);
+        }
+
+        var expectedMd5 [md5.Size]byte = md5.Sum(data);
+        if (md5String != hex.EncodeToString(expectedMd5[:])) {
+            t.Errorf("Wrong md5 for file of size %d. Expected: %s, Found: %s.", len(data), hex.EncodeToString(expectedMd5[:]), md5String);
+        }
+
+        checkBytes(t, "Round trip", data, readFile(t, fsConnector, fileInfo, blockCipher));
+
+        // A rewrite replaces the whole file.
+        var newData []byte = testData(len(data) / 2 + 3);
+        writeFile(t, fsConnector, fileInfo, blockCipher, newData);
+        checkBytes(t, "Rewrite", newData, readFile(t, fsConnector, fileInfo, blockCipher));
+    }
+}
+
+// A rewrite leaves the old file in place until it is closed, and an aborted rewrite leaves the old file as it was.
+func testRewriteAbort(t *testing.T, factory Factory, name string) {
+    var fsConnector connector.Connector = open(t, factory, name);
+    defer closeConnector(t, fsConnector);
+
+    var blockCipher = newBlockCipher(t);
+    var data []byte = testData(2 * cipherio.IO_BLOCK_SIZE + 100);
+    var fileInfo *dirent.Dirent = newFile();
+    writeFile(t, fsConnector, fileInfo, blockCipher, data);
+
+    // The rewrite is under another IV (like a put, which gets a new key and IV).
+    var newInfo *dirent.Dirent = fileInfo.Clone();
+    newInfo.IV = util.GenIV();
+
+    writer, err := fsConnector.GetCipherWriter(newInfo, blockCipher);
+    if (err != nil) {
+        t.Fatalf("Failed to get writer: %+v", err);
+    }
+
+    _, err = writer.Write(testData(3 * cipherio.IO_BLOCK_SIZE));
+    if (err != nil) {
+        writer.Abort();
+        t.Fatalf("Failed to write: %+v", err);
+    }
+
+    checkBytes(t, "Open rewrite", data, readFile(t, fsConnector, fileInfo, blockCipher));
+
+    err = writer.Abort();
+    if (err != nil) {
+        t.Fatalf("Failed to abort: %+v", err);
+    }
+
+    checkBytes(t, "Aborted rewrite", data, readFile(t, fsConnector, fileInfo, blockCipher));
+}
+
+func testMetadataRoundTrip(t *testing.T, factory Factory, name string) {
+    var fsConnector connector.Connector = open(t, factory, name);
+    defer closeConnector(t, fsConnector);
+
+    var blockCipher = newBlockCipher(t);
+    const metadataId = "connectortest_metadata";
+
+    for _, size := range([]int{0, 100, cipherio.IO_BLOCK_SIZE + 5}) {
+        var data []byte = testData(size);
+
+        writer, err := fsConnector.GetMetadataWriter(metadataId, blockCipher);
+        if (err != nil) {
+            t.Fatalf("Failed to get metadata writer: %+v", err);
+        }
+
+        _, err = writer.Write(data);
+        if (err != nil) {
+            t.Fatalf("Failed to write metadata: %+v", err);
+        }
+
+        err = writer.Close();
+        if (err != nil) {
+            t.Fatalf("Failed to close metadata writer: %+v", err);
+        }
+
+        reader, err := fsConnector.GetMetadataReader(metadataId, blockCipher, nil);
+        if (err != nil) {
+            t.Fatalf("Failed to get metadata reader: %+v", err);
+        }
+
+        readData, err := ioutil.ReadAll(reader);
+        reader.Close();
+
+        if (err != nil) {
+            t.Fatalf("Failed to read metadata: %+v", err);
+        }
+
+        checkBytes(t, "Metadata round trip", data, readData);
+    }
+
+    err := fsConnector.RemoveMetadataFile(metadataId);
+    if (err != nil) {
+        t.Fatalf("Failed to remove metadata: %+v", err);
+    }
+
+    _, err = fsConnector.GetMetadataReader(metadataId, blockCipher, nil);
+    if (err == nil) {
+        t.Errorf("Got a reader for removed metadata.");
+    }
+}
+
+func testAdminObjects(t *testing.T, factory Factory, name string) {
+    var fsConnector connector.Connector = open(t, factory, name);
+    defer closeConnector(t, fsConnector);
+
+    const objectId = "connectortest_admin";
+
+    _, err := fsConnector.ReadAdminObject(objectId);
+    if (err == nil || !os.IsNotExist(errors.Cause(err))) {
+        t.Errorf("Reading a missing admin object should be a not exist error, found: %+v", err);
+    }
+
+    for _, data := range([][]byte{[]byte("first"), []byte("second, and longer")}) {
+        err = fsConnector.WriteAdminObject(objectId, data);
+        if (err != nil) {
+            t.Fatalf("Failed to write admin object: %+v", err);
+        }
+
+        readData, err := fsConnector.ReadAdminObject(objectId);
+        if (err != nil) {
+            t.Fatalf("Failed to read admin object: %+v", err);
+        }
+
+        checkBytes(t, "Admin object", data, readData);
+    }
+
+    metadataIds, err := fsConnector.ListMetadata();
+    if (err != nil) {
+        t.Fatalf("Failed to list metadata: %+v", err);
+    }
+
+    if (!containsString(metadataIds, objectId)) {
+        t.Errorf("Admin object (%s) not listed with the metadata: %v.", objectId, metadataIds);
+    }
+}
+
+func testSeekChunkBoundaries(t *testing.T, factory Factory, name string) {
+    var fsConnector connector.Connector = open(t, factory, name);
+    defer closeConnector(t, fsConnector);
+
+    var blockCipher = newBlockCipher(t);
+    var data []byte = testData(3 * cipherio.IO_BLOCK_SIZE + cipherio.IO_BLOCK_SIZE / 2);
+    var fileInfo *dirent.Dirent = newFile();
+    writeFile(t, fsConnector, fileInfo, blockCipher, data);
+
+    reader, err := fsConnector.GetCipherReader(fileInfo, blockCipher);
+    if (err != nil) {
+        t.Fatalf("Failed to get reader: %+v", err);
+    }
+    defer reader.Close();
+
+    var offsets []int64 = []int64{0, 1};
+    for chunk := int64(1); chunk <= 3; chunk++ {
+        var boundary int64 = chunk * cipherio.IO_BLOCK_SIZE;
+        offsets = append(offsets, boundary - 1, boundary, boundary + 1);
+    }
+    offsets = append(offsets, int64(len(data) - 1));
+
+    const readLength = 64;
+
+    for _, offset := range(offsets) {
+        var expectedEnd int64 = offset + readLength;
+        if (expectedEnd > int64(len(data))) {
+            expectedEnd = int64(len(data));
+        }
+        var expected []byte = data[offset:expectedEnd];
+
+        // Seek to the same place from each direction (starting from somewhere else).
+        var seeks = []struct{offset int64; whence int}{
+            {offset, io.SeekStart},
+            {offset - int64(len(data)), io.SeekEnd},
+            {offset - cipherio.IO_BLOCK_SIZE, io.SeekCurrent},
+        };
+
+        for _, seek := range(seeks) {
+            _, err = reader.Seek(cipherio.IO_BLOCK_SIZE, io.SeekStart);
+            if (err != nil) {
+                t.Fatalf("Failed to seek to the start position: %+v", err);
+            }
+
+            position, err := reader.Seek(seek.offset, seek.whence);
+            if (err != nil) {
+                t.Fatalf("Failed to seek to %d (whence: %d): %+v", seek.offset, seek.whence, err);
+            }
+
+            if (position != offset) {
+                t.Errorf("Seek (%d, whence: %d) went to the wrong place. Expected: %d, Found: %d.", seek.offset, seek.whence, offset, position);
+                continue;
+            }
+
+            readData, err := readAtMost(reader, readLength);
+            if (err != nil) {
+                t.Fatalf("Failed to read after seeking to %d: %+v", offset, err);
+            }
+
+            checkBytes(t, "Read after seek", expected, readData);
+        }
+    }
+}
+
+// Edit a file in place across a chunk boundary with a chunk writer.
+func testChunkEdit(t *testing.T, factory Factory, name string) {
+    var fsConnector connector.Connector = open(t, factory, name);
+    defer closeConnector(t, fsConnector);
+
+    var blockCipher = newBlockCipher(t);
+    var data []byte = testData(2 * cipherio.IO_BLOCK_SIZE + 100);
+    var fileInfo *dirent.Dirent = newFile();
+    writeFile(t, fsConnector, fileInfo, blockCipher, data);
+
+    reader, err := fsConnector.GetCipherReader(fileInfo, blockCipher);
+    if (err != nil) {
+        t.Fatalf("Failed to get reader: %+v", err);
+    }
+    defer reader.Close();
+
+    writer, err := fsConnector.GetChunkWriter(fileInfo);
+    if (err != nil) {
+        t.Fatalf("Failed to get chunk writer: %+v", err);
+    }
+
+    editor, err := cipherio.NewChunkEditor(reader, writer, connector.FileStreamParams(fileInfo, blockCipher), int64(len(data)));
+    if (err != nil) {
+        t.Fatalf("Failed to get chunk editor: %+v", err);
+    }
+
+    var edit []byte = []byte("connectortest edit");
+    var offset int64 = cipherio.IO_BLOCK_SIZE - 5;
+
+    _, err = editor.WriteAt(edit, offset);
+    if (err != nil) {
+        editor.Abort();
+        t.Fatalf("Failed to edit: %+v", err);
+    }
+
+    err = editor.Close();
+    if (err != nil) {
+        t.Fatalf("Failed to close editor: %+v", err);
+    }
+
+    fileInfo.ChunkIVs = editor.GetChunkIVs();
+
+    var expected []byte = append([]byte(nil), data...);
+    copy(expected[offset:], edit);
+
+    checkBytes(t, "Chunk edit", expected, readFile(t, fsConnector, fileInfo, blockCipher));
+}
+
+// An aborted edit leaves the file as it was, and nothing of an edit is seen until it is closed.
+func testChunkEditAbort(t *testing.T, factory Factory, name string) {
+    var fsConnector connector.Connector = open(t, factory, name);
+    defer closeConnector(t, fsConnector);
+
+    var blockCipher = newBlockCipher(t);
+    var data []byte = testData(2 * cipherio.IO_BLOCK_SIZE + 100);
+    var fileInfo *dirent.Dirent = newFile();
+    writeFile(t, fsConnector, fileInfo, blockCipher, data);
+
+    writer, err := fsConnector.GetChunkWriter(fileInfo);
+    if (err != nil) {
+        t.Fatalf("Failed to get chunk writer: %+v", err);
+    }
+
+    err = writer.WriteChunk(1, testData(cipherio.CIPHER_BLOCK_SIZE));
+    if (err != nil) {
+        writer.Abort();
+        t.Fatalf("Failed to write chunk: %+v", err);
+    }
+
+    err = writer.Truncate(cipherio.CIPHER_BLOCK_SIZE);
+    if (err != nil) {
+        writer.Abort();
+        t.Fatalf("Failed to truncate: %+v", err);
+    }
+
+    checkBytes(t, "Open chunk edit", data, readFile(t, fsConnector, fileInfo, blockCipher));
+
+    err = writer.Abort();
+    if (err != nil) {
+        t.Fatalf("Failed to abort: %+v", err);
+    }
+
+    checkBytes(t, "Aborted chunk edit", data, readFile(t, fsConnector, fileInfo, blockCipher));
+}
+
+// Removing something that does not exist may succeed, or fail with a not exist error.
+func testRemoveMissing(t *testing.T, factory Factory, name string) {
+    var fsConnector connector.Connector = open(t, factory, name);
+    defer closeConnector(t, fsConnector);
+
+    err := fsConnector.RemoveFile(newFile());
+    if (err != nil && !os.IsNotExist(errors.Cause(err))) {
+        t.Errorf("Removing a missing file should succeed or be a not exist error, found: %+v", err);
+    }
+
+    err = fsConnector.RemoveMetadataFile("connectortest_missing");
+    if (err != nil && !os.IsNotExist(errors.Cause(err))) {
+        t.Errorf("Removing missing metadata should succeed or be a not exist error, found: %+v", err);
+    }
+
+    // Remove a real file, then remove it again.
+    var blockCipher = newBlockCipher(t);
+    var fileInfo *dirent.Dirent = newFile();
+    writeFile(t, fsConnector, fileInfo, blockCipher, testData(10));
+
+    err = fsConnector.RemoveFile(fileInfo);
+    if (err != nil) {
+        t.Fatalf("Failed to remove file: %+v", err);
+    }
+
+    _, err = fsConnector.GetCipherReader(fileInfo, blockCipher);
+    if (err == nil) {
+        t.Errorf("Got a reader for a removed file.");
+    }
+
+    _, err = fsConnector.Stat(fileInfo.Id);
+    if (err == nil || !os.IsNotExist(errors.Cause(err))) {
+        t.Errorf("Stating a removed file should be a not exist error, found: %+v", err);
+    }
+
+    err = fsConnector.RemoveFile(fileInfo);
+    if (err != nil && !os.IsNotExist(errors.Cause(err))) {
+        t.Errorf("Removing a removed file should succeed or be a not exist error, found: %+v", err);
+    }
+}
+
+func testListAndStat(t *testing.T, factory Factory, name string) {
+    var fsConnector connector.Connector = open(t, factory, name);
+    defer closeConnector(t, fsConnector);
+
+    var blockCipher = newBlockCipher(t);
+    var ids []string = make([]string, 0);
+    var files []*dirent.Dirent = make([]*dirent.Dirent, 0);
+
+    for i := 0; i < 5; i++ {
+        var fileInfo *dirent.Dirent = newFile();
+        writeFile(t, fsConnector, fileInfo, blockCipher, testData(1000 * i));
+
+        files = append(files, fileInfo);
+        ids = append(ids, string(fileInfo.Id));
+    }
+
+    listed, err := fsConnector.ListData("");
+    if (err != nil) {
+        t.Fatalf("Failed to list data: %+v", err);
+    }
+
+    var listedIds []string = make([]string, 0, len(listed));
+    for _, id := range(listed) {
+        listedIds = append(listedIds, string(id));
+    }
+
+    sort.Strings(ids);
+    sort.Strings(listedIds);
+
+    if (len(ids) != len(listedIds)) {
+        t.Fatalf("Wrong data listed. Expected: %v, Found: %v.", ids, listedIds);
+    }
+
+    for i, _ := range(ids) {
+        if (ids[i] != listedIds[i]) {
+            t.Fatalf("Wrong data listed. Expected: %v, Found: %v.", ids, listedIds);
+        }
+    }
+
+    // Prefixes of one and more characters.
+    for _, prefixLength := range([]int{1, 3}) {
+        var prefix string = ids[0][0:prefixLength];
+
+        prefixed, err := fsConnector.ListData(prefix);
+        if (err != nil) {
+            t.Fatalf("Failed to list data with prefix (%s): %+v", prefix, err);
+        }
+
+        var expected int = 0;
+        for _, id := range(ids) {
+            if (id[0:prefixLength] == prefix) {
+                expected++;
+            }
+        }
+
+        if (len(prefixed) != expected) {
+            t.Errorf("Wrong number of ids listed with prefix (%s). Expected: %d, Found: %d.", prefix, expected, len(prefixed));
+        }
+
+        for _, id := range(prefixed) {
+            if (string(id)[0:prefixLength] != prefix) {
+                t.Errorf("Id (%s) listed for prefix (%s).", string(id), prefix);
+            }
+        }
+    }
+
+    var fileInfo *dirent.Dirent = files[len(files) - 1];
+
+    info, err := fsConnector.Stat(fileInfo.Id);
+    if (err != nil) {
+        t.Fatalf("Failed to stat: %+v", err);
+    }
+
+    // The ciphertext always carries some overhead.
+    if (info.CiphertextSize <= int64(fileInfo.Size)) {
+        t.Errorf("Ciphertext size (%d) is not larger than the cleartext size (%d).", info.CiphertextSize, fileInfo.Size);
+    }
+
+    if (info.ETag == "") {
+        t.Errorf("Empty ETag.");
+    }
+
+    writeFile(t, fsConnector, fileInfo, blockCipher, testData(12345));
+
+    newInfo, err := fsConnector.Stat(fileInfo.Id);
+    if (err != nil) {
+        t.Fatalf("Failed to stat after rewrite: %+v", err);
+    }
+
+    if (newInfo.ETag == info.ETag) {
+        t.Errorf("ETag (%s) did not change after a rewrite.", info.ETag);
+    }
+}
+
+func testLock(t *testing.T, factory Factory, name string) {
+    var fsConnector connector.Connector = open(t, factory, name);
+
+    otherConnector, err := factory.Open(name, false);
+    if (err == nil) {
+        otherConnector.Close();
+        closeConnector(t, fsConnector);
+        t.Fatalf("Opened a second connection to locked storage.");
+    }
+
+    closeConnector(t, fsConnector);
+
+    // Closing should release the lock (in the same process too).
+    fsConnector, err = factory.Open(name, false);
+    if (err != nil) {
+        t.Fatalf("Could not reconnect after closing: %+v", err);
+    }
+    closeConnector(t, fsConnector);
+}
+
+func testForceLock(t *testing.T, factory Factory, name string) {
+    // Keep some data around, forcing a lock should not touch it.
+    var fsConnector connector.Connector = open(t, factory, name);
+    var blockCipher = newBlockCipher(t);
+    var data []byte = testData(2000);
+    var fileInfo *dirent.Dirent = newFile();
+    writeFile(t, fsConnector, fileInfo, blockCipher, data);
+
+    forcedConnector, err := factory.Open(name, true);
+    if (err != nil) {
+        closeConnector(t, fsConnector);
+        t.Fatalf("Failed to force a connection: %+v", err);
+    }
+
+    checkBytes(t, "Read after force", data, readFile(t, forcedConnector, fileInfo, blockCipher));
+
+    // The stale connection goes away (as a crashed process would).
+    fsConnector.Close();
+    closeConnector(t, forcedConnector);
+
+    fsConnector, err = factory.Open(name, false);
+    if (err != nil) {
+        t.Fatalf("Could not reconnect after closing a forced connection: %+v", err);
+    }
+    closeConnector(t, fsConnector);
+}
+
+func containsString(haystack []string, needle string) bool {
+    for _, value := range(haystack) {
+        if (value == needle) {
+            return true;
+        }
+    }
+
+    return false;
+}
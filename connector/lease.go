@@ -0,0 +1,328 @@
+package connector;
+
+// A lock on a filesystem's storage, held as a lease.
+// The lock object says who owns the storage and for how long.
+// The owner keeps renewing the lease in the background, so a lease only runs out when its owner is gone
+// (or cannot reach the storage), and then anyone may take the storage over without forcing it.
+//
+// Changes to the lock object are compare-and-swaps on the object's version (see LeaseBackend),
+// so two connections racing for the lock cannot both win.
+// Not every backend can do a true compare-and-swap, so every write is also read back to check that it stuck.
+
+import (
+   "encoding/json"
+   "os"
+   "strings"
+   "sync"
+   "time"
+
+   "github.com/pkg/errors"
+
+   "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+   DEFAULT_LEASE_DURATION = 60 * time.Second
+   // How many times a lease is renewed in the time it lasts.
+   LEASE_RENEWALS_PER_DURATION = 3
+   // How many times to try for the lock while other connections keep changing it.
+   LEASE_ACQUIRE_ATTEMPTS = 5
+   LEASE_OWNER_LENGTH = 32
+   UNKNOWN_LEASE_HOSTNAME = "unknown"
+)
+
+var ErrLeaseConflict error = errors.New("The lock was changed by someone else.");
+
+// The contents of a lock object.
+type Lease struct {
+   // Unique to a single connection.
+   Owner string
+   Hostname string
+   Pid int
+   // Only for people to read, what counts is how long ago the backend says the lease was written.
+   Renewed time.Time
+   Expires time.Time
+   Duration time.Duration
+}
+
+// How a connector stores its lock object.
+type LeaseBackend interface {
+   // Get the lock object, or nil (and no error) if there is none.
+   ReadLease() (*LeaseRecord, error)
+   // Write the lock object only if it does not exist, and give back its new version.
+   // Gives ErrLeaseConflict (as the cause) if it does exist.
+   CreateLease(data []byte) (string, error)
+   // Replace the lock object only if it is still at |version|, and give back its new version.
+   // Gives ErrLeaseConflict (as the cause) if it is not.
+   ReplaceLease(data []byte, version string) (string, error)
+   // Remove the lock object only if it is still at |version|.
+   // Gives ErrLeaseConflict (as the cause) if it is not.
+   RemoveLease(version string) error
+}
+
+type LeaseRecord struct {
+   Data []byte
+   // Changes whenever the lock object is written.
+   Version string
+   // How long ago the lock object was written.
+   // Backends should use their own clock when they have one, so the clocks of the hosts do not matter.
+   Age time.Duration
+}
+
+type LeaseLock struct {
+   backend LeaseBackend
+   // What is being locked (for messages).
+   name string
+   duration time.Duration
+   // Protects everything below.
+   lock *sync.Mutex
+   lease Lease
+   version string
+   lastRenewal time.Time
+   // Set once the lease is gone.
+   lostError error
+   released bool
+   stop chan bool
+   stopped *sync.WaitGroup
+}
+
+// Parse a lock object.
+// Locks from before leases were just a hostname or pid, and give an error.
+func ParseLease(data []byte) (*Lease, error) {
+   var lease Lease;
+   err := json.Unmarshal(data, &lease);
+   if (err != nil || lease.Owner == "") {
+      return nil, errors.Errorf("Not a lease: [%s].", strings.TrimSpace(string(data)));
+   }
+
+   return &lease, nil;
+}
+
+// Take the lock on |name| (through |backend|) and keep renewing it until it is released.
+// A lock that is held by someone else can only be taken once its lease runs out, or if |force| is true.
+func AcquireLease(backend LeaseBackend, name string, duration time.Duration, force bool) (*LeaseLock, error) {
+   if (duration <= 0) {
+      duration = DEFAULT_LEASE_DURATION;
+   }
+
+   hostname, err := os.Hostname();
+   if (err != nil) {
+      hostname = UNKNOWN_LEASE_HOSTNAME;
+   }
+
+   var leaseLock LeaseLock = LeaseLock{
+      backend: backend,
+      name: name,
+      duration: duration,
+      lock: &sync.Mutex{},
+      lease: Lease{
+         Owner: util.RandomString(LEASE_OWNER_LENGTH),
+         Hostname: hostname,
+         Pid: os.Getpid(),
+         Duration: duration,
+      },
+      stop: make(chan bool),
+      stopped: &sync.WaitGroup{},
+   };
+
+   for attempt := 0; attempt < LEASE_ACQUIRE_ATTEMPTS; attempt++ {
+      acquired, err := leaseLock.tryAcquire(force);
+      if (err != nil) {
+         return nil, errors.WithStack(err);
+      }
+
+      if (acquired) {
+         leaseLock.stopped.Add(1);
+         go leaseLock.heartbeat();
+         return &leaseLock, nil;
+      }
+   }
+
+   return nil, errors.Errorf("Could not lock %s, the lock kept changing.", name);
+}
+
+// Returns false if the lock changed while we were trying (so it is worth trying again).
+func (this *LeaseLock) tryAcquire(force bool) (bool, error) {
+   record, err := this.backend.ReadLease();
+   if (err != nil) {
+      return false, errors.WithStack(err);
+   }
+
+   var lease Lease = this.nextLease();
+   data, err := json.Marshal(&lease);
+   if (err != nil) {
+      return false, errors.WithStack(err);
+   }
+
+   if (record == nil) {
+      _, err = this.backend.CreateLease(data);
+   } else {
+      current, parseErr := ParseLease(record.Data);
+
+      if (!force && parseErr != nil) {
+         return false, errors.Errorf("%s is locked by an old connection [%s] whose lock does not expire." +
+               " Ensure that it is no longer running and remove the lock or force the connection.",
+               this.name, strings.TrimSpace(string(record.Data)));
+      }
+
+      if (!force && current.Owner != this.lease.Owner && record.Age < current.Duration) {
+         return false, errors.Errorf("%s is locked by [%s] (pid %d) for about %s more." +
+               " Wait for its lease to run out, or ensure that it is no longer running and force the connection.",
+               this.name, current.Hostname, current.Pid, (current.Duration - record.Age).Round(time.Second));
+      }
+
+      _, err = this.backend.ReplaceLease(data, record.Version);
+   }
+
+   if (errors.Cause(err) == ErrLeaseConflict) {
+      return false, nil;
+   } else if (err != nil) {
+      return false, errors.WithStack(err);
+   }
+
+   // Make sure that our write is the one that stuck.
+   version, ok, err := this.readOwnVersion();
+   if (err != nil || !ok) {
+      return false, errors.WithStack(err);
+   }
+
+   this.lease = lease;
+   this.version = version;
+   this.lastRenewal = lease.Renewed;
+
+   return true, nil;
+}
+
+// Get the version of the lock object if it is still ours.
+func (this *LeaseLock) readOwnVersion() (string, bool, error) {
+   record, err := this.backend.ReadLease();
+   if (err != nil) {
+      return "", false, errors.WithStack(err);
+   }
+
+   if (record == nil) {
+      return "", false, nil;
+   }
+
+   current, err := ParseLease(record.Data);
+   if (err != nil || current.Owner != this.lease.Owner) {
+      return "", false, nil;
+   }
+
+   return record.Version, true, nil;
+}
+
+func (this *LeaseLock) nextLease() Lease {
+   var lease Lease = this.lease;
+   lease.Renewed = time.Now();
+   lease.Expires = lease.Renewed.Add(this.duration);
+   return lease;
+}
+
+func (this *LeaseLock) heartbeat() {
+   defer this.stopped.Done();
+
+   ticker := time.NewTicker(this.duration / LEASE_RENEWALS_PER_DURATION);
+   defer ticker.Stop();
+
+   for {
+      select {
+         case <-this.stop:
+            return;
+         case <-ticker.C:
+            if (!this.renew()) {
+               return;
+            }
+      }
+   }
+}
+
+// Returns false once the lease is lost.
+// A failed renewal is fine, as long as a later one works before the lease runs out.
+func (this *LeaseLock) renew() bool {
+   this.lock.Lock();
+   defer this.lock.Unlock();
+
+   var lease Lease = this.nextLease();
+   data, err := json.Marshal(&lease);
+   if (err == nil) {
+      var version string;
+      version, err = this.backend.ReplaceLease(data, this.version);
+      if (err == nil) {
+         this.lease = lease;
+         this.version = version;
+         this.lastRenewal = lease.Renewed;
+         return true;
+      }
+   }
+
+   if (errors.Cause(err) == ErrLeaseConflict) {
+      // A renewal that looked like it failed may have still gone through.
+      version, ok, readErr := this.readOwnVersion();
+      if (readErr == nil && ok) {
+         this.version = version;
+         return true;
+      }
+
+      this.lostError = errors.Errorf("The lock on %s was taken by another connection.", this.name);
+      return false;
+   }
+
+   if (time.Since(this.lastRenewal) >= this.duration) {
+      this.lostError = errors.Wrapf(err, "Could not renew the lock on %s before it ran out", this.name);
+      return false;
+   }
+
+   return true;
+}
+
+// Check that the lock is still held.
+// Anything that changes the storage should check first.
+func (this *LeaseLock) Check() error {
+   this.lock.Lock();
+   defer this.lock.Unlock();
+
+   if (this.lostError != nil) {
+      return this.lostError;
+   }
+
+   // The heartbeat may be stuck.
+   if (time.Since(this.lastRenewal) >= this.duration) {
+      return errors.Errorf("The lock on %s has not been renewed in time.", this.name);
+   }
+
+   return nil;
+}
+
+// Stop renewing the lease and remove the lock (unless someone else has it now).
+func (this *LeaseLock) Release() error {
+   this.lock.Lock();
+   var released bool = this.released;
+   if (!released) {
+      this.released = true;
+      close(this.stop);
+   }
+   this.lock.Unlock();
+
+   if (released) {
+      return nil;
+   }
+
+   this.stopped.Wait();
+
+   this.lock.Lock();
+   defer this.lock.Unlock();
+
+   if (this.lostError != nil) {
+      return nil;
+   }
+
+   this.lostError = errors.Errorf("The lock on %s was released.", this.name);
+
+   err := this.backend.RemoveLease(this.version);
+   if (errors.Cause(err) == ErrLeaseConflict) {
+      return nil;
+   }
+
+   return errors.WithStack(err);
+}
@@ -0,0 +1,170 @@
+package local;
+
+// Random-access writes for local files.
+// The new chunks are written to a journal next to the file, which is only renamed into place on Close() (see atomicWriter).
+// Once the journal is in place the edit is committed: it is applied to the file in place and then removed.
+// If applying is interrupted (e.g. by a crash), the journal is applied again the next time the file is used (see finishEdit()).
+// So an edit only costs the chunks that it touches, and a crash never leaves a partial edit behind.
+// Nothing may read the file while an edit is being applied (the driver's file locks see to this).
+
+import (
+    "bufio"
+    "encoding/binary"
+    "io"
+    "os"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/cipherio"
+)
+
+const (
+    // The index of a journal entry that truncates the file (instead of writing a chunk).
+    JOURNAL_TRUNCATE = -1
+)
+
+// Every journal entry is: index (int64), value (int64), and then (for chunks) |value| bytes of ciphertext.
+// For a chunk the value is the size of the ciphertext, for a truncate it is the new size of the file.
+type localChunkWriter struct {
+    journal *atomicWriter
+    buffer *bufio.Writer
+    path string
+}
+
+// Any earlier edit is applied first, so the journal only ever holds one edit.
+func newLocalChunkWriter(path string) (*localChunkWriter, error) {
+    err := finishEdit(path);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    journal, err := newAtomicWriter(path + JOURNAL_SUFFIX);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    return &localChunkWriter{journal, bufio.NewWriter(journal), path}, nil;
+}
+
+func (this *localChunkWriter) WriteChunk(index int64, ciphertext []byte) error {
+    err := this.writeEntry(index, int64(len(ciphertext)));
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    _, err = this.buffer.Write(ciphertext);
+    return errors.WithStack(err);
+}
+
+func (this *localChunkWriter) Truncate(size int64) error {
+    return errors.WithStack(this.writeEntry(JOURNAL_TRUNCATE, size));
+}
+
+func (this *localChunkWriter) writeEntry(index int64, value int64) error {
+    return errors.WithStack(binary.Write(this.buffer, binary.BigEndian, [2]int64{index, value}));
+}
+
+func (this *localChunkWriter) Abort() error {
+    return errors.WithStack(this.journal.Abort());
+}
+
+// Once the journal is in place the edit is committed,
+// so a failure to apply it is left for the next use of the file (which will fail if it still cannot be applied).
+func (this *localChunkWriter) Close() error {
+    err := this.buffer.Flush();
+    if (err != nil) {
+        this.journal.Abort();
+        return errors.WithStack(err);
+    }
+
+    err = this.journal.Close();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    finishEdit(this.path);
+    return nil;
+}
+
+// Apply a committed edit to its file (if there is one), and then remove the journal.
+// Applying an edit more than once is the same as applying it once.
+// A missing file is just empty.
+func finishEdit(path string) error {
+    var journalPath string = path + JOURNAL_SUFFIX;
+
+    journal, err := os.Open(journalPath);
+    if (os.IsNotExist(err)) {
+        return nil;
+    }
+
+    if (err != nil) {
+        return errors.Wrap(err, journalPath);
+    }
+    defer journal.Close();
+
+    file, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE, 0600);
+    if (err != nil) {
+        return errors.Wrap(err, path);
+    }
+
+    err = applyJournal(file, bufio.NewReader(journal));
+    if (err != nil) {
+        file.Close();
+        return errors.Wrap(err, "Failed to apply edit to: " + path);
+    }
+
+    err = file.Sync();
+    if (err != nil) {
+        file.Close();
+        return errors.Wrap(err, path);
+    }
+
+    err = file.Close();
+    if (err != nil) {
+        return errors.Wrap(err, path);
+    }
+
+    return errors.Wrap(os.Remove(journalPath), journalPath);
+}
+
+func applyJournal(file *os.File, journal io.Reader) error {
+    var ciphertext []byte = make([]byte, cipherio.CIPHER_BLOCK_SIZE);
+
+    for {
+        var entry [2]int64;
+        err := binary.Read(journal, binary.BigEndian, &entry);
+        if (err == io.EOF) {
+            return nil;
+        }
+
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+
+        var index int64 = entry[0];
+        var value int64 = entry[1];
+
+        if (index == JOURNAL_TRUNCATE) {
+            err = file.Truncate(value);
+            if (err != nil) {
+                return errors.WithStack(err);
+            }
+
+            continue;
+        }
+
+        if (index < 0 || value < 0 || value > cipherio.CIPHER_BLOCK_SIZE) {
+            return errors.Errorf("Bad journal entry (index: %d, size: %d).", index, value);
+        }
+
+        _, err = io.ReadFull(journal, ciphertext[0:value]);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+
+        _, err = file.WriteAt(ciphertext[0:value], index * cipherio.CIPHER_BLOCK_SIZE);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+    }
+}
@@ -0,0 +1,132 @@
+package local;
+
+import (
+    "bytes"
+    "crypto/aes"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/eriq-augustine/elfs/cipherio"
+    "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/dirent"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+// A chunk writer that stops right after the edit is committed (as if it crashed before applying it).
+type crashingChunkWriter struct {
+    *localChunkWriter
+}
+
+func (this *crashingChunkWriter) Close() error {
+    err := this.buffer.Flush();
+    if (err != nil) {
+        return err;
+    }
+
+    return this.journal.Close();
+}
+
+// An edit that is committed but not applied leaves the file alone, and is applied the next time the file is read.
+func TestUnappliedEdit(t *testing.T) {
+    root, err := ioutil.TempDir("", "elfs-local-test-");
+    if (err != nil) {
+        t.Fatalf("Failed to make temp dir: %+v", err);
+    }
+    defer os.RemoveAll(root);
+
+    fsConnector, err := NewLocalConnector(filepath.Join(root, "store"), false);
+    if (err == nil) {
+        err = fsConnector.PrepareStorage();
+    }
+
+    if (err != nil) {
+        t.Fatalf("Failed to open connector: %+v", err);
+    }
+    defer fsConnector.Close();
+
+    blockCipher, err := aes.NewCipher(util.GenAESKey());
+    if (err != nil) {
+        t.Fatalf("Failed to make cipher: %+v", err);
+    }
+
+    var fileInfo *dirent.Dirent = &dirent.Dirent{
+        Id: dirent.NewId(),
+        IsFile: true,
+        IV: util.GenIV(),
+        CipherVersion: cipherio.CURRENT_CIPHER_VERSION,
+    };
+
+    var data []byte = util.RandomBytes(3 * cipherio.IO_BLOCK_SIZE + 100);
+    _, _, err = connector.Write(fsConnector, fileInfo, blockCipher, bytes.NewReader(data));
+    if (err != nil) {
+        t.Fatalf("Failed to write file: %+v", err);
+    }
+
+    var path string = fsConnector.getDiskPath(fileInfo);
+    original, err := ioutil.ReadFile(path);
+    if (err != nil) {
+        t.Fatalf("Failed to read object: %+v", err);
+    }
+
+    reader, err := fsConnector.GetCipherReader(fileInfo, blockCipher);
+    if (err != nil) {
+        t.Fatalf("Failed to get reader: %+v", err);
+    }
+
+    writer, err := newLocalChunkWriter(path);
+    if (err != nil) {
+        t.Fatalf("Failed to get chunk writer: %+v", err);
+    }
+
+    editor, err := cipherio.NewChunkEditor(reader, &crashingChunkWriter{writer}, connector.FileStreamParams(fileInfo, blockCipher), int64(len(data)));
+    if (err != nil) {
+        t.Fatalf("Failed to get chunk editor: %+v", err);
+    }
+
+    var edit []byte = []byte("unapplied edit");
+    var offset int64 = 2 * cipherio.IO_BLOCK_SIZE - 3;
+
+    _, err = editor.WriteAt(edit, offset);
+    if (err == nil) {
+        err = editor.Close();
+    }
+    reader.Close();
+
+    if (err != nil) {
+        t.Fatalf("Failed to edit: %+v", err);
+    }
+
+    fileInfo.ChunkIVs = editor.GetChunkIVs();
+
+    onDisk, err := ioutil.ReadFile(path);
+    if (err != nil || !bytes.Equal(onDisk, original)) {
+        t.Fatalf("The object changed before the edit was applied: %+v", err);
+    }
+
+    ids, err := fsConnector.ListData("");
+    if (err != nil || len(ids) != 1 || ids[0] != fileInfo.Id) {
+        t.Fatalf("Bad listing with an unapplied edit (%v): %+v", ids, err);
+    }
+
+    reader, err = fsConnector.GetCipherReader(fileInfo, blockCipher);
+    if (err != nil) {
+        t.Fatalf("Failed to get reader: %+v", err);
+    }
+
+    readData, err := ioutil.ReadAll(reader);
+    reader.Close();
+
+    var expected []byte = append([]byte(nil), data...);
+    copy(expected[offset:], edit);
+
+    if (err != nil || !bytes.Equal(readData, expected)) {
+        t.Fatalf("The edit was not applied on read: %+v", err);
+    }
+
+    _, err = os.Stat(path + JOURNAL_SUFFIX);
+    if (!os.IsNotExist(err)) {
+        t.Fatalf("The journal is left after it was applied: %+v", err);
+    }
+}
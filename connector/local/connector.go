@@ -9,6 +9,7 @@ import (
     "io/ioutil"
     "os"
     "path/filepath"
+    "strings"
     "sync"
 
     "github.com/pkg/errors"
@@ -20,22 +21,24 @@ import (
 )
 
 // Keep track of the active connections so two instances don't connect to the same storage.
-var activeConnections map[string]bool;
+// A forced connection replaces the old one here.
+var activeConnections map[string]*LocalConnector;
 var activeConnectionsLock *sync.Mutex;
 
 func init() {
-    activeConnections = make(map[string]bool);
+    activeConnections = make(map[string]*LocalConnector);
     activeConnectionsLock = &sync.Mutex{};
 }
 
 type LocalConnector struct {
     path string
+    lease *connector.LeaseLock
 }
 
 // Create a new connection to a local filesystem.
 // There should only ever be one connection to a filesystem at a time.
-// If an old connection has not been properly closed, then the force parameter
-// may be used to cleanup the old connection.
+// If an old connection has not been properly closed, then its lock runs out on its own
+// (see connector.LeaseLock), or the force parameter may be used to take the lock right away.
 func NewLocalConnector(path string, force bool) (*LocalConnector, error) {
     activeConnectionsLock.Lock();
     defer activeConnectionsLock.Unlock();
@@ -45,8 +48,7 @@ func NewLocalConnector(path string, force bool) (*LocalConnector, error) {
         return nil, errors.Wrap(err, "Failed to create absolute path for local connector.");
     }
 
-    _, ok := activeConnections[path];
-    if (ok) {
+    if (activeConnections[path] != nil && !force) {
         return nil, errors.Errorf("Cannot create two connections to the same storage: %s", path);
     }
 
@@ -56,11 +58,12 @@ func NewLocalConnector(path string, force bool) (*LocalConnector, error) {
         path: path,
     };
 
-    err = connector.lock(force);
+    connector.lease, err = connector.lock(force);
     if (err != nil) {
         return nil, errors.Wrap(err, path);
     }
 
+    activeConnections[path] = &connector;
     return &connector, nil;
 }
 
@@ -99,6 +102,11 @@ func (this *LocalConnector) PrepareStorage() error {
 func (this *LocalConnector) GetCipherReader(fileInfo *dirent.Dirent, blockCipher cipher.Block) (util.ReadSeekCloser, error) {
     var path string = this.getDiskPath(fileInfo);
 
+    err := finishEdit(path);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
     file, err := os.Open(path);
     if (err != nil) {
         return nil, errors.Wrap(err, "Unable to open file on disk at: " + path);
@@ -109,10 +117,10 @@ func (this *LocalConnector) GetCipherReader(fileInfo *dirent.Dirent, blockCipher
         return nil, errors.WithStack(err);
     }
 
-    return cipherio.NewCipherReader(file, blockCipher, fileInfo.IV, fileStat.Size());
+    return cipherio.NewCipherReader(file, connector.FileStreamParams(fileInfo, blockCipher), fileStat.Size());
 }
 
-func (this *LocalConnector) GetMetadataReader(metadataId string, blockCipher cipher.Block, iv []byte) (util.ReadSeekCloser, error) {
+func (this *LocalConnector) GetMetadataReader(metadataId string, blockCipher cipher.Block, legacyIV []byte) (*cipherio.MetadataReader, error) {
     var path string = this.getMetadataPath(metadataId);
 
     file, err := os.Open(path);
@@ -125,83 +133,240 @@ func (this *LocalConnector) GetMetadataReader(metadataId string, blockCipher cip
         return nil, errors.WithStack(err);
     }
 
-    return cipherio.NewCipherReader(file, blockCipher, iv, fileStat.Size());
+    return cipherio.NewMetadataReader(file, blockCipher, legacyIV, metadataId, fileStat.Size());
 }
 
 func (this *LocalConnector) GetCipherWriter(fileInfo *dirent.Dirent, blockCipher cipher.Block) (*cipherio.CipherWriter, error) {
+    err := this.lease.Check();
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
     var path string = this.getDiskPath(fileInfo);
 
-    file, err := os.Create(path);
+    // Leave the old object whole in case this write does not go through.
+    err = finishEdit(path);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    // The old object stays in place until the whole new one is written.
+    writer, err := newAtomicWriter(path);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    cipherWriter, err := cipherio.NewCipherWriter(writer, connector.FileStreamParams(fileInfo, blockCipher));
     if (err != nil) {
-        return nil, errors.Wrap(err, "Unable to create file on disk at: " + path);
+        writer.Abort();
+        return nil, errors.WithStack(err);
     }
 
-    err = file.Chmod(0600);
+    return cipherWriter, nil;
+}
+
+func (this *LocalConnector) GetChunkWriter(fileInfo *dirent.Dirent) (cipherio.ChunkWriter, error) {
+    err := this.lease.Check();
     if (err != nil) {
-        return nil, errors.Wrap(err, "Unable to change file permissions of: " + path);
+        return nil, errors.WithStack(err);
     }
 
-    return cipherio.NewCipherWriter(file, blockCipher, fileInfo.IV);
+    return newLocalChunkWriter(this.getDiskPath(fileInfo));
 }
 
-func (this *LocalConnector) GetMetadataWriter(metadataId string, blockCipher cipher.Block, iv []byte) (*cipherio.CipherWriter, error) {
-    var path string = this.getMetadataPath(metadataId);
+func (this *LocalConnector) GetMetadataWriter(metadataId string, blockCipher cipher.Block) (*cipherio.CipherWriter, error) {
+    err := this.lease.Check();
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
 
-    file, err := os.Create(path);
+    writer, err := newAtomicWriter(this.getMetadataPath(metadataId));
     if (err != nil) {
-        return nil, errors.Wrap(err, "Unable to create file on disk at: " + path);
+        return nil, errors.WithStack(err);
     }
 
-    err = file.Chmod(0600);
+    cipherWriter, err := cipherio.NewMetadataWriter(writer, blockCipher, metadataId);
     if (err != nil) {
-        return nil, errors.Wrap(err, "Unable to change file permissions of: " + path);
+        writer.Abort();
+        return nil, errors.WithStack(err);
     }
 
-    return cipherio.NewCipherWriter(file, blockCipher, iv);
+    return cipherWriter, nil;
 }
 
 func (this *LocalConnector) RemoveFile(file *dirent.Dirent) error {
-    return errors.WithStack(os.Remove(this.getDiskPath(file)));
+    err := this.lease.Check();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    // The journal goes first, so it can never be applied to a removed file.
+    var path string = this.getDiskPath(file);
+    err = os.Remove(path + JOURNAL_SUFFIX);
+    if (err != nil && !os.IsNotExist(err)) {
+        return errors.WithStack(err);
+    }
+
+    return errors.WithStack(os.Remove(path));
 }
 
 func (this *LocalConnector) RemoveMetadataFile(metadataId string) error {
+    err := this.lease.Check();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
     return errors.WithStack(os.Remove(this.getMetadataPath(metadataId)));
 }
 
-func (this* LocalConnector) Close() error {
-    activeConnectionsLock.Lock();
-    defer activeConnectionsLock.Unlock();
+func (this *LocalConnector) ReadAdminObject(objectId string) ([]byte, error) {
+    var path string = this.getMetadataPath(objectId);
 
-    activeConnections[this.path] = false;
-    return errors.WithStack(this.unlock());
+    data, err := ioutil.ReadFile(path);
+    if (err != nil) {
+        return nil, errors.Wrap(err, path);
+    }
+
+    return data, nil;
 }
 
-func (this* LocalConnector) lock(force bool) error {
-    var lockPath string = this.getLockPath();
+// Write to the side and rename, so a crash never leaves a partial object.
+func (this *LocalConnector) WriteAdminObject(objectId string, data []byte) error {
+    err := this.lease.Check();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
 
-    inFile, err := os.Open(lockPath);
-    if (err != nil && !os.IsNotExist(err)) {
-        return errors.Wrap(err, lockPath);
+    var path string = this.getMetadataPath(objectId);
+    var tempPath string = path + TEMP_SUFFIX;
+
+    err = ioutil.WriteFile(tempPath, data, 0600);
+    if (err != nil) {
+        return errors.Wrap(err, tempPath);
+    }
+
+    return errors.Wrap(os.Rename(tempPath, path), path);
+}
+
+func (this *LocalConnector) ListData(prefix string) ([]dirent.Id, error) {
+    var ids []dirent.Id = make([]dirent.Id, 0);
+
+    var groupDirs []string = make([]string, 0);
+    if (len(prefix) >= connector.DATA_GROUP_PREFIX_LEN) {
+        groupDirs = append(groupDirs, filepath.Join(this.path, connector.FS_SYS_DIR_DATA, prefix[0:connector.DATA_GROUP_PREFIX_LEN]));
+    } else {
+        entries, err := ioutil.ReadDir(filepath.Join(this.path, connector.FS_SYS_DIR_DATA));
+        if (err != nil) {
+            return nil, errors.WithStack(err);
+        }
+
+        for _, entry := range(entries) {
+            if (entry.IsDir() && strings.HasPrefix(entry.Name(), prefix)) {
+                groupDirs = append(groupDirs, filepath.Join(this.path, connector.FS_SYS_DIR_DATA, entry.Name()));
+            }
+        }
     }
-    defer inFile.Close();
 
-    // Lock already exists and we were not told to force it.
-    if (err == nil && !force) {
-        pid, err := ioutil.ReadAll(inFile);
+    for _, groupDir := range(groupDirs) {
+        entries, err := ioutil.ReadDir(groupDir);
         if (err != nil) {
-            return errors.Wrap(err, lockPath);
+            if (os.IsNotExist(err)) {
+                continue;
+            }
+
+            return nil, errors.WithStack(err);
+        }
+
+        for _, entry := range(entries) {
+            // Skip any partial writes and edits.
+            if (!entry.IsDir() && strings.HasPrefix(entry.Name(), prefix) &&
+                    !strings.HasSuffix(entry.Name(), TEMP_SUFFIX) && !strings.HasSuffix(entry.Name(), JOURNAL_SUFFIX)) {
+                ids = append(ids, dirent.Id(entry.Name()));
+            }
+        }
+    }
+
+    return ids, nil;
+}
+
+func (this *LocalConnector) ListMetadata() ([]string, error) {
+    entries, err := ioutil.ReadDir(filepath.Join(this.path, connector.FS_SYS_DIR_ADMIN));
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    var ids []string = make([]string, 0, len(entries));
+    for _, entry := range(entries) {
+        // Skip the lock and any partial writes.
+        if (entry.IsDir() || entry.Name() == LOCK_FILENAME || entry.Name() == LOCK_GUARD_FILENAME ||
+                strings.HasSuffix(entry.Name(), TEMP_SUFFIX)) {
+            continue;
         }
 
-        return errors.Errorf("Local filesystem (at %s) already owned by [%s]." +
-                " Ensure that the processes is dead and remove the lock or force the connector.",
-                this.path, string(pid));
+        ids = append(ids, entry.Name());
+    }
+
+    return ids, nil;
+}
+
+// Local files have no ETag, so make one from the modification time and size.
+func (this *LocalConnector) Stat(id dirent.Id) (*connector.ObjectInfo, error) {
+    var path string = this.getDiskPath(&dirent.Dirent{Id: id});
+
+    err := finishEdit(path);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    fileStat, err := os.Stat(path);
+    if (err != nil) {
+        return nil, errors.Wrap(err, path);
+    }
+
+    var info connector.ObjectInfo = connector.ObjectInfo{
+        CiphertextSize: fileStat.Size(),
+        ModTime: fileStat.ModTime(),
+        ETag: fmt.Sprintf("%x-%x", fileStat.ModTime().UnixNano(), fileStat.Size()),
+    };
+
+    return &info, nil;
+}
+
+func (this *LocalConnector) QuarantineData(id dirent.Id) error {
+    err := this.lease.Check();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    var quarantineDir string = filepath.Join(this.path, connector.FS_SYS_DIR_QUARANTINE);
+
+    err = os.MkdirAll(quarantineDir, 0700);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    var path string = this.getDiskPath(&dirent.Dirent{Id: id});
+
+    err = finishEdit(path);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    return errors.Wrap(os.Rename(path, filepath.Join(quarantineDir, string(id))), path);
+}
+
+func (this* LocalConnector) Close() error {
+    activeConnectionsLock.Lock();
+    defer activeConnectionsLock.Unlock();
+
+    // A connection that was forced out no longer owns the lock (and releasing will leave it be).
+    if (activeConnections[this.path] == this) {
+        delete(activeConnections, this.path);
     }
 
-    // Lock doesn't exist, or we can force it.
-    return errors.Wrap(ioutil.WriteFile(lockPath, []byte(fmt.Sprintf("%d", os.Getpid())), 0600), lockPath);
+    return errors.WithStack(this.lease.Release());
 }
 
-func (this* LocalConnector) unlock() error {
-    var lockPath string = this.getLockPath();
-    return errors.Wrap(os.Remove(lockPath), lockPath);
+func (this* LocalConnector) lock(force bool) (*connector.LeaseLock, error) {
+    return connector.AcquireLease(&lockFile{this.getLockPath(), this.getLockGuardPath()}, "local filesystem (at " + this.path + ")", connector.DEFAULT_LEASE_DURATION, force);
 }
@@ -0,0 +1,35 @@
+package local;
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/connector/connectortest"
+    "github.com/pkg/errors"
+)
+
+// Every storage is a dir under |root|.
+type localFactory struct {
+    root string
+}
+
+func (this localFactory) Open(name string, force bool) (connector.Connector, error) {
+    return NewLocalConnector(filepath.Join(this.root, name), force);
+}
+
+func (this localFactory) Destroy(name string) error {
+    return errors.WithStack(os.RemoveAll(filepath.Join(this.root, name)));
+}
+
+func TestConnector(t *testing.T) {
+    root, err := ioutil.TempDir("", "elfs-local-test-");
+    if (err != nil) {
+        t.Fatalf("Failed to make temp dir: %+v", err);
+    }
+    defer os.RemoveAll(root);
+
+    connectortest.Run(t, localFactory{root});
+}
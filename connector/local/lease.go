@@ -0,0 +1,221 @@
+package local;
+
+// The lock file for a local filesystem (see connector.LeaseLock).
+// Files are created with a hard link, which fails if the lock already exists.
+// Replacing or removing a file cannot be made conditional by itself,
+// so it is only done while holding a guard file (created with O_EXCL), and the file is checked after taking the guard.
+// The guard is only ever held for a moment, so one that is old was left by a process that died while holding it.
+// Versions are the md5 of the lock file.
+
+import (
+    "crypto/md5"
+    "encoding/hex"
+    "io/ioutil"
+    "os"
+    "time"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+    // A guard this old was left behind.
+    LOCK_GUARD_STALE_AGE = 10 * time.Second
+    LOCK_GUARD_RETRY_DELAY = 5 * time.Millisecond
+    // Give up on getting the guard after this long (it would have been stale first).
+    LOCK_GUARD_TIMEOUT = 2 * LOCK_GUARD_STALE_AGE
+)
+
+type lockFile struct {
+    path string
+    guardPath string
+}
+
+func (this *lockFile) ReadLease() (*connector.LeaseRecord, error) {
+    data, err := ioutil.ReadFile(this.path);
+    if (err != nil) {
+        if (os.IsNotExist(err)) {
+            return nil, nil;
+        }
+
+        return nil, errors.Wrap(err, this.path);
+    }
+
+    fileStat, err := os.Stat(this.path);
+    if (err != nil) {
+        if (os.IsNotExist(err)) {
+            return nil, nil;
+        }
+
+        return nil, errors.Wrap(err, this.path);
+    }
+
+    var record connector.LeaseRecord = connector.LeaseRecord{
+        Data: data,
+        Version: lockVersion(data),
+        Age: time.Since(fileStat.ModTime()),
+    };
+
+    return &record, nil;
+}
+
+func (this *lockFile) CreateLease(data []byte) (string, error) {
+    tempPath, err := this.writeTemp(data);
+    if (err != nil) {
+        return "", errors.WithStack(err);
+    }
+    defer os.Remove(tempPath);
+
+    err = os.Link(tempPath, this.path);
+    if (err != nil) {
+        if (os.IsExist(err)) {
+            return "", errors.WithStack(connector.ErrLeaseConflict);
+        }
+
+        return "", errors.Wrap(err, this.path);
+    }
+
+    return lockVersion(data), nil;
+}
+
+func (this *lockFile) ReplaceLease(data []byte, version string) (string, error) {
+    err := this.acquireGuard();
+    if (err != nil) {
+        return "", errors.WithStack(err);
+    }
+    defer this.releaseGuard();
+
+    err = this.checkVersion(version);
+    if (err != nil) {
+        return "", errors.WithStack(err);
+    }
+
+    tempPath, err := this.writeTemp(data);
+    if (err != nil) {
+        return "", errors.WithStack(err);
+    }
+
+    err = os.Rename(tempPath, this.path);
+    if (err != nil) {
+        os.Remove(tempPath);
+        return "", errors.Wrap(err, this.path);
+    }
+
+    return lockVersion(data), nil;
+}
+
+func (this *lockFile) RemoveLease(version string) error {
+    err := this.acquireGuard();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+    defer this.releaseGuard();
+
+    err = this.checkVersion(version);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    return errors.Wrap(os.Remove(this.path), this.path);
+}
+
+func (this *lockFile) checkVersion(version string) error {
+    record, err := this.ReadLease();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    if (record == nil || record.Version != version) {
+        return errors.WithStack(connector.ErrLeaseConflict);
+    }
+
+    return nil;
+}
+
+// Wait for the guard to be free and take it.
+func (this *lockFile) acquireGuard() error {
+    var start time.Time = time.Now();
+
+    for {
+        file, err := os.OpenFile(this.guardPath, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600);
+        if (err == nil) {
+            return errors.Wrap(file.Close(), this.guardPath);
+        }
+
+        if (!os.IsExist(err)) {
+            return errors.Wrap(err, this.guardPath);
+        }
+
+        err = this.breakStaleGuard();
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+
+        if (time.Since(start) >= LOCK_GUARD_TIMEOUT) {
+            return errors.Errorf("Timed out waiting for the lock guard (%s).", this.guardPath);
+        }
+
+        time.Sleep(LOCK_GUARD_RETRY_DELAY);
+    }
+}
+
+func (this *lockFile) releaseGuard() {
+    os.Remove(this.guardPath);
+}
+
+// Remove the guard if it was left behind.
+// It is first moved out of the way (which only one process can do),
+// and put back if it turns out to be a new guard that was just taken.
+func (this *lockFile) breakStaleGuard() error {
+    fileStat, err := os.Stat(this.guardPath);
+    if (err != nil) {
+        if (os.IsNotExist(err)) {
+            return nil;
+        }
+
+        return errors.Wrap(err, this.guardPath);
+    }
+
+    if (time.Since(fileStat.ModTime()) < LOCK_GUARD_STALE_AGE) {
+        return nil;
+    }
+
+    var stalePath string = this.guardPath + "." + util.RandomString(TEMP_ID_LENGTH) + TEMP_SUFFIX;
+    err = os.Rename(this.guardPath, stalePath);
+    if (err != nil) {
+        if (os.IsNotExist(err)) {
+            return nil;
+        }
+
+        return errors.Wrap(err, this.guardPath);
+    }
+    defer os.Remove(stalePath);
+
+    fileStat, err = os.Stat(stalePath);
+    if (err == nil && time.Since(fileStat.ModTime()) < LOCK_GUARD_STALE_AGE) {
+        // Put it back (unless yet another guard has been taken, which will wait for this one anyways).
+        os.Link(stalePath, this.guardPath);
+    }
+
+    return nil;
+}
+
+// Temp files end in TEMP_SUFFIX, so they are never listed as metadata.
+func (this *lockFile) writeTemp(data []byte) (string, error) {
+    var tempPath string = this.path + "." + util.RandomString(TEMP_ID_LENGTH) + TEMP_SUFFIX;
+
+    err := ioutil.WriteFile(tempPath, data, 0600);
+    if (err != nil) {
+        os.Remove(tempPath);
+        return "", errors.Wrap(err, tempPath);
+    }
+
+    return tempPath, nil;
+}
+
+func lockVersion(data []byte) string {
+    var hash [md5.Size]byte = md5.Sum(data);
+    return hex.EncodeToString(hash[:]);
+}
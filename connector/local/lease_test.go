@@ -0,0 +1,115 @@
+package local;
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/connector"
+)
+
+const (
+    TEST_LEASE_WRITERS = 8
+    TEST_LEASE_ROUNDS = 20
+)
+
+func newTestLockFile(t *testing.T) (*lockFile, func()) {
+    root, err := ioutil.TempDir("", "elfs-lease-test-");
+    if (err != nil) {
+        t.Fatalf("Failed to make temp dir: %+v", err);
+    }
+
+    var lock lockFile = lockFile{filepath.Join(root, LOCK_FILENAME), filepath.Join(root, LOCK_GUARD_FILENAME)};
+    return &lock, func() { os.RemoveAll(root); };
+}
+
+// When many writers replace the same version at once, exactly one of them wins.
+func TestReplaceLeaseConflict(t *testing.T) {
+    lock, cleanup := newTestLockFile(t);
+    defer cleanup();
+
+    version, err := lock.CreateLease([]byte("initial"));
+    if (err != nil) {
+        t.Fatalf("Failed to create lease: %+v", err);
+    }
+
+    for round := 0; round < TEST_LEASE_ROUNDS; round++ {
+        var versions chan string = make(chan string, TEST_LEASE_WRITERS);
+        var errs chan error = make(chan error, TEST_LEASE_WRITERS);
+        var start chan bool = make(chan bool);
+
+        var writers sync.WaitGroup;
+        for i := 0; i < TEST_LEASE_WRITERS; i++ {
+            writers.Add(1);
+            go func(writer int) {
+                defer writers.Done();
+                <-start;
+
+                newVersion, err := lock.ReplaceLease([]byte(fmt.Sprintf("round %d, writer %d", round, writer)), version);
+                if (err == nil) {
+                    versions <- newVersion;
+                } else if (errors.Cause(err) != connector.ErrLeaseConflict) {
+                    errs <- err;
+                }
+            }(i);
+        }
+
+        close(start);
+        writers.Wait();
+        close(versions);
+        close(errs);
+
+        for err := range(errs) {
+            t.Fatalf("Failed to replace lease: %+v", err);
+        }
+
+        if (len(versions) != 1) {
+            t.Fatalf("Round %d: %d writers replaced the same version of the lease.", round, len(versions));
+        }
+
+        version = <-versions;
+    }
+}
+
+// A guard left behind by a process that died does not block the lease forever.
+func TestStaleLeaseGuard(t *testing.T) {
+    lock, cleanup := newTestLockFile(t);
+    defer cleanup();
+
+    version, err := lock.CreateLease([]byte("initial"));
+    if (err != nil) {
+        t.Fatalf("Failed to create lease: %+v", err);
+    }
+
+    err = ioutil.WriteFile(lock.guardPath, []byte{}, 0600);
+    if (err != nil) {
+        t.Fatalf("Failed to write guard: %+v", err);
+    }
+
+    var old time.Time = time.Now().Add(-2 * LOCK_GUARD_STALE_AGE);
+    err = os.Chtimes(lock.guardPath, old, old);
+    if (err != nil) {
+        t.Fatalf("Failed to age guard: %+v", err);
+    }
+
+    version, err = lock.ReplaceLease([]byte("replaced"), version);
+    if (err != nil) {
+        t.Fatalf("Failed to replace lease past a stale guard: %+v", err);
+    }
+
+    err = lock.RemoveLease(version);
+    if (err != nil) {
+        t.Fatalf("Failed to remove lease: %+v", err);
+    }
+
+    _, err = os.Stat(lock.guardPath);
+    if (!os.IsNotExist(err)) {
+        t.Fatalf("Guard was left behind: %v", err);
+    }
+}
@@ -11,6 +11,13 @@ import (
 
 const (
     LOCK_FILENAME = ".local_lock"
+    // Held while the lock is replaced or removed (see lease.go).
+    LOCK_GUARD_FILENAME = ".local_lock_guard"
+    TEMP_SUFFIX = ".tmp"
+    // A committed edit that has not been applied to its file yet (see chunk.go).
+    JOURNAL_SUFFIX = ".journal"
+    // Random part of temp file names, so writers never share a temp file.
+    TEMP_ID_LENGTH = 16
 )
 
 func (this *LocalConnector) getDiskPath(direntInfo *dirent.Dirent) string {
@@ -34,3 +41,7 @@ func (this *LocalConnector) getMetadataPath(metadataId string) string {
 func (this *LocalConnector) getLockPath() string {
     return path.Join(this.path, connector.FS_SYS_DIR_ADMIN, LOCK_FILENAME);
 }
+
+func (this *LocalConnector) getLockGuardPath() string {
+    return path.Join(this.path, connector.FS_SYS_DIR_ADMIN, LOCK_GUARD_FILENAME);
+}
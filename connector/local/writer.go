@@ -0,0 +1,86 @@
+package local;
+
+// Objects (metadata, file data, and edit journals) are written to the side and only renamed into place on Close(),
+// so a crash (or an abort) never leaves a partial object behind.
+
+import (
+    "os"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/util"
+)
+
+type atomicWriter struct {
+    file *os.File
+    path string
+    tempPath string
+    done bool
+}
+
+func newAtomicWriter(path string) (*atomicWriter, error) {
+    var tempPath string = path + "." + util.RandomString(TEMP_ID_LENGTH) + TEMP_SUFFIX;
+
+    file, err := os.OpenFile(tempPath, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600);
+    if (err != nil) {
+        return nil, errors.Wrap(err, "Unable to create file on disk at: " + tempPath);
+    }
+
+    var writer atomicWriter = atomicWriter{
+        file: file,
+        path: path,
+        tempPath: tempPath,
+        done: false,
+    };
+
+    return &writer, nil;
+}
+
+func (this *atomicWriter) Write(data []byte) (int, error) {
+    if (this.done) {
+        return 0, errors.New("Writer is closed.");
+    }
+
+    return this.file.Write(data);
+}
+
+// Make sure the data is on disk before it replaces the old object.
+func (this *atomicWriter) Close() error {
+    if (this.done) {
+        return nil;
+    }
+
+    this.done = true;
+
+    err := this.file.Sync();
+    if (err != nil) {
+        this.file.Close();
+        os.Remove(this.tempPath);
+        return errors.Wrap(err, this.tempPath);
+    }
+
+    err = this.file.Close();
+    if (err != nil) {
+        os.Remove(this.tempPath);
+        return errors.Wrap(err, this.tempPath);
+    }
+
+    err = os.Rename(this.tempPath, this.path);
+    if (err != nil) {
+        os.Remove(this.tempPath);
+        return errors.Wrap(err, this.path);
+    }
+
+    return nil;
+}
+
+func (this *atomicWriter) Abort() error {
+    if (this.done) {
+        return nil;
+    }
+
+    this.done = true;
+    this.file.Close();
+
+    return errors.Wrap(os.Remove(this.tempPath), this.tempPath);
+}
@@ -0,0 +1,405 @@
+package memory;
+
+// A connector that keeps everything in memory.
+// Good for tests and scratch filesystems, nothing survives the process.
+//
+// Storage is named, and stays around (for the life of the process) after a connector is closed,
+// so a filesystem can be closed and opened again.
+// Like the local connector, a store can only have one connection at a time (unless forced).
+// A connection that was forced out can still read, but can no longer change anything.
+
+import (
+    "bytes"
+    "crypto/cipher"
+    "fmt"
+    "os"
+    "path"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/cipherio"
+    "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/dirent"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+    TOKEN_LENGTH = 16
+)
+
+// All the stores in this process, by name.
+var stores map[string]*store;
+var storesLock *sync.Mutex;
+
+func init() {
+    stores = make(map[string]*store);
+    storesLock = &sync.Mutex{};
+}
+
+type MemoryConnector struct {
+    name string
+    store *store
+}
+
+type store struct {
+    lock *sync.Mutex
+    // Different for every store (even with the same name),
+    // so anything keyed by the connector id (like the metadata cache) does not outlive the store.
+    token string
+    // Objects are keyed by their path (like the other connectors).
+    objects map[string]*object
+    // The connection that holds the lock (nil if unlocked).
+    owner *MemoryConnector
+    // Zero means no limit.
+    maxBytes int64
+    usedBytes int64
+    nextVersion uint64
+}
+
+type object struct {
+    // Never modified in place (writes replace the whole slice), so readers can share it.
+    data []byte
+    modTime time.Time
+    version uint64
+}
+
+// Connect to the store called |name| (creating it if it does not exist).
+// |maxBytes| limits the total size of all the objects in the store (0 for no limit),
+// and replaces any limit from an earlier connection.
+// If an old connection has not been properly closed, then the force parameter
+// may be used to take over from it.
+func NewMemoryConnector(name string, maxBytes int64, force bool) (*MemoryConnector, error) {
+    if (name == "") {
+        return nil, errors.New("Memory connector needs a name.");
+    }
+
+    storesLock.Lock();
+    defer storesLock.Unlock();
+
+    memoryStore, ok := stores[name];
+    if (!ok) {
+        memoryStore = &store{
+            lock: &sync.Mutex{},
+            token: util.RandomString(TOKEN_LENGTH),
+            objects: make(map[string]*object),
+            owner: nil,
+            maxBytes: 0,
+            usedBytes: 0,
+            nextVersion: 1,
+        };
+        stores[name] = memoryStore;
+    }
+
+    memoryStore.lock.Lock();
+    defer memoryStore.lock.Unlock();
+
+    if (memoryStore.owner != nil && !force) {
+        return nil, errors.Errorf("Memory filesystem (%s) already has a connection." +
+                " Close the other connection or force the connector.", name);
+    }
+
+    var connector MemoryConnector = MemoryConnector{
+        name: name,
+        store: memoryStore,
+    };
+
+    memoryStore.owner = &connector;
+    memoryStore.maxBytes = maxBytes;
+
+    return &connector, nil;
+}
+
+// Throw away a store and everything in it.
+// The store must not have a connection.
+func RemoveStore(name string) error {
+    storesLock.Lock();
+    defer storesLock.Unlock();
+
+    memoryStore, ok := stores[name];
+    if (!ok) {
+        return nil;
+    }
+
+    memoryStore.lock.Lock();
+    defer memoryStore.lock.Unlock();
+
+    if (memoryStore.owner != nil) {
+        return errors.Errorf("Cannot remove memory filesystem (%s) while it has a connection.", name);
+    }
+
+    delete(stores, name);
+    return nil;
+}
+
+func (this *MemoryConnector) GetId() string {
+    return connector.CONNECTOR_TYPE_MEMORY + ":" + this.name + ":" + this.store.token;
+}
+
+// Nothing necessary in memory.
+func (this *MemoryConnector) PrepareStorage() error {
+    return nil;
+}
+
+func (this *MemoryConnector) GetCipherReader(fileInfo *dirent.Dirent, blockCipher cipher.Block) (util.ReadSeekCloser, error) {
+    reader, size, err := this.getReader(getDataPath(fileInfo.Id));
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    return cipherio.NewCipherReader(reader, connector.FileStreamParams(fileInfo, blockCipher), size);
+}
+
+func (this *MemoryConnector) GetMetadataReader(metadataId string, blockCipher cipher.Block, legacyIV []byte) (*cipherio.MetadataReader, error) {
+    reader, size, err := this.getReader(getMetadataPath(metadataId));
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    return cipherio.NewMetadataReader(reader, blockCipher, legacyIV, metadataId, size);
+}
+
+func (this *MemoryConnector) getReader(objectPath string) (util.ReadSeekCloser, int64, error) {
+    data, err := this.store.get(objectPath);
+    if (err != nil) {
+        return nil, 0, errors.WithStack(err);
+    }
+
+    return &memoryReader{bytes.NewReader(data)}, int64(len(data)), nil;
+}
+
+func (this *MemoryConnector) GetCipherWriter(fileInfo *dirent.Dirent, blockCipher cipher.Block) (*cipherio.CipherWriter, error) {
+    return cipherio.NewCipherWriter(newMemoryWriter(this, getDataPath(fileInfo.Id)), connector.FileStreamParams(fileInfo, blockCipher));
+}
+
+func (this *MemoryConnector) GetChunkWriter(fileInfo *dirent.Dirent) (cipherio.ChunkWriter, error) {
+    return newMemoryChunkWriter(this, getDataPath(fileInfo.Id)), nil;
+}
+
+func (this *MemoryConnector) GetMetadataWriter(metadataId string, blockCipher cipher.Block) (*cipherio.CipherWriter, error) {
+    return cipherio.NewMetadataWriter(newMemoryWriter(this, getMetadataPath(metadataId)), blockCipher, metadataId);
+}
+
+func (this *MemoryConnector) RemoveMetadataFile(metadataId string) error {
+    return errors.WithStack(this.store.remove(this, getMetadataPath(metadataId)));
+}
+
+func (this *MemoryConnector) ReadAdminObject(objectId string) ([]byte, error) {
+    data, err := this.store.get(getMetadataPath(objectId));
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    return append([]byte(nil), data...), nil;
+}
+
+func (this *MemoryConnector) WriteAdminObject(objectId string, data []byte) error {
+    return errors.WithStack(this.store.put(this, getMetadataPath(objectId), append([]byte(nil), data...)));
+}
+
+func (this *MemoryConnector) RemoveFile(file *dirent.Dirent) error {
+    return errors.WithStack(this.store.remove(this, getDataPath(file.Id)));
+}
+
+func (this *MemoryConnector) ListData(prefix string) ([]dirent.Id, error) {
+    var ids []dirent.Id = make([]dirent.Id, 0);
+    for _, name := range(this.store.list(connector.FS_SYS_DIR_DATA)) {
+        if (strings.HasPrefix(name, prefix)) {
+            ids = append(ids, dirent.Id(name));
+        }
+    }
+
+    return ids, nil;
+}
+
+func (this *MemoryConnector) ListMetadata() ([]string, error) {
+    return this.store.list(connector.FS_SYS_DIR_ADMIN), nil;
+}
+
+// The ETag is just the object's version.
+func (this *MemoryConnector) Stat(id dirent.Id) (*connector.ObjectInfo, error) {
+    var objectPath string = getDataPath(id);
+
+    this.store.lock.Lock();
+    defer this.store.lock.Unlock();
+
+    memoryObject, ok := this.store.objects[objectPath];
+    if (!ok) {
+        return nil, errors.Wrap(os.ErrNotExist, objectPath);
+    }
+
+    var info connector.ObjectInfo = connector.ObjectInfo{
+        CiphertextSize: int64(len(memoryObject.data)),
+        ModTime: memoryObject.modTime,
+        ETag: fmt.Sprintf("%x", memoryObject.version),
+    };
+
+    return &info, nil;
+}
+
+func (this *MemoryConnector) QuarantineData(id dirent.Id) error {
+    var objectPath string = getDataPath(id);
+
+    this.store.lock.Lock();
+    defer this.store.lock.Unlock();
+
+    err := this.store.checkOwner(this);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    memoryObject, ok := this.store.objects[objectPath];
+    if (!ok) {
+        return errors.Wrap(os.ErrNotExist, objectPath);
+    }
+
+    delete(this.store.objects, objectPath);
+    this.store.objects[path.Join(connector.FS_SYS_DIR_QUARANTINE, string(id))] = memoryObject;
+
+    return nil;
+}
+
+// Closing a connection that was forced out does not unlock the store.
+func (this *MemoryConnector) Close() error {
+    this.store.lock.Lock();
+    defer this.store.lock.Unlock();
+
+    if (this.store.owner == this) {
+        this.store.owner = nil;
+    }
+
+    return nil;
+}
+
+func (this *store) get(objectPath string) ([]byte, error) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    memoryObject, ok := this.objects[objectPath];
+    if (!ok) {
+        return nil, errors.Wrap(os.ErrNotExist, objectPath);
+    }
+
+    return memoryObject.data, nil;
+}
+
+// Replace (or create) an object (as |connection|).
+// |data| now belongs to the store.
+func (this *store) put(connection *MemoryConnector, objectPath string, data []byte) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    err := this.checkOwner(connection);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    err = this.checkSpace(objectPath, int64(len(data)));
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    oldObject, ok := this.objects[objectPath];
+    if (ok) {
+        this.usedBytes -= int64(len(oldObject.data));
+    }
+
+    this.objects[objectPath] = &object{
+        data: data,
+        modTime: time.Now(),
+        version: this.nextVersion,
+    };
+
+    this.usedBytes += int64(len(data));
+    this.nextVersion++;
+
+    return nil;
+}
+
+func (this *store) remove(connection *MemoryConnector, objectPath string) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    err := this.checkOwner(connection);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    memoryObject, ok := this.objects[objectPath];
+    if (!ok) {
+        return errors.Wrap(os.ErrNotExist, objectPath);
+    }
+
+    this.usedBytes -= int64(len(memoryObject.data));
+    delete(this.objects, objectPath);
+
+    return nil;
+}
+
+// Get the (sorted) names of all the objects under a dir (at any depth).
+func (this *store) list(dir string) []string {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    var names []string = make([]string, 0);
+    for objectPath, _ := range(this.objects) {
+        if (strings.HasPrefix(objectPath, dir + "/")) {
+            names = append(names, path.Base(objectPath));
+        }
+    }
+
+    sort.Strings(names);
+    return names;
+}
+
+// Only the connection that holds the store may change it.
+// The caller must hold the lock.
+func (this *store) checkOwner(connection *MemoryConnector) error {
+    if (this.owner != connection) {
+        return errors.Errorf("Memory filesystem (%s) is no longer held by this connection (it was closed or forced out).", connection.name);
+    }
+
+    return nil;
+}
+
+// Check if an object can be |size| bytes (replacing any existing object at the same path).
+// The caller must hold the lock.
+func (this *store) checkSpace(objectPath string, size int64) error {
+    if (this.maxBytes <= 0) {
+        return nil;
+    }
+
+    var newUsed int64 = this.usedBytes + size;
+
+    oldObject, ok := this.objects[objectPath];
+    if (ok) {
+        newUsed -= int64(len(oldObject.data));
+    }
+
+    if (newUsed > this.maxBytes) {
+        return errors.Errorf("Memory filesystem is full (limit: %d bytes, would need: %d bytes).", this.maxBytes, newUsed);
+    }
+
+    return nil;
+}
+
+// Data objects are grouped by prefix (like the other connectors), even though nothing needs it here.
+func getDataPath(id dirent.Id) string {
+    var prefix string = string(id);
+    if (len(prefix) > connector.DATA_GROUP_PREFIX_LEN) {
+        prefix = prefix[0:connector.DATA_GROUP_PREFIX_LEN];
+    }
+
+    return path.Join(connector.FS_SYS_DIR_DATA, prefix, string(id));
+}
+
+func getMetadataPath(metadataId string) string {
+    if (metadataId == "") {
+        panic("Cannot get path for empty metadata.");
+    }
+
+    return path.Join(connector.FS_SYS_DIR_ADMIN, metadataId);
+}
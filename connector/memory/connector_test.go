@@ -0,0 +1,135 @@
+package memory;
+
+import (
+    "bytes"
+    "crypto/aes"
+    "io/ioutil"
+    "testing"
+
+    "github.com/eriq-augustine/elfs/cipherio"
+    "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/connector/connectortest"
+    "github.com/eriq-augustine/elfs/dirent"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+type memoryFactory struct {}
+
+func (this memoryFactory) Open(name string, force bool) (connector.Connector, error) {
+    return NewMemoryConnector(name, 0, force);
+}
+
+func (this memoryFactory) Destroy(name string) error {
+    return RemoveStore(name);
+}
+
+func TestConnector(t *testing.T) {
+    connectortest.Run(t, memoryFactory{});
+}
+
+// A connection that was forced out cannot change the store (but the connection that forced it out can).
+func TestForcedOutWrites(t *testing.T) {
+    var name string = "memorytest-" + util.RandomString(8);
+    defer RemoveStore(name);
+
+    oldConnector, err := NewMemoryConnector(name, 0, false);
+    if (err != nil) {
+        t.Fatalf("Failed to connect: %+v", err);
+    }
+
+    blockCipher, err := aes.NewCipher(util.GenAESKey());
+    if (err != nil) {
+        t.Fatalf("Failed to make cipher: %+v", err);
+    }
+
+    var fileInfo *dirent.Dirent = &dirent.Dirent{
+        Id: dirent.NewId(),
+        IsFile: true,
+        IV: util.GenIV(),
+        CipherVersion: cipherio.CURRENT_CIPHER_VERSION,
+    };
+
+    var data []byte = util.RandomBytes(cipherio.IO_BLOCK_SIZE + 100);
+    _, _, err = connector.Write(oldConnector, fileInfo, blockCipher, bytes.NewReader(data));
+    if (err != nil) {
+        t.Fatalf("Failed to write file: %+v", err);
+    }
+
+    // Started before being forced out, finished after.
+    pendingWriter, err := oldConnector.GetMetadataWriter("pending", blockCipher);
+    if (err != nil) {
+        t.Fatalf("Failed to get writer: %+v", err);
+    }
+
+    newConnector, err := NewMemoryConnector(name, 0, true);
+    if (err != nil) {
+        t.Fatalf("Failed to force a connection: %+v", err);
+    }
+    defer newConnector.Close();
+
+    var writes map[string]func() error = map[string]func() error{
+        "finish pending write": func() error {
+            return pendingWriter.Close();
+        },
+        "write file": func() error {
+            _, _, err := connector.Write(oldConnector, fileInfo, blockCipher, bytes.NewReader(util.RandomBytes(10)));
+            return err;
+        },
+        "write admin object": func() error {
+            return oldConnector.WriteAdminObject("admin", []byte("admin"));
+        },
+        "remove file": func() error {
+            return oldConnector.RemoveFile(fileInfo);
+        },
+        "quarantine file": func() error {
+            return oldConnector.QuarantineData(fileInfo.Id);
+        },
+        "edit file": func() error {
+            writer, err := oldConnector.GetChunkWriter(fileInfo);
+            if (err != nil) {
+                return err;
+            }
+
+            err = writer.Truncate(0);
+            if (err != nil) {
+                return err;
+            }
+
+            return writer.Close();
+        },
+    };
+
+    for operation, write := range(writes) {
+        if (write() == nil) {
+            t.Errorf("Forced out connection could %s.", operation);
+        }
+    }
+
+    // Reads still work, and nothing changed.
+    for _, fsConnector := range([]*MemoryConnector{oldConnector, newConnector}) {
+        reader, err := fsConnector.GetCipherReader(fileInfo, blockCipher);
+        if (err != nil) {
+            t.Fatalf("Failed to get reader: %+v", err);
+        }
+
+        readData, err := ioutil.ReadAll(reader);
+        reader.Close();
+
+        if (err != nil || !bytes.Equal(readData, data)) {
+            t.Fatalf("File changed after being forced out: %+v", err);
+        }
+    }
+
+    metadataIds, err := newConnector.ListMetadata();
+    if (err != nil || len(metadataIds) != 0) {
+        t.Fatalf("Forced out connection wrote metadata (%v): %+v", metadataIds, err);
+    }
+
+    // Closing the old connection does not unlock the store.
+    oldConnector.Close();
+
+    err = newConnector.WriteAdminObject("admin", []byte("admin"));
+    if (err != nil) {
+        t.Fatalf("Connection that forced the old one out cannot write: %+v", err);
+    }
+}
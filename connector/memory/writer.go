@@ -0,0 +1,132 @@
+package memory;
+
+// Writers buffer everything and only replace the object on Close(),
+// so a partial write is never seen.
+
+import (
+    "bytes"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/cipherio"
+)
+
+type memoryReader struct {
+    *bytes.Reader
+}
+
+func (this *memoryReader) Close() error {
+    return nil;
+}
+
+type memoryWriter struct {
+    connection *MemoryConnector
+    store *store
+    objectPath string
+    buffer *bytes.Buffer
+    closed bool
+}
+
+func newMemoryWriter(connection *MemoryConnector, objectPath string) *memoryWriter {
+    return &memoryWriter{
+        connection: connection,
+        store: connection.store,
+        objectPath: objectPath,
+        buffer: &bytes.Buffer{},
+        closed: false,
+    };
+}
+
+// Fail as soon as the object would not fit, instead of waiting for Close().
+func (this *memoryWriter) Write(data []byte) (int, error) {
+    if (this.closed) {
+        return 0, errors.New("Writer is closed.");
+    }
+
+    this.store.lock.Lock();
+    err := this.store.checkOwner(this.connection);
+    if (err == nil) {
+        err = this.store.checkSpace(this.objectPath, int64(this.buffer.Len() + len(data)));
+    }
+    this.store.lock.Unlock();
+
+    if (err != nil) {
+        return 0, errors.WithStack(err);
+    }
+
+    return this.buffer.Write(data);
+}
+
+func (this *memoryWriter) Close() error {
+    if (this.closed) {
+        return nil;
+    }
+
+    this.closed = true;
+    return errors.WithStack(this.store.put(this.connection, this.objectPath, this.buffer.Bytes()));
+}
+
+// Edits a copy of the object.
+type memoryChunkWriter struct {
+    connection *MemoryConnector
+    objectPath string
+    data []byte
+}
+
+func newMemoryChunkWriter(connection *MemoryConnector, objectPath string) *memoryChunkWriter {
+    var data []byte = nil;
+
+    // A missing object is just empty.
+    existing, err := connection.store.get(objectPath);
+    if (err == nil) {
+        data = append([]byte(nil), existing...);
+    }
+
+    return &memoryChunkWriter{
+        connection: connection,
+        objectPath: objectPath,
+        data: data,
+    };
+}
+
+func (this *memoryChunkWriter) WriteChunk(index int64, ciphertext []byte) error {
+    var start int64 = index * cipherio.CIPHER_BLOCK_SIZE;
+    var end int64 = start + int64(len(ciphertext));
+
+    if (end > int64(len(this.data))) {
+        var grown []byte = make([]byte, end);
+        copy(grown, this.data);
+        this.data = grown;
+    }
+
+    copy(this.data[start:end], ciphertext);
+    return nil;
+}
+
+func (this *memoryChunkWriter) Truncate(size int64) error {
+    if (size < int64(len(this.data))) {
+        this.data = this.data[0:size];
+    } else if (size > int64(len(this.data))) {
+        var grown []byte = make([]byte, size);
+        copy(grown, this.data);
+        this.data = grown;
+    }
+
+    return nil;
+}
+
+func (this *memoryChunkWriter) Abort() error {
+    this.data = nil;
+    return nil;
+}
+
+func (this *memoryChunkWriter) Close() error {
+    return errors.WithStack(this.connection.store.put(this.connection, this.objectPath, this.data));
+}
+
+// Nothing is stored until Close(), so just drop the buffer.
+func (this *memoryWriter) Abort() error {
+    this.closed = true;
+    this.buffer = nil;
+    return nil;
+}
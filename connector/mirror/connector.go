@@ -0,0 +1,451 @@
+package mirror;
+
+// A connector that keeps the same storage in several other connectors (replicas),
+// eg a local disk for speed and S3 to keep a copy off-site.
+//
+// Every write goes to every replica, and fails if any replica fails.
+// A write that only partly works leaves some replicas out of sync, which are recorded (see dirty.go).
+// Reads come from the first healthy replica that is in sync and fall back to the others on an error.
+// A replica that fails is moved to the back of the line for reads until it works again.
+// Replicas that are missing objects (eg a replica that was added later) or are out of sync
+// can be fixed with a resync (see connector.Resyncable).
+
+import (
+    "crypto/cipher"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/cipherio"
+    "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/dirent"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+    MIN_REPLICAS = 2
+    ID_SEPARATOR = ","
+)
+
+type MirrorConnector struct {
+    replicas []connector.Connector
+    // Protects |healthy| and |dirty|.
+    lock *sync.Mutex
+    healthy []bool
+    // The keys of the objects that are out of sync, by replica id (see dirty.go).
+    dirty map[string]map[string]bool
+    // Serializes storing |dirty|.
+    saveLock *sync.Mutex
+}
+
+// The first replica is the one that reads prefer.
+// The mirror takes ownership of the replicas (even on failure).
+func NewMirrorConnector(replicas []connector.Connector) (*MirrorConnector, error) {
+    if (len(replicas) < MIN_REPLICAS) {
+        closeAll(replicas);
+        return nil, errors.Errorf("A mirror needs at least %d replicas, got %d.", MIN_REPLICAS, len(replicas));
+    }
+
+    var healthy []bool = make([]bool, len(replicas));
+    for i, _ := range(healthy) {
+        healthy[i] = true;
+    }
+
+    var connector MirrorConnector = MirrorConnector{
+        replicas: append([]connector.Connector(nil), replicas...),
+        lock: &sync.Mutex{},
+        healthy: healthy,
+        dirty: make(map[string]map[string]bool),
+        saveLock: &sync.Mutex{},
+    };
+
+    err := connector.loadDirty();
+    if (err != nil) {
+        closeAll(replicas);
+        return nil, errors.WithStack(err);
+    }
+
+    return &connector, nil;
+}
+
+func (this *MirrorConnector) GetId() string {
+    var ids []string = make([]string, 0, len(this.replicas));
+    for _, replica := range(this.replicas) {
+        ids = append(ids, replica.GetId());
+    }
+
+    return connector.CONNECTOR_TYPE_MIRROR + ":" + strings.Join(ids, ID_SEPARATOR);
+}
+
+func (this *MirrorConnector) PrepareStorage() error {
+    return errors.WithStack(this.writeAll("", func(replica connector.Connector) error {
+        return replica.PrepareStorage();
+    }));
+}
+
+func (this *MirrorConnector) GetCipherReader(fileInfo *dirent.Dirent, blockCipher cipher.Block) (util.ReadSeekCloser, error) {
+    return newFallbackReader(this, fileInfo, blockCipher);
+}
+
+// Metadata readers can only fall back when opening, not partway through.
+func (this *MirrorConnector) GetMetadataReader(metadataId string, blockCipher cipher.Block, legacyIV []byte) (*cipherio.MetadataReader, error) {
+    var reader *cipherio.MetadataReader = nil;
+
+    err := this.readAny(metadataKey(metadataId), func(replica connector.Connector) error {
+        var err error;
+        reader, err = replica.GetMetadataReader(metadataId, blockCipher, legacyIV);
+        return err;
+    });
+
+    return reader, errors.WithStack(err);
+}
+
+func (this *MirrorConnector) GetCipherWriter(fileInfo *dirent.Dirent, blockCipher cipher.Block) (*cipherio.CipherWriter, error) {
+    var writers []*cipherio.CipherWriter = make([]*cipherio.CipherWriter, 0, len(this.replicas));
+
+    for _, replica := range(this.replicas) {
+        writer, err := replica.GetCipherWriter(fileInfo, blockCipher);
+        if (err != nil) {
+            abortAll(writers);
+            return nil, errors.Wrap(err, replica.GetId());
+        }
+
+        writers = append(writers, writer);
+    }
+
+    return cipherio.NewTeeCipherWriterWithHook(writers, this.teeCloseHook(dataKey(fileInfo.Id))), nil;
+}
+
+// Out of sync replicas are not edited (editing does not bring them back in sync), they need a resync.
+func (this *MirrorConnector) GetChunkWriter(fileInfo *dirent.Dirent) (cipherio.ChunkWriter, error) {
+    var key string = dataKey(fileInfo.Id);
+    var writers []cipherio.ChunkWriter = make([]cipherio.ChunkWriter, 0, len(this.replicas));
+    var indexes []int = make([]int, 0, len(this.replicas));
+
+    for i, replica := range(this.replicas) {
+        if (this.isDirty(i, key)) {
+            continue;
+        }
+
+        writer, err := replica.GetChunkWriter(fileInfo);
+        if (err != nil) {
+            for _, opened := range(writers) {
+                opened.Abort();
+            }
+
+            return nil, errors.Wrap(err, replica.GetId());
+        }
+
+        writers = append(writers, writer);
+        indexes = append(indexes, i);
+    }
+
+    if (len(writers) == 0) {
+        return nil, errors.Errorf("File (%s) is out of sync in every replica.", fileInfo.Id);
+    }
+
+    return &teeChunkWriter{this, key, writers, indexes}, nil;
+}
+
+// Every replica writes its own envelope (with its own IV).
+func (this *MirrorConnector) GetMetadataWriter(metadataId string, blockCipher cipher.Block) (*cipherio.CipherWriter, error) {
+    var writers []*cipherio.CipherWriter = make([]*cipherio.CipherWriter, 0, len(this.replicas));
+
+    for _, replica := range(this.replicas) {
+        writer, err := replica.GetMetadataWriter(metadataId, blockCipher);
+        if (err != nil) {
+            abortAll(writers);
+            return nil, errors.Wrap(err, replica.GetId());
+        }
+
+        writers = append(writers, writer);
+    }
+
+    return cipherio.NewTeeCipherWriterWithHook(writers, this.teeCloseHook(metadataKey(metadataId))), nil;
+}
+
+func (this *MirrorConnector) RemoveMetadataFile(metadataId string) error {
+    return errors.WithStack(this.writeAll(metadataKey(metadataId), func(replica connector.Connector) error {
+        return ignoreMissing(replica.RemoveMetadataFile(metadataId));
+    }));
+}
+
+// An object that is only missing from some replicas is still found.
+func (this *MirrorConnector) ReadAdminObject(objectId string) ([]byte, error) {
+    var data []byte = nil;
+
+    err := this.readAny(metadataKey(objectId), func(replica connector.Connector) error {
+        var err error;
+        data, err = replica.ReadAdminObject(objectId);
+        return err;
+    });
+
+    return data, errors.WithStack(err);
+}
+
+func (this *MirrorConnector) WriteAdminObject(objectId string, data []byte) error {
+    return errors.WithStack(this.writeAll(metadataKey(objectId), func(replica connector.Connector) error {
+        return replica.WriteAdminObject(objectId, data);
+    }));
+}
+
+func (this *MirrorConnector) RemoveFile(file *dirent.Dirent) error {
+    return errors.WithStack(this.writeAll(dataKey(file.Id), func(replica connector.Connector) error {
+        return ignoreMissing(replica.RemoveFile(file));
+    }));
+}
+
+// Every replica is listed, so an object in any replica is included.
+func (this *MirrorConnector) ListData(prefix string) ([]dirent.Id, error) {
+    var ids []dirent.Id = make([]dirent.Id, 0);
+    var seen map[dirent.Id]bool = make(map[dirent.Id]bool);
+
+    for _, replica := range(this.replicas) {
+        replicaIds, err := replica.ListData(prefix);
+        if (err != nil) {
+            return nil, errors.Wrap(err, replica.GetId());
+        }
+
+        for _, id := range(replicaIds) {
+            if (!seen[id]) {
+                seen[id] = true;
+                ids = append(ids, id);
+            }
+        }
+    }
+
+    return ids, nil;
+}
+
+// Every replica is listed, so an object in any replica is included.
+// The mirror's own record of dirty objects is left out.
+func (this *MirrorConnector) ListMetadata() ([]string, error) {
+    var ids []string = make([]string, 0);
+    var seen map[string]bool = make(map[string]bool);
+
+    for _, replica := range(this.replicas) {
+        replicaIds, err := replica.ListMetadata();
+        if (err != nil) {
+            return nil, errors.Wrap(err, replica.GetId());
+        }
+
+        for _, id := range(replicaIds) {
+            if (!seen[id] && id != DIRTY_OBJECT_ID) {
+                seen[id] = true;
+                ids = append(ids, id);
+            }
+        }
+    }
+
+    return ids, nil;
+}
+
+// Replicas make up their own ETags, so an object's ETag may change if a different replica answers.
+func (this *MirrorConnector) Stat(id dirent.Id) (*connector.ObjectInfo, error) {
+    var info *connector.ObjectInfo = nil;
+
+    err := this.readAny(dataKey(id), func(replica connector.Connector) error {
+        var err error;
+        info, err = replica.Stat(id);
+        return err;
+    });
+
+    return info, errors.WithStack(err);
+}
+
+// Only works if every replica is auditable.
+func (this *MirrorConnector) QuarantineData(id dirent.Id) error {
+    for _, replica := range(this.replicas) {
+        _, ok := replica.(connector.Auditable);
+        if (!ok) {
+            return errors.Errorf("Replica (%s) cannot quarantine data.", replica.GetId());
+        }
+    }
+
+    return errors.WithStack(this.writeAll(dataKey(id), func(replica connector.Connector) error {
+        return ignoreMissing(replica.(connector.Auditable).QuarantineData(id));
+    }));
+}
+
+// Sweeps any replicas that can be swept.
+func (this *MirrorConnector) SweepStaleUploads(minAge time.Duration) (*connector.SweepReport, error) {
+    var report connector.SweepReport = connector.SweepReport{};
+
+    for _, replica := range(this.replicas) {
+        sweepable, ok := replica.(connector.Sweepable);
+        if (!ok) {
+            continue;
+        }
+
+        replicaReport, err := sweepable.SweepStaleUploads(minAge);
+        if (err != nil) {
+            return nil, errors.Wrap(err, replica.GetId());
+        }
+
+        report.Aborted += replicaReport.Aborted;
+        report.Skipped += replicaReport.Skipped;
+        report.BytesReclaimed += replicaReport.BytesReclaimed;
+    }
+
+    return &report, nil;
+}
+
+// Every replica is closed, even if some fail.
+func (this *MirrorConnector) Close() error {
+    return errors.WithStack(closeAll(this.replicas));
+}
+
+// Do an operation that replaces (or removes) the object at |key| on every replica.
+// Every replica is tried (so one bad replica does not stop the others), and the first error is returned.
+// If the operation works on some replicas, then the ones that failed are out of sync and the rest are in sync.
+// An empty key is not tracked.
+func (this *MirrorConnector) writeAll(key string, operation func(connector.Connector) error) error {
+    var firstErr error = nil;
+    var failed []int = make([]int, 0);
+    var succeeded []int = make([]int, 0, len(this.replicas));
+
+    for i, replica := range(this.replicas) {
+        err := operation(replica);
+        if (err != nil) {
+            this.setHealthy(i, false);
+            failed = append(failed, i);
+            if (firstErr == nil) {
+                firstErr = errors.Wrap(err, replica.GetId());
+            }
+
+            continue;
+        }
+
+        succeeded = append(succeeded, i);
+    }
+
+    if (key == "" || len(succeeded) == 0) {
+        return firstErr;
+    }
+
+    err := this.setDirty(succeeded, key, false);
+    if (err != nil && firstErr == nil) {
+        return errors.WithStack(err);
+    }
+
+    return this.markDirty(failed, key, firstErr);
+}
+
+// Track a tee writer for the object at |key| that goes to every replica (in order).
+// If only some replicas committed, then they are out of sync (since the caller sees the write fail).
+// If every replica committed, then they are all in sync.
+func (this *MirrorConnector) teeCloseHook(key string) cipherio.TeeCloseHook {
+    return func(closed int, err error) error {
+        if (err == nil) {
+            var all []int = make([]int, 0, len(this.replicas));
+            for i, _ := range(this.replicas) {
+                all = append(all, i);
+            }
+
+            return errors.WithStack(this.setDirty(all, key, false));
+        }
+
+        this.setHealthy(closed, false);
+
+        var committed []int = make([]int, 0, closed);
+        for i := 0; i < closed; i++ {
+            committed = append(committed, i);
+        }
+
+        return this.markDirty(committed, key, errors.Wrap(err, this.replicas[closed].GetId()));
+    };
+}
+
+// Do an operation on replicas (in read order) until it works on one.
+// Replicas where the object at |key| is out of sync are skipped (an empty key skips none).
+// If it works on none, the error from the first replica tried is returned.
+func (this *MirrorConnector) readAny(key string, operation func(connector.Connector) error) error {
+    var firstErr error = nil;
+
+    for _, i := range(this.readOrder()) {
+        if (key != "" && this.isDirty(i, key)) {
+            continue;
+        }
+
+        err := operation(this.replicas[i]);
+        if (err == nil) {
+            this.setHealthy(i, true);
+            return nil;
+        }
+
+        // A missing object is not a sign of a bad replica.
+        if (!os.IsNotExist(errors.Cause(err))) {
+            this.setHealthy(i, false);
+        }
+
+        if (firstErr == nil) {
+            firstErr = errors.Wrap(err, this.replicas[i].GetId());
+        }
+    }
+
+    if (firstErr == nil) {
+        return errors.Errorf("Object (%s) is out of sync in every replica that has it.", key);
+    }
+
+    return firstErr;
+}
+
+// The replicas (by index) in the order that they should be read from:
+// the healthy ones first, and the rest after (in case they have recovered).
+func (this *MirrorConnector) readOrder() []int {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    var order []int = make([]int, 0, len(this.replicas));
+    for i, healthy := range(this.healthy) {
+        if (healthy) {
+            order = append(order, i);
+        }
+    }
+
+    for i, healthy := range(this.healthy) {
+        if (!healthy) {
+            order = append(order, i);
+        }
+    }
+
+    return order;
+}
+
+func (this *MirrorConnector) setHealthy(index int, healthy bool) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    this.healthy[index] = healthy;
+}
+
+// An object that is being removed may have only been in some of the replicas.
+func ignoreMissing(err error) error {
+    if (os.IsNotExist(errors.Cause(err))) {
+        return nil;
+    }
+
+    return err;
+}
+
+func abortAll(writers []*cipherio.CipherWriter) {
+    for _, writer := range(writers) {
+        writer.Abort();
+    }
+}
+
+func closeAll(replicas []connector.Connector) error {
+    var firstErr error = nil;
+
+    for _, replica := range(replicas) {
+        err := replica.Close();
+        if (err != nil && firstErr == nil) {
+            firstErr = errors.Wrap(err, replica.GetId());
+        }
+    }
+
+    return firstErr;
+}
@@ -0,0 +1,348 @@
+package mirror;
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/cipher"
+    "io/ioutil"
+    "testing"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/cipherio"
+    "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/connector/connectortest"
+    "github.com/eriq-augustine/elfs/connector/memory"
+    "github.com/eriq-augustine/elfs/dirent"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+    TEST_ROOT_ID = "metadata_root"
+)
+
+var TEST_REPLICA_SUFFIXES []string = []string{"-a", "-b"};
+
+// Every storage is a mirror of memory stores.
+type mirrorFactory struct {}
+
+func (this mirrorFactory) Open(name string, force bool) (connector.Connector, error) {
+    var replicas []connector.Connector = make([]connector.Connector, 0, len(TEST_REPLICA_SUFFIXES));
+    for _, suffix := range(TEST_REPLICA_SUFFIXES) {
+        replica, err := memory.NewMemoryConnector(name + suffix, 0, force);
+        if (err != nil) {
+            closeAll(replicas);
+            return nil, errors.WithStack(err);
+        }
+
+        replicas = append(replicas, replica);
+    }
+
+    return NewMirrorConnector(replicas);
+}
+
+func (this mirrorFactory) Destroy(name string) error {
+    for _, suffix := range(TEST_REPLICA_SUFFIXES) {
+        err := memory.RemoveStore(name + suffix);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+    }
+
+    return nil;
+}
+
+func TestConnector(t *testing.T) {
+    connectortest.Run(t, mirrorFactory{});
+}
+
+// A replica that can be made to fail.
+type failingReplica struct {
+    connector.Connector
+    // Chunk writers fail to close (after the edit is written).
+    failChunkClose bool
+    // Admin objects that fail to be written.
+    failAdmin map[string]bool
+}
+
+type failingChunkWriter struct {
+    cipherio.ChunkWriter
+}
+
+func (this *failingChunkWriter) Close() error {
+    this.ChunkWriter.Abort();
+    return errors.New("Injected chunk writer failure.");
+}
+
+func (this *failingReplica) GetChunkWriter(fileInfo *dirent.Dirent) (cipherio.ChunkWriter, error) {
+    writer, err := this.Connector.GetChunkWriter(fileInfo);
+    if (err != nil || !this.failChunkClose) {
+        return writer, err;
+    }
+
+    return &failingChunkWriter{writer}, nil;
+}
+
+func (this *failingReplica) WriteAdminObject(objectId string, data []byte) error {
+    if (this.failAdmin[objectId]) {
+        return errors.New("Injected admin object failure.");
+    }
+
+    return this.Connector.WriteAdminObject(objectId, data);
+}
+
+// Two memory replicas, the second of which can fail.
+func newTestReplicas(t *testing.T) (connector.Connector, *failingReplica, func()) {
+    var name string = "mirrortest-" + util.RandomString(8);
+
+    first, err := memory.NewMemoryConnector(name + TEST_REPLICA_SUFFIXES[0], 0, false);
+    if (err != nil) {
+        t.Fatalf("Failed to open memory store: %+v", err);
+    }
+
+    second, err := memory.NewMemoryConnector(name + TEST_REPLICA_SUFFIXES[1], 0, false);
+    if (err != nil) {
+        t.Fatalf("Failed to open memory store: %+v", err);
+    }
+
+    var cleanup func() = func() {
+        first.Close();
+        second.Close();
+        mirrorFactory{}.Destroy(name);
+    };
+
+    return first, &failingReplica{second, false, make(map[string]bool)}, cleanup;
+}
+
+// The replicas stay open (a mirror closes its replicas, so they are wrapped).
+func openTestMirror(t *testing.T, replicas ...connector.Connector) *MirrorConnector {
+    var wrapped []connector.Connector = make([]connector.Connector, 0, len(replicas));
+    for _, replica := range(replicas) {
+        wrapped = append(wrapped, &unclosedReplica{replica});
+    }
+
+    mirror, err := NewMirrorConnector(wrapped);
+    if (err != nil) {
+        t.Fatalf("Failed to open mirror: %+v", err);
+    }
+
+    return mirror;
+}
+
+type unclosedReplica struct {
+    connector.Connector
+}
+
+func (this *unclosedReplica) Close() error {
+    return nil;
+}
+
+func newTestCipher(t *testing.T) cipher.Block {
+    blockCipher, err := aes.NewCipher(util.GenAESKey());
+    if (err != nil) {
+        t.Fatalf("Failed to make cipher: %+v", err);
+    }
+
+    return blockCipher;
+}
+
+func readTestFile(fsConnector connector.Connector, fileInfo *dirent.Dirent, blockCipher cipher.Block) ([]byte, error) {
+    reader, err := fsConnector.GetCipherReader(fileInfo, blockCipher);
+    if (err != nil) {
+        return nil, err;
+    }
+    defer reader.Close();
+
+    return ioutil.ReadAll(reader);
+}
+
+// An edit that commits in one replica but fails in another leaves the first out of sync.
+// It is never read (even after the mirror is opened again), and a resync fixes it.
+func TestPartialEdit(t *testing.T) {
+    first, second, cleanup := newTestReplicas(t);
+    defer cleanup();
+
+    var mirror *MirrorConnector = openTestMirror(t, first, second);
+    var blockCipher cipher.Block = newTestCipher(t);
+
+    var fileInfo *dirent.Dirent = &dirent.Dirent{
+        Id: dirent.NewId(),
+        IsFile: true,
+        IV: util.GenIV(),
+        CipherVersion: cipherio.CURRENT_CIPHER_VERSION,
+    };
+
+    var data []byte = util.RandomBytes(1000);
+    size, _, err := connector.Write(mirror, fileInfo, blockCipher, bytes.NewReader(data));
+    if (err != nil) {
+        t.Fatalf("Failed to write file: %+v", err);
+    }
+    fileInfo.Size = size;
+
+    // Edit the file, which only commits in the first replica.
+    second.failChunkClose = true;
+
+    reader, err := mirror.GetCipherReader(fileInfo, blockCipher);
+    if (err != nil) {
+        t.Fatalf("Failed to get reader: %+v", err);
+    }
+
+    writer, err := mirror.GetChunkWriter(fileInfo);
+    if (err != nil) {
+        t.Fatalf("Failed to get chunk writer: %+v", err);
+    }
+
+    editor, err := cipherio.NewChunkEditor(reader, writer, connector.FileStreamParams(fileInfo, blockCipher), int64(len(data)));
+    if (err != nil) {
+        t.Fatalf("Failed to get chunk editor: %+v", err);
+    }
+
+    _, err = editor.WriteAt([]byte("edit"), 10);
+    if (err != nil) {
+        t.Fatalf("Failed to edit: %+v", err);
+    }
+
+    err = editor.Close();
+    reader.Close();
+    if (err == nil) {
+        t.Fatalf("Edit should have failed.");
+    }
+
+    second.failChunkClose = false;
+
+    // The edit failed, so the file is what it was (and only the second replica still has that).
+    _, err = readTestFile(first, fileInfo, blockCipher);
+    if (err == nil) {
+        t.Fatalf("The first replica should have the (unrecorded) edit.");
+    }
+
+    // Open the mirror again, so anything it knows about the replicas must have been stored.
+    mirror.Close();
+    mirror = openTestMirror(t, first, second);
+    defer mirror.Close();
+
+    if (!mirror.isDirty(0, dataKey(fileInfo.Id))) {
+        t.Fatalf("The first replica should be out of sync.");
+    }
+
+    readData, err := readTestFile(mirror, fileInfo, blockCipher);
+    if (err != nil || !bytes.Equal(data, readData)) {
+        t.Fatalf("Failed to read the file through the mirror: %+v", err);
+    }
+
+    report, err := mirror.ResyncData(fileInfo, blockCipher);
+    if (err != nil || report.Copied != 1 || report.Failed != 0) {
+        t.Fatalf("Bad resync (%+v): %+v", report, err);
+    }
+
+    readData, err = readTestFile(first, fileInfo, blockCipher);
+    if (err != nil || !bytes.Equal(data, readData)) {
+        t.Fatalf("The first replica was not resynced: %+v", err);
+    }
+
+    if (mirror.isDirty(0, dataKey(fileInfo.Id))) {
+        t.Fatalf("The first replica should be in sync after a resync.");
+    }
+}
+
+// An admin object that fails to be written to one replica is never read from it (even after the mirror is opened again),
+// and a resync fixes it.
+func TestStaleAdminObject(t *testing.T) {
+    first, second, cleanup := newTestReplicas(t);
+    defer cleanup();
+
+    var mirror *MirrorConnector = openTestMirror(t, first, second);
+
+    err := mirror.WriteAdminObject(TEST_ROOT_ID, []byte("old"));
+    if (err != nil) {
+        t.Fatalf("Failed to write admin object: %+v", err);
+    }
+
+    second.failAdmin[TEST_ROOT_ID] = true;
+    err = mirror.WriteAdminObject(TEST_ROOT_ID, []byte("new"));
+    if (err == nil) {
+        t.Fatalf("Write should have failed.");
+    }
+    second.failAdmin[TEST_ROOT_ID] = false;
+
+    // Open the mirror again, preferring the stale replica.
+    mirror.Close();
+    mirror = openTestMirror(t, second, first);
+    defer mirror.Close();
+
+    data, err := mirror.ReadAdminObject(TEST_ROOT_ID);
+    if (err != nil || string(data) != "new") {
+        t.Fatalf("Read a stale admin object (%s): %+v", string(data), err);
+    }
+
+    report, err := mirror.ResyncMetadata();
+    if (err != nil || report.Copied != 1 || report.Failed != 0) {
+        t.Fatalf("Bad resync (%+v): %+v", report, err);
+    }
+
+    data, err = second.ReadAdminObject(TEST_ROOT_ID);
+    if (err != nil || string(data) != "new") {
+        t.Fatalf("The stale replica was not resynced (%s): %+v", string(data), err);
+    }
+}
+
+// Objects that every replica has, but that differ, are resynced.
+func TestResyncDifferentObjects(t *testing.T) {
+    first, second, cleanup := newTestReplicas(t);
+    defer cleanup();
+
+    var mirror *MirrorConnector = openTestMirror(t, first, second);
+    defer mirror.Close();
+
+    var blockCipher cipher.Block = newTestCipher(t);
+
+    err := mirror.WriteAdminObject(TEST_ROOT_ID, []byte("good"));
+    if (err != nil) {
+        t.Fatalf("Failed to write admin object: %+v", err);
+    }
+
+    var fileInfo *dirent.Dirent = &dirent.Dirent{
+        Id: dirent.NewId(),
+        IsFile: true,
+        IV: util.GenIV(),
+        CipherVersion: cipherio.CURRENT_CIPHER_VERSION,
+    };
+
+    var data []byte = util.RandomBytes(1000);
+    size, _, err := connector.Write(mirror, fileInfo, blockCipher, bytes.NewReader(data));
+    if (err != nil) {
+        t.Fatalf("Failed to write file: %+v", err);
+    }
+    fileInfo.Size = size;
+
+    // Change the objects in the second replica behind the mirror's back.
+    err = second.WriteAdminObject(TEST_ROOT_ID, []byte("bad"));
+    if (err != nil) {
+        t.Fatalf("Failed to write admin object: %+v", err);
+    }
+
+    _, _, err = connector.Write(second, fileInfo, blockCipher, bytes.NewReader(data[0:10]));
+    if (err != nil) {
+        t.Fatalf("Failed to write file: %+v", err);
+    }
+
+    report, err := mirror.ResyncMetadata();
+    if (err != nil || report.Copied != 1 || report.Failed != 0) {
+        t.Fatalf("Bad metadata resync (%+v): %+v", report, err);
+    }
+
+    report, err = mirror.ResyncData(fileInfo, blockCipher);
+    if (err != nil || report.Copied != 1 || report.Failed != 0) {
+        t.Fatalf("Bad data resync (%+v): %+v", report, err);
+    }
+
+    adminData, err := second.ReadAdminObject(TEST_ROOT_ID);
+    if (err != nil || string(adminData) != "good") {
+        t.Fatalf("Admin object was not resynced (%s): %+v", string(adminData), err);
+    }
+
+    readData, err := readTestFile(second, fileInfo, blockCipher);
+    if (err != nil || !bytes.Equal(data, readData)) {
+        t.Fatalf("File was not resynced: %+v", err);
+    }
+}
@@ -0,0 +1,236 @@
+package mirror;
+
+// Objects that are known to be out of sync in some replicas (dirty).
+// A replica's copy of a dirty object is never read, since it does not match what the filesystem expects:
+//  - When a write is committed by some replicas but then fails in another,
+//    the caller sees the failure (and will not refer to what was written), so the replicas that committed are dirty.
+//  - When an admin object write or a removal only works in some replicas,
+//    the replicas that failed still have the old object, so they are dirty.
+// An object stops being dirty in a replica once a full write (or removal) of it works there, or it is resynced.
+//
+// The dirty objects are stored as an admin object in every replica,
+// and every copy that can be read is merged when the mirror is opened,
+// so they are not forgotten (and stale objects are not read) after a restart.
+
+import (
+    "encoding/json"
+    "os"
+    "sort"
+    "strings"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/dirent"
+)
+
+const (
+    DIRTY_OBJECT_ID = "mirror_dirty"
+
+    DIRTY_DATA_PREFIX = "data:"
+    DIRTY_METADATA_PREFIX = "metadata:"
+)
+
+func dataKey(id dirent.Id) string {
+    return DIRTY_DATA_PREFIX + string(id);
+}
+
+// Metadata and admin objects share ids.
+func metadataKey(metadataId string) string {
+    return DIRTY_METADATA_PREFIX + metadataId;
+}
+
+// Merge in the dirty objects stored in every replica.
+// A replica that cannot be read is skipped (the others hold the same objects).
+func (this *MirrorConnector) loadDirty() error {
+    var loaded int = 0;
+    var firstErr error = nil;
+
+    for i, replica := range(this.replicas) {
+        data, err := replica.ReadAdminObject(DIRTY_OBJECT_ID);
+        if (err != nil) {
+            if (os.IsNotExist(errors.Cause(err))) {
+                loaded++;
+                continue;
+            }
+
+            this.healthy[i] = false;
+            if (firstErr == nil) {
+                firstErr = errors.Wrap(err, replica.GetId());
+            }
+
+            continue;
+        }
+
+        var stored map[string][]string = nil;
+        err = json.Unmarshal(data, &stored);
+        if (err != nil) {
+            if (firstErr == nil) {
+                firstErr = errors.Wrapf(err, "Bad dirty objects in %s", replica.GetId());
+            }
+
+            continue;
+        }
+
+        for replicaId, keys := range(stored) {
+            for _, key := range(keys) {
+                this.addDirty(replicaId, key);
+            }
+        }
+
+        loaded++;
+    }
+
+    if (loaded == 0) {
+        return errors.Wrap(firstErr, "Could not read the dirty objects from any replica");
+    }
+
+    return nil;
+}
+
+// The caller must hold the lock.
+func (this *MirrorConnector) addDirty(replicaId string, key string) {
+    keys, ok := this.dirty[replicaId];
+    if (!ok) {
+        keys = make(map[string]bool);
+        this.dirty[replicaId] = keys;
+    }
+
+    keys[key] = true;
+}
+
+func (this *MirrorConnector) isDirty(index int, key string) bool {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    return this.dirty[this.replicas[index].GetId()][key];
+}
+
+// Any replicas (by index) that have |key| dirty.
+func (this *MirrorConnector) dirtyReplicas(key string) []int {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    var indexes []int = make([]int, 0);
+    for i, replica := range(this.replicas) {
+        if (this.dirty[replica.GetId()][key]) {
+            indexes = append(indexes, i);
+        }
+    }
+
+    return indexes;
+}
+
+// Mark |key| as dirty (or clean) in the replicas at |indexes|, and store the change.
+func (this *MirrorConnector) setDirty(indexes []int, key string, dirty bool) error {
+    var changed bool = false;
+
+    this.lock.Lock();
+    for _, i := range(indexes) {
+        var replicaId string = this.replicas[i].GetId();
+        if (this.dirty[replicaId][key] == dirty) {
+            continue;
+        }
+
+        changed = true;
+        if (dirty) {
+            this.addDirty(replicaId, key);
+        } else {
+            delete(this.dirty[replicaId], key);
+            if (len(this.dirty[replicaId]) == 0) {
+                delete(this.dirty, replicaId);
+            }
+        }
+    }
+    this.lock.Unlock();
+
+    if (!changed) {
+        return nil;
+    }
+
+    return errors.WithStack(this.saveDirty());
+}
+
+// Store the dirty objects in every replica that will take them.
+// Only fails if no replica could store them.
+func (this *MirrorConnector) saveDirty() error {
+    // Saves are serialized, so an older set never replaces a newer one.
+    this.saveLock.Lock();
+    defer this.saveLock.Unlock();
+
+    this.lock.Lock();
+    var stored map[string][]string = make(map[string][]string, len(this.dirty));
+    for replicaId, keys := range(this.dirty) {
+        var sortedKeys []string = make([]string, 0, len(keys));
+        for key, _ := range(keys) {
+            sortedKeys = append(sortedKeys, key);
+        }
+
+        sort.Strings(sortedKeys);
+        stored[replicaId] = sortedKeys;
+    }
+    this.lock.Unlock();
+
+    data, err := json.Marshal(stored);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    var saved bool = false;
+    var firstErr error = nil;
+
+    for i, replica := range(this.replicas) {
+        err = replica.WriteAdminObject(DIRTY_OBJECT_ID, data);
+        if (err != nil) {
+            this.setHealthy(i, false);
+            if (firstErr == nil) {
+                firstErr = errors.Wrap(err, replica.GetId());
+            }
+
+            continue;
+        }
+
+        saved = true;
+    }
+
+    if (!saved) {
+        return errors.Wrap(firstErr, "Could not store the dirty objects in any replica");
+    }
+
+    return nil;
+}
+
+// After a write that failed in some replicas, mark the ones at |indexes| as dirty.
+// |err| is the write's error, any failure to store the dirty objects is added to it.
+func (this *MirrorConnector) markDirty(indexes []int, key string, err error) error {
+    if (len(indexes) == 0) {
+        return err;
+    }
+
+    dirtyErr := this.setDirty(indexes, key, true);
+    if (dirtyErr != nil) {
+        return errors.Wrapf(err, "(the replicas that are now out of sync could not be recorded: %v)", dirtyErr);
+    }
+
+    return err;
+}
+
+// All the keys (that start with |prefix|) that are out of sync in any replica.
+func (this *MirrorConnector) dirtyKeys(prefix string) []string {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    var seen map[string]bool = make(map[string]bool);
+    var keys []string = make([]string, 0);
+
+    for _, replicaKeys := range(this.dirty) {
+        for key, _ := range(replicaKeys) {
+            if (strings.HasPrefix(key, prefix) && !seen[key]) {
+                seen[key] = true;
+                keys = append(keys, key);
+            }
+        }
+    }
+
+    sort.Strings(keys);
+    return keys;
+}
@@ -0,0 +1,152 @@
+package mirror;
+
+// A reader that falls back to the other replicas if reading from one fails partway through.
+// The next replica picks up where the failed one stopped,
+// which works since every replica holds the same cleartext for a file.
+// Replicas where the file is out of sync are never read.
+
+import (
+    "crypto/cipher"
+    "io"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/dirent"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+type fallbackReader struct {
+    mirror *MirrorConnector
+    fileInfo *dirent.Dirent
+    blockCipher cipher.Block
+    // The replicas (by index) that have not been tried yet.
+    remaining []int
+    // The index of the replica being read from.
+    current int
+    reader util.ReadSeekCloser
+    // The cleartext offset of the next read.
+    offset int64
+}
+
+func newFallbackReader(mirror *MirrorConnector, fileInfo *dirent.Dirent, blockCipher cipher.Block) (*fallbackReader, error) {
+    var key string = dataKey(fileInfo.Id);
+    var remaining []int = make([]int, 0, len(mirror.replicas));
+    for _, i := range(mirror.readOrder()) {
+        if (!mirror.isDirty(i, key)) {
+            remaining = append(remaining, i);
+        }
+    }
+
+    var reader fallbackReader = fallbackReader{
+        mirror: mirror,
+        fileInfo: fileInfo,
+        blockCipher: blockCipher,
+        remaining: remaining,
+        current: -1,
+        reader: nil,
+        offset: 0,
+    };
+
+    err := reader.next(nil);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    return &reader, nil;
+}
+
+func (this *fallbackReader) Read(outBuffer []byte) (int, error) {
+    for {
+        readSize, err := this.reader.Read(outBuffer);
+        this.offset += int64(readSize);
+
+        // Hold on to any data that came before an error, the error will come up again on the next read.
+        if (err == nil || err == io.EOF || readSize > 0) {
+            if (err != nil && err != io.EOF) {
+                err = nil;
+            }
+
+            return readSize, err;
+        }
+
+        err = this.next(err);
+        if (err != nil) {
+            return 0, errors.WithStack(err);
+        }
+    }
+}
+
+func (this *fallbackReader) Seek(offset int64, whence int) (int64, error) {
+    for {
+        position, err := this.reader.Seek(offset, whence);
+        if (err == nil) {
+            this.offset = position;
+            return position, nil;
+        }
+
+        err = this.next(err);
+        if (err != nil) {
+            return 0, errors.WithStack(err);
+        }
+    }
+}
+
+func (this *fallbackReader) Close() error {
+    if (this.reader == nil) {
+        return nil;
+    }
+
+    err := this.reader.Close();
+    this.reader = nil;
+
+    return errors.WithStack(err);
+}
+
+// Give up on the current replica (if any) because of |cause|,
+// and open the next replica that works at the current offset.
+func (this *fallbackReader) next(cause error) error {
+    if (this.reader != nil) {
+        this.reader.Close();
+        this.reader = nil;
+        this.mirror.setHealthy(this.current, false);
+    }
+
+    for (len(this.remaining) > 0) {
+        var index int = this.remaining[0];
+        this.remaining = this.remaining[1:];
+
+        reader, err := this.open(index);
+        if (err == nil) {
+            this.current = index;
+            this.reader = reader;
+            return nil;
+        }
+
+        if (cause == nil) {
+            cause = errors.Wrap(err, this.mirror.replicas[index].GetId());
+        }
+    }
+
+    if (cause == nil) {
+        cause = errors.Errorf("File (%s) is out of sync in every replica.", this.fileInfo.Id);
+    }
+
+    return errors.Wrap(cause, "No replica left to read from");
+}
+
+func (this *fallbackReader) open(index int) (util.ReadSeekCloser, error) {
+    reader, err := this.mirror.replicas[index].GetCipherReader(this.fileInfo, this.blockCipher);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    if (this.offset != 0) {
+        _, err = reader.Seek(this.offset, io.SeekStart);
+        if (err != nil) {
+            reader.Close();
+            return nil, errors.WithStack(err);
+        }
+    }
+
+    return reader, nil;
+}
@@ -0,0 +1,254 @@
+package mirror;
+
+// Bringing replicas back in sync (see connector.Resyncable).
+// Metadata (and admin) objects are copied byte for byte,
+// and are compared byte for byte in the replicas that already have them.
+// Data objects are decrypted from a replica that has them and encrypted again (with the same stream params)
+// for the ones that do not, so every replica ends up with the same ciphertext.
+// Replicas make up their own ETags, so data objects that every replica has are compared by size
+// (anything else that is out of sync was recorded when it happened, see dirty.go).
+// The first replica (in read order) with a good copy is the one that the others are synced to.
+
+import (
+    "bytes"
+    "crypto/cipher"
+    "io"
+    "os"
+    "strings"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/cipherio"
+    "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/dirent"
+)
+
+func (this *MirrorConnector) ResyncMetadata() (*connector.ResyncReport, error) {
+    var report connector.ResyncReport = connector.ResyncReport{};
+
+    // The objects each replica has, and all of the objects in the order they were found.
+    var has []map[string]bool = make([]map[string]bool, len(this.replicas));
+    var ids []string = make([]string, 0);
+
+    for i, replica := range(this.replicas) {
+        replicaIds, err := replica.ListMetadata();
+        if (err != nil) {
+            return nil, errors.Wrap(err, replica.GetId());
+        }
+
+        has[i] = make(map[string]bool, len(replicaIds));
+        for _, id := range(replicaIds) {
+            // The mirror keeps its own record in sync.
+            if (id == DIRTY_OBJECT_ID) {
+                continue;
+            }
+
+            has[i][id] = true;
+
+            if (!anyHas(has[0:i], id)) {
+                ids = append(ids, id);
+            }
+        }
+    }
+
+    for _, id := range(ids) {
+        report.Checked++;
+        this.resyncMetadataObject(has, id, &report);
+    }
+
+    // Anything still recorded as out of sync for an object that is gone from every replica is done.
+    for _, key := range(this.dirtyKeys(DIRTY_METADATA_PREFIX)) {
+        if (!anyHas(has, strings.TrimPrefix(key, DIRTY_METADATA_PREFIX))) {
+            err := this.setDirty(this.dirtyReplicas(key), key, false);
+            if (err != nil) {
+                return nil, errors.WithStack(err);
+            }
+        }
+    }
+
+    return &report, nil;
+}
+
+func (this *MirrorConnector) resyncMetadataObject(has []map[string]bool, id string, report *connector.ResyncReport) {
+    var key string = metadataKey(id);
+
+    source, data, err := this.readAdminObjectFrom(has, key, id);
+    if (err != nil) {
+        report.Failed++;
+        report.Errors = append(report.Errors, errors.Wrapf(err, "Could not read %s from any replica", id));
+        return;
+    }
+
+    // Only out of sync replicas have it, so it was removed.
+    if (source == -1) {
+        for _, i := range(this.dirtyReplicas(key)) {
+            err = ignoreMissing(this.replicas[i].RemoveMetadataFile(id));
+            if (err == nil) {
+                err = this.setDirty([]int{i}, key, false);
+            }
+
+            if (err != nil) {
+                this.setHealthy(i, false);
+                report.Failed++;
+                report.Errors = append(report.Errors, errors.Wrapf(err, "Could not remove %s from %s", id, this.replicas[i].GetId()));
+                continue;
+            }
+
+            report.Removed++;
+        }
+
+        return;
+    }
+
+    for i, replica := range(this.replicas) {
+        if (i == source) {
+            continue;
+        }
+
+        if (has[i][id] && !this.isDirty(i, key)) {
+            existing, err := replica.ReadAdminObject(id);
+            if (err == nil && bytes.Equal(existing, data)) {
+                continue;
+            }
+        }
+
+        err = replica.WriteAdminObject(id, data);
+        if (err == nil) {
+            err = this.setDirty([]int{i}, key, false);
+        }
+
+        if (err != nil) {
+            this.setHealthy(i, false);
+            report.Failed++;
+            report.Errors = append(report.Errors, errors.Wrapf(err, "Could not copy %s to %s", id, replica.GetId()));
+            continue;
+        }
+
+        report.Copied++;
+    }
+}
+
+func (this *MirrorConnector) ResyncData(fileInfo *dirent.Dirent, blockCipher cipher.Block) (*connector.ResyncReport, error) {
+    var report connector.ResyncReport = connector.ResyncReport{Checked: 1};
+    var key string = dataKey(fileInfo.Id);
+    var expectedSize int64 = cipherio.CiphertextSize(fileInfo.CipherVersion, int64(fileInfo.Size));
+
+    // Replicas (by index, in read order) that have a good copy of the object, and the ones that need one.
+    var sources []int = make([]int, 0);
+    var targets []int = make([]int, 0);
+
+    for _, i := range(this.readOrder()) {
+        info, err := this.replicas[i].Stat(fileInfo.Id);
+        if (err == nil) {
+            if (this.isDirty(i, key) || info.CiphertextSize != expectedSize) {
+                targets = append(targets, i);
+            } else {
+                sources = append(sources, i);
+            }
+        } else if (os.IsNotExist(errors.Cause(err))) {
+            targets = append(targets, i);
+        } else {
+            this.setHealthy(i, false);
+            report.Failed++;
+            report.Errors = append(report.Errors, errors.Wrapf(err, "Could not check %s in %s", fileInfo.Id, this.replicas[i].GetId()));
+        }
+    }
+
+    if (len(targets) == 0) {
+        return &report, nil;
+    }
+
+    if (len(sources) == 0) {
+        report.Failed += len(targets);
+        report.Errors = append(report.Errors, errors.Errorf("%s is not in sync in any replica.", fileInfo.Id));
+        return &report, nil;
+    }
+
+    for _, i := range(targets) {
+        err := this.copyData(sources, i, fileInfo, blockCipher);
+        if (err == nil) {
+            err = this.setDirty([]int{i}, key, false);
+        }
+
+        if (err != nil) {
+            report.Failed++;
+            report.Errors = append(report.Errors, errors.Wrapf(err, "Could not copy %s to %s", fileInfo.Id, this.replicas[i].GetId()));
+            continue;
+        }
+
+        report.Copied++;
+    }
+
+    return &report, nil;
+}
+
+// Copy a file from the first of |sources| that can be read to |dest|.
+func (this *MirrorConnector) copyData(sources []int, dest int, fileInfo *dirent.Dirent, blockCipher cipher.Block) error {
+    var lastErr error = nil;
+
+    for _, source := range(sources) {
+        reader, err := this.replicas[source].GetCipherReader(fileInfo, blockCipher);
+        if (err != nil) {
+            lastErr = errors.Wrap(err, this.replicas[source].GetId());
+            continue;
+        }
+
+        writer, err := this.replicas[dest].GetCipherWriter(fileInfo, blockCipher);
+        if (err != nil) {
+            reader.Close();
+            this.setHealthy(dest, false);
+            return errors.WithStack(err);
+        }
+
+        _, err = io.Copy(writer, reader);
+        reader.Close();
+
+        if (err != nil) {
+            writer.Abort();
+            lastErr = errors.Wrap(err, this.replicas[source].GetId());
+            continue;
+        }
+
+        err = writer.Close();
+        if (err != nil) {
+            this.setHealthy(dest, false);
+            return errors.WithStack(err);
+        }
+
+        return nil;
+    }
+
+    return lastErr;
+}
+
+// Read an admin object from the first replica (in read order) that has it in sync.
+// Returns the replica (by index) that it was read from, or -1 if no replica has it in sync.
+func (this *MirrorConnector) readAdminObjectFrom(has []map[string]bool, key string, id string) (int, []byte, error) {
+    var lastErr error = nil;
+
+    for _, i := range(this.readOrder()) {
+        if (!has[i][id] || this.isDirty(i, key)) {
+            continue;
+        }
+
+        data, err := this.replicas[i].ReadAdminObject(id);
+        if (err == nil) {
+            return i, data, nil;
+        }
+
+        this.setHealthy(i, false);
+        lastErr = errors.Wrap(err, this.replicas[i].GetId());
+    }
+
+    return -1, nil, lastErr;
+}
+
+func anyHas(has []map[string]bool, id string) bool {
+    for _, replicaHas := range(has) {
+        if (replicaHas[id]) {
+            return true;
+        }
+    }
+
+    return false;
+}
@@ -0,0 +1,75 @@
+package mirror;
+
+// Random-access writes to every replica that is in sync.
+
+import (
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/cipherio"
+)
+
+type teeChunkWriter struct {
+    mirror *MirrorConnector
+    // The key of the file being written (see dirty.go).
+    key string
+    writers []cipherio.ChunkWriter
+    // The replica (by index) of each writer.
+    indexes []int
+}
+
+func (this *teeChunkWriter) WriteChunk(index int64, ciphertext []byte) error {
+    for _, writer := range(this.writers) {
+        err := writer.WriteChunk(index, ciphertext);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+    }
+
+    return nil;
+}
+
+func (this *teeChunkWriter) Truncate(size int64) error {
+    for _, writer := range(this.writers) {
+        err := writer.Truncate(size);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+    }
+
+    return nil;
+}
+
+// If any writer fails to close, then the ones that are not closed yet are aborted,
+// and the replicas that already committed the edit are out of sync (the caller will not record the edit).
+func (this *teeChunkWriter) Close() error {
+    for i, writer := range(this.writers) {
+        err := writer.Close();
+        if (err != nil) {
+            for _, rest := range(this.writers[i + 1:]) {
+                rest.Abort();
+            }
+
+            var failed int = this.indexes[i];
+            this.mirror.setHealthy(failed, false);
+
+            return this.mirror.markDirty(this.indexes[0:i], this.key,
+                    errors.Wrap(err, this.mirror.replicas[failed].GetId()));
+        }
+    }
+
+    return nil;
+}
+
+// Abort every writer, even if some fail.
+func (this *teeChunkWriter) Abort() error {
+    var firstErr error = nil;
+
+    for _, writer := range(this.writers) {
+        err := writer.Abort();
+        if (err != nil && firstErr == nil) {
+            firstErr = err;
+        }
+    }
+
+    return errors.WithStack(firstErr);
+}
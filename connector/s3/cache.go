@@ -0,0 +1,296 @@
+package s3;
+
+// A cache of decrypted chunks that is shared by all the readers of a connector.
+// Every round trip to S3 is expensive, and FUSE opens a new reader for every read it gets from the kernel,
+// so without this a sequential read would fetch (and decrypt) each chunk many times over.
+//
+// Chunks are keyed by object, the object's generation, and the chunk index.
+// A connector is the only one allowed to change its bucket (see lock()),
+// so all changes to an object go through the connector and bump the object's generation.
+// A chunk from an old generation (including one that was being loaded during the change) is never used.
+
+import (
+    "container/list"
+    "io"
+    "sync"
+
+    "github.com/eriq-augustine/elfs/cipherio"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+type chunkKey struct {
+    objectId string
+    generation uint64
+    index int64
+}
+
+type cachedChunk struct {
+    key chunkKey
+    cleartext []byte
+}
+
+type cachedSize struct {
+    generation uint64
+    size int64
+}
+
+type chunkCache struct {
+    lock *sync.Mutex
+    maxBytes int64
+    usedBytes int64
+    // Most recently used at the front.
+    lru *list.List
+    chunks map[chunkKey]*list.Element
+    // Objects that have never changed are generation zero.
+    generations map[string]uint64
+    nextGeneration uint64
+    // The ciphertext size of objects, so opening a reader does not need to ask S3.
+    sizes map[string]cachedSize
+    // Chunks being read ahead, closed when the load is done (successful or not).
+    loading map[chunkKey]chan bool
+    // Limits the number of read-ahead requests at a time.
+    readAheadSlots chan bool
+}
+
+func newChunkCache(maxBytes int64, readAhead int) *chunkCache {
+    return &chunkCache{
+        lock: &sync.Mutex{},
+        maxBytes: maxBytes,
+        usedBytes: 0,
+        lru: list.New(),
+        chunks: make(map[chunkKey]*list.Element),
+        generations: make(map[string]uint64),
+        nextGeneration: 1,
+        sizes: make(map[string]cachedSize),
+        loading: make(map[chunkKey]chan bool),
+        readAheadSlots: make(chan bool, util.MaxInt(1, readAhead)),
+    };
+}
+
+func (this *chunkCache) generation(objectId string) uint64 {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    return this.generations[objectId];
+}
+
+// Get a chunk, waiting for it if it is being loaded.
+func (this *chunkCache) get(key chunkKey) ([]byte, bool) {
+    this.lock.Lock();
+    loaded, isLoading := this.loading[key];
+    this.lock.Unlock();
+
+    if (isLoading) {
+        <-loaded;
+    }
+
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    element, ok := this.chunks[key];
+    if (!ok) {
+        return nil, false;
+    }
+
+    this.lru.MoveToFront(element);
+    return element.Value.(*cachedChunk).cleartext, true;
+}
+
+// The cleartext is copied.
+func (this *chunkCache) put(key chunkKey, cleartext []byte) {
+    if (int64(len(cleartext)) > this.maxBytes) {
+        return;
+    }
+
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    // The object has changed since this chunk was read.
+    if (this.generations[key.objectId] != key.generation) {
+        return;
+    }
+
+    element, ok := this.chunks[key];
+    if (ok) {
+        this.lru.MoveToFront(element);
+        return;
+    }
+
+    var chunk cachedChunk = cachedChunk{
+        key: key,
+        cleartext: append([]byte(nil), cleartext...),
+    };
+
+    this.chunks[key] = this.lru.PushFront(&chunk);
+    this.usedBytes += int64(len(chunk.cleartext));
+
+    for (this.usedBytes > this.maxBytes) {
+        this.removeElement(this.lru.Back());
+    }
+}
+
+func (this *chunkCache) getSize(objectId string) (int64, bool) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    size, ok := this.sizes[objectId];
+    if (!ok || size.generation != this.generations[objectId]) {
+        return 0, false;
+    }
+
+    return size.size, true;
+}
+
+func (this *chunkCache) putSize(objectId string, generation uint64, size int64) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    if (this.generations[objectId] != generation) {
+        return;
+    }
+
+    this.sizes[objectId] = cachedSize{generation, size};
+}
+
+// Note that an object is changing (or has changed).
+// Everything cached for the object is dropped.
+func (this *chunkCache) invalidate(objectId string) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    this.generations[objectId] = this.nextGeneration;
+    this.nextGeneration++;
+
+    delete(this.sizes, objectId);
+
+    for key, element := range(this.chunks) {
+        if (key.objectId == objectId) {
+            this.removeElement(element);
+        }
+    }
+}
+
+// Returns false if the chunk is already cached or being loaded.
+// Otherwise, the caller must call finishLoad() when done.
+func (this *chunkCache) startLoad(key chunkKey) bool {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    _, isCached := this.chunks[key];
+    _, isLoading := this.loading[key];
+    if (isCached || isLoading) {
+        return false;
+    }
+
+    this.loading[key] = make(chan bool);
+    return true;
+}
+
+func (this *chunkCache) finishLoad(key chunkKey) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    close(this.loading[key]);
+    delete(this.loading, key);
+}
+
+// The caller must hold the lock.
+func (this *chunkCache) removeElement(element *list.Element) {
+    var chunk *cachedChunk = element.Value.(*cachedChunk);
+
+    this.lru.Remove(element);
+    delete(this.chunks, chunk.key);
+    this.usedBytes -= int64(len(chunk.cleartext));
+}
+
+// The view of the cache for a single reader (see cipherio.ChunkCache).
+// Asking for a chunk also starts reading ahead the chunks after it.
+type readerCache struct {
+    connector *S3Connector
+    objectId string
+    generation uint64
+    params cipherio.StreamParams
+    ciphertextSize int64
+    numChunks int64
+}
+
+func (this *readerCache) GetChunk(index int64) ([]byte, bool) {
+    this.readAhead(index);
+    return this.connector.cache.get(this.key(index));
+}
+
+func (this *readerCache) PutChunk(index int64, cleartext []byte) {
+    this.connector.cache.put(this.key(index), cleartext);
+}
+
+func (this *readerCache) key(index int64) chunkKey {
+    return chunkKey{this.objectId, this.generation, index};
+}
+
+func (this *readerCache) readAhead(index int64) {
+    var lastIndex int64 = util.MinInt64(index + int64(this.connector.options.ReadAhead), this.numChunks - 1);
+
+    for readIndex := index + 1; readIndex <= lastIndex; readIndex++ {
+        var key chunkKey = this.key(readIndex);
+        if (this.connector.cache.startLoad(key)) {
+            go this.loadChunk(key);
+        }
+    }
+}
+
+// Read ahead is just a hint, so any failure is dropped
+// (the reader will run into it again when it actually needs the chunk).
+func (this *readerCache) loadChunk(key chunkKey) {
+    defer this.connector.cache.finishLoad(key);
+
+    this.connector.cache.readAheadSlots <- true;
+    defer func() {
+        <-this.connector.cache.readAheadSlots;
+    }();
+
+    var start int64 = key.index * cipherio.CIPHER_BLOCK_SIZE;
+    var end int64 = util.MinInt64(start + cipherio.CIPHER_BLOCK_SIZE, this.ciphertextSize);
+
+    var reader *S3Reader = NewS3Reader(this.connector.bucket, this.objectId, this.connector.s3Client, this.ciphertextSize);
+    _, err := reader.Seek(start, io.SeekStart);
+    if (err != nil) {
+        return;
+    }
+
+    var ciphertext []byte = make([]byte, end - start);
+    _, err = io.ReadFull(reader, ciphertext);
+    if (err != nil) {
+        return;
+    }
+
+    cleartext, err := cipherio.DecryptChunk(this.params, key.index, key.index == this.numChunks - 1, ciphertext);
+    if (err != nil) {
+        return;
+    }
+
+    this.connector.cache.put(key, cleartext);
+}
+
+// Writers invalidate again when they are done,
+// in case a reader cached the object while it was being written.
+type invalidatingWriter struct {
+    *S3Writer
+    connector *S3Connector
+    objectId string
+}
+
+func (this *invalidatingWriter) Close() error {
+    defer this.connector.invalidate(this.objectId);
+    return this.S3Writer.Close();
+}
+
+type invalidatingChunkWriter struct {
+    cipherio.ChunkWriter
+    connector *S3Connector
+    objectId string
+}
+
+func (this *invalidatingChunkWriter) Close() error {
+    defer this.connector.invalidate(this.objectId);
+    return this.ChunkWriter.Close();
+}
@@ -0,0 +1,174 @@
+package s3;
+
+// Random-access writes for S3.
+// S3 objects cannot be modified in place, so the object is rebuilt with a multipart upload
+// where any chunk that was not touched is copied server-side from the existing object.
+// Chunks are the same size as multipart parts, so every untouched chunk is just a part copy.
+
+import (
+   "bytes"
+   "fmt"
+
+   "github.com/aws/aws-sdk-go/aws"
+   "github.com/aws/aws-sdk-go/service/s3"
+   "github.com/pkg/errors"
+
+   "github.com/eriq-augustine/elfs/cipherio"
+   "github.com/eriq-augustine/elfs/util"
+)
+
+type s3ChunkWriter struct {
+   bucket string
+   objectId string
+   s3Client *s3.S3
+   // The size of the existing object (before any changes).
+   originalSize int64
+   // The size of the object once the changes are applied.
+   ciphertextSize int64
+   storageClass string
+   partsInFlight int
+   // Replaced chunks are held in memory until Close().
+   chunks map[int64][]byte
+   changed bool
+}
+
+func newS3ChunkWriter(bucket string, objectId string, s3Client *s3.S3, storageClass string, partsInFlight int) (*s3ChunkWriter, error) {
+   size, err := GetSize(bucket, objectId, s3Client);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   return &s3ChunkWriter{
+      bucket: bucket,
+      objectId: objectId,
+      s3Client: s3Client,
+      originalSize: size,
+      ciphertextSize: size,
+      storageClass: storageClass,
+      partsInFlight: partsInFlight,
+      chunks: make(map[int64][]byte),
+      changed: false,
+   }, nil;
+}
+
+func (this *s3ChunkWriter) WriteChunk(index int64, ciphertext []byte) error {
+   this.chunks[index] = append([]byte(nil), ciphertext...);
+   this.ciphertextSize = util.MaxInt64(this.ciphertextSize, index * cipherio.CIPHER_BLOCK_SIZE + int64(len(ciphertext)));
+   this.changed = true;
+
+   return nil;
+}
+
+func (this *s3ChunkWriter) Truncate(size int64) error {
+   for index, chunk := range(this.chunks) {
+      var chunkStart int64 = index * cipherio.CIPHER_BLOCK_SIZE;
+
+      if (chunkStart >= size) {
+         delete(this.chunks, index);
+      } else if (chunkStart + int64(len(chunk)) > size) {
+         this.chunks[index] = chunk[0:size - chunkStart];
+      }
+   }
+
+   this.ciphertextSize = size;
+   this.changed = true;
+
+   return nil;
+}
+
+// Nothing has been uploaded yet, so just drop the chunks.
+func (this *s3ChunkWriter) Abort() error {
+   this.chunks = nil;
+   this.changed = false;
+   return nil;
+}
+
+func (this *s3ChunkWriter) Close() error {
+   if (!this.changed) {
+      return nil;
+   }
+
+   // Multipart uploads need at least one part.
+   if (this.ciphertextSize == 0) {
+      request := &s3.PutObjectInput{
+         Bucket: aws.String(this.bucket),
+         Key: aws.String(this.objectId),
+         Body: bytes.NewReader([]byte{}),
+         StorageClass: aws.String(this.storageClass),
+      };
+
+      _, err := this.s3Client.PutObject(request);
+      return errors.Wrap(err, this.objectId);
+   }
+
+   writer, err := NewS3Writer(this.bucket, this.objectId, this.s3Client, this.storageClass, this.partsInFlight);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   var numChunks int64 = (this.ciphertextSize + cipherio.CIPHER_BLOCK_SIZE - 1) / cipherio.CIPHER_BLOCK_SIZE;
+   for index := int64(0); index < numChunks; index++ {
+      chunk, ok := this.chunks[index];
+      if (ok) {
+         _, err = writer.Write(chunk);
+         if (err != nil) {
+            return errors.Wrapf(err, "Failed to upload chunk %d", index);
+         }
+
+         continue;
+      }
+
+      var start int64 = index * cipherio.CIPHER_BLOCK_SIZE;
+      var end int64 = util.MinInt64(start + cipherio.CIPHER_BLOCK_SIZE, this.ciphertextSize);
+      if (end > this.originalSize) {
+         writer.Abort();
+         return errors.Errorf("Chunk %d of %s was never written.", index, this.objectId);
+      }
+
+      err = writer.CopyPart(this.objectId, start, end);
+      if (err != nil) {
+         return errors.Wrapf(err, "Failed to copy chunk %d", index);
+      }
+   }
+
+   return errors.WithStack(writer.Close());
+}
+
+// Add a part to the upload by copying the range [start, end) of another object in the same bucket.
+// Like any other part, the copy happens in the background.
+func (this *S3Writer) CopyPart(sourceObjectId string, start int64, end int64) error {
+   if (this.uploadId == nil) {
+      return errors.Errorf("Upload is already closed: [%s]", *this.objectId);
+   }
+
+   // Anything written before this must be its own part.
+   if (len(this.buffer) > 0) {
+      err := this.flush();
+      if (err != nil) {
+         return errors.WithStack(err);
+      }
+   }
+
+   return errors.WithStack(this.startPart(func(uploadId *string, partNumber int64) (*string, error) {
+      request := &s3.UploadPartCopyInput{
+         Bucket: this.bucket,
+         Key: this.objectId,
+         CopySource: aws.String(*this.bucket + "/" + sourceObjectId),
+         // Note that http byte ranges are inclusive (hence the -1).
+         CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end - 1)),
+         PartNumber: aws.Int64(partNumber),
+         UploadId: uploadId,
+      };
+
+      response, err := this.s3Client.UploadPartCopy(request);
+      if (err != nil) {
+         return nil, errors.Wrapf(err, "Failed to copy part %d of %s", partNumber, *this.objectId);
+      }
+
+      if (response.CopyPartResult == nil) {
+         return nil, nil;
+      }
+
+      return response.CopyPartResult.ETag, nil;
+   }));
+}
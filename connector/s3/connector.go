@@ -3,9 +3,11 @@ package s3;
 // A connector that pulls data from an S3 bucket.
 
 import (
+    "bytes"
     "crypto/cipher"
     "io/ioutil"
     "os"
+    "path"
     "strings"
     "sync"
 
@@ -22,39 +24,48 @@ import (
     "github.com/eriq-augustine/elfs/util"
 )
 
-const (
-    UNKNOWN_HOSTNAME = "unknown"
-)
-
 // Keep track of the active connections so two instances don't connect to the same storage.
-var activeConnections map[string]bool;
+// A forced connection replaces the old one here.
+var activeConnections map[string]*S3Connector;
 var activeConnectionsLock *sync.Mutex;
 
 func init() {
-    activeConnections = make(map[string]bool);
+    activeConnections = make(map[string]*S3Connector);
     activeConnectionsLock = &sync.Mutex{};
 }
 
 type S3Connector struct {
     bucket string
     s3Client *s3.S3
+    options Options
+    // Nil if caching is off.
+    cache *chunkCache
+    lease *connector.LeaseLock
 }
 
 // There should only ever be one connection to a filesystem at a time.
-// If an old connection has not been properly closed, then the force parameter
-// may be used to cleanup the old connection.
+// If an old connection has not been properly closed, then its lock runs out on its own
+// (see connector.LeaseLock), or the force parameter may be used to take the lock right away.
 func NewS3Connector(bucket string, credentialsPath string, awsProfile string, region string, endpoint string, force bool) (*S3Connector, error) {
+    return NewS3ConnectorWithOptions(bucket, credentialsPath, awsProfile, region, endpoint, force, DefaultOptions());
+}
+
+func NewS3ConnectorWithOptions(bucket string, credentialsPath string, awsProfile string, region string, endpoint string, force bool, options Options) (*S3Connector, error) {
     activeConnectionsLock.Lock();
     defer activeConnectionsLock.Unlock();
 
-    _, ok := activeConnections[bucket];
-    if (ok) {
+    if (activeConnections[bucket] != nil && !force) {
         return nil, errors.Errorf("Cannot create two connections to the same storage: %s", bucket);
     }
 
+    err := options.validate();
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
     var awsCreds *credentials.Credentials = credentials.NewSharedCredentials(credentialsPath, awsProfile);
     // Make sure we can get the credentials.
-    _, err := awsCreds.Get();
+    _, err = awsCreds.Get();
     if (err != nil) {
         return nil, errors.WithStack(err);
     }
@@ -63,6 +74,8 @@ func NewS3Connector(bucket string, credentialsPath string, awsProfile string, re
         Credentials: credentials.NewSharedCredentials(credentialsPath, awsProfile),
         Region: aws.String(region),
         Endpoint: &endpoint,
+        S3ForcePathStyle: aws.Bool(usePathStyle(endpoint)),
+        Retryer: newRetryer(options),
     });
     if (err != nil) {
         return nil, errors.Wrap(err, bucket);
@@ -71,13 +84,22 @@ func NewS3Connector(bucket string, credentialsPath string, awsProfile string, re
     var connector S3Connector = S3Connector {
         bucket: bucket,
         s3Client: s3.New(awsSession),
+        options: options,
+        cache: nil,
     };
 
-    err = connector.lock(force);
+    options.Encryption.install(connector.s3Client);
+
+    if (options.CacheBytes > 0) {
+        connector.cache = newChunkCache(options.CacheBytes, options.ReadAhead);
+    }
+
+    connector.lease, err = connector.lock(force);
     if (err != nil) {
         return nil, errors.Wrap(err, bucket);
     }
 
+    activeConnections[bucket] = &connector;
     return &connector, nil;
 }
 
@@ -91,45 +113,134 @@ func (this *S3Connector) PrepareStorage() error {
 }
 
 func (this *S3Connector) GetCipherReader(fileInfo *dirent.Dirent, blockCipher cipher.Block) (util.ReadSeekCloser, error) {
-    return this.getReader(this.getDataPath(fileInfo), blockCipher, fileInfo.IV);
+    if (this.cache != nil) {
+        return this.getCachedCipherReader(fileInfo, blockCipher);
+    }
+
+    reader, ciphertextSize, err := this.getReader(this.getDataPath(fileInfo));
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    return cipherio.NewCipherReader(reader, connector.FileStreamParams(fileInfo, blockCipher), ciphertextSize);
+}
+
+func (this *S3Connector) getCachedCipherReader(fileInfo *dirent.Dirent, blockCipher cipher.Block) (util.ReadSeekCloser, error) {
+    var objectId string = this.getDataPath(fileInfo);
+
+    // Get the generation first, so a change while we are looking is not missed.
+    var generation uint64 = this.cache.generation(objectId);
+
+    ciphertextSize, ok := this.cache.getSize(objectId);
+    if (!ok) {
+        var err error;
+        ciphertextSize, err = GetSize(this.bucket, objectId, this.s3Client);
+        if (err != nil) {
+            return nil, errors.WithStack(err);
+        }
+
+        this.cache.putSize(objectId, generation, ciphertextSize);
+    }
+
+    var params cipherio.StreamParams = connector.FileStreamParams(fileInfo, blockCipher);
+
+    var readerCache readerCache = readerCache{
+        connector: this,
+        objectId: objectId,
+        generation: generation,
+        params: params,
+        ciphertextSize: ciphertextSize,
+        numChunks: cipherio.NumCiphertextChunks(ciphertextSize),
+    };
+
+    var reader *S3Reader = NewS3Reader(this.bucket, objectId, this.s3Client, ciphertextSize);
+    return cipherio.NewCachedCipherReader(reader, params, ciphertextSize, &readerCache);
 }
 
-func (this *S3Connector) GetMetadataReader(metadataId string, blockCipher cipher.Block, iv []byte) (util.ReadSeekCloser, error) {
-    return this.getReader(this.getMetadataPath(metadataId), blockCipher, iv);
+func (this *S3Connector) GetMetadataReader(metadataId string, blockCipher cipher.Block, legacyIV []byte) (*cipherio.MetadataReader, error) {
+    reader, ciphertextSize, err := this.getReader(this.getMetadataPath(metadataId));
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    return cipherio.NewMetadataReader(reader, blockCipher, legacyIV, metadataId, ciphertextSize);
 }
 
-func (this *S3Connector) getReader(id string, blockCipher cipher.Block, iv []byte) (util.ReadSeekCloser, error) {
+func (this *S3Connector) getReader(id string) (*S3Reader, int64, error) {
     ciphertextSize, err := GetSize(this.bucket, id, this.s3Client);
     if (err != nil) {
-        return nil, errors.WithStack(err);
+        return nil, 0, errors.WithStack(err);
     }
 
-    var reader *S3Reader = NewS3Reader(this.bucket, id, this.s3Client, ciphertextSize);
-    return cipherio.NewCipherReader(reader, blockCipher, iv, ciphertextSize);
+    return NewS3Reader(this.bucket, id, this.s3Client, ciphertextSize), ciphertextSize, nil;
 }
 
 func (this *S3Connector) GetCipherWriter(fileInfo *dirent.Dirent, blockCipher cipher.Block) (*cipherio.CipherWriter, error) {
-    return this.getWriter(this.getDataPath(fileInfo), blockCipher, fileInfo.IV, false);
+    err := this.lease.Check();
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    var objectId string = this.getDataPath(fileInfo);
+
+    writer, err := NewS3Writer(this.bucket, objectId, this.s3Client, this.dataStorageClass(fileInfo), this.options.PartsInFlight);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    this.invalidate(objectId);
+    return cipherio.NewCipherWriter(&invalidatingWriter{writer, this, objectId}, connector.FileStreamParams(fileInfo, blockCipher));
 }
 
-func (this *S3Connector) GetMetadataWriter(metadataId string, blockCipher cipher.Block, iv []byte) (*cipherio.CipherWriter, error) {
-    return this.getWriter(this.getMetadataPath(metadataId), blockCipher, iv, true);
+func (this *S3Connector) GetChunkWriter(fileInfo *dirent.Dirent) (cipherio.ChunkWriter, error) {
+    err := this.lease.Check();
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    var objectId string = this.getDataPath(fileInfo);
+
+    writer, err := newS3ChunkWriter(this.bucket, objectId, this.s3Client, this.dataStorageClass(fileInfo), this.options.PartsInFlight);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    this.invalidate(objectId);
+    return &invalidatingChunkWriter{writer, this, objectId}, nil;
 }
 
-func (this *S3Connector) getWriter(id string, blockCipher cipher.Block, iv []byte, isMetadata bool) (*cipherio.CipherWriter, error) {
-    writer, err := NewS3Writer(this.bucket, id, this.s3Client, isMetadata);
+func (this *S3Connector) GetMetadataWriter(metadataId string, blockCipher cipher.Block) (*cipherio.CipherWriter, error) {
+    err := this.lease.Check();
     if (err != nil) {
         return nil, errors.WithStack(err);
     }
 
-    return cipherio.NewCipherWriter(writer, blockCipher, iv);
+    writer, err := NewS3Writer(this.bucket, this.getMetadataPath(metadataId), this.s3Client, this.options.MetadataStorageClass, this.options.PartsInFlight);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    return cipherio.NewMetadataWriter(writer, blockCipher, metadataId);
 }
 
 func (this *S3Connector) RemoveFile(file *dirent.Dirent) error {
-    return errors.WithStack(this.removeFile(this.getDataPath(file)));
+    err := this.lease.Check();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    var objectId string = this.getDataPath(file);
+
+    this.invalidate(objectId);
+    return errors.WithStack(this.removeFile(objectId));
 }
 
 func (this *S3Connector) RemoveMetadataFile(metadataId string) error {
+    err := this.lease.Check();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
     return errors.WithStack(this.removeFile(this.getMetadataPath(metadataId)));
 }
 
@@ -147,85 +258,208 @@ func (this *S3Connector) removeFile(id string) error {
     return nil;
 }
 
-func (this* S3Connector) Close() error {
-    activeConnectionsLock.Lock();
-    defer activeConnectionsLock.Unlock();
-
-    activeConnections[this.bucket] = false;
-    return errors.WithStack(this.unlock());
-}
+func (this *S3Connector) ReadAdminObject(objectId string) ([]byte, error) {
+    var id string = this.getMetadataPath(objectId);
 
-func (this *S3Connector) checkLock() (string, error) {
     request := &s3.GetObjectInput{
         Bucket: aws.String(this.bucket),
-        Key: aws.String(this.getLockPath()),
+        Key: aws.String(id),
     };
 
-    data, err := this.s3Client.GetObject(request);
+    response, err := this.s3Client.GetObject(request);
     if (err != nil) {
         awsError, ok := err.(awserr.Error);
         if (ok && awsError.Code() == s3.ErrCodeNoSuchKey) {
-            return "", nil;
+            return nil, errors.Wrap(os.ErrNotExist, id);
         }
 
-        return "", errors.WithStack(err);
+        return nil, errors.Wrap(err, id);
     }
+    defer response.Body.Close();
 
-    hostname, err := ioutil.ReadAll(data.Body);
+    data, err := ioutil.ReadAll(response.Body);
     if (err != nil) {
-        return "", errors.WithStack(err);
+        return nil, errors.Wrap(err, id);
     }
 
-    return string(hostname), errors.WithStack(data.Body.Close());
+    return data, nil;
 }
 
-func (this *S3Connector) writeLock() error {
-    hostname, err := os.Hostname();
+// Puts are atomic, so there is no chance of a partial object.
+func (this *S3Connector) WriteAdminObject(objectId string, data []byte) error {
+    err := this.lease.Check();
     if (err != nil) {
-        hostname = UNKNOWN_HOSTNAME;
+        return errors.WithStack(err);
     }
 
+    var id string = this.getMetadataPath(objectId);
+
     request := &s3.PutObjectInput{
         Bucket: aws.String(this.bucket),
-        Key: aws.String(this.getLockPath()),
-        Body: strings.NewReader(hostname),
+        Key: aws.String(id),
+        Body: bytes.NewReader(data),
+        StorageClass: aws.String(this.options.MetadataStorageClass),
     };
 
     _, err = this.s3Client.PutObject(request);
     if (err != nil) {
-        return errors.WithStack(err);
+        return errors.Wrap(err, id);
     }
 
     return nil;
 }
 
-func (this* S3Connector) lock(force bool) error {
-    hostname, err := this.checkLock();
+func (this *S3Connector) ListData(prefix string) ([]dirent.Id, error) {
+    // The group dir can only be put into the search prefix if we know it.
+    var searchPrefix string = connector.FS_SYS_DIR_DATA + "/";
+    if (len(prefix) >= connector.DATA_GROUP_PREFIX_LEN) {
+        searchPrefix = path.Join(connector.FS_SYS_DIR_DATA, prefix[0:connector.DATA_GROUP_PREFIX_LEN], prefix);
+    }
+
+    names, err := this.listObjects(searchPrefix);
     if (err != nil) {
-        return errors.WithStack(err);
+        return nil, errors.WithStack(err);
     }
 
-    // Lock already exists and we were not told to force it.
-    if (hostname != "" && !force) {
-        return errors.Errorf("S3 filesystem (at %s) already owned by [%s]." +
-                " Ensure that the server is dead and remove the lock or force the connector.",
-                this.bucket, hostname);
+    var ids []dirent.Id = make([]dirent.Id, 0, len(names));
+    for _, name := range(names) {
+        if (strings.HasPrefix(name, prefix)) {
+            ids = append(ids, dirent.Id(name));
+        }
     }
 
-    // Lock doesn't exist, or we can force it.
-    return errors.WithStack(this.writeLock());
+    return ids, nil;
 }
 
-func (this* S3Connector) unlock() error {
-    request := &s3.DeleteObjectInput{
+func (this *S3Connector) ListMetadata() ([]string, error) {
+    names, err := this.listObjects(connector.FS_SYS_DIR_ADMIN + "/");
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    var ids []string = make([]string, 0, len(names));
+    for _, name := range(names) {
+        if (name != LOCK_FILENAME) {
+            ids = append(ids, name);
+        }
+    }
+
+    return ids, nil;
+}
+
+func (this *S3Connector) Stat(id dirent.Id) (*connector.ObjectInfo, error) {
+    response, err := headObject(this.bucket, this.getDataPath(&dirent.Dirent{Id: id}), this.s3Client);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    var info connector.ObjectInfo = connector.ObjectInfo{
+        CiphertextSize: aws.Int64Value(response.ContentLength),
+        ModTime: aws.TimeValue(response.LastModified),
+        ETag: strings.Trim(aws.StringValue(response.ETag), "\""),
+    };
+
+    return &info, nil;
+}
+
+// Get the base names of all the objects under |prefix| (all pages).
+func (this *S3Connector) listObjects(prefix string) ([]string, error) {
+    var names []string = make([]string, 0);
+
+    request := &s3.ListObjectsV2Input{
         Bucket: aws.String(this.bucket),
-        Key: aws.String(this.getLockPath()),
+        Prefix: aws.String(prefix),
     };
 
-    _, err := this.s3Client.DeleteObject(request);
+    err := this.s3Client.ListObjectsV2Pages(request, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+        for _, object := range(page.Contents) {
+            names = append(names, path.Base(aws.StringValue(object.Key)));
+        }
+
+        return true;
+    });
+
+    if (err != nil) {
+        return nil, errors.Wrap(err, prefix);
+    }
+
+    return names, nil;
+}
+
+// S3 has no move, so copy and then remove.
+func (this *S3Connector) QuarantineData(id dirent.Id) error {
+    err := this.lease.Check();
     if (err != nil) {
         return errors.WithStack(err);
     }
 
-    return nil;
+    var source string = this.getDataPath(&dirent.Dirent{Id: id});
+    var dest string = path.Join(connector.FS_SYS_DIR_QUARANTINE, string(id));
+
+    this.invalidate(source);
+
+    // Keep the object in the class it is in (S3 leaves out the standard class).
+    head, err := headObject(this.bucket, source, this.s3Client);
+    if (err != nil) {
+        return errors.Wrap(err, source);
+    }
+
+    var fileInfo *dirent.Dirent = &dirent.Dirent{Id: id, StorageClass: s3.StorageClassStandard};
+    if (aws.StringValue(head.StorageClass) != "") {
+        fileInfo.StorageClass = aws.StringValue(head.StorageClass);
+    }
+
+    request := &s3.CopyObjectInput{
+        Bucket: aws.String(this.bucket),
+        CopySource: aws.String(this.bucket + "/" + source),
+        Key: aws.String(dest),
+        StorageClass: aws.String(this.dataStorageClass(fileInfo)),
+    };
+
+    _, err = this.s3Client.CopyObject(request);
+    if (err != nil) {
+        return errors.Wrap(err, source);
+    }
+
+    return errors.WithStack(this.removeFile(source));
+}
+
+// A file's own storage class wins over the filesystem's,
+// unless it is not one that a file may use (see ValidOverrideStorageClass()).
+func (this *S3Connector) dataStorageClass(fileInfo *dirent.Dirent) string {
+    if (ValidOverrideStorageClass(fileInfo.StorageClass)) {
+        return fileInfo.StorageClass;
+    }
+
+    return this.options.DataStorageClass;
+}
+
+// Drop anything cached for an object that is changing.
+func (this *S3Connector) invalidate(objectId string) {
+    if (this.cache != nil) {
+        this.cache.invalidate(objectId);
+    }
+}
+
+func (this* S3Connector) Close() error {
+    activeConnectionsLock.Lock();
+    defer activeConnectionsLock.Unlock();
+
+    // A connection that was forced out no longer owns the lock (and releasing will leave it be).
+    if (activeConnections[this.bucket] == this) {
+        delete(activeConnections, this.bucket);
+    }
+
+    return errors.WithStack(this.lease.Release());
+}
+
+func (this* S3Connector) lock(force bool) (*connector.LeaseLock, error) {
+    var lockObject lockObject = lockObject{
+        bucket: this.bucket,
+        key: this.getLockPath(),
+        s3Client: this.s3Client,
+        storageClass: this.options.MetadataStorageClass,
+    };
+
+    return connector.AcquireLease(&lockObject, "S3 filesystem (at " + this.bucket + ")", this.options.LeaseDuration, force);
 }
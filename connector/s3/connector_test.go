@@ -0,0 +1,244 @@
+package s3;
+
+import (
+    "bytes"
+    "crypto/aes"
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/cipherio"
+    "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/connector/connectortest"
+    "github.com/eriq-augustine/elfs/connector/s3/fakes3"
+    "github.com/eriq-augustine/elfs/dirent"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+    TEST_PROFILE = "fakes3"
+    TEST_REGION = "us-east-1"
+)
+
+// Every storage is a bucket on a fake S3 server.
+type s3Factory struct {
+    server *fakes3.Server
+    endpoint string
+    credentialsPath string
+}
+
+func (this s3Factory) Open(name string, force bool) (connector.Connector, error) {
+    this.server.CreateBucket(name);
+    return NewS3Connector(name, this.credentialsPath, TEST_PROFILE, TEST_REGION, this.endpoint, force);
+}
+
+func (this s3Factory) Destroy(name string) error {
+    this.server.RemoveBucket(name);
+    return nil;
+}
+
+// Start a fake S3 server, and give back a factory for buckets on it and a function to stop it.
+func startTestServer(t *testing.T) (s3Factory, func()) {
+    var server *fakes3.Server = fakes3.NewServer();
+    endpoint, err := server.Start("127.0.0.1:0");
+    if (err != nil) {
+        t.Fatalf("Failed to start fake S3: %+v", err);
+    }
+
+    dir, err := ioutil.TempDir("", "elfs-s3-test-");
+    if (err != nil) {
+        server.Close();
+        t.Fatalf("Failed to make temp dir: %+v", err);
+    }
+
+    var cleanup func() = func() {
+        server.Close();
+        os.RemoveAll(dir);
+    };
+
+    var credentialsPath string = filepath.Join(dir, "credentials");
+    err = fakes3.WriteCredentials(credentialsPath, TEST_PROFILE);
+    if (err != nil) {
+        cleanup();
+        t.Fatalf("Failed to write credentials: %+v", err);
+    }
+
+    return s3Factory{server, endpoint, credentialsPath}, cleanup;
+}
+
+func TestConnector(t *testing.T) {
+    factory, cleanup := startTestServer(t);
+    defer cleanup();
+
+    connectortest.Run(t, factory);
+}
+
+type storageClassCase struct {
+    // The class in the file's dirent.
+    fileClass string
+    // The class the object should be put in.
+    expected string
+}
+
+// Files may not be put in an archive class (they could not be read),
+// and quarantined objects keep their class.
+func TestStorageClasses(t *testing.T) {
+    factory, cleanup := startTestServer(t);
+    defer cleanup();
+
+    fsConnector, err := factory.Open("storage-classes", false);
+    if (err != nil) {
+        t.Fatalf("Failed to open connector: %+v", err);
+    }
+    defer fsConnector.Close();
+
+    var s3Connector *S3Connector = fsConnector.(*S3Connector);
+
+    blockCipher, err := aes.NewCipher(util.GenAESKey());
+    if (err != nil) {
+        t.Fatalf("Failed to make cipher: %+v", err);
+    }
+
+    var cases []storageClassCase = []storageClassCase{
+        {"", DEFAULT_DATA_STORAGE_CLASS},
+        {s3.StorageClassOnezoneIa, s3.StorageClassOnezoneIa},
+        {s3.StorageClassGlacier, DEFAULT_DATA_STORAGE_CLASS},
+        {s3.StorageClassDeepArchive, DEFAULT_DATA_STORAGE_CLASS},
+    };
+
+    for _, testCase := range(cases) {
+        var fileInfo *dirent.Dirent = &dirent.Dirent{
+            Id: dirent.NewId(),
+            IsFile: true,
+            IV: util.GenIV(),
+            CipherVersion: cipherio.CURRENT_CIPHER_VERSION,
+            StorageClass: testCase.fileClass,
+        };
+
+        _, _, err = connector.Write(fsConnector, fileInfo, blockCipher, bytes.NewReader(util.RandomBytes(100)));
+        if (err != nil) {
+            t.Fatalf("Failed to write file: %+v", err);
+        }
+
+        var dataPath string = s3Connector.getDataPath(fileInfo);
+        checkTestStorageClass(t, s3Connector, dataPath, testCase.expected);
+
+        err = s3Connector.QuarantineData(fileInfo.Id);
+        if (err != nil) {
+            t.Fatalf("Failed to quarantine file: %+v", err);
+        }
+
+        checkTestStorageClass(t, s3Connector, path.Join(connector.FS_SYS_DIR_QUARANTINE, string(fileInfo.Id)), testCase.expected);
+    }
+}
+
+func checkTestStorageClass(t *testing.T, s3Connector *S3Connector, objectId string, expected string) {
+    head, err := headObject(s3Connector.bucket, objectId, s3Connector.s3Client);
+    if (err != nil) {
+        t.Fatalf("Failed to head (%s): %+v", objectId, err);
+    }
+
+    var storageClass string = aws.StringValue(head.StorageClass);
+    if (storageClass == "") {
+        storageClass = s3.StorageClassStandard;
+    }
+
+    if (storageClass != expected) {
+        t.Fatalf("Object (%s) is in storage class %s, expected %s.", objectId, storageClass, expected);
+    }
+}
+
+// Once an upload is aborted (by the caller or by a failure), writes keep failing.
+func TestWriteAfterAbort(t *testing.T) {
+    factory, cleanup := startTestServer(t);
+    defer cleanup();
+
+    fsConnector, err := factory.Open("write-after-abort", false);
+    if (err != nil) {
+        t.Fatalf("Failed to open connector: %+v", err);
+    }
+    defer fsConnector.Close();
+
+    var s3Connector *S3Connector = fsConnector.(*S3Connector);
+
+    writer, err := NewS3Writer(s3Connector.bucket, "aborted", s3Connector.s3Client, s3.StorageClassStandard, 1);
+    if (err != nil) {
+        t.Fatalf("Failed to make writer: %+v", err);
+    }
+
+    err = writer.Abort();
+    if (err != nil) {
+        t.Fatalf("Failed to abort: %+v", err);
+    }
+
+    _, err = writer.Write(util.RandomBytes(10));
+    if (err == nil) {
+        t.Fatalf("Write after an abort should fail.");
+    }
+
+    // Parts fail once the upload is gone.
+    writer, err = NewS3Writer(s3Connector.bucket, "failed", s3Connector.s3Client, s3.StorageClassStandard, 1);
+    if (err != nil) {
+        t.Fatalf("Failed to make writer: %+v", err);
+    }
+
+    factory.server.RemoveBucket("write-after-abort");
+
+    var uploadErr error = nil;
+    for i := 0; i < 3 && uploadErr == nil; i++ {
+        _, uploadErr = writer.Write(util.RandomBytes(MIN_PART_SIZE));
+    }
+
+    if (uploadErr == nil) {
+        t.Fatalf("Writes to a removed upload should fail.");
+    }
+
+    _, err = writer.Write(util.RandomBytes(10));
+    if (err == nil || errors.Cause(err) != errors.Cause(uploadErr)) {
+        t.Fatalf("Write after a failed upload should give the failure (%v), got: %v.", uploadErr, err);
+    }
+}
+
+// Sweeping uploads younger than the floor could abort ones that are still going.
+func TestSweepMinAge(t *testing.T) {
+    factory, cleanup := startTestServer(t);
+    defer cleanup();
+
+    fsConnector, err := factory.Open("sweep-min-age", false);
+    if (err != nil) {
+        t.Fatalf("Failed to open connector: %+v", err);
+    }
+    defer fsConnector.Close();
+
+    var s3Connector *S3Connector = fsConnector.(*S3Connector);
+
+    var pending *S3Writer;
+    pending, err = NewS3Writer(s3Connector.bucket, path.Join(connector.FS_SYS_DIR_DATA, "pending"), s3Connector.s3Client, s3.StorageClassStandard, 1);
+    if (err == nil) {
+        _, err = pending.Write(util.RandomBytes(MIN_PART_SIZE + 1));
+    }
+
+    if (err != nil) {
+        t.Fatalf("Failed to start upload: %+v", err);
+    }
+    defer pending.Abort();
+
+    for _, minAge := range([]time.Duration{-time.Hour, 0, time.Minute, MIN_STALE_UPLOAD_AGE - time.Second}) {
+        _, err = s3Connector.SweepStaleUploads(minAge);
+        if (err == nil) {
+            t.Fatalf("Swept uploads younger than %s.", minAge);
+        }
+    }
+
+    report, err := s3Connector.SweepStaleUploads(MIN_STALE_UPLOAD_AGE);
+    if (err != nil || report.Aborted != 0 || report.Skipped != 1) {
+        t.Fatalf("Bad sweep (%+v): %+v", report, err);
+    }
+}
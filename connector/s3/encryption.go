@@ -0,0 +1,111 @@
+package s3;
+
+// Server-side encryption (SSE) for the objects in a bucket.
+// This is on top of the filesystem's own encryption, for buckets with policies that demand it.
+//
+// SSE-S3 has S3 encrypt objects with its own keys, so it only needs to be asked for when writing.
+// SSE-C has S3 encrypt objects with a key that we give it (and that S3 does not keep),
+// so the key must be sent with every request that reads or writes an object.
+// The SDK will only send SSE-C keys over https.
+//
+// The SSE headers are added to requests by a handler on the client,
+// so the connector's readers and writers do not need to know about them.
+
+import (
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/request"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "github.com/pkg/errors"
+)
+
+const (
+    SSE_NONE = ""
+    SSE_S3 = "sse-s3"
+    SSE_C = "sse-c"
+
+    SSE_C_KEY_LENGTH = 32
+
+    // The only algorithm S3 has for both kinds of SSE.
+    SSE_ALGORITHM = "AES256"
+)
+
+type ServerSideEncryption struct {
+    // SSE_NONE, SSE_S3, or SSE_C.
+    Mode string
+    // The 256-bit key for SSE_C.
+    // Objects cannot be read without it, and S3 cannot recover it.
+    CustomerKey []byte
+}
+
+func (this ServerSideEncryption) validate() error {
+    switch this.Mode {
+        case SSE_NONE, SSE_S3:
+            if (len(this.CustomerKey) != 0) {
+                return errors.Errorf("A customer key can only be used with %s.", SSE_C);
+            }
+        case SSE_C:
+            if (len(this.CustomerKey) != SSE_C_KEY_LENGTH) {
+                return errors.Errorf("%s keys must be %d bytes, got %d.", SSE_C, SSE_C_KEY_LENGTH, len(this.CustomerKey));
+            }
+        default:
+            return errors.Errorf("Unknown server-side encryption: '%s'.", this.Mode);
+    }
+
+    return nil;
+}
+
+// Add the SSE parameters to a request.
+// This runs before the SDK validates the request, so the SDK still checks for https and fills in the key's md5.
+func (this ServerSideEncryption) apply(awsRequest *request.Request) {
+    if (this.Mode == SSE_S3) {
+        switch params := awsRequest.Params.(type) {
+            case *s3.PutObjectInput:
+                params.ServerSideEncryption = aws.String(SSE_ALGORITHM);
+            case *s3.CreateMultipartUploadInput:
+                params.ServerSideEncryption = aws.String(SSE_ALGORITHM);
+            case *s3.CopyObjectInput:
+                params.ServerSideEncryption = aws.String(SSE_ALGORITHM);
+        }
+
+        return;
+    }
+
+    if (this.Mode != SSE_C) {
+        return;
+    }
+
+    var algorithm *string = aws.String(SSE_ALGORITHM);
+    var key *string = aws.String(string(this.CustomerKey));
+
+    switch params := awsRequest.Params.(type) {
+        case *s3.GetObjectInput:
+            params.SSECustomerAlgorithm, params.SSECustomerKey = algorithm, key;
+        case *s3.HeadObjectInput:
+            params.SSECustomerAlgorithm, params.SSECustomerKey = algorithm, key;
+        case *s3.PutObjectInput:
+            params.SSECustomerAlgorithm, params.SSECustomerKey = algorithm, key;
+        case *s3.CreateMultipartUploadInput:
+            params.SSECustomerAlgorithm, params.SSECustomerKey = algorithm, key;
+        case *s3.UploadPartInput:
+            params.SSECustomerAlgorithm, params.SSECustomerKey = algorithm, key;
+        // Copies read an object (with the key) and write one (with the same key).
+        case *s3.UploadPartCopyInput:
+            params.SSECustomerAlgorithm, params.SSECustomerKey = algorithm, key;
+            params.CopySourceSSECustomerAlgorithm, params.CopySourceSSECustomerKey = algorithm, key;
+        case *s3.CopyObjectInput:
+            params.SSECustomerAlgorithm, params.SSECustomerKey = algorithm, key;
+            params.CopySourceSSECustomerAlgorithm, params.CopySourceSSECustomerKey = algorithm, key;
+    }
+}
+
+// Have |s3Client| add the SSE parameters to all of its requests.
+func (this ServerSideEncryption) install(s3Client *s3.S3) {
+    if (this.Mode == SSE_NONE) {
+        return;
+    }
+
+    s3Client.Handlers.Validate.PushFrontNamed(request.NamedHandler{
+        Name: "elfs.ServerSideEncryption",
+        Fn: this.apply,
+    });
+}
@@ -0,0 +1,59 @@
+package fakes3;
+
+// Conditional writes (If-Match and If-None-Match on PUT and DELETE).
+// The conditions are checked under the server's lock along with the write,
+// so only one of two racing writes can pass.
+
+import (
+    "net/http"
+    "strings"
+)
+
+// Check an object (nil if there is none) against the request's conditions.
+// Returns the error status, code, and message; or zero if the conditions hold.
+func checkConditions(existing *object, request *http.Request) (int, string, string) {
+    var ifMatch string = request.Header.Get("If-Match");
+    var ifNoneMatch string = request.Header.Get("If-None-Match");
+
+    if (ifNoneMatch != "") {
+        if (ifNoneMatch != "*") {
+            return http.StatusNotImplemented, "NotImplemented", "A header you provided implies functionality that is not implemented";
+        }
+
+        if (existing != nil) {
+            return http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold";
+        }
+    }
+
+    if (ifMatch != "") {
+        if (existing == nil) {
+            return http.StatusNotFound, "NoSuchKey", "The specified key does not exist.";
+        }
+
+        if (ifMatch != "*" && strings.Trim(ifMatch, "\"") != existing.etag) {
+            return http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold";
+        }
+    }
+
+    return 0, "", "";
+}
+
+// Store an object if the request's conditions hold.
+// Returns the error status, code, and message; or zero if the object was stored.
+func (this *Server) storeObjectIf(bucketName string, key string, newObject *object, request *http.Request) (int, string, string) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    bucket, ok := this.buckets[bucketName];
+    if (!ok) {
+        return http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.";
+    }
+
+    status, code, message := checkConditions(bucket.objects[key], request);
+    if (status != 0) {
+        return status, code, message;
+    }
+
+    bucket.objects[key] = newObject;
+    return 0, "", "";
+}
@@ -0,0 +1,117 @@
+package fakes3;
+
+// Server-side encryption.
+// Nothing is actually encrypted, but the SSE headers are checked like S3 does:
+// an SSE-C object can only be read (or copied) with the key it was written with.
+
+import (
+    "crypto/md5"
+    "encoding/base64"
+    "net/http"
+)
+
+const (
+    SSE_HEADER = "x-amz-server-side-encryption"
+    SSE_CUSTOMER_PREFIX = "x-amz-server-side-encryption-customer-"
+    COPY_SOURCE_SSE_CUSTOMER_PREFIX = "x-amz-copy-source-server-side-encryption-customer-"
+
+    SSE_ALGORITHM = "AES256"
+    SSE_CUSTOMER_KEY_LENGTH = 32
+)
+
+type encryption struct {
+    // SSE_ALGORITHM for SSE-S3, empty otherwise.
+    algorithm string
+    // The (base64) md5 of the SSE-C key, empty if the object does not use SSE-C.
+    customerKeyMd5 string
+}
+
+// Get the encryption that a write asks for.
+// On failure, the error has already been written.
+func (this *Server) readEncryption(response http.ResponseWriter, request *http.Request) (encryption, bool) {
+    var algorithm string = request.Header.Get(SSE_HEADER);
+    if (algorithm != "" && algorithm != SSE_ALGORITHM) {
+        this.writeError(response, request, http.StatusBadRequest, "InvalidArgument", "The encryption method specified is not supported");
+        return encryption{}, false;
+    }
+
+    customerKeyMd5, ok := this.readCustomerKey(response, request, SSE_CUSTOMER_PREFIX);
+    if (!ok) {
+        return encryption{}, false;
+    }
+
+    if (algorithm != "" && customerKeyMd5 != "") {
+        this.writeError(response, request, http.StatusBadRequest, "InvalidArgument", "Server Side Encryption with Customer provided key is incompatible with the encryption method specified");
+        return encryption{}, false;
+    }
+
+    return encryption{algorithm, customerKeyMd5}, true;
+}
+
+// Get the md5 of the SSE-C key in the headers that start with |prefix| (empty if there is no key).
+// On failure, the error has already been written.
+func (this *Server) readCustomerKey(response http.ResponseWriter, request *http.Request, prefix string) (string, bool) {
+    var algorithm string = request.Header.Get(prefix + "algorithm");
+    var encodedKey string = request.Header.Get(prefix + "key");
+    var keyMd5 string = request.Header.Get(prefix + "key-MD5");
+
+    if (algorithm == "" && encodedKey == "" && keyMd5 == "") {
+        return "", true;
+    }
+
+    if (algorithm != SSE_ALGORITHM) {
+        this.writeError(response, request, http.StatusBadRequest, "InvalidEncryptionAlgorithmError", "The encryption request you specified is not valid. The valid value is AES256.");
+        return "", false;
+    }
+
+    key, err := base64.StdEncoding.DecodeString(encodedKey);
+    if (err != nil || len(key) != SSE_CUSTOMER_KEY_LENGTH) {
+        this.writeError(response, request, http.StatusBadRequest, "InvalidArgument", "The secret key was invalid for the specified algorithm.");
+        return "", false;
+    }
+
+    var hash [md5.Size]byte = md5.Sum(key);
+    if (keyMd5 != base64.StdEncoding.EncodeToString(hash[:])) {
+        this.writeError(response, request, http.StatusBadRequest, "InvalidArgument", "The calculated MD5 hash of the key did not match the hash that was provided.");
+        return "", false;
+    }
+
+    return keyMd5, true;
+}
+
+// Check that a request that reads an object has the object's SSE-C key (in the headers that start with |prefix|).
+// On failure, the error has already been written.
+func (this *Server) checkCustomerKey(response http.ResponseWriter, request *http.Request, headOnly bool, prefix string, objectEncryption encryption) bool {
+    customerKeyMd5, ok := this.readCustomerKey(response, request, prefix);
+    if (!ok) {
+        return false;
+    }
+
+    if (objectEncryption.customerKeyMd5 == "" && customerKeyMd5 != "") {
+        this.writeHeadAwareError(response, request, headOnly, http.StatusBadRequest, "InvalidRequest", "The encryption parameters are not applicable to this object.");
+        return false;
+    }
+
+    if (objectEncryption.customerKeyMd5 != "" && customerKeyMd5 == "") {
+        this.writeHeadAwareError(response, request, headOnly, http.StatusBadRequest, "InvalidRequest", "The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object.");
+        return false;
+    }
+
+    if (objectEncryption.customerKeyMd5 != customerKeyMd5) {
+        this.writeHeadAwareError(response, request, headOnly, http.StatusForbidden, "AccessDenied", "Access Denied");
+        return false;
+    }
+
+    return true;
+}
+
+func writeEncryptionHeaders(response http.ResponseWriter, objectEncryption encryption) {
+    if (objectEncryption.algorithm != "") {
+        response.Header().Set(SSE_HEADER, objectEncryption.algorithm);
+    }
+
+    if (objectEncryption.customerKeyMd5 != "") {
+        response.Header().Set(SSE_CUSTOMER_PREFIX + "algorithm", SSE_ALGORITHM);
+        response.Header().Set(SSE_CUSTOMER_PREFIX + "key-MD5", objectEncryption.customerKeyMd5);
+    }
+}
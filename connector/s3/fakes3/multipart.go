@@ -0,0 +1,541 @@
+package fakes3;
+
+// Multipart uploads.
+// Parts are held by the upload until it is completed (or aborted), just like S3.
+
+import (
+    "crypto/md5"
+    "encoding/hex"
+    "encoding/xml"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+    MIN_PART_NUMBER = 1
+    MAX_PART_NUMBER = 10000
+    MAX_LIST_UPLOADS = 1000
+    MAX_LIST_PARTS = 1000
+)
+
+type upload struct {
+    id string
+    bucket string
+    key string
+    initiated time.Time
+    // Kept from the create request and given to the final object.
+    storageClass string
+    contentType string
+    encryption encryption
+    parts map[int64]*part
+}
+
+type part struct {
+    data []byte
+    etag string
+}
+
+type initiateUploadResult struct {
+    XMLName xml.Name `xml:"InitiateMultipartUploadResult"`
+    Xmlns string `xml:"xmlns,attr"`
+    Bucket string `xml:"Bucket"`
+    Key string `xml:"Key"`
+    UploadId string `xml:"UploadId"`
+}
+
+type copyPartResult struct {
+    XMLName xml.Name `xml:"CopyPartResult"`
+    ETag string `xml:"ETag"`
+    LastModified string `xml:"LastModified"`
+}
+
+type completeUploadRequest struct {
+    XMLName xml.Name `xml:"CompleteMultipartUpload"`
+    Parts []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+    PartNumber int64 `xml:"PartNumber"`
+    ETag string `xml:"ETag"`
+}
+
+type completeUploadResult struct {
+    XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+    Xmlns string `xml:"xmlns,attr"`
+    Location string `xml:"Location"`
+    Bucket string `xml:"Bucket"`
+    Key string `xml:"Key"`
+    ETag string `xml:"ETag"`
+}
+
+type listUploadsResult struct {
+    XMLName xml.Name `xml:"ListMultipartUploadsResult"`
+    Xmlns string `xml:"xmlns,attr"`
+    Bucket string `xml:"Bucket"`
+    KeyMarker string `xml:"KeyMarker"`
+    UploadIdMarker string `xml:"UploadIdMarker"`
+    NextKeyMarker string `xml:"NextKeyMarker,omitempty"`
+    NextUploadIdMarker string `xml:"NextUploadIdMarker,omitempty"`
+    Prefix string `xml:"Prefix"`
+    MaxUploads int `xml:"MaxUploads"`
+    IsTruncated bool `xml:"IsTruncated"`
+    Uploads []listUploadEntry `xml:"Upload"`
+}
+
+type listUploadEntry struct {
+    Key string `xml:"Key"`
+    UploadId string `xml:"UploadId"`
+    Initiated string `xml:"Initiated"`
+    StorageClass string `xml:"StorageClass"`
+}
+
+type listPartsResult struct {
+    XMLName xml.Name `xml:"ListPartsResult"`
+    Xmlns string `xml:"xmlns,attr"`
+    Bucket string `xml:"Bucket"`
+    Key string `xml:"Key"`
+    UploadId string `xml:"UploadId"`
+    PartNumberMarker int64 `xml:"PartNumberMarker"`
+    NextPartNumberMarker int64 `xml:"NextPartNumberMarker"`
+    MaxParts int `xml:"MaxParts"`
+    IsTruncated bool `xml:"IsTruncated"`
+    StorageClass string `xml:"StorageClass"`
+    Parts []listPartEntry `xml:"Part"`
+}
+
+type listPartEntry struct {
+    PartNumber int64 `xml:"PartNumber"`
+    LastModified string `xml:"LastModified"`
+    ETag string `xml:"ETag"`
+    Size int64 `xml:"Size"`
+}
+
+func (this *Server) createUpload(response http.ResponseWriter, request *http.Request, bucketName string, key string) {
+    objectEncryption, ok := this.readEncryption(response, request);
+    if (!ok) {
+        return;
+    }
+
+    // Borrow the defaults from a new object.
+    var template *object = newObject(nil, "", request);
+
+    var newUpload upload = upload{
+        id: util.RandomString(UPLOAD_ID_LENGTH),
+        bucket: bucketName,
+        key: key,
+        initiated: time.Now().UTC(),
+        storageClass: template.storageClass,
+        contentType: template.contentType,
+        encryption: objectEncryption,
+        parts: make(map[int64]*part),
+    };
+
+    this.lock.Lock();
+    _, ok = this.buckets[bucketName];
+    if (ok) {
+        this.uploads[newUpload.id] = &newUpload;
+    }
+    this.lock.Unlock();
+
+    if (!ok) {
+        this.writeError(response, request, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.");
+        return;
+    }
+
+    writeEncryptionHeaders(response, objectEncryption);
+    this.writeXML(response, http.StatusOK, &initiateUploadResult{
+        Xmlns: S3_XMLNS,
+        Bucket: bucketName,
+        Key: key,
+        UploadId: newUpload.id,
+    });
+}
+
+// Handles both UploadPart and UploadPartCopy.
+func (this *Server) uploadPart(response http.ResponseWriter, request *http.Request, bucketName string, key string, uploadId string) {
+    partNumber, err := strconv.ParseInt(request.URL.Query().Get("partNumber"), 10, 64);
+    if (err != nil || partNumber < MIN_PART_NUMBER || partNumber > MAX_PART_NUMBER) {
+        this.writeError(response, request, http.StatusBadRequest, "InvalidArgument",
+                fmt.Sprintf("Part number must be an integer between %d and %d, inclusive", MIN_PART_NUMBER, MAX_PART_NUMBER));
+        return;
+    }
+
+    // Parts must be sent with the upload's SSE-C key.
+    this.lock.Lock();
+    activeUpload := this.getUpload(bucketName, key, uploadId);
+    var uploadEncryption encryption;
+    if (activeUpload != nil) {
+        uploadEncryption = activeUpload.encryption;
+    }
+    this.lock.Unlock();
+
+    if (activeUpload == nil) {
+        this.writeNoSuchUpload(response, request);
+        return;
+    }
+
+    if (!this.checkCustomerKey(response, request, false, SSE_CUSTOMER_PREFIX, encryption{"", uploadEncryption.customerKeyMd5})) {
+        return;
+    }
+
+    var data []byte;
+    var isCopy bool = request.Header.Get("x-amz-copy-source") != "";
+
+    if (isCopy) {
+        var ok bool;
+        data, ok = this.readCopySource(response, request);
+        if (!ok) {
+            return;
+        }
+    } else {
+        data, err = ioutil.ReadAll(request.Body);
+        if (err != nil) {
+            this.writeError(response, request, http.StatusBadRequest, "IncompleteBody", err.Error());
+            return;
+        }
+    }
+
+    var newPart part = part{
+        data: data,
+        etag: md5Hex(data),
+    };
+
+    // The upload may have gone away while the part was being read.
+    this.lock.Lock();
+    activeUpload = this.getUpload(bucketName, key, uploadId);
+    if (activeUpload != nil) {
+        activeUpload.parts[partNumber] = &newPart;
+    }
+    this.lock.Unlock();
+
+    if (activeUpload == nil) {
+        this.writeNoSuchUpload(response, request);
+        return;
+    }
+
+    writeEncryptionHeaders(response, uploadEncryption);
+
+    if (isCopy) {
+        this.writeXML(response, http.StatusOK, &copyPartResult{
+            ETag: quote(newPart.etag),
+            LastModified: time.Now().UTC().Format(XML_TIME_FORMAT),
+        });
+        return;
+    }
+
+    response.Header().Set("ETag", quote(newPart.etag));
+    response.WriteHeader(http.StatusOK);
+}
+
+// Get the (possibly ranged) data for a part copy.
+// On failure, the error has already been written.
+func (this *Server) readCopySource(response http.ResponseWriter, request *http.Request) ([]byte, bool) {
+    sourceBucket, sourceKey, ok := parseCopySource(request.Header.Get("x-amz-copy-source"));
+    if (!ok) {
+        this.writeError(response, request, http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey");
+        return nil, false;
+    }
+
+    source, code, message := this.lookupObject(sourceBucket, sourceKey);
+    if (source == nil) {
+        this.writeError(response, request, http.StatusNotFound, code, message);
+        return nil, false;
+    }
+
+    if (!this.checkCustomerKey(response, request, false, COPY_SOURCE_SSE_CUSTOMER_PREFIX, source.encryption)) {
+        return nil, false;
+    }
+
+    var rangeHeader string = request.Header.Get("x-amz-copy-source-range");
+    if (rangeHeader == "") {
+        return source.data, true;
+    }
+
+    start, end, ok := parseRange(rangeHeader, int64(len(source.data)));
+    if (!ok) {
+        this.writeError(response, request, http.StatusBadRequest, "InvalidArgument", "The x-amz-copy-source-range value must be of the form bytes=first-last where first and last are the zero-based offsets of the first and last bytes to copy");
+        return nil, false;
+    }
+
+    return source.data[start:end], true;
+}
+
+func (this *Server) completeUpload(response http.ResponseWriter, request *http.Request, bucketName string, key string, uploadId string) {
+    body, err := ioutil.ReadAll(request.Body);
+    if (err != nil) {
+        this.writeError(response, request, http.StatusBadRequest, "IncompleteBody", err.Error());
+        return;
+    }
+
+    var completeRequest completeUploadRequest;
+    err = xml.Unmarshal(body, &completeRequest);
+    if (err != nil || len(completeRequest.Parts) == 0) {
+        this.writeError(response, request, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema.");
+        return;
+    }
+
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    activeUpload := this.getUpload(bucketName, key, uploadId);
+    if (activeUpload == nil) {
+        this.writeNoSuchUpload(response, request);
+        return;
+    }
+
+    bucket, ok := this.buckets[bucketName];
+    if (!ok) {
+        this.writeError(response, request, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.");
+        return;
+    }
+
+    var data []byte = make([]byte, 0);
+    var partHashes []byte = make([]byte, 0, md5.Size * len(completeRequest.Parts));
+    var lastPartNumber int64 = 0;
+
+    for i, requestPart := range(completeRequest.Parts) {
+        if (requestPart.PartNumber <= lastPartNumber) {
+            this.writeError(response, request, http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order. The parts list must be specified in order by part number.");
+            return;
+        }
+        lastPartNumber = requestPart.PartNumber;
+
+        uploadedPart, ok := activeUpload.parts[requestPart.PartNumber];
+        if (!ok || quote(uploadedPart.etag) != requestPart.ETag) {
+            this.writeError(response, request, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found. The part might not have been uploaded, or the specified entity tag might not have matched the part's entity tag.");
+            return;
+        }
+
+        if (i != len(completeRequest.Parts) - 1 && len(uploadedPart.data) < MIN_PART_SIZE) {
+            this.writeError(response, request, http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size.");
+            return;
+        }
+
+        data = append(data, uploadedPart.data...);
+
+        partHash, _ := hex.DecodeString(uploadedPart.etag);
+        partHashes = append(partHashes, partHash...);
+    }
+
+    // Multipart ETags are the hash of the part hashes, and the number of parts.
+    var etag string = fmt.Sprintf("%s-%d", md5Hex(partHashes), len(completeRequest.Parts));
+
+    bucket.objects[key] = &object{
+        data: data,
+        etag: etag,
+        modTime: time.Now().UTC().Truncate(time.Second),
+        storageClass: activeUpload.storageClass,
+        contentType: activeUpload.contentType,
+        encryption: activeUpload.encryption,
+    };
+
+    delete(this.uploads, uploadId);
+
+    this.writeXML(response, http.StatusOK, &completeUploadResult{
+        Xmlns: S3_XMLNS,
+        Location: "/" + bucketName + "/" + key,
+        Bucket: bucketName,
+        Key: key,
+        ETag: quote(etag),
+    });
+}
+
+func (this *Server) abortUpload(response http.ResponseWriter, request *http.Request, bucketName string, key string, uploadId string) {
+    this.lock.Lock();
+    activeUpload := this.getUpload(bucketName, key, uploadId);
+    if (activeUpload != nil) {
+        delete(this.uploads, uploadId);
+    }
+    this.lock.Unlock();
+
+    if (activeUpload == nil) {
+        this.writeNoSuchUpload(response, request);
+        return;
+    }
+
+    response.WriteHeader(http.StatusNoContent);
+}
+
+// The caller must hold the lock.
+func (this *Server) getUpload(bucketName string, key string, uploadId string) *upload {
+    activeUpload, ok := this.uploads[uploadId];
+    if (!ok || activeUpload.bucket != bucketName || activeUpload.key != key) {
+        return nil;
+    }
+
+    return activeUpload;
+}
+
+func (this *Server) writeNoSuchUpload(response http.ResponseWriter, request *http.Request) {
+    this.writeError(response, request, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist. The upload ID may be invalid, or the upload may have been aborted or completed.");
+}
+
+// Uploads are listed in order of key, and then upload id.
+// Delimiters are not supported.
+func (this *Server) listUploads(response http.ResponseWriter, request *http.Request, bucketName string) {
+    var query = request.URL.Query();
+
+    var result listUploadsResult = listUploadsResult{
+        Xmlns: S3_XMLNS,
+        Bucket: bucketName,
+        KeyMarker: query.Get("key-marker"),
+        UploadIdMarker: query.Get("upload-id-marker"),
+        Prefix: query.Get("prefix"),
+        MaxUploads: MAX_LIST_UPLOADS,
+        Uploads: make([]listUploadEntry, 0),
+    };
+
+    if (query.Get("max-uploads") != "") {
+        maxUploads, err := strconv.Atoi(query.Get("max-uploads"));
+        if (err != nil || maxUploads < 0) {
+            this.writeError(response, request, http.StatusBadRequest, "InvalidArgument", "Invalid max-uploads.");
+            return;
+        }
+
+        if (maxUploads < MAX_LIST_UPLOADS) {
+            result.MaxUploads = maxUploads;
+        }
+    }
+
+    this.lock.Lock();
+    _, ok := this.buckets[bucketName];
+    var uploads []upload = make([]upload, 0);
+    if (ok) {
+        for _, activeUpload := range(this.uploads) {
+            if (activeUpload.bucket == bucketName && strings.HasPrefix(activeUpload.key, result.Prefix) &&
+                    afterUploadMarker(activeUpload, result.KeyMarker, result.UploadIdMarker)) {
+                uploads = append(uploads, *activeUpload);
+            }
+        }
+    }
+    this.lock.Unlock();
+
+    if (!ok) {
+        this.writeError(response, request, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.");
+        return;
+    }
+
+    sort.Slice(uploads, func(i int, j int) bool {
+        if (uploads[i].key != uploads[j].key) {
+            return uploads[i].key < uploads[j].key;
+        }
+
+        return uploads[i].id < uploads[j].id;
+    });
+
+    for _, activeUpload := range(uploads) {
+        if (len(result.Uploads) >= result.MaxUploads) {
+            result.IsTruncated = true;
+            break;
+        }
+
+        result.Uploads = append(result.Uploads, listUploadEntry{
+            Key: activeUpload.key,
+            UploadId: activeUpload.id,
+            Initiated: activeUpload.initiated.Format(XML_TIME_FORMAT),
+            StorageClass: activeUpload.storageClass,
+        });
+
+        result.NextKeyMarker = activeUpload.key;
+        result.NextUploadIdMarker = activeUpload.id;
+    }
+
+    this.writeXML(response, http.StatusOK, &result);
+}
+
+// Without an upload id marker, the key marker skips every upload for that key.
+func afterUploadMarker(activeUpload *upload, keyMarker string, uploadIdMarker string) bool {
+    if (uploadIdMarker == "" || activeUpload.key != keyMarker) {
+        return activeUpload.key > keyMarker;
+    }
+
+    return activeUpload.id > uploadIdMarker;
+}
+
+func (this *Server) listParts(response http.ResponseWriter, request *http.Request, bucketName string, key string, uploadId string) {
+    var query = request.URL.Query();
+
+    var result listPartsResult = listPartsResult{
+        Xmlns: S3_XMLNS,
+        Bucket: bucketName,
+        Key: key,
+        UploadId: uploadId,
+        MaxParts: MAX_LIST_PARTS,
+        Parts: make([]listPartEntry, 0),
+    };
+
+    if (query.Get("part-number-marker") != "") {
+        marker, err := strconv.ParseInt(query.Get("part-number-marker"), 10, 64);
+        if (err != nil || marker < 0) {
+            this.writeError(response, request, http.StatusBadRequest, "InvalidArgument", "Invalid part-number-marker.");
+            return;
+        }
+
+        result.PartNumberMarker = marker;
+    }
+
+    if (query.Get("max-parts") != "") {
+        maxParts, err := strconv.Atoi(query.Get("max-parts"));
+        if (err != nil || maxParts < 0) {
+            this.writeError(response, request, http.StatusBadRequest, "InvalidArgument", "Invalid max-parts.");
+            return;
+        }
+
+        if (maxParts < MAX_LIST_PARTS) {
+            result.MaxParts = maxParts;
+        }
+    }
+
+    this.lock.Lock();
+    activeUpload := this.getUpload(bucketName, key, uploadId);
+    var partNumbers []int64 = make([]int64, 0);
+    var parts map[int64]*part = make(map[int64]*part);
+    var initiated time.Time;
+    if (activeUpload != nil) {
+        result.StorageClass = activeUpload.storageClass;
+        initiated = activeUpload.initiated;
+
+        for partNumber, uploadedPart := range(activeUpload.parts) {
+            if (partNumber > result.PartNumberMarker) {
+                partNumbers = append(partNumbers, partNumber);
+                parts[partNumber] = uploadedPart;
+            }
+        }
+    }
+    this.lock.Unlock();
+
+    if (activeUpload == nil) {
+        this.writeNoSuchUpload(response, request);
+        return;
+    }
+
+    sort.Slice(partNumbers, func(i int, j int) bool {
+        return partNumbers[i] < partNumbers[j];
+    });
+
+    for _, partNumber := range(partNumbers) {
+        if (len(result.Parts) >= result.MaxParts) {
+            result.IsTruncated = true;
+            break;
+        }
+
+        result.Parts = append(result.Parts, listPartEntry{
+            PartNumber: partNumber,
+            // Parts do not keep their own time.
+            LastModified: initiated.Format(XML_TIME_FORMAT),
+            ETag: quote(parts[partNumber].etag),
+            Size: int64(len(parts[partNumber].data)),
+        });
+
+        result.NextPartNumberMarker = partNumber;
+    }
+
+    this.writeXML(response, http.StatusOK, &result);
+}
@@ -0,0 +1,478 @@
+package fakes3;
+
+// Single object operations and listing.
+
+import (
+    "crypto/md5"
+    "encoding/hex"
+    "encoding/xml"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    S3_XMLNS = "http://s3.amazonaws.com/doc/2006-03-01/"
+    DEFAULT_STORAGE_CLASS = "STANDARD"
+    DEFAULT_CONTENT_TYPE = "binary/octet-stream"
+    XML_TIME_FORMAT = "2006-01-02T15:04:05.000Z"
+)
+
+type errorResult struct {
+    XMLName xml.Name `xml:"Error"`
+    Code string `xml:"Code"`
+    Message string `xml:"Message"`
+    Resource string `xml:"Resource"`
+    RequestId string `xml:"RequestId"`
+}
+
+type copyObjectResult struct {
+    XMLName xml.Name `xml:"CopyObjectResult"`
+    ETag string `xml:"ETag"`
+    LastModified string `xml:"LastModified"`
+}
+
+type listBucketResult struct {
+    XMLName xml.Name `xml:"ListBucketResult"`
+    Xmlns string `xml:"xmlns,attr"`
+    Name string `xml:"Name"`
+    Prefix string `xml:"Prefix"`
+    Delimiter string `xml:"Delimiter,omitempty"`
+    StartAfter string `xml:"StartAfter,omitempty"`
+    ContinuationToken string `xml:"ContinuationToken,omitempty"`
+    NextContinuationToken string `xml:"NextContinuationToken,omitempty"`
+    KeyCount int `xml:"KeyCount"`
+    MaxKeys int `xml:"MaxKeys"`
+    IsTruncated bool `xml:"IsTruncated"`
+    Contents []listEntry `xml:"Contents"`
+    CommonPrefixes []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type listEntry struct {
+    Key string `xml:"Key"`
+    LastModified string `xml:"LastModified"`
+    ETag string `xml:"ETag"`
+    Size int64 `xml:"Size"`
+    StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+    Prefix string `xml:"Prefix"`
+}
+
+func newObject(data []byte, etag string, request *http.Request) *object {
+    var storageClass string = request.Header.Get("x-amz-storage-class");
+    if (storageClass == "") {
+        storageClass = DEFAULT_STORAGE_CLASS;
+    }
+
+    var contentType string = request.Header.Get("Content-Type");
+    if (contentType == "") {
+        contentType = DEFAULT_CONTENT_TYPE;
+    }
+
+    return &object{
+        data: data,
+        etag: etag,
+        // S3 only keeps seconds.
+        modTime: time.Now().UTC().Truncate(time.Second),
+        storageClass: storageClass,
+        contentType: contentType,
+    };
+}
+
+func (this *Server) getObject(response http.ResponseWriter, request *http.Request, bucketName string, key string, headOnly bool) {
+    object, code, message := this.lookupObject(bucketName, key);
+    if (object == nil) {
+        this.writeHeadAwareError(response, request, headOnly, http.StatusNotFound, code, message);
+        return;
+    }
+
+    if (!this.checkCustomerKey(response, request, headOnly, SSE_CUSTOMER_PREFIX, object.encryption)) {
+        return;
+    }
+
+    var size int64 = int64(len(object.data));
+    var start int64 = 0;
+    var end int64 = size;
+    var status int = http.StatusOK;
+
+    var rangeHeader string = request.Header.Get("Range");
+    if (rangeHeader != "") {
+        var ok bool;
+        start, end, ok = parseRange(rangeHeader, size);
+        if (!ok) {
+            response.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size));
+            this.writeHeadAwareError(response, request, headOnly, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable");
+            return;
+        }
+
+        status = http.StatusPartialContent;
+        response.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end - 1, size));
+    }
+
+    response.Header().Set("Content-Length", strconv.FormatInt(end - start, 10));
+    response.Header().Set("Content-Type", object.contentType);
+    response.Header().Set("ETag", quote(object.etag));
+    response.Header().Set("Last-Modified", object.modTime.Format(http.TimeFormat));
+    response.Header().Set("Accept-Ranges", "bytes");
+
+    // S3 leaves out the header for the standard class.
+    if (object.storageClass != DEFAULT_STORAGE_CLASS) {
+        response.Header().Set("x-amz-storage-class", object.storageClass);
+    }
+
+    writeEncryptionHeaders(response, object.encryption);
+
+    response.WriteHeader(status);
+
+    if (!headOnly) {
+        response.Write(object.data[start:end]);
+    }
+}
+
+func (this *Server) putObject(response http.ResponseWriter, request *http.Request, bucketName string, key string) {
+    objectEncryption, ok := this.readEncryption(response, request);
+    if (!ok) {
+        return;
+    }
+
+    data, err := ioutil.ReadAll(request.Body);
+    if (err != nil) {
+        this.writeError(response, request, http.StatusBadRequest, "IncompleteBody", err.Error());
+        return;
+    }
+
+    var etag string = md5Hex(data);
+    var newObject *object = newObject(data, etag, request);
+    newObject.encryption = objectEncryption;
+
+    status, code, message := this.storeObjectIf(bucketName, key, newObject, request);
+    if (status != 0) {
+        this.writeError(response, request, status, code, message);
+        return;
+    }
+
+    writeEncryptionHeaders(response, objectEncryption);
+    response.Header().Set("ETag", quote(etag));
+    response.WriteHeader(http.StatusOK);
+}
+
+func (this *Server) copyObject(response http.ResponseWriter, request *http.Request, bucketName string, key string) {
+    sourceBucket, sourceKey, ok := parseCopySource(request.Header.Get("x-amz-copy-source"));
+    if (!ok) {
+        this.writeError(response, request, http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey");
+        return;
+    }
+
+    source, code, message := this.lookupObject(sourceBucket, sourceKey);
+    if (source == nil) {
+        this.writeError(response, request, http.StatusNotFound, code, message);
+        return;
+    }
+
+    if (!this.checkCustomerKey(response, request, false, COPY_SOURCE_SSE_CUSTOMER_PREFIX, source.encryption)) {
+        return;
+    }
+
+    // Like S3, the copy is only encrypted if asked (whatever the source was).
+    objectEncryption, ok := this.readEncryption(response, request);
+    if (!ok) {
+        return;
+    }
+
+    var copied *object = newObject(source.data, source.etag, request);
+    copied.encryption = objectEncryption;
+
+    // Unless told to replace it, the metadata comes along with the data.
+    if (request.Header.Get("x-amz-metadata-directive") != "REPLACE") {
+        copied.contentType = source.contentType;
+    }
+
+    if (request.Header.Get("x-amz-storage-class") == "") {
+        copied.storageClass = source.storageClass;
+    }
+
+    if (!this.storeObject(bucketName, key, copied)) {
+        this.writeError(response, request, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.");
+        return;
+    }
+
+    writeEncryptionHeaders(response, objectEncryption);
+    this.writeXML(response, http.StatusOK, &copyObjectResult{
+        ETag: quote(copied.etag),
+        LastModified: copied.modTime.Format(XML_TIME_FORMAT),
+    });
+}
+
+// Like S3, deleting a missing key is not an error (unless the delete is conditional).
+func (this *Server) deleteObject(response http.ResponseWriter, request *http.Request, bucketName string, key string) {
+    var status int = 0;
+    var code string = "";
+    var message string = "";
+
+    this.lock.Lock();
+    bucket, ok := this.buckets[bucketName];
+    if (!ok) {
+        status, code, message = http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.";
+    } else {
+        status, code, message = checkConditions(bucket.objects[key], request);
+        if (status == 0) {
+            delete(bucket.objects, key);
+        }
+    }
+    this.lock.Unlock();
+
+    if (status != 0) {
+        this.writeError(response, request, status, code, message);
+        return;
+    }
+
+    response.WriteHeader(http.StatusNoContent);
+}
+
+func (this *Server) listObjects(response http.ResponseWriter, request *http.Request, bucketName string) {
+    var query = request.URL.Query();
+
+    var result listBucketResult = listBucketResult{
+        Xmlns: S3_XMLNS,
+        Name: bucketName,
+        Prefix: query.Get("prefix"),
+        Delimiter: query.Get("delimiter"),
+        StartAfter: query.Get("start-after"),
+        ContinuationToken: query.Get("continuation-token"),
+        MaxKeys: MAX_LIST_KEYS,
+        Contents: make([]listEntry, 0),
+        CommonPrefixes: make([]commonPrefix, 0),
+    };
+
+    if (query.Get("max-keys") != "") {
+        maxKeys, err := strconv.Atoi(query.Get("max-keys"));
+        if (err != nil || maxKeys < 0) {
+            this.writeError(response, request, http.StatusBadRequest, "InvalidArgument", "Invalid max-keys.");
+            return;
+        }
+
+        if (maxKeys < MAX_LIST_KEYS) {
+            result.MaxKeys = maxKeys;
+        }
+    }
+
+    // The continuation token is just the last key of the previous page.
+    var after string = result.StartAfter;
+    if (result.ContinuationToken != "") {
+        after = result.ContinuationToken;
+    }
+
+    this.lock.Lock();
+    bucket, ok := this.buckets[bucketName];
+    var keys []string = make([]string, 0);
+    var objects map[string]*object = make(map[string]*object);
+    if (ok) {
+        for key, object := range(bucket.objects) {
+            if (strings.HasPrefix(key, result.Prefix) && key > after) {
+                keys = append(keys, key);
+                objects[key] = object;
+            }
+        }
+    }
+    this.lock.Unlock();
+
+    if (!ok) {
+        this.writeError(response, request, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.");
+        return;
+    }
+
+    sort.Strings(keys);
+
+    var seenPrefixes map[string]bool = make(map[string]bool);
+    var lastKey string = "";
+
+    for _, key := range(keys) {
+        if (result.KeyCount >= result.MaxKeys) {
+            result.IsTruncated = true;
+            break;
+        }
+
+        lastKey = key;
+
+        // Everything past the delimiter gets rolled up into a common prefix.
+        if (result.Delimiter != "") {
+            var index int = strings.Index(key[len(result.Prefix):], result.Delimiter);
+            if (index >= 0) {
+                var rolledPrefix string = key[0:len(result.Prefix) + index + len(result.Delimiter)];
+                if (!seenPrefixes[rolledPrefix]) {
+                    seenPrefixes[rolledPrefix] = true;
+                    result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{rolledPrefix});
+                    result.KeyCount++;
+                }
+
+                continue;
+            }
+        }
+
+        var object *object = objects[key];
+        result.Contents = append(result.Contents, listEntry{
+            Key: key,
+            LastModified: object.modTime.Format(XML_TIME_FORMAT),
+            ETag: quote(object.etag),
+            Size: int64(len(object.data)),
+            StorageClass: object.storageClass,
+        });
+        result.KeyCount++;
+    }
+
+    if (result.IsTruncated) {
+        result.NextContinuationToken = lastKey;
+    }
+
+    this.writeXML(response, http.StatusOK, &result);
+}
+
+// Returns the object, or nil and the error code/message.
+func (this *Server) lookupObject(bucketName string, key string) (*object, string, string) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    bucket, ok := this.buckets[bucketName];
+    if (!ok) {
+        return nil, "NoSuchBucket", "The specified bucket does not exist.";
+    }
+
+    object, ok := bucket.objects[key];
+    if (!ok) {
+        return nil, "NoSuchKey", "The specified key does not exist.";
+    }
+
+    return object, "", "";
+}
+
+// Returns false if the bucket does not exist.
+func (this *Server) storeObject(bucketName string, key string, newObject *object) bool {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    bucket, ok := this.buckets[bucketName];
+    if (!ok) {
+        return false;
+    }
+
+    bucket.objects[key] = newObject;
+    return true;
+}
+
+func (this *Server) writeXML(response http.ResponseWriter, status int, body interface{}) {
+    data, err := xml.Marshal(body);
+    if (err != nil) {
+        http.Error(response, err.Error(), http.StatusInternalServerError);
+        return;
+    }
+
+    response.Header().Set("Content-Type", "application/xml");
+    response.Header().Set("Content-Length", strconv.Itoa(len(xml.Header) + len(data)));
+    response.WriteHeader(status);
+    response.Write([]byte(xml.Header));
+    response.Write(data);
+}
+
+func (this *Server) writeError(response http.ResponseWriter, request *http.Request, status int, code string, message string) {
+    this.writeXML(response, status, &errorResult{
+        Code: code,
+        Message: message,
+        Resource: request.URL.Path,
+        RequestId: response.Header().Get("x-amz-request-id"),
+    });
+}
+
+// HEAD responses cannot have a body, so clients only get the status.
+func (this *Server) writeHeadAwareError(response http.ResponseWriter, request *http.Request, headOnly bool, status int, code string, message string) {
+    if (!headOnly) {
+        this.writeError(response, request, status, code, message);
+        return;
+    }
+
+    response.WriteHeader(status);
+}
+
+// Parse a single http byte range ("bytes=start-end", "bytes=start-", or "bytes=-suffix").
+// Returns [start, end) (note that http ranges are inclusive).
+func parseRange(header string, size int64) (int64, int64, bool) {
+    if (!strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",")) {
+        return 0, 0, false;
+    }
+
+    var parts []string = strings.SplitN(strings.TrimPrefix(header, "bytes="), "-", 2);
+    if (len(parts) != 2) {
+        return 0, 0, false;
+    }
+
+    if (parts[0] == "") {
+        suffix, err := strconv.ParseInt(parts[1], 10, 64);
+        if (err != nil || suffix <= 0 || size == 0) {
+            return 0, 0, false;
+        }
+
+        if (suffix > size) {
+            suffix = size;
+        }
+
+        return size - suffix, size, true;
+    }
+
+    start, err := strconv.ParseInt(parts[0], 10, 64);
+    if (err != nil || start < 0 || start >= size) {
+        return 0, 0, false;
+    }
+
+    var end int64 = size;
+    if (parts[1] != "") {
+        inclusiveEnd, err := strconv.ParseInt(parts[1], 10, 64);
+        if (err != nil || inclusiveEnd < start) {
+            return 0, 0, false;
+        }
+
+        // Like S3, a range past the end is just cut off.
+        if (inclusiveEnd + 1 < size) {
+            end = inclusiveEnd + 1;
+        }
+    }
+
+    return start, end, true;
+}
+
+// "bucket/key" or "/bucket/key" (possibly url encoded) -> ("bucket", "key").
+func parseCopySource(source string) (string, string, bool) {
+    unescaped, err := url.PathUnescape(source);
+    if (err != nil) {
+        return "", "", false;
+    }
+
+    // Version ids are not supported, so just drop them.
+    unescaped = strings.SplitN(unescaped, "?", 2)[0];
+
+    bucketName, key := splitPath(unescaped);
+    if (bucketName == "" || key == "") {
+        return "", "", false;
+    }
+
+    return bucketName, key, true;
+}
+
+func md5Hex(data []byte) string {
+    var hash [md5.Size]byte = md5.Sum(data);
+    return hex.EncodeToString(hash[:]);
+}
+
+func quote(etag string) string {
+    return "\"" + etag + "\"";
+}
+
+func sortedStrings(values []string) []string {
+    sort.Strings(values);
+    return values;
+}
@@ -0,0 +1,336 @@
+package fakes3;
+
+// A small in-memory stand-in for S3, so the S3 connector can be used without AWS.
+// It only speaks enough of the S3 REST API for S3Connector (and friends):
+// buckets, HeadObject, (ranged) GetObject, PutObject, CopyObject, DeleteObject,
+// ListObjectsV2, and multipart uploads (including part copies, and listing uploads and their parts).
+//
+// Server-side encryption headers are checked, but nothing is actually encrypted.
+// Only path-style addressing (http://host/bucket/key) is supported,
+// and requests are not authenticated (any credentials will do).
+// Nothing is persisted, everything is lost when the server goes away.
+
+import (
+    "fmt"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pkg/errors"
+)
+
+const (
+    // Matches S3: every part but the last must be at least this large.
+    MIN_PART_SIZE = 5 * 1024 * 1024
+    MAX_LIST_KEYS = 1000
+
+    UPLOAD_ID_LENGTH = 32
+)
+
+type Server struct {
+    lock *sync.Mutex
+    buckets map[string]*bucket
+    // Every upload, by upload id.
+    uploads map[string]*upload
+    nextRequestId uint64
+    httpServer *http.Server
+    listener net.Listener
+}
+
+type bucket struct {
+    name string
+    objects map[string]*object
+    created time.Time
+}
+
+type object struct {
+    // Never modified in place, so it can be handed out without copying.
+    data []byte
+    etag string
+    modTime time.Time
+    storageClass string
+    contentType string
+    encryption encryption
+}
+
+// Make a server with no buckets.
+// The server can be used as an http.Handler directly, or started with Start().
+func NewServer() *Server {
+    return &Server{
+        lock: &sync.Mutex{},
+        buckets: make(map[string]*bucket),
+        uploads: make(map[string]*upload),
+        nextRequestId: 1,
+        httpServer: nil,
+        listener: nil,
+    };
+}
+
+// Start serving on |address| (e.g. "127.0.0.1:0" for any free port).
+// Returns the endpoint to give to the S3 client (e.g. "http://127.0.0.1:9000").
+func (this *Server) Start(address string) (string, error) {
+    if (this.listener != nil) {
+        return "", errors.New("Server is already started.");
+    }
+
+    listener, err := net.Listen("tcp", address);
+    if (err != nil) {
+        return "", errors.Wrap(err, address);
+    }
+
+    this.listener = listener;
+    this.httpServer = &http.Server{Handler: this};
+
+    go this.httpServer.Serve(listener);
+
+    return this.Endpoint(), nil;
+}
+
+// The endpoint of a started server.
+func (this *Server) Endpoint() string {
+    if (this.listener == nil) {
+        return "";
+    }
+
+    return "http://" + this.listener.Addr().String();
+}
+
+// Stop serving (if started).
+// The data stays, so the server can be started again.
+func (this *Server) Close() error {
+    if (this.httpServer == nil) {
+        return nil;
+    }
+
+    err := this.httpServer.Close();
+    this.httpServer = nil;
+    this.listener = nil;
+
+    return errors.WithStack(err);
+}
+
+// Create a bucket (if it does not already exist).
+func (this *Server) CreateBucket(name string) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    this.createBucket(name);
+}
+
+// Remove a bucket along with all its objects and uploads.
+func (this *Server) RemoveBucket(name string) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    delete(this.buckets, name);
+
+    for uploadId, upload := range(this.uploads) {
+        if (upload.bucket == name) {
+            delete(this.uploads, uploadId);
+        }
+    }
+}
+
+// The keys of all the objects in a bucket.
+func (this *Server) Keys(bucketName string) []string {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    var keys []string = make([]string, 0);
+
+    bucket, ok := this.buckets[bucketName];
+    if (!ok) {
+        return keys;
+    }
+
+    for key, _ := range(bucket.objects) {
+        keys = append(keys, key);
+    }
+
+    return sortedStrings(keys);
+}
+
+// The number of multipart uploads that have not been completed or aborted.
+func (this *Server) PendingUploads() int {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    return len(this.uploads);
+}
+
+// Make every pending upload look like it was started |age| earlier,
+// so anything that looks at how old uploads are can be tried without waiting.
+func (this *Server) AgeUploads(age time.Duration) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    for _, activeUpload := range(this.uploads) {
+        activeUpload.initiated = activeUpload.initiated.Add(-age);
+    }
+}
+
+// Write an AWS shared credentials file for |profile| that the S3 client can use with this server.
+// The server does not check credentials, so the keys are just placeholders.
+func WriteCredentials(path string, profile string) error {
+    var content string = fmt.Sprintf("[%s]\naws_access_key_id = FAKES3ACCESSKEY\naws_secret_access_key = FAKES3SECRETKEY\n", profile);
+
+    err := ioutil.WriteFile(path, []byte(content), 0600);
+    if (err != nil) {
+        return errors.Wrap(err, path);
+    }
+
+    return nil;
+}
+
+func (this *Server) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+    this.lock.Lock();
+    var requestId string = fmt.Sprintf("%016X", this.nextRequestId);
+    this.nextRequestId++;
+    this.lock.Unlock();
+
+    response.Header().Set("x-amz-request-id", requestId);
+    response.Header().Set("Server", "fakes3");
+
+    bucketName, key := splitPath(request.URL.Path);
+
+    if (bucketName == "") {
+        this.writeError(response, request, http.StatusNotImplemented, "NotImplemented", "Listing buckets is not supported.");
+        return;
+    }
+
+    if (key == "") {
+        this.serveBucket(response, request, bucketName);
+    } else {
+        this.serveObject(response, request, bucketName, key);
+    }
+}
+
+func (this *Server) serveBucket(response http.ResponseWriter, request *http.Request, bucketName string) {
+    var query = request.URL.Query();
+
+    switch request.Method {
+        case http.MethodPut:
+            this.CreateBucket(bucketName);
+            response.Header().Set("Location", "/" + bucketName);
+            response.WriteHeader(http.StatusOK);
+        case http.MethodHead:
+            if (!this.hasBucket(bucketName)) {
+                this.writeError(response, request, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.");
+                return;
+            }
+            response.WriteHeader(http.StatusOK);
+        case http.MethodDelete:
+            this.deleteBucket(response, request, bucketName);
+        case http.MethodGet:
+            _, isUploads := query["uploads"];
+            if (query.Get("list-type") == "2") {
+                this.listObjects(response, request, bucketName);
+            } else if (isUploads) {
+                this.listUploads(response, request, bucketName);
+            } else {
+                this.writeError(response, request, http.StatusNotImplemented, "NotImplemented", "Only ListObjectsV2 and ListMultipartUploads are supported.");
+            }
+        default:
+            this.writeError(response, request, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.");
+    }
+}
+
+func (this *Server) serveObject(response http.ResponseWriter, request *http.Request, bucketName string, key string) {
+    var query = request.URL.Query();
+    _, isUploads := query["uploads"];
+    var uploadId string = query.Get("uploadId");
+
+    switch request.Method {
+        case http.MethodHead:
+            this.getObject(response, request, bucketName, key, true);
+        case http.MethodGet:
+            if (uploadId != "") {
+                this.listParts(response, request, bucketName, key, uploadId);
+            } else {
+                this.getObject(response, request, bucketName, key, false);
+            }
+        case http.MethodPut:
+            if (uploadId != "") {
+                this.uploadPart(response, request, bucketName, key, uploadId);
+            } else if (request.Header.Get("x-amz-copy-source") != "") {
+                this.copyObject(response, request, bucketName, key);
+            } else {
+                this.putObject(response, request, bucketName, key);
+            }
+        case http.MethodPost:
+            if (isUploads) {
+                this.createUpload(response, request, bucketName, key);
+            } else if (uploadId != "") {
+                this.completeUpload(response, request, bucketName, key, uploadId);
+            } else {
+                this.writeError(response, request, http.StatusNotImplemented, "NotImplemented", "Unsupported POST.");
+            }
+        case http.MethodDelete:
+            if (uploadId != "") {
+                this.abortUpload(response, request, bucketName, key, uploadId);
+            } else {
+                this.deleteObject(response, request, bucketName, key);
+            }
+        default:
+            this.writeError(response, request, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.");
+    }
+}
+
+func (this *Server) hasBucket(bucketName string) bool {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    _, ok := this.buckets[bucketName];
+    return ok;
+}
+
+// The caller must hold the lock.
+func (this *Server) createBucket(name string) {
+    _, ok := this.buckets[name];
+    if (ok) {
+        return;
+    }
+
+    this.buckets[name] = &bucket{
+        name: name,
+        objects: make(map[string]*object),
+        created: time.Now(),
+    };
+}
+
+func (this *Server) deleteBucket(response http.ResponseWriter, request *http.Request, bucketName string) {
+    this.lock.Lock();
+    bucket, ok := this.buckets[bucketName];
+    var empty bool = ok && len(bucket.objects) == 0;
+    if (empty) {
+        delete(this.buckets, bucketName);
+    }
+    this.lock.Unlock();
+
+    if (!ok) {
+        this.writeError(response, request, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.");
+        return;
+    }
+
+    if (!empty) {
+        this.writeError(response, request, http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty.");
+        return;
+    }
+
+    response.WriteHeader(http.StatusNoContent);
+}
+
+// "/bucket/some/key" -> ("bucket", "some/key").
+func splitPath(urlPath string) (string, string) {
+    urlPath = strings.TrimPrefix(urlPath, "/");
+
+    var parts []string = strings.SplitN(urlPath, "/", 2);
+    if (len(parts) == 1) {
+        return parts[0], "";
+    }
+
+    return parts[0], parts[1];
+}
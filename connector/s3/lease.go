@@ -0,0 +1,153 @@
+package s3;
+
+// The lock object for a bucket (see connector.LeaseLock).
+// Writes are conditional on the object's ETag (If-Match) or on there being no object (If-None-Match),
+// so S3 itself decides which of two racing connections gets the lock.
+// Ages come from S3's clock (the response's Date against the object's LastModified).
+
+import (
+    "bytes"
+    "io/ioutil"
+    "net/http"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/connector"
+)
+
+const (
+    IF_MATCH_HEADER = "If-Match"
+    IF_NONE_MATCH_HEADER = "If-None-Match"
+    DATE_HEADER = "Date"
+)
+
+// Error codes that mean a condition on a write did not hold.
+var conflictCodes map[string]bool = map[string]bool{
+    "PreconditionFailed": true,
+    // S3 says this when another conditional write to the object is in progress.
+    "ConditionalRequestConflict": true,
+    // S3 says this for an If-Match on an object that is gone.
+    s3.ErrCodeNoSuchKey: true,
+}
+
+type lockObject struct {
+    bucket string
+    key string
+    s3Client *s3.S3
+    storageClass string
+}
+
+func (this *lockObject) ReadLease() (*connector.LeaseRecord, error) {
+    awsRequest, response := this.s3Client.GetObjectRequest(&s3.GetObjectInput{
+        Bucket: aws.String(this.bucket),
+        Key: aws.String(this.key),
+    });
+
+    err := awsRequest.Send();
+    if (err != nil) {
+        awsError, ok := err.(awserr.Error);
+        if (ok && awsError.Code() == s3.ErrCodeNoSuchKey) {
+            return nil, nil;
+        }
+
+        return nil, errors.Wrap(err, this.key);
+    }
+    defer response.Body.Close();
+
+    data, err := ioutil.ReadAll(response.Body);
+    if (err != nil) {
+        return nil, errors.Wrap(err, this.key);
+    }
+
+    // Fall back to our own clock if S3 does not give its own.
+    var now time.Time = time.Now();
+    serverTime, err := http.ParseTime(awsRequest.HTTPResponse.Header.Get(DATE_HEADER));
+    if (err == nil) {
+        now = serverTime;
+    }
+
+    var age time.Duration = 0;
+    if (response.LastModified != nil) {
+        age = now.Sub(*response.LastModified);
+    }
+
+    var record connector.LeaseRecord = connector.LeaseRecord{
+        Data: data,
+        Version: aws.StringValue(response.ETag),
+        Age: age,
+    };
+
+    return &record, nil;
+}
+
+func (this *lockObject) CreateLease(data []byte) (string, error) {
+    return this.put(data, IF_NONE_MATCH_HEADER, "*");
+}
+
+func (this *lockObject) ReplaceLease(data []byte, version string) (string, error) {
+    return this.put(data, IF_MATCH_HEADER, version);
+}
+
+// Not every S3 compatible service can do a conditional delete,
+// so also check the version first.
+func (this *lockObject) RemoveLease(version string) error {
+    record, err := this.ReadLease();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    if (record == nil || record.Version != version) {
+        return errors.WithStack(connector.ErrLeaseConflict);
+    }
+
+    awsRequest, _ := this.s3Client.DeleteObjectRequest(&s3.DeleteObjectInput{
+        Bucket: aws.String(this.bucket),
+        Key: aws.String(this.key),
+    });
+    awsRequest.HTTPRequest.Header.Set(IF_MATCH_HEADER, version);
+
+    err = awsRequest.Send();
+    if (isConflict(err)) {
+        return errors.WithStack(connector.ErrLeaseConflict);
+    }
+
+    return errors.Wrap(err, this.key);
+}
+
+// This SDK does not know about conditional puts, so the header is set by hand.
+func (this *lockObject) put(data []byte, header string, value string) (string, error) {
+    awsRequest, response := this.s3Client.PutObjectRequest(&s3.PutObjectInput{
+        Bucket: aws.String(this.bucket),
+        Key: aws.String(this.key),
+        Body: bytes.NewReader(data),
+        StorageClass: aws.String(this.storageClass),
+    });
+    awsRequest.HTTPRequest.Header.Set(header, value);
+
+    err := awsRequest.Send();
+    if (isConflict(err)) {
+        return "", errors.WithStack(connector.ErrLeaseConflict);
+    } else if (err != nil) {
+        return "", errors.Wrap(err, this.key);
+    }
+
+    return aws.StringValue(response.ETag), nil;
+}
+
+func isConflict(err error) bool {
+    if (err == nil) {
+        return false;
+    }
+
+    awsError, ok := err.(awserr.Error);
+    if (ok && conflictCodes[awsError.Code()]) {
+        return true;
+    }
+
+    requestFailure, ok := err.(awserr.RequestFailure);
+    return ok && requestFailure.StatusCode() == http.StatusPreconditionFailed;
+}
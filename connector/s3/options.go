@@ -0,0 +1,110 @@
+package s3;
+
+// Tuning for an S3 connector.
+
+import (
+    "time"
+
+    "github.com/aws/aws-sdk-go/service/s3"
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/connector"
+)
+
+const (
+    DEFAULT_CACHE_BYTES = 64 * 1024 * 1024
+    DEFAULT_READ_AHEAD = 2
+    DEFAULT_PARTS_IN_FLIGHT = 4
+    DEFAULT_MAX_RETRIES = 5
+    DEFAULT_RETRY_BASE_DELAY = 200 * time.Millisecond
+    DEFAULT_RETRY_MAX_DELAY = 20 * time.Second
+    DEFAULT_DATA_STORAGE_CLASS = s3.StorageClassStandardIa
+    DEFAULT_METADATA_STORAGE_CLASS = s3.StorageClassStandard
+    DEFAULT_LEASE_DURATION = connector.DEFAULT_LEASE_DURATION
+
+    // Not in this version of the SDK.
+    STORAGE_CLASS_GLACIER_IR = "GLACIER_IR"
+)
+
+// The storage classes that S3 knows about.
+var storageClasses map[string]bool = map[string]bool{
+    s3.StorageClassStandard: true,
+    s3.StorageClassReducedRedundancy: true,
+    s3.StorageClassStandardIa: true,
+    s3.StorageClassOnezoneIa: true,
+    s3.StorageClassIntelligentTiering: true,
+    STORAGE_CLASS_GLACIER_IR: true,
+    s3.StorageClassGlacier: true,
+    s3.StorageClassDeepArchive: true,
+}
+
+// Objects in these classes must be restored before they can be read (or copied from),
+// which the connector does not do.
+// So files in these classes can be written (and removed) but not read or edited.
+var archiveStorageClasses map[string]bool = map[string]bool{
+    s3.StorageClassGlacier: true,
+    s3.StorageClassDeepArchive: true,
+}
+
+type Options struct {
+    // The most decrypted chunk data (in bytes) to keep around for readers.
+    // Zero turns off the cache (and read-ahead).
+    CacheBytes int64
+    // The number of chunks past the one being read to fetch in the background.
+    // Read-ahead chunks go into the cache, so this should be well under the number of chunks that fit in it.
+    ReadAhead int
+    // The most parts of a single upload that will be uploading at once.
+    // Every part in flight holds a chunk (a bit over 5MB) in memory.
+    PartsInFlight int
+    // The most times a single request (or read of an object) will be tried again after a transient failure.
+    // Zero turns off retries.
+    MaxRetries int
+    // The delay before a retry starts at up to RetryBaseDelay and doubles with each try, up to RetryMaxDelay.
+    RetryBaseDelay time.Duration
+    RetryMaxDelay time.Duration
+    // The storage class for file data, unless the file says otherwise (see dirent.Dirent.StorageClass).
+    DataStorageClass string
+    // The storage class for metadata, which must be readable right away.
+    MetadataStorageClass string
+    Encryption ServerSideEncryption
+    // How long the lock on the bucket lasts without being renewed.
+    // A connection that dies keeps others out for this long (unless they force it).
+    LeaseDuration time.Duration
+}
+
+func DefaultOptions() Options {
+    return Options{
+        CacheBytes: DEFAULT_CACHE_BYTES,
+        ReadAhead: DEFAULT_READ_AHEAD,
+        PartsInFlight: DEFAULT_PARTS_IN_FLIGHT,
+        MaxRetries: DEFAULT_MAX_RETRIES,
+        RetryBaseDelay: DEFAULT_RETRY_BASE_DELAY,
+        RetryMaxDelay: DEFAULT_RETRY_MAX_DELAY,
+        DataStorageClass: DEFAULT_DATA_STORAGE_CLASS,
+        MetadataStorageClass: DEFAULT_METADATA_STORAGE_CLASS,
+        Encryption: ServerSideEncryption{Mode: SSE_NONE},
+        LeaseDuration: DEFAULT_LEASE_DURATION,
+    };
+}
+
+func ValidStorageClass(storageClass string) bool {
+    return storageClasses[storageClass];
+}
+
+// Check a class that a dir (and so its files) may use instead of the filesystem's (see dirent.Dirent.StorageClass).
+// Files that are in use must stay readable, so archive classes are not allowed.
+func ValidOverrideStorageClass(storageClass string) bool {
+    return storageClasses[storageClass] && !archiveStorageClasses[storageClass];
+}
+
+func (this Options) validate() error {
+    if (!ValidStorageClass(this.DataStorageClass)) {
+        return errors.Errorf("Unknown storage class for data: '%s'.", this.DataStorageClass);
+    }
+
+    if (!ValidStorageClass(this.MetadataStorageClass) || archiveStorageClasses[this.MetadataStorageClass]) {
+        return errors.Errorf("Metadata cannot use storage class '%s'.", this.MetadataStorageClass);
+    }
+
+    return errors.WithStack(this.Encryption.validate());
+}
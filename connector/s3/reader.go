@@ -8,9 +8,12 @@ package s3;
 import (
    "fmt"
    "io"
+   "os"
    "syscall"
+   "time"
 
    "github.com/aws/aws-sdk-go/aws"
+   "github.com/aws/aws-sdk-go/aws/awserr"
    "github.com/aws/aws-sdk-go/service/s3"
    "github.com/pkg/errors"
 
@@ -21,6 +24,7 @@ type S3Reader struct {
    bucket *string
    objectId *string
    s3Client *s3.S3
+   retryer *retryer
    offset int64
    ciphertextSize int64
 }
@@ -30,17 +34,42 @@ func NewS3Reader(bucket string, objectId string, s3Client *s3.S3, ciphertextSize
       bucket: aws.String(bucket),
       objectId: aws.String(objectId),
       s3Client: s3Client,
+      retryer: getRetryer(s3Client),
       offset: 0,
       ciphertextSize: ciphertextSize,
    };
 }
 
+// The SDK retries the request, but the body is read after the SDK is done with it.
+// So if reading the body fails, then the rest of the range is requested again.
+// Callers (like cipherio.CipherReader) expect a whole chunk from a single read,
+// so a read is only ever short at the end of the object.
 func (this *S3Reader) Read(outBuffer []byte) (int, error) {
    // Return EOF if we are already at the end.
    if (this.offset >= this.ciphertextSize) {
       return 0, io.EOF;
    }
 
+   var totalSize int = 0;
+   for retries := 0; ; retries++ {
+      readSize, bodyError, err := this.read(outBuffer[totalSize:]);
+      totalSize += readSize;
+
+      if (bodyError == nil) {
+         return totalSize, err;
+      }
+
+      if (retries >= this.retryer.MaxRetries() || !canRetry(classifyNetworkError(bodyError), true)) {
+         return totalSize, errors.WithStack(err);
+      }
+
+      time.Sleep(this.retryer.backoff(retries));
+   }
+}
+
+// Do a single ranged GET.
+// If reading the body failed, then the cause is also given back (so it can be retried).
+func (this *S3Reader) read(outBuffer []byte) (int, error, error) {
    // Figure out the end for this read.
    // Note that http byte ranges are inclusive (hence the -1).
    var requestEndOffset int64 = util.MinInt64(this.ciphertextSize, this.offset + int64(len(outBuffer))) - 1;
@@ -54,11 +83,12 @@ func (this *S3Reader) Read(outBuffer []byte) (int, error) {
 
    object, err := this.s3Client.GetObject(request);
    if (err != nil) {
-      return 0, errors.Wrap(err, *this.objectId);
+      return 0, nil, errors.Wrap(err, *this.objectId);
    }
+   defer object.Body.Close();
 
    if (object.ContentLength == nil) {
-      return 0, errors.Errorf("Got a nil content length: %s", *this.objectId);
+      return 0, nil, errors.Errorf("Got a nil content length: %s", *this.objectId);
    }
 
    // Sometimes S3 gives us an extra byte.
@@ -71,12 +101,7 @@ func (this *S3Reader) Read(outBuffer []byte) (int, error) {
    readSize, err := io.ReadFull(object.Body, outBuffer);
    this.offset += int64(readSize);
    if (err != nil && err != io.EOF) {
-      return readSize, errors.WithStack(err);
-   }
-
-   err = object.Body.Close();
-   if (err != nil) {
-      return readSize, errors.WithStack(err);
+      return readSize, err, errors.Wrapf(err, "Failed to read %s at %d", *this.objectId, this.offset);
    }
 
    // Return EOF if we have read to the end.
@@ -85,7 +110,7 @@ func (this *S3Reader) Read(outBuffer []byte) (int, error) {
       err = io.EOF;
    }
 
-   return readSize, err;
+   return readSize, nil, err;
 }
 
 func (this *S3Reader) Seek(offset int64, whence int) (int64, error) {
@@ -133,6 +158,19 @@ func (this *S3Reader) Close() error {
 // Utility that just gets an object's size.
 // Will require one fetch.
 func GetSize(bucket string, objectId string, s3Client *s3.S3) (int64, error) {
+   response, err := headObject(bucket, objectId, s3Client);
+   if (err != nil) {
+      return 0, errors.WithStack(err);
+   }
+
+   if (response.ContentLength == nil) {
+      return 0, errors.Errorf("Content length does not exist on response: %s", objectId);
+   }
+
+   return *response.ContentLength, nil;
+}
+
+func headObject(bucket string, objectId string, s3Client *s3.S3) (*s3.HeadObjectOutput, error) {
    request := &s3.HeadObjectInput{
       Bucket: aws.String(bucket),
       Key: aws.String(objectId),
@@ -140,12 +178,14 @@ func GetSize(bucket string, objectId string, s3Client *s3.S3) (int64, error) {
 
    response, err := s3Client.HeadObject(request);
    if (err != nil) {
-      return 0, errors.Wrap(err, objectId);
-   }
+      // HEAD responses have no body, so a missing object is just "NotFound".
+      awsError, ok := err.(awserr.Error);
+      if (ok && (awsError.Code() == HEAD_NOT_FOUND_CODE || awsError.Code() == s3.ErrCodeNoSuchKey)) {
+         return nil, errors.Wrap(os.ErrNotExist, objectId);
+      }
 
-   if (response.ContentLength == nil) {
-      return 0, errors.Errorf("Content length does not exist on response: %s", objectId);
+      return nil, errors.Wrap(err, objectId);
    }
 
-   return *response.ContentLength, nil;
+   return response, nil;
 }
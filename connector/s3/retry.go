@@ -0,0 +1,218 @@
+package s3;
+
+// Retries for S3 requests.
+// The retryer is installed on the S3 client, so the SDK retries each request (e.g. a single part of an upload) on its own.
+// Whether a failed request is retried depends on what kind of failure it was, and whether the operation is idempotent:
+// a request that never reached S3 can always be sent again,
+// but a request that was cut off partway could have already been done by S3.
+// Delays grow exponentially (with full jitter) up to a cap.
+
+import (
+    "context"
+    "crypto/x509"
+    "math/rand"
+    "net"
+    "net/http"
+    "syscall"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/aws/request"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "github.com/pkg/errors"
+)
+
+type errorClass int;
+
+const (
+    // Trying again will not help (e.g. a missing object or bad credentials).
+    ERROR_PERMANENT errorClass = iota
+    // The request never reached S3 (e.g. the connection was refused).
+    ERROR_NOT_SENT
+    // S3 got the request and said to try again (e.g. a 503 or SlowDown).
+    ERROR_SERVER
+    // The request may or may not have been done by S3 (e.g. the connection was reset before the response).
+    ERROR_AMBIGUOUS
+)
+
+// Error codes that S3 (or S3 compatible services) use to say that a request may be tried again.
+var retryableCodes map[string]bool = map[string]bool{
+    "InternalError": true,
+    "OperationAborted": true,
+    "RequestTimeout": true,
+    "RequestLimitExceeded": true,
+    "ServiceUnavailable": true,
+    "SlowDown": true,
+    "Throttling": true,
+    "ThrottlingException": true,
+    "TooManyRequests": true,
+}
+
+// Operations that have the same effect no matter how many times they are done.
+// Notably, this does not include creating or completing a multipart upload.
+var idempotentOperations map[string]bool = map[string]bool{
+    "AbortMultipartUpload": true,
+    "CopyObject": true,
+    "DeleteObject": true,
+    "GetObject": true,
+    "HeadObject": true,
+    "ListMultipartUploads": true,
+    "ListObjectsV2": true,
+    "PutObject": true,
+    "UploadPart": true,
+    "UploadPartCopy": true,
+}
+
+// Implements request.Retryer.
+type retryer struct {
+    maxRetries int
+    baseDelay time.Duration
+    maxDelay time.Duration
+}
+
+func newRetryer(options Options) *retryer {
+    var policy retryer = retryer{
+        maxRetries: options.MaxRetries,
+        baseDelay: options.RetryBaseDelay,
+        maxDelay: options.RetryMaxDelay,
+    };
+
+    if (policy.maxRetries < 0) {
+        policy.maxRetries = 0;
+    }
+
+    if (policy.maxDelay < policy.baseDelay) {
+        policy.maxDelay = policy.baseDelay;
+    }
+
+    return &policy;
+}
+
+// Get the retryer a connector installed on a client.
+// Clients that were made some other way get no retries.
+func getRetryer(s3Client *s3.S3) *retryer {
+    policy, ok := s3Client.Retryer.(*retryer);
+    if (!ok) {
+        return newRetryer(Options{});
+    }
+
+    return policy;
+}
+
+func (this *retryer) MaxRetries() int {
+    return this.maxRetries;
+}
+
+func (this *retryer) ShouldRetry(awsRequest *request.Request) bool {
+    var statusCode int = 0;
+    if (awsRequest.HTTPResponse != nil) {
+        statusCode = awsRequest.HTTPResponse.StatusCode;
+    }
+
+    var operation string = "";
+    if (awsRequest.Operation != nil) {
+        operation = awsRequest.Operation.Name;
+    }
+
+    return canRetry(classifyError(awsRequest.Error, statusCode), idempotentOperations[operation]);
+}
+
+func (this *retryer) RetryRules(awsRequest *request.Request) time.Duration {
+    return this.backoff(awsRequest.RetryCount);
+}
+
+// The delay before retry number |attempt| (zero-indexed).
+// The delay is picked uniformly from zero up to the exponential delay (full jitter),
+// so clients that failed together do not all come back together.
+func (this *retryer) backoff(attempt int) time.Duration {
+    var ceiling time.Duration = this.maxDelay;
+    if (attempt < 32 && this.baseDelay << uint(attempt) < this.maxDelay) {
+        ceiling = this.baseDelay << uint(attempt);
+    }
+
+    if (ceiling <= 0) {
+        return 0;
+    }
+
+    return time.Duration(rand.Int63n(int64(ceiling) + 1));
+}
+
+func canRetry(class errorClass, idempotent bool) bool {
+    switch class {
+        case ERROR_NOT_SENT, ERROR_SERVER:
+            return true;
+        case ERROR_AMBIGUOUS:
+            return idempotent;
+        default:
+            return false;
+    }
+}
+
+// |statusCode| is zero if there was no response.
+func classifyError(err error, statusCode int) errorClass {
+    if (err == nil) {
+        return ERROR_PERMANENT;
+    }
+
+    awsError, ok := err.(awserr.Error);
+    if (!ok) {
+        return classifyNetworkError(err);
+    }
+
+    switch awsError.Code() {
+        case request.CanceledErrorCode:
+            return ERROR_PERMANENT;
+        case request.ErrCodeRequestError, request.ErrCodeResponseTimeout, request.ErrCodeRead:
+            // The request did not make it there and back.
+            if (awsError.OrigErr() == nil) {
+                return ERROR_AMBIGUOUS;
+            }
+
+            return classifyNetworkError(awsError.OrigErr());
+    }
+
+    if (retryableCodes[awsError.Code()]) {
+        return ERROR_SERVER;
+    }
+
+    switch statusCode {
+        case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+                http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+            return ERROR_SERVER;
+    }
+
+    return ERROR_PERMANENT;
+}
+
+// Any error from the connection itself is assumed to be passing (like a dropped connection),
+// unless it is known to be otherwise.
+func classifyNetworkError(err error) errorClass {
+    if (errors.Is(err, context.Canceled)) {
+        return ERROR_PERMANENT;
+    }
+
+    if (errors.Is(err, syscall.ECONNREFUSED)) {
+        return ERROR_NOT_SENT;
+    }
+
+    var dnsError *net.DNSError;
+    if (errors.As(err, &dnsError)) {
+        return ERROR_NOT_SENT;
+    }
+
+    var opError *net.OpError;
+    if (errors.As(err, &opError) && opError.Op == "dial") {
+        return ERROR_NOT_SENT;
+    }
+
+    // A bad certificate will still be bad next time.
+    var authorityError x509.UnknownAuthorityError;
+    var hostnameError x509.HostnameError;
+    var certificateError x509.CertificateInvalidError;
+    if (errors.As(err, &authorityError) || errors.As(err, &hostnameError) || errors.As(err, &certificateError)) {
+        return ERROR_PERMANENT;
+    }
+
+    // Timeouts, unexpected closes, and the like.
+    return ERROR_AMBIGUOUS;
+}
@@ -0,0 +1,139 @@
+package s3;
+
+// Cleaning up multipart uploads that were never finished.
+// S3 keeps (and bills for) the parts of an upload until it is completed or aborted,
+// so an upload that was cut off (e.g. the process died) stays around forever.
+
+import (
+    "path"
+    "time"
+
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/service/s3"
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/connector"
+)
+
+const (
+    // Uploads only take as long as a single put, so anything a day old has surely been abandoned.
+    DEFAULT_STALE_UPLOAD_AGE = 24 * time.Hour
+    // Anything younger may still be going (a big part can take a while,
+    // and an old connection may not know that it lost the lease yet).
+    // The lease duration is also a floor, if it is longer.
+    MIN_STALE_UPLOAD_AGE = time.Hour
+)
+
+// Abort any upload under the data and admin dirs that was started at least |minAge| ago.
+// |minAge| cannot be less than MIN_STALE_UPLOAD_AGE (or the lease duration),
+// so uploads from this connection that are still going are not swept.
+func (this *S3Connector) SweepStaleUploads(minAge time.Duration) (*connector.SweepReport, error) {
+    var floor time.Duration = MIN_STALE_UPLOAD_AGE;
+    if (this.options.LeaseDuration > floor) {
+        floor = this.options.LeaseDuration;
+    }
+
+    if (minAge < floor) {
+        return nil, errors.Errorf("Only uploads at least %s old can be swept (not %s), younger ones may still be going.", floor, minAge);
+    }
+
+    err := this.lease.Check();
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    var report connector.SweepReport = connector.SweepReport{};
+    var cutoff time.Time = time.Now().Add(-minAge);
+
+    for _, dir := range([]string{connector.FS_SYS_DIR_DATA, connector.FS_SYS_DIR_ADMIN}) {
+        uploads, err := this.listUploads(dir + "/");
+        if (err != nil) {
+            return nil, errors.WithStack(err);
+        }
+
+        for _, upload := range(uploads) {
+            if (aws.TimeValue(upload.Initiated).After(cutoff)) {
+                report.Skipped++;
+                continue;
+            }
+
+            // The lease may run out while sweeping.
+            err = this.lease.Check();
+            if (err != nil) {
+                return nil, errors.WithStack(err);
+            }
+
+            size, err := this.abortUpload(aws.StringValue(upload.Key), aws.StringValue(upload.UploadId));
+            if (err != nil) {
+                return nil, errors.WithStack(err);
+            }
+
+            report.Aborted++;
+            report.BytesReclaimed += size;
+        }
+    }
+
+    return &report, nil;
+}
+
+// Get all the in-progress uploads under |prefix| (all pages).
+func (this *S3Connector) listUploads(prefix string) ([]*s3.MultipartUpload, error) {
+    var uploads []*s3.MultipartUpload = make([]*s3.MultipartUpload, 0);
+
+    request := &s3.ListMultipartUploadsInput{
+        Bucket: aws.String(this.bucket),
+        Prefix: aws.String(prefix),
+    };
+
+    err := this.s3Client.ListMultipartUploadsPages(request, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+        uploads = append(uploads, page.Uploads...);
+        return true;
+    });
+
+    if (err != nil) {
+        return nil, errors.Wrap(err, prefix);
+    }
+
+    return uploads, nil;
+}
+
+// Abort an upload and give back the size of the parts it was holding.
+// An upload that is already gone (e.g. it finished while we were looking) is not an error.
+func (this *S3Connector) abortUpload(key string, uploadId string) (int64, error) {
+    var size int64 = 0;
+
+    listRequest := &s3.ListPartsInput{
+        Bucket: aws.String(this.bucket),
+        Key: aws.String(key),
+        UploadId: aws.String(uploadId),
+    };
+
+    err := this.s3Client.ListPartsPages(listRequest, func(page *s3.ListPartsOutput, lastPage bool) bool {
+        for _, part := range(page.Parts) {
+            size += aws.Int64Value(part.Size);
+        }
+
+        return true;
+    });
+
+    if (isNoSuchUpload(err)) {
+        return 0, nil;
+    } else if (err != nil) {
+        return 0, errors.Wrap(err, path.Join(key, uploadId));
+    }
+
+    abortRequest := &s3.AbortMultipartUploadInput{
+        Bucket: aws.String(this.bucket),
+        Key: aws.String(key),
+        UploadId: aws.String(uploadId),
+    };
+
+    _, err = this.s3Client.AbortMultipartUpload(abortRequest);
+    if (isNoSuchUpload(err)) {
+        return 0, nil;
+    } else if (err != nil) {
+        return 0, errors.Wrap(err, path.Join(key, uploadId));
+    }
+
+    return size, nil;
+}
@@ -3,14 +3,20 @@ package s3;
 // Simple utilties.
 
 import (
+    "net"
+    "net/url"
     "path"
 
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/service/s3"
+
     "github.com/eriq-augustine/elfs/connector"
     "github.com/eriq-augustine/elfs/dirent"
 )
 
 const (
     LOCK_FILENAME = "remote_lock"
+    HEAD_NOT_FOUND_CODE = "NotFound"
 )
 
 func (this *S3Connector) getDataPath(direntInfo *dirent.Dirent) string {
@@ -34,3 +40,20 @@ func (this *S3Connector) getMetadataPath(metadataId string) string {
 func (this *S3Connector) getLockPath() string {
     return path.Join(connector.FS_SYS_DIR_ADMIN, LOCK_FILENAME);
 }
+
+// Virtual-hosted style requests (http://bucket.host/key) need DNS for the bucket's host,
+// which local endpoints (like an IP or localhost) do not have.
+func usePathStyle(endpoint string) bool {
+    endpointUrl, err := url.Parse(endpoint);
+    if (err != nil || endpointUrl.Hostname() == "") {
+        return false;
+    }
+
+    var host string = endpointUrl.Hostname();
+    return host == "localhost" || net.ParseIP(host) != nil;
+}
+
+func isNoSuchUpload(err error) bool {
+    awsError, ok := err.(awserr.Error);
+    return ok && awsError.Code() == s3.ErrCodeNoSuchUpload;
+}
@@ -1,28 +1,51 @@
 package s3;
 
+// Writes an object with a multipart upload.
+// Parts are uploaded in the background (up to a limit at a time),
+// so the caller can keep encrypting while earlier parts are in flight.
+// Any failure aborts the whole upload.
+
 import (
    "bytes"
+   "sync"
 
    "github.com/aws/aws-sdk-go/aws"
    "github.com/aws/aws-sdk-go/service/s3"
    "github.com/pkg/errors"
 )
 
+const (
+   // Every part but the last must be at least this large.
+   MIN_PART_SIZE = 5 * 1024 * 1024
+)
+
 type S3Writer struct {
    bucket *string
    objectId *string
    s3Client *s3.S3
    // We need to keep the identifiers for each part for when we complete the multiplart upload.
+   // Part numbers are handed out in order, so part N is at index N - 1 (nil until it is done).
    parts []*s3.CompletedPart
+   // Small writes (like a metadata header) are held until there is enough for a part.
+   buffer []byte
    // We must be extra cautious about making sure this is closed on success or failure.
    // Not closing could result in billable storage being used by intermitent data.
    uploadId *string
+   // Each part in flight holds a slot, which bounds the memory held by parts.
+   slots chan bool
+   inFlight *sync.WaitGroup
+   // Protects parts and uploadError (which are written by the background uploads).
+   lock *sync.Mutex
+   // The first background failure.
+   uploadError error
+   // Why the upload was aborted (nil if it was not).
+   abortError error
 }
 
-func NewS3Writer(bucket string, objectId string, s3Client *s3.S3, isMetadata bool) (*S3Writer, error) {
-   var storageClass string = s3.StorageClassStandardIa;
-   if (isMetadata) {
-      storageClass = s3.StorageClassStandard;
+// |partsInFlight| is the most parts that will be uploading at once (at least one).
+func NewS3Writer(bucket string, objectId string, s3Client *s3.S3, storageClass string, partsInFlight int) (*S3Writer, error) {
+   if (partsInFlight < 1) {
+      partsInFlight = 1;
    }
 
    request := &s3.CreateMultipartUploadInput{
@@ -46,49 +69,152 @@ func NewS3Writer(bucket string, objectId string, s3Client *s3.S3, isMetadata boo
       objectId: aws.String(objectId),
       s3Client: s3Client,
       parts: make([]*s3.CompletedPart, 0),
+      buffer: make([]byte, 0),
       uploadId: aws.String(uploadId),
+      slots: make(chan bool, partsInFlight),
+      inFlight: &sync.WaitGroup{},
+      lock: &sync.Mutex{},
+      uploadError: nil,
+      abortError: nil,
    }, nil;
 }
 
 func (this *S3Writer) Write(data []byte) (int, error) {
-   // Return EOF if we are already at the end.
-   if (len(data) == 0 || this.uploadId == nil) {
+   if (this.uploadId == nil) {
+      if (this.abortError != nil) {
+         return 0, this.abortError;
+      }
+
+      return 0, errors.Errorf("Upload is already closed: [%s]", *this.objectId);
+   }
+
+   if (len(data) == 0) {
       return 0, nil;
    }
 
-   request := &s3.UploadPartInput{
-      Bucket: this.bucket,
-      Key: this.objectId,
-      Body: bytes.NewReader(data),
-      PartNumber: aws.Int64(int64(len(this.parts) + 1)),  // One-indexed.
-      UploadId: this.uploadId,
-   };
+   this.buffer = append(this.buffer, data...);
+   if (len(this.buffer) < MIN_PART_SIZE) {
+      return len(data), nil;
+   }
 
-   response, err := this.s3Client.UploadPart(request);
+   err := this.flush();
    if (err != nil) {
-      this.Abort();
-      return 0, errors.Wrap(err, *this.objectId);
+      return 0, errors.WithStack(err);
    }
 
-   if (response.ETag == nil) {
-      this.Abort();
-      return 0, errors.Errorf("Reponse does not have an ETag: [%s]", *this.objectId);
+   return len(data), nil;
+}
+
+// Start uploading whatever is buffered as the next part.
+func (this *S3Writer) flush() error {
+   // The buffer now belongs to the upload.
+   var data []byte = this.buffer;
+   this.buffer = make([]byte, 0, len(data));
+
+   return errors.WithStack(this.startPart(func(uploadId *string, partNumber int64) (*string, error) {
+      request := &s3.UploadPartInput{
+         Bucket: this.bucket,
+         Key: this.objectId,
+         Body: bytes.NewReader(data),
+         PartNumber: aws.Int64(partNumber),
+         UploadId: uploadId,
+      };
+
+      response, err := this.s3Client.UploadPart(request);
+      if (err != nil) {
+         return nil, errors.Wrapf(err, "Failed to upload part %d of %s", partNumber, *this.objectId);
+      }
+
+      return response.ETag, nil;
+   }));
+}
+
+// Give the next part number to |upload| and run it in the background once there is room.
+// |upload| gives back the part's ETag.
+// If an earlier part has failed, then the upload is aborted and that failure is returned.
+func (this *S3Writer) startPart(upload func(uploadId *string, partNumber int64) (*string, error)) error {
+   if (this.uploadId == nil) {
+      if (this.abortError != nil) {
+         return this.abortError;
+      }
+
+      return errors.Errorf("Upload is already closed: [%s]", *this.objectId);
    }
-   var etag string = *response.ETag;
 
-   this.parts = append(this.parts, &s3.CompletedPart{
-      PartNumber: aws.Int64(int64(len(this.parts) + 1)),  // One-indexed
-      ETag: aws.String(etag),
-   });
+   // Wait for room.
+   this.slots <- true;
 
-   return len(data), nil;
+   err := this.getUploadError();
+   if (err != nil) {
+      <-this.slots;
+      this.abort(err);
+      return errors.WithStack(err);
+   }
+
+   this.lock.Lock();
+   this.parts = append(this.parts, nil);
+   var partNumber int64 = int64(len(this.parts));  // One-indexed.
+   this.lock.Unlock();
+
+   // The writer's upload id is cleared once it is done (after waiting for all the parts).
+   var uploadId *string = this.uploadId;
+
+   this.inFlight.Add(1);
+   go func() {
+      defer this.inFlight.Done();
+      defer func() {
+         <-this.slots;
+      }();
+
+      etag, err := upload(uploadId, partNumber);
+      if (err == nil && etag == nil) {
+         err = errors.Errorf("Reponse does not have an ETag: [%s] part %d", *this.objectId, partNumber);
+      }
+
+      this.lock.Lock();
+      defer this.lock.Unlock();
+
+      if (err != nil) {
+         if (this.uploadError == nil) {
+            this.uploadError = err;
+         }
+
+         return;
+      }
+
+      this.parts[partNumber - 1] = &s3.CompletedPart{
+         PartNumber: aws.Int64(partNumber),
+         ETag: aws.String(*etag),
+      };
+   }();
+
+   return nil;
+}
+
+func (this *S3Writer) getUploadError() error {
+   this.lock.Lock();
+   defer this.lock.Unlock();
+
+   return this.uploadError;
 }
 
+// Waits for any parts in flight before aborting,
+// otherwise a part could finish after the abort and be left behind.
+// Any later writes fail.
 func (this *S3Writer) Abort() error {
+   return this.abort(errors.Errorf("Upload was aborted: [%s]", *this.objectId));
+}
+
+// Abort because of |cause|, which is what any later writes fail with.
+func (this *S3Writer) abort(cause error) error {
    if (this.uploadId == nil) {
       return nil;
    }
 
+   this.abortError = cause;
+
+   this.inFlight.Wait();
+
    request := &s3.AbortMultipartUploadInput{
       Bucket: this.bucket,
       Key: this.objectId,
@@ -96,6 +222,7 @@ func (this *S3Writer) Abort() error {
    };
 
    this.uploadId = nil;
+   this.buffer = nil;
 
    _, err := this.s3Client.AbortMultipartUpload(request);
    return errors.WithStack(err);
@@ -106,6 +233,22 @@ func (this *S3Writer) Close() error {
       return nil;
    }
 
+   // An upload needs at least one part, even if it is empty.
+   if (len(this.buffer) > 0 || len(this.parts) == 0) {
+      err := this.flush();
+      if (err != nil) {
+         return errors.WithStack(err);
+      }
+   }
+
+   this.inFlight.Wait();
+
+   err := this.getUploadError();
+   if (err != nil) {
+      this.abort(err);
+      return errors.WithStack(err);
+   }
+
    request := &s3.CompleteMultipartUploadInput{
       Bucket: this.bucket,
       Key: this.objectId,
@@ -113,9 +256,16 @@ func (this *S3Writer) Close() error {
       MultipartUpload: &s3.CompletedMultipartUpload{Parts: this.parts},
    };
 
+   _, err = this.s3Client.CompleteMultipartUpload(request);
+   if (err != nil) {
+      err = errors.Wrap(err, *this.objectId);
+      this.abort(err);
+      return err;
+   }
+
    this.uploadId = nil;
    this.parts = nil;
+   this.buffer = nil;
 
-   _, err := this.s3Client.CompleteMultipartUpload(request);
-   return errors.WithStack(err);
+   return nil;
 }
@@ -10,6 +10,18 @@ import (
    "github.com/eriq-augustine/elfs/dirent"
 )
 
+// Get the parameters to encrypt/decrypt a file's data.
+// The dirent id is the stream id, so a file's chunks cannot be passed off as another's.
+func FileStreamParams(fileInfo *dirent.Dirent, blockCipher cipher.Block) cipherio.StreamParams {
+   return cipherio.StreamParams{
+      BlockCipher: blockCipher,
+      IV: fileInfo.IV,
+      ChunkIVs: fileInfo.ChunkIVs,
+      StreamId: string(fileInfo.Id),
+      Version: fileInfo.CipherVersion,
+   };
+}
+
 // A convenience function for synchronious writes.
 // Returns: (size, md5 hash (hex), error).
 func Write(connector Connector, fileInfo *dirent.Dirent,
@@ -30,6 +42,7 @@ func Write(connector Connector, fileInfo *dirent.Dirent,
       readSize, err := clearbytes.Read(data);
       if (err != nil) {
          if (err != io.EOF) {
+            writer.Abort();
             return 0, "", errors.Wrap(err, "Failed to read clearbytes.");
          }
 
@@ -39,6 +52,7 @@ func Write(connector Connector, fileInfo *dirent.Dirent,
       if (readSize > 0) {
          _, err = writer.Write(data[0:readSize]);
          if (err != nil) {
+            writer.Abort();
             return 0, "", errors.Wrap(err, "Failed to write.");
          }
       }
@@ -34,8 +34,22 @@ type Dirent struct {
     AccessCount uint
     Permissions Permissions
     Size uint64  // bytes
+    // Cleared by partial writes (see driver.Driver.WriteAt()), since getting it would mean reading the whole file.
+    // Filled back in when the file is put again, rekeyed, or checked by a repairing fsck.
     Md5 string
     Parent Id
+    // The IVs for any chunks that have been rewritten since the last full write.
+    ChunkIVs map[int64][]byte `json:",omitempty"`
+    // The format the file's data was written in (see cipherio.StreamParams).
+    // Files written before versioning are legacy (0).
+    CipherVersion int
+    // The file's data key, wrapped by the master key (see util.WrapKey()).
+    // Files written before per-file keys have none and are encrypted with the master key directly.
+    Key []byte `json:",omitempty"`
+    // For a dir, the storage class for files put into it (empty to use its parent's).
+    // For a file, the storage class its data was last put with (see driver.Driver.SetStorageClass()).
+    // Storage classes are up to the connector (e.g. an S3 storage class), empty is the connector's default.
+    StorageClass string `json:",omitempty"`
 }
 
 func NewDir(id Id, name string, parent Id,
@@ -80,6 +94,26 @@ func NewFile(id Id, name string, parent Id,
     };
 }
 
+// Get a deep copy of this dirent.
+// The driver only hands out copies so callers never see (or race with) changes to the live FAT.
+func (this *Dirent) Clone() *Dirent {
+    var clone Dirent = *this;
+    clone.IV = append([]byte(nil), this.IV...);
+
+    if (this.Key != nil) {
+        clone.Key = append([]byte(nil), this.Key...);
+    }
+
+    if (this.ChunkIVs != nil) {
+        clone.ChunkIVs = make(map[int64][]byte, len(this.ChunkIVs));
+        for index, iv := range(this.ChunkIVs) {
+            clone.ChunkIVs[index] = append([]byte(nil), iv...);
+        }
+    }
+
+    return &clone;
+}
+
 func NewId() Id {
     return Id(util.RandomString(ID_LENGTH));
 }
@@ -7,12 +7,22 @@ import (
     "fmt"
     "os"
     "os/signal"
+    "strings"
     "syscall"
+    "time"
 
     "github.com/pkg/errors"
     "github.com/spf13/pflag"
 
     "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/connector/local"
+    "github.com/eriq-augustine/elfs/connector/memory"
+    "github.com/eriq-augustine/elfs/connector/mirror"
+    "github.com/eriq-augustine/elfs/connector/s3"
+    "github.com/eriq-augustine/elfs/identity"
+    "github.com/eriq-augustine/elfs/keyring"
+    "github.com/eriq-augustine/elfs/metadata"
+    "github.com/eriq-augustine/elfs/util"
 )
 
 const (
@@ -26,6 +36,56 @@ const (
 // This will just exit on bad args.
 // The caller is responsible for closing the driver when done.
 func GetDriverFromArgs() (*Driver, *Args) {
+    fsConnector, args := GetConnectorFromArgs();
+
+    var fsDriver *Driver = nil;
+    var err error = nil;
+
+    if (args.ConnectorType == connector.CONNECTOR_TYPE_MEMORY) {
+        fsDriver, err = getScratchDriver(args, fsConnector);
+        if (err != nil) {
+            fsConnector.Close();
+            fmt.Printf("%+v\n", errors.Wrap(err, "Failed to create scratch filesystem"));
+            os.Exit(7);
+        }
+    }
+
+    if (fsDriver == nil) {
+        key, iv, err := GetKeyFromArgs(args, fsConnector);
+        if (err != nil) {
+            fsConnector.Close();
+            fmt.Printf("%+v\n", errors.Wrap(err, "Failed to get the master key"));
+            os.Exit(5);
+        }
+
+        fsDriver, err = NewDriverWithEncoding(key, iv, fsConnector, args.MetadataEncoding);
+        if (err != nil) {
+            fsConnector.Close();
+            fmt.Printf("%+v\n", errors.Wrap(err, "Failed to get driver"));
+            os.Exit(6);
+        }
+
+        if (fsDriver.MetadataFallback() != nil) {
+            fmt.Printf("WARNING: The current metadata could not be read: %v\n", fsDriver.MetadataFallback());
+        }
+    }
+
+    // Gracefully handle SIGINT and SIGTERM.
+    sigChan := make(chan os.Signal, 1);
+    signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM);
+    go func() {
+        <-sigChan;
+        fsDriver.Close();
+        os.Exit(0);
+    }();
+
+    return fsDriver, args;
+}
+
+// Parse the args and connect to the storage, but do not load any filesystem.
+// This will just exit on bad args.
+// The caller is responsible for closing the connector (or the driver that it is given to).
+func GetConnectorFromArgs() (connector.Connector, *Args) {
     args, err := parseArgs();
     if (err != nil) {
         pflag.Usage();
@@ -33,34 +93,178 @@ func GetDriverFromArgs() (*Driver, *Args) {
         os.Exit(1);
     }
 
-    var fsDriver *Driver = nil;
+    var fsConnector connector.Connector = nil;
     if (args.ConnectorType == connector.CONNECTOR_TYPE_LOCAL) {
-        fsDriver, err = NewLocalDriver(args.Key, args.IV, args.Path, args.Force);
+        fsConnector, err = local.NewLocalConnector(args.Path, args.Force);
         if (err != nil) {
-            fmt.Printf("%+v\n", errors.Wrap(err, "Failed to get local driver"));
+            fmt.Printf("%+v\n", errors.Wrap(err, "Failed to get local connector"));
             os.Exit(2);
         }
     } else if (args.ConnectorType == connector.CONNECTOR_TYPE_S3) {
-        fsDriver, err = NewS3Driver(args.Key, args.IV, args.Path, args.AwsCredPath, args.AwsProfile, args.AwsRegion, args.AwsEndpoint, args.Force);
+        fsConnector, err = s3.NewS3ConnectorWithOptions(args.Path, args.AwsCredPath, args.AwsProfile, args.AwsRegion, args.AwsEndpoint, args.Force, args.s3Options());
         if (err != nil) {
-            fmt.Printf("%+v\n", errors.Wrap(err, "Failed to get S3 driver"));
+            fmt.Printf("%+v\n", errors.Wrap(err, "Failed to get S3 connector"));
             os.Exit(3);
         }
+    } else if (args.ConnectorType == connector.CONNECTOR_TYPE_MEMORY) {
+        fsConnector, err = memory.NewMemoryConnector(args.Path, args.MemoryLimit, args.Force);
+        if (err != nil) {
+            fmt.Printf("%+v\n", errors.Wrap(err, "Failed to get memory connector"));
+            os.Exit(2);
+        }
     } else {
         fmt.Printf("Unknown connector type: [%s]\n", args.ConnectorType);
         os.Exit(4);
     }
 
-    // Gracefully handle SIGINT and SIGTERM.
-    sigChan := make(chan os.Signal, 1);
-    signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM);
-    go func() {
-        <-sigChan;
-        fsDriver.Close();
-        os.Exit(0);
-    }();
+    if (len(args.Mirrors) > 0) {
+        fsConnector, err = getMirrorConnector(args, fsConnector);
+        if (err != nil) {
+            fmt.Printf("%+v\n", errors.Wrap(err, "Failed to get mirror connector"));
+            os.Exit(8);
+        }
+    }
 
-    return fsDriver, args;
+    return fsConnector, args;
+}
+
+// Mirror the storage from --type and --path to every storage from --mirror (see connector/mirror).
+// The mirror takes ownership of |primary| (even on failure).
+func getMirrorConnector(args *Args, primary connector.Connector) (connector.Connector, error) {
+    var replicas []connector.Connector = []connector.Connector{primary};
+
+    for _, replicaSpec := range(args.Mirrors) {
+        var parts []string = strings.SplitN(replicaSpec, ":", 2);
+        if (len(parts) != 2 || parts[1] == "") {
+            closeConnectors(replicas);
+            return nil, errors.Errorf("Mirrors should look like 'type:path', found [%s].", replicaSpec);
+        }
+
+        replica, err := connectReplica(args, parts[0], parts[1]);
+        if (err != nil) {
+            closeConnectors(replicas);
+            return nil, errors.Wrap(err, replicaSpec);
+        }
+
+        replicas = append(replicas, replica);
+    }
+
+    mirrorConnector, err := mirror.NewMirrorConnector(replicas);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    return mirrorConnector, nil;
+}
+
+func connectReplica(args *Args, connectorType string, path string) (connector.Connector, error) {
+    if (connectorType == connector.CONNECTOR_TYPE_LOCAL) {
+        replica, err := local.NewLocalConnector(path, args.Force);
+        if (err != nil) {
+            return nil, errors.WithStack(err);
+        }
+
+        return replica, nil;
+    } else if (connectorType == connector.CONNECTOR_TYPE_S3) {
+        replica, err := s3.NewS3ConnectorWithOptions(path, args.AwsCredPath, args.AwsProfile, args.AwsRegion, args.AwsEndpoint, args.Force, args.s3Options());
+        if (err != nil) {
+            return nil, errors.WithStack(err);
+        }
+
+        return replica, nil;
+    }
+
+    return nil, errors.Errorf("Unknown connector type for a mirror: [%s]", connectorType);
+}
+
+func closeConnectors(connectors []connector.Connector) {
+    for _, fsConnector := range(connectors) {
+        fsConnector.Close();
+    }
+}
+
+func (this *Args) s3Options() s3.Options {
+    var options s3.Options = s3.Options{
+        CacheBytes: this.S3CacheBytes,
+        ReadAhead: this.S3ReadAhead,
+        PartsInFlight: this.S3PartsInFlight,
+        MaxRetries: this.S3MaxRetries,
+        RetryBaseDelay: this.S3RetryBaseDelay,
+        RetryMaxDelay: this.S3RetryMaxDelay,
+        DataStorageClass: this.S3DataStorageClass,
+        MetadataStorageClass: this.S3MetadataStorageClass,
+        Encryption: s3.ServerSideEncryption{
+            Mode: this.S3Encryption,
+            CustomerKey: this.S3CustomerKey,
+        },
+        LeaseDuration: this.S3LeaseDuration,
+    };
+    return options;
+}
+
+// Get the master key and IV.
+// They are either given directly (--key and --iv),
+// or unlocked from the key header (see keyring) with a passphrase from --key-file or a prompt.
+func GetKeyFromArgs(args *Args, fsConnector connector.Connector) ([]byte, []byte, error) {
+    if (args.Key != nil) {
+        return args.Key, args.IV, nil;
+    }
+
+    hasHeader, err := keyring.Exists(fsConnector);
+    if (err != nil) {
+        return nil, nil, errors.WithStack(err);
+    }
+
+    if (!hasHeader) {
+        return nil, nil, errors.New("No key given and the filesystem does not have a key header.");
+    }
+
+    passphrase, err := keyring.GetPassphrase(args.KeyFile, "Passphrase", false);
+    if (err != nil) {
+        return nil, nil, errors.WithStack(err);
+    }
+
+    header, key, _, err := UnlockKeyHeader(fsConnector, passphrase);
+    if (err != nil) {
+        return nil, nil, errors.WithStack(err);
+    }
+
+    return key, header.IV, nil;
+}
+
+// A memory filesystem starts out empty (in every new process), so make a new filesystem in it.
+// The key is random unless one is given, and root's password is the one given.
+// Returns nil (with no error) if the memory filesystem already exists.
+func getScratchDriver(args *Args, fsConnector connector.Connector) (*Driver, error) {
+    metadataIds, err := fsConnector.ListMetadata();
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    if (len(metadataIds) > 0) {
+        return nil, nil;
+    }
+
+    var key []byte = args.Key;
+    var iv []byte = args.IV;
+
+    if (key == nil) {
+        key = util.GenAESKey();
+        iv = util.GenIV();
+    }
+
+    fsDriver, err := NewDriverWithEncoding(key, iv, fsConnector, args.MetadataEncoding);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    err = fsDriver.CreateFilesystem(util.Weakhash(identity.ROOT_NAME, args.Pass));
+    if (err != nil) {
+        fsDriver.cache.Close();
+        return nil, errors.WithStack(err);
+    }
+
+    return fsDriver, nil;
 }
 
 func parseArgs() (*Args, error) {
@@ -68,22 +272,37 @@ func parseArgs() (*Args, error) {
     var awsEndpoint *string = pflag.StringP("aws-endpoint", "e", DEFAULT_AWS_ENDPOINT, "AWS endpoint to use. Empty string uses standard AWS S3, 'https://s3.wasabisys.com' uses Wasabi, etc..");
     var awsProfile *string = pflag.StringP("aws-profile", "l", DEFAULT_AWS_PROFILE, "AWS profile to use");
     var awsRegion *string = pflag.StringP("aws-region", "r", DEFAULT_AWS_REGION, "AWS region to use");
-    var connectorType *string = pflag.StringP("type", "t", "", "Connector type ('s3' or 'local')");
-    var hexKey *string = pflag.StringP("key", "k", "", "Encryption key in hex");
-    var hexIV *string = pflag.StringP("iv", "i", "", "IV in hex");
-    var path *string = pflag.StringP("path", "p", "", "Path to the filesystem");
+    var connectorType *string = pflag.StringP("type", "t", "", "Connector type ('s3', 'local', or 'memory')");
+    var hexKey *string = pflag.StringP("key", "k", "", "Encryption key in hex (instead of unlocking the key header)");
+    var hexIV *string = pflag.StringP("iv", "i", "", "IV in hex (required with --key)");
+    var keyFile *string = pflag.String("key-file", "", "File holding the passphrase for the key header (prompts if not given)");
+    var path *string = pflag.StringP("path", "p", "", "Path to the filesystem (the name of a memory filesystem)");
+    var metadataEncoding *string = pflag.String("metadata-encoding", metadata.DEFAULT_ENCODING.String(), "How to write metadata ('binary' or 'json' for debugging), add '+deflate' to compress it");
+    var memoryLimit *int64 = pflag.Int64("memory-limit", 0, "Size limit (in bytes) of a memory filesystem (0 for no limit)");
+    var s3CacheBytes *int64 = pflag.Int64("s3-cache-bytes", s3.DEFAULT_CACHE_BYTES, "Size limit (in bytes) of the S3 decrypted chunk cache (0 to turn off caching and read-ahead)");
+    var s3ReadAhead *int = pflag.Int("s3-read-ahead", s3.DEFAULT_READ_AHEAD, "Number of chunks to fetch ahead of S3 reads");
+    var s3PartsInFlight *int = pflag.Int("s3-parts-in-flight", s3.DEFAULT_PARTS_IN_FLIGHT, "Number of parts of an S3 upload to send at once (each holds a chunk in memory)");
+    var s3MaxRetries *int = pflag.Int("s3-max-retries", s3.DEFAULT_MAX_RETRIES, "Number of times to retry an S3 request after a transient failure (0 to turn off retries)");
+    var s3RetryBaseDelay *time.Duration = pflag.Duration("s3-retry-base-delay", s3.DEFAULT_RETRY_BASE_DELAY, "Delay before the first S3 retry (doubles with each retry)");
+    var s3RetryMaxDelay *time.Duration = pflag.Duration("s3-retry-max-delay", s3.DEFAULT_RETRY_MAX_DELAY, "Longest delay between S3 retries");
+    var s3DataStorageClass *string = pflag.String("s3-storage-class", s3.DEFAULT_DATA_STORAGE_CLASS, "S3 storage class for file data (dirs may override this)");
+    var s3MetadataStorageClass *string = pflag.String("s3-metadata-storage-class", s3.DEFAULT_METADATA_STORAGE_CLASS, "S3 storage class for metadata");
+    var s3Encryption *string = pflag.String("s3-sse", s3.SSE_NONE, "S3 server-side encryption ('', 'sse-s3', or 'sse-c')");
+    var s3CustomerKeyFile *string = pflag.String("s3-sse-key-file", "", "File holding the key in hex for S3 SSE-C (prompts with --s3-sse=sse-c if not given)");
+    var s3LeaseDuration *time.Duration = pflag.Duration("s3-lease-duration", s3.DEFAULT_LEASE_DURATION, "How long the lock on an S3 filesystem lasts without being renewed");
     var user *string = pflag.StringP("user", "u", "root", "User to login as");
     var pass *string = pflag.StringP("password", "w", "", "Password to use for login");
+    var mirrors *[]string = pflag.StringArray("mirror", nil, "Also keep the filesystem in this storage, as 'type:path' (eg 's3:my-bucket'), may be given more than once");
     var force *bool = pflag.BoolP("force", "f", false, "Force the filesystem to mount regardless of locks");
 
     pflag.Parse();
 
-    if (hexKey == nil || *hexKey == "") {
-        return nil, errors.New("Error: Key required.");
+    if (*hexKey != "" && *hexIV == "") {
+        return nil, errors.New("Error: IV required with a key.");
     }
 
-    if (hexIV == nil || *hexIV == "") {
-        return nil, errors.New("Error: IV required.");
+    if (*hexKey != "" && *keyFile != "") {
+        return nil, errors.New("Error: Give either a key or a key file, not both.");
     }
 
     if (connectorType == nil || *connectorType == "") {
@@ -96,14 +315,43 @@ func parseArgs() (*Args, error) {
         return nil, errors.New("Error: Path required.");
     }
 
-    key, err := hex.DecodeString(*hexKey);
-    if (err != nil) {
-        return nil, errors.Wrap(err, "Could not decode hex key.");
+    // Without a key, the key header will be used.
+    var key []byte = nil;
+    var iv []byte = nil;
+
+    if (*hexKey != "") {
+        var err error;
+
+        key, err = hex.DecodeString(*hexKey);
+        if (err != nil) {
+            return nil, errors.Wrap(err, "Could not decode hex key.");
+        }
+
+        iv, err = hex.DecodeString(*hexIV);
+        if (err != nil) {
+            return nil, errors.Wrap(err, "Could not decode hex iv.");
+        }
     }
 
-    iv, err := hex.DecodeString(*hexIV);
+    encoding, err := metadata.ParseEncoding(*metadataEncoding);
     if (err != nil) {
-        return nil, errors.Wrap(err, "Could not decode hex iv.");
+        return nil, errors.WithStack(err);
+    }
+
+    // The SSE-C key is a secret, so (like the passphrase) it never goes on the command line.
+    var s3CustomerKey []byte = nil;
+    if (*s3Encryption == s3.SSE_C) {
+        s3CustomerKeyHex, err := keyring.GetPassphrase(*s3CustomerKeyFile, "S3 SSE-C key (hex)", false);
+        if (err != nil) {
+            return nil, errors.Wrap(err, "Failed to get SSE-C key");
+        }
+
+        s3CustomerKey, err = hex.DecodeString(string(s3CustomerKeyHex));
+        if (err != nil) {
+            return nil, errors.Wrap(err, "Could not decode hex SSE-C key.");
+        }
+    } else if (*s3CustomerKeyFile != "") {
+        return nil, errors.New("Error: An SSE-C key file was given without --s3-sse=sse-c.");
     }
 
     var rtn Args = Args{
@@ -114,7 +362,22 @@ func parseArgs() (*Args, error) {
         ConnectorType: *connectorType,
         Key: key,
         IV: iv,
+        KeyFile: *keyFile,
+        MemoryLimit: *memoryLimit,
+        MetadataEncoding: encoding,
         Path: *path,
+        S3CacheBytes: *s3CacheBytes,
+        S3ReadAhead: *s3ReadAhead,
+        S3PartsInFlight: *s3PartsInFlight,
+        S3MaxRetries: *s3MaxRetries,
+        S3RetryBaseDelay: *s3RetryBaseDelay,
+        S3RetryMaxDelay: *s3RetryMaxDelay,
+        S3DataStorageClass: *s3DataStorageClass,
+        S3MetadataStorageClass: *s3MetadataStorageClass,
+        S3Encryption: *s3Encryption,
+        S3CustomerKey: s3CustomerKey,
+        S3LeaseDuration: *s3LeaseDuration,
+        Mirrors: *mirrors,
         User: *user,
         Pass: *pass,
         Force: *force,
@@ -131,7 +394,24 @@ type Args struct {
     ConnectorType string
     Key []byte
     IV []byte
+    KeyFile string
+    MemoryLimit int64
+    MetadataEncoding metadata.Encoding
     Path string
+    S3CacheBytes int64
+    S3ReadAhead int
+    S3PartsInFlight int
+    S3MaxRetries int
+    S3RetryBaseDelay time.Duration
+    S3RetryMaxDelay time.Duration
+    S3DataStorageClass string
+    S3MetadataStorageClass string
+    // See s3.ServerSideEncryption.
+    S3Encryption string
+    S3CustomerKey []byte
+    S3LeaseDuration time.Duration
+    // Other storage to keep a copy of the filesystem in, as "type:path".
+    Mirrors []string
     User string
     Pass string
     Force bool
@@ -7,12 +7,14 @@ import (
 
     "github.com/pkg/errors"
 
+    "github.com/eriq-augustine/elfs/connector"
     "github.com/eriq-augustine/elfs/dirent"
     "github.com/eriq-augustine/elfs/identity"
 )
 
 func (this *Driver) Close() {
     this.SyncToDisk(false);
+    this.cache.Close();
     this.connector.Close();
 }
 
@@ -20,6 +22,12 @@ func (this *Driver) ConnectionString() string {
     return this.connector.GetId();
 }
 
+// Why the metadata was not read from the current generation when the filesystem was loaded (nil if it was).
+// Nothing is done about it until the next checkpoint, which commits a new generation.
+func (this *Driver) MetadataFallback() error {
+    return this.metadataFallback;
+}
+
 // Create a new filesystem.
 func (this *Driver) CreateFilesystem(rootPasshash string) error {
     this.connector.PrepareStorage();
@@ -29,6 +37,8 @@ func (this *Driver) CreateFilesystem(rootPasshash string) error {
         return errors.Wrap(err, "Could not create root user.");
     }
 
+    this.lock.Lock();
+
     this.users[rootUser.Id] = rootUser;
     this.groups[rootGroup.Id] = rootGroup;
 
@@ -38,6 +48,8 @@ func (this *Driver) CreateFilesystem(rootPasshash string) error {
     this.fat[dirent.ROOT_ID] = dirent.NewDir(dirent.ROOT_ID, dirent.ROOT_NAME, dirent.ROOT_ID,
             rootUser.Id, rootGroup.Id, time.Now().Unix());
 
+    this.lock.Unlock();
+
     // Force a write of the FAT, users, and groups.
     this.SyncToDisk(true);
 
@@ -45,7 +57,8 @@ func (this *Driver) CreateFilesystem(rootPasshash string) error {
 }
 
 // Read all the metadata from disk into memory.
-// This should only be done once when the driver initializes.
+// This should only be done once when the driver initializes
+// (before it is shared between goroutines).
 func (this *Driver) SyncFromDisk() error {
     err := this.readMetadata();
     if (err != nil) {
@@ -53,11 +66,22 @@ func (this *Driver) SyncFromDisk() error {
     }
 
     // If the metadata has been successfully read, write it back out to a shadow.
-    err = this.writeMetadata(true);
+    err = this.writeMetadata(true, this.snapshotMetadata());
     if (err != nil) {
         return errors.WithStack(err);
     }
 
+    // Metadata from before the metadata envelope gets upgraded as soon as it is read,
+    // so it is never again written with a fixed IV.
+    if (this.legacyMetadata) {
+        err = this.writeMetadata(false, this.snapshotMetadata());
+        if (err != nil) {
+            return errors.Wrap(err, "Failed to upgrade legacy metadata.");
+        }
+
+        this.legacyMetadata = false;
+    }
+
     // Also check the cache for incomplete transactions.
     err = this.loadFromCache();
     if (err != nil) {
@@ -70,59 +94,191 @@ func (this *Driver) SyncFromDisk() error {
     return nil;
 }
 
-// Write all metadata to disk and clear the cache after.
+// Get all metadata changes on disk and clear the cache after.
+// Changes are appended to the journal, and every so often (or if |force|) the full tables are written (see journal.go).
 func (this *Driver) SyncToDisk(force bool) error {
+    this.syncLock.Lock();
+    defer this.syncLock.Unlock();
+
     if (!force && this.cache.IsEmpty()) {
         return nil;
     }
 
-    err := this.writeMetadata(false);
+    // Changes always go in the journal (even right before a checkpoint),
+    // so the previous generation plus the journal never falls behind the current generation.
+    err := this.syncJournal();
     if (err != nil) {
         return errors.WithStack(err);
     }
 
-    // All changes are on disk, the cache is safe to clear.
-    this.cache.Clear();
+    if (!force && this.journalSegments < JOURNAL_SEGMENTS_PER_CHECKPOINT) {
+        return nil;
+    }
 
-    return nil;
+    // Anything that changes after the segment stays in the cache for the next segment
+    // (replaying it on top of newer tables is harmless).
+    return errors.WithStack(this.writeMetadata(false, this.snapshotMetadata()));
 }
 
-func (this *Driver) readMetadata() error {
-    err := this.readFat();
+// Append everything in the cache to the journal, and then clear the cache (unless it changed in the meantime).
+// The caller must hold the sync lock.
+func (this *Driver) syncJournal() error {
+    if (this.cache.IsEmpty()) {
+        return nil;
+    }
+
+    segment, cacheGeneration := this.snapshotJournal();
+
+    err := this.appendJournal(segment);
     if (err != nil) {
         return errors.WithStack(err);
     }
 
-    err = this.readUsers();
+    this.cache.ClearGeneration(cacheGeneration);
+    return nil;
+}
+
+// Write out the full metadata tables.
+// Unless it is a shadow, this commits a new generation (see generation.go),
+// which is also a checkpoint of the journal (see journal.go).
+// The caller must hold the sync lock (or be the only one using the driver).
+func (this *Driver) writeMetadata(shadow bool, snapshot *metadataSnapshot) error {
+    if (shadow) {
+        return errors.WithStack(this.writeTables(shadowSource(), snapshot));
+    }
+
+    return errors.WithStack(this.commitGeneration(snapshot, false));
+}
+
+// Throw away unfinished uploads in the storage that are at least |minAge| old (see connector.Sweepable).
+// Only root may do this.
+func (this *Driver) SweepStaleUploads(contextUser identity.UserId, minAge time.Duration) (*connector.SweepReport, error) {
+    if (contextUser != identity.ROOT_USER_ID) {
+        return nil, errors.WithStack(NewPermissionsError("Only root can sweep the storage."));
+    }
+
+    sweepable, ok := this.connector.(connector.Sweepable);
+    if (!ok) {
+        return nil, errors.Errorf("This connector (%s) does not leave unfinished uploads.", this.connector.GetId());
+    }
+
+    report, err := sweepable.SweepStaleUploads(minAge);
     if (err != nil) {
-        return errors.WithStack(err);
+        return nil, errors.WithStack(err);
+    }
+
+    return report, nil;
+}
+
+// Copy anything that is missing from a replica of the storage (see connector.Resyncable).
+// Only root may do this.
+func (this *Driver) Resync(contextUser identity.UserId) (*connector.ResyncReport, error) {
+    if (contextUser != identity.ROOT_USER_ID) {
+        return nil, errors.WithStack(NewPermissionsError("Only root can resync the storage."));
     }
 
-    err = this.readGroups();
+    resyncable, ok := this.connector.(connector.Resyncable);
+    if (!ok) {
+        return nil, errors.Errorf("This connector (%s) does not have replicas.", this.connector.GetId());
+    }
+
+    // A new replica may not be ready for anything to be written to it.
+    err := this.connector.PrepareStorage();
     if (err != nil) {
-        return errors.WithStack(err);
+        return nil, errors.WithStack(err);
     }
 
-    return nil;
+    // Get the latest metadata into the storage first.
+    err = this.SyncToDisk(false);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    report, err := resyncable.ResyncMetadata();
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    var fileIds []dirent.Id = make([]dirent.Id, 0);
+    this.lock.RLock();
+    for id, entry := range(this.fat) {
+        if (entry.IsFile) {
+            fileIds = append(fileIds, id);
+        }
+    }
+    this.lock.RUnlock();
+
+    for _, id := range(fileIds) {
+        fileReport, err := this.resyncFile(resyncable, id);
+        if (err != nil) {
+            return nil, errors.WithStack(err);
+        }
+
+        report.Add(fileReport);
+    }
+
+    return report, nil;
 }
 
-func (this *Driver) writeMetadata(shadow bool) error {
-    err := this.writeFat(shadow);
+func (this *Driver) resyncFile(resyncable connector.Resyncable, id dirent.Id) (*connector.ResyncReport, error) {
+    this.fileLocks.Lock(id);
+    defer this.fileLocks.Unlock(id);
+
+    // The file may have changed (or gone away) since it was listed.
+    this.lock.RLock();
+    fileInfo, ok := this.fat[id];
+    if (ok) {
+        fileInfo = fileInfo.Clone();
+    }
+    this.lock.RUnlock();
+
+    if (!ok) {
+        return &connector.ResyncReport{}, nil;
+    }
+
+    this.lock.RLock();
+    fileCipher, err := this.fileCipher(fileInfo);
+    this.lock.RUnlock();
+
     if (err != nil) {
-        return errors.WithStack(err);
+        return nil, errors.WithStack(err);
+    }
+
+    report, err := resyncable.ResyncData(fileInfo, fileCipher);
+    if (err != nil) {
+        return nil, errors.Wrap(err, string(id));
+    }
+
+    return report, nil;
+}
+
+// Rewrite all the metadata in the current format (see metadata/migrate.go).
+// Metadata in an older format is migrated whenever it is read, but it stays in that format in storage until it is rewritten.
+// Only root may do this.
+func (this *Driver) UpgradeMetadata(contextUser identity.UserId) error {
+    if (contextUser != identity.ROOT_USER_ID) {
+        return errors.WithStack(NewPermissionsError("Only root can upgrade the metadata."));
     }
 
-    err = this.writeUsers(shadow);
+    // Gets the cache into storage (and out of the local cache file).
+    err := this.SyncToDisk(true);
     if (err != nil) {
         return errors.WithStack(err);
     }
 
-    err = this.writeGroups(shadow);
+    this.syncLock.Lock();
+    defer this.syncLock.Unlock();
+
+    // Another generation replaces the previous one (which may still be in an older format),
+    // and the journal segments that the previous one needed go with it.
+    var snapshot *metadataSnapshot = this.snapshotMetadata();
+
+    err = this.writeMetadata(false, snapshot);
     if (err != nil) {
         return errors.WithStack(err);
     }
 
-    return nil;
+    return errors.WithStack(this.writeMetadata(true, snapshot));
 }
 
 // Read the cache and if there are entries, sync them to disk.
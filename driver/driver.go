@@ -7,6 +7,8 @@ package driver;
 import (
    "crypto/aes"
    "crypto/cipher"
+   "os"
+   "sync"
 
    "github.com/pkg/errors"
 
@@ -14,27 +16,91 @@ import (
    "github.com/eriq-augustine/elfs/connector"
    "github.com/eriq-augustine/elfs/dirent"
    "github.com/eriq-augustine/elfs/identity"
+   "github.com/eriq-augustine/elfs/metadata"
 )
 
+// A driver is safe to use from multiple goroutines.
+// All the in-memory metadata (fat, dirs, users, and groups) is guarded by |lock|,
+// which is never held while talking to the connector.
+// Callers only ever get copies of dirents, users, and groups.
 type Driver struct {
+   lock *sync.RWMutex
+   // Serializes writing out the metadata tables.
+   syncLock *sync.Mutex
+   // Serializes IO on the backing object of a single file.
+   fileLocks *fileLockMap
    connector connector.Connector
+   // The master key.
+   // Metadata is encrypted with it, and it wraps the per-file keys (see keys.go).
+   // Only kept around as the file key of files from before per-file keys.
+   key []byte
+   // Guarded by |lock| (and |syncLock|), since it changes when the master key is rotated.
    blockCipher cipher.Block
+   // The cipher that metadata is read and written with.
+   // The same as |blockCipher|, except while the master key is being rotated (see rotateKey()).
+   // Guarded by |syncLock|.
+   metadataCipher cipher.Block
+   // The version of each table is the last journal segment that it includes (see journal.go).
    fatVersion int
    fat map[dirent.Id]*dirent.Dirent
    usersVersion int
    users map[identity.UserId]*identity.User
    groupsVersion int
    groups map[identity.GroupId]*identity.Group
+   // The sequence number of the last journal segment, and how many segments there are since the last checkpoint.
+   // Guarded by |syncLock|.
+   journalSequence int
+   journalSegments int
+   // The generation that the tables were read from or last committed as (see generation.go),
+   // and the journal sequence that it includes.
+   // Guarded by |syncLock|.
+   generation int
+   generationSequence int
+   // Why the metadata was not read from the current generation (nil if it was).
+   metadataFallback error
    cache *cache.MetadataCache
    // A map of all directories to their children.
    dirs map[dirent.Id][]*dirent.Dirent
    // Base IV for metadata tables.
+   // Metadata is now written with a fresh IV every time (see cipherio.NewMetadataWriter),
+   // so these are only used to read metadata written before that.
    iv []byte
-   // Speific IVs for metadata tables.
+   // Speific (legacy) IVs for metadata tables.
    usersIV []byte
    groupsIV []byte
    fatIV []byte
    cacheIV []byte
+   // Set if any metadata table was read in the legacy format and needs to be rewritten.
+   legacyMetadata bool
+   // How metadata tables are written (any encoding can be read).
+   metadataEncoding metadata.Encoding
+}
+
+// Get a driver for an existing connector and load any existing filesystem.
+// The driver takes ownership of the connector.
+func NewDriverWithConnector(key []byte, iv []byte, fsConnector connector.Connector) (*Driver, error) {
+   return NewDriverWithEncoding(key, iv, fsConnector, metadata.DEFAULT_ENCODING);
+}
+
+// Same as NewDriverWithConnector(), but metadata is written with |encoding| (see metadata.Encoding).
+func NewDriverWithEncoding(key []byte, iv []byte, fsConnector connector.Connector, encoding metadata.Encoding) (*Driver, error) {
+   driver, err := newDriver(key, iv, fsConnector);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   driver.metadataEncoding = encoding;
+   driver.cache.SetEncoding(encoding);
+
+   // Try to init the filesystem from any existing metadata.
+   err = driver.SyncFromDisk();
+   if (err != nil && errors.Cause(err) != nil && !os.IsNotExist(errors.Cause(err))) {
+      // The connector is still the caller's to close.
+      driver.cache.Close();
+      return nil, errors.WithStack(err);
+   }
+
+   return driver, nil;
 }
 
 // Get a new, uninitialized driver.
@@ -48,14 +114,24 @@ func newDriver(key []byte, iv []byte, connector connector.Connector) (*Driver, e
    }
 
    var driver Driver = Driver{
+      lock: &sync.RWMutex{},
+      syncLock: &sync.Mutex{},
+      fileLocks: newFileLockMap(),
       connector: connector,
+      key: append([]byte(nil), key...),
       blockCipher: blockCipher,
+      metadataCipher: blockCipher,
       fatVersion: 0,
       fat: make(map[dirent.Id]*dirent.Dirent),
       usersVersion: 0,
       users: make(map[identity.UserId]*identity.User),
       groupsVersion: 0,
       groups: make(map[identity.GroupId]*identity.Group),
+      journalSequence: 0,
+      journalSegments: 0,
+      generation: NO_GENERATION,
+      generationSequence: NO_SEQUENCE,
+      metadataFallback: nil,
       cache: nil,
       dirs: make(map[dirent.Id][]*dirent.Dirent),
       iv: iv,
@@ -63,6 +139,8 @@ func newDriver(key []byte, iv []byte, connector connector.Connector) (*Driver, e
       groupsIV: nil,
       fatIV: nil,
       cacheIV: nil,
+      legacyMetadata: false,
+      metadataEncoding: metadata.DEFAULT_ENCODING,
    };
 
    driver.initIVs();
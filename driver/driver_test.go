@@ -0,0 +1,285 @@
+package driver;
+
+// A driver is safe to use from multiple goroutines (run these with -race).
+
+import (
+   "bytes"
+   "crypto/md5"
+   "encoding/hex"
+   "fmt"
+   "io/ioutil"
+   "sync"
+   "testing"
+
+   "github.com/eriq-augustine/elfs/connector/memory"
+   "github.com/eriq-augustine/elfs/identity"
+   "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+   TEST_PASS = "pass"
+   TEST_WORKERS = 8
+   TEST_ROUNDS = 5
+   TEST_FILE_SIZE = 64 * 1024
+   TEST_EDIT_SIZE = 1024
+)
+
+// A new filesystem on a new memory store.
+// Returns the driver and what is needed to open the filesystem again.
+func newTestDriver(t *testing.T) (*Driver, string, []byte, []byte) {
+   var name string = "drivertest-" + util.RandomString(8);
+   var key []byte = util.GenAESKey();
+   var iv []byte = util.GenIV();
+
+   return openTestDriver(t, name, key, iv, true), name, key, iv;
+}
+
+func openTestDriver(t *testing.T, name string, key []byte, iv []byte, create bool) *Driver {
+   fsConnector, err := memory.NewMemoryConnector(name, 0, false);
+   if (err != nil) {
+      t.Fatalf("Failed to open memory store: %+v", err);
+   }
+
+   fsDriver, err := NewDriverWithConnector(key, iv, fsConnector);
+   if (err != nil) {
+      fsConnector.Close();
+      t.Fatalf("Failed to make driver: %+v", err);
+   }
+
+   if (create) {
+      err = fsDriver.CreateFilesystem(util.Weakhash(identity.ROOT_NAME, TEST_PASS));
+      if (err != nil) {
+         fsDriver.Close();
+         t.Fatalf("Failed to create filesystem: %+v", err);
+      }
+   }
+
+   return fsDriver;
+}
+
+func closeTestDriver(t *testing.T, fsDriver *Driver, name string) {
+   fsDriver.Close();
+
+   err := memory.RemoveStore(name);
+   if (err != nil) {
+      t.Errorf("Failed to remove memory store: %+v", err);
+   }
+}
+
+func readTestPath(fsDriver *Driver, path string) ([]byte, error) {
+   reader, err := fsDriver.ReadPath(identity.ROOT_USER_ID, path);
+   if (err != nil) {
+      return nil, err;
+   }
+   defer reader.Close();
+
+   return ioutil.ReadAll(reader);
+}
+
+// Every worker makes its own dirs and files (along with paths shared by all the workers),
+// writes and edits its files, and reads them back;
+// while the metadata is synced to disk.
+// Afterwards, the filesystem must load with every file intact.
+func TestConcurrentIO(t *testing.T) {
+   fsDriver, name, key, iv := newTestDriver(t);
+
+   var contents [][]byte = make([][]byte, TEST_WORKERS);
+   var errs chan error = make(chan error, TEST_WORKERS + 1);
+   var done chan bool = make(chan bool);
+
+   var workers sync.WaitGroup;
+   for i := 0; i < TEST_WORKERS; i++ {
+      workers.Add(1);
+      go func(worker int) {
+         defer workers.Done();
+         content, err := runTestWorker(fsDriver, worker);
+         if (err != nil) {
+            errs <- fmt.Errorf("Worker %d: %+v", worker, err);
+            return;
+         }
+         contents[worker] = content;
+      }(i);
+   }
+
+   var syncer sync.WaitGroup;
+   syncer.Add(1);
+   go func() {
+      defer syncer.Done();
+      for {
+         select {
+            case <-done:
+               return;
+            default:
+         }
+
+         err := fsDriver.SyncToDisk(false);
+         if (err != nil) {
+            errs <- fmt.Errorf("Sync: %+v", err);
+            return;
+         }
+      }
+   }();
+
+   workers.Wait();
+   close(done);
+   syncer.Wait();
+   close(errs);
+
+   for err := range(errs) {
+      t.Error(err);
+   }
+
+   if (t.Failed()) {
+      closeTestDriver(t, fsDriver, name);
+      return;
+   }
+
+   // Load the filesystem again and check every file.
+   fsDriver.Close();
+   fsDriver = openTestDriver(t, name, key, iv, false);
+   defer closeTestDriver(t, fsDriver, name);
+
+   for i := 0; i < TEST_WORKERS; i++ {
+      data, err := readTestPath(fsDriver, testWorkerPath(i));
+      if (err != nil) {
+         t.Fatalf("Worker %d: failed to read file after reload: %+v", i, err);
+      }
+
+      if (!bytes.Equal(data, contents[i])) {
+         t.Fatalf("Worker %d: file does not match after reload.", i);
+      }
+   }
+}
+
+func testWorkerPath(worker int) string {
+   return fmt.Sprintf("/shared/worker_%d/data.bin", worker);
+}
+
+// Returns the final content of the worker's file.
+func runTestWorker(fsDriver *Driver, worker int) ([]byte, error) {
+   var path string = testWorkerPath(worker);
+   var content []byte;
+
+   for round := 0; round < TEST_ROUNDS; round++ {
+      // Every worker makes the shared dir, along with its own.
+      _, err := fsDriver.MkdirAll(identity.ROOT_USER_ID, "/shared");
+      if (err != nil) {
+         return nil, err;
+      }
+
+      _, err = fsDriver.MkdirAll(identity.ROOT_USER_ID, fmt.Sprintf("/shared/worker_%d/round_%d", worker, round));
+      if (err != nil) {
+         return nil, err;
+      }
+
+      content = util.RandomBytes(TEST_FILE_SIZE);
+      fileId, err := fsDriver.PutPath(identity.ROOT_USER_ID, path, bytes.NewReader(content));
+      if (err != nil) {
+         return nil, err;
+      }
+
+      var edit []byte = util.RandomBytes(TEST_EDIT_SIZE);
+      var offset int = (round * TEST_EDIT_SIZE * 7) % (TEST_FILE_SIZE - TEST_EDIT_SIZE);
+      _, err = fsDriver.WriteAt(identity.ROOT_USER_ID, fileId, edit, int64(offset));
+      if (err != nil) {
+         return nil, err;
+      }
+      copy(content[offset:], edit);
+
+      data, err := readTestPath(fsDriver, path);
+      if (err != nil) {
+         return nil, err;
+      }
+
+      if (!bytes.Equal(data, content)) {
+         return nil, fmt.Errorf("Read does not match what was written in round %d.", round);
+      }
+   }
+
+   return content, nil;
+}
+
+// Reads of a file while it is being edited see the file either before or after each edit.
+// The edits clear the md5, and a repairing fsck fills it back in.
+func TestReadDuringEdit(t *testing.T) {
+   fsDriver, name, _, _ := newTestDriver(t);
+   defer closeTestDriver(t, fsDriver, name);
+
+   var path string = "/edited.bin";
+   var content []byte = util.RandomBytes(TEST_FILE_SIZE);
+   fileId, err := fsDriver.PutPath(identity.ROOT_USER_ID, path, bytes.NewReader(content));
+   if (err != nil) {
+      t.Fatalf("Failed to put file: %+v", err);
+   }
+
+   var errs chan error = make(chan error, 2);
+   var done chan bool = make(chan bool);
+
+   var readers sync.WaitGroup;
+   readers.Add(1);
+   go func() {
+      defer readers.Done();
+      for {
+         select {
+            case <-done:
+               return;
+            default:
+         }
+
+         data, err := readTestPath(fsDriver, path);
+         if (err != nil) {
+            errs <- fmt.Errorf("Read: %+v", err);
+            return;
+         }
+
+         if (len(data) != TEST_FILE_SIZE) {
+            errs <- fmt.Errorf("Read %d bytes, expected %d.", len(data), TEST_FILE_SIZE);
+            return;
+         }
+      }
+   }();
+
+   for round := 0; round < TEST_ROUNDS * 4; round++ {
+      var edit []byte = util.RandomBytes(TEST_EDIT_SIZE);
+      var offset int = (round * TEST_EDIT_SIZE * 3) % (TEST_FILE_SIZE - TEST_EDIT_SIZE);
+
+      _, err = fsDriver.WriteAt(identity.ROOT_USER_ID, fileId, edit, int64(offset));
+      if (err != nil) {
+         errs <- fmt.Errorf("WriteAt: %+v", err);
+         break;
+      }
+      copy(content[offset:], edit);
+   }
+
+   close(done);
+   readers.Wait();
+   close(errs);
+
+   for err := range(errs) {
+      t.Fatal(err);
+   }
+
+   fileInfo, err := fsDriver.GetDirent(identity.ROOT_USER_ID, fileId);
+   if (err != nil) {
+      t.Fatalf("Failed to get file: %+v", err);
+   }
+
+   if (fileInfo.Md5 != "") {
+      t.Fatalf("Md5 after edits is (%s), expected none.", fileInfo.Md5);
+   }
+
+   report, err := fsDriver.Fsck(identity.ROOT_USER_ID, FsckOptions{VerifyData: true, Repair: true});
+   if (err != nil || len(report.Problems) != 0) {
+      t.Fatalf("Bad fsck (%+v): %+v", report, err);
+   }
+
+   fileInfo, err = fsDriver.GetDirent(identity.ROOT_USER_ID, fileId);
+   if (err != nil) {
+      t.Fatalf("Failed to get file: %+v", err);
+   }
+
+   var expectedMd5 [md5.Size]byte = md5.Sum(content);
+   if (fileInfo.Md5 != hex.EncodeToString(expectedMd5[:])) {
+      t.Fatalf("Md5 after fsck is (%s), expected (%s).", fileInfo.Md5, hex.EncodeToString(expectedMd5[:]));
+   }
+}
@@ -0,0 +1,425 @@
+package driver;
+
+// Checking (and repairing) the consistency of a filesystem.
+
+import (
+    "fmt"
+    "sort"
+    "time"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/dirent"
+    "github.com/eriq-augustine/elfs/identity"
+)
+
+const (
+    LOST_AND_FOUND_NAME = "lost+found"
+
+    // A dirent whose parent does not exist (or is a file).
+    FSCK_ORPHAN = "orphan"
+    // A directory that is its own ancestor.
+    FSCK_CYCLE = "cycle"
+    FSCK_DUPLICATE_NAME = "duplicate-name"
+    FSCK_BAD_OWNER = "bad-owner"
+    FSCK_BAD_GROUP = "bad-group"
+    // A data object that no dirent refers to.
+    FSCK_UNREFERENCED_OBJECT = "unreferenced-object"
+    // A file whose data object does not exist.
+    FSCK_MISSING_OBJECT = "missing-object"
+    FSCK_SIZE_MISMATCH = "size-mismatch"
+    FSCK_MD5_MISMATCH = "md5-mismatch"
+    FSCK_READ_ERROR = "read-error"
+)
+
+type FsckOptions struct {
+    // Re-read every file to check its size and md5.
+    VerifyData bool
+    // Fix what can be fixed.
+    // Orphans (and cycles) are moved into /lost+found, duplicate names get renamed,
+    // bad owners/groups are given to root, and unreferenced objects are quarantined.
+    // Problems with file data are only reported (but files without an md5 get one).
+    Repair bool
+    // Remove unreferenced objects instead of quarantining them.
+    DeleteUnreferenced bool
+}
+
+type FsckProblem struct {
+    Type string
+    // A dirent id, or the id of an unreferenced object.
+    Id dirent.Id
+    Message string
+    Repaired bool
+}
+
+type FsckReport struct {
+    Problems []*FsckProblem
+    FilesChecked int
+}
+
+func (this *FsckReport) Unrepaired() int {
+    var count int = 0;
+    for _, problem := range(this.Problems) {
+        if (!problem.Repaired) {
+            count++;
+        }
+    }
+
+    return count;
+}
+
+func (this *FsckReport) add(problemType string, id dirent.Id, message string) *FsckProblem {
+    var problem FsckProblem = FsckProblem{
+        Type: problemType,
+        Id: id,
+        Message: message,
+        Repaired: false,
+    };
+
+    this.Problems = append(this.Problems, &problem);
+    return &problem;
+}
+
+// Check the filesystem for problems (and repair them if asked).
+// Only root may do this, and the filesystem should not be in use by anything else.
+func (this *Driver) Fsck(contextUser identity.UserId, options FsckOptions) (*FsckReport, error) {
+    if (contextUser != identity.ROOT_USER_ID) {
+        return nil, errors.WithStack(NewPermissionsError("Only root can check the filesystem."));
+    }
+
+    var report FsckReport = FsckReport{
+        Problems: make([]*FsckProblem, 0),
+        FilesChecked: 0,
+    };
+
+    this.lock.Lock();
+    err := this.fsckMetadata(&report, options);
+    var files []*dirent.Dirent = make([]*dirent.Dirent, 0);
+    for _, direntInfo := range(this.fat) {
+        if (direntInfo.IsFile) {
+            files = append(files, direntInfo.Clone());
+        }
+    }
+    this.lock.Unlock();
+
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    sort.Slice(files, func(i int, j int) bool {
+        return files[i].Id < files[j].Id;
+    });
+
+    missing, err := this.fsckObjects(&report, options, files);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    if (options.VerifyData) {
+        this.fsckData(&report, options, files, missing);
+    }
+
+    if (options.Repair) {
+        err = this.SyncToDisk(true);
+        if (err != nil) {
+            return nil, errors.Wrap(err, "Failed to write repaired metadata");
+        }
+    }
+
+    return &report, nil;
+}
+
+// Check the structure of the FAT and the users/groups it refers to.
+// The caller must hold the write lock.
+func (this *Driver) fsckMetadata(report *FsckReport, options FsckOptions) error {
+    root, ok := this.fat[dirent.ROOT_ID];
+    if (!ok || root.IsFile) {
+        return errors.New("The filesystem has no root directory, it cannot be checked.");
+    }
+
+    var ids []dirent.Id = make([]dirent.Id, 0, len(this.fat));
+    for id, _ := range(this.fat) {
+        ids = append(ids, id);
+    }
+    sort.Slice(ids, func(i int, j int) bool {
+        return ids[i] < ids[j];
+    });
+
+    // Find the dirents that are cut off from root.
+    // Only the top of a cut off tree is reported (moving it will bring along everything under it).
+    var detached []*FsckProblem = make([]*FsckProblem, 0);
+    var reachable map[dirent.Id]bool = make(map[dirent.Id]bool);
+    reachable[dirent.ROOT_ID] = true;
+
+    for _, id := range(ids) {
+        // The path we walked up to get here, and the index of each dirent in it.
+        var path []dirent.Id = make([]dirent.Id, 0);
+        var seen map[dirent.Id]int = make(map[dirent.Id]int);
+
+        var current dirent.Id = id;
+        for {
+            _, known := reachable[current];
+            if (known) {
+                break;
+            }
+
+            index, ok := seen[current];
+            if (ok) {
+                // Break the cycle at its smallest id.
+                var cycle []dirent.Id = path[index:];
+                var top dirent.Id = cycle[0];
+                for _, member := range(cycle) {
+                    if (member < top) {
+                        top = member;
+                    }
+                }
+
+                detached = append(detached, report.add(FSCK_CYCLE, top,
+                        fmt.Sprintf("Directory is its own ancestor (cycle of %d).", len(cycle))));
+                break;
+            }
+
+            seen[current] = len(path);
+            path = append(path, current);
+
+            var parentId dirent.Id = this.fat[current].Parent;
+            parent, ok := this.fat[parentId];
+            if (!ok || parent.IsFile) {
+                detached = append(detached, report.add(FSCK_ORPHAN, current,
+                        fmt.Sprintf("Parent (%s) does not exist or is not a directory.", string(parentId))));
+                break;
+            }
+
+            current = parentId;
+        }
+
+        // Everything on this path will be reachable (once repaired) or has already been reported.
+        for _, member := range(path) {
+            reachable[member] = true;
+        }
+    }
+
+    if (options.Repair && len(detached) > 0) {
+        lostAndFound, err := this.getLostAndFound();
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+
+        for _, problem := range(detached) {
+            this.fat[problem.Id].Parent = lostAndFound;
+            this.cache.CacheDirentPut(this.fat[problem.Id]);
+            problem.Repaired = true;
+        }
+    }
+
+    this.dirs = dirent.BuildDirs(this.fat);
+
+    // Duplicate names (the oldest dirent keeps the name).
+    // Look at the rebuilt dirs, since /lost+found may be new.
+    var dirIds []dirent.Id = make([]dirent.Id, 0, len(this.dirs));
+    for id, _ := range(this.dirs) {
+        dirIds = append(dirIds, id);
+    }
+    sort.Slice(dirIds, func(i int, j int) bool {
+        return dirIds[i] < dirIds[j];
+    });
+
+    for _, id := range(dirIds) {
+
+        var children []*dirent.Dirent = append([]*dirent.Dirent(nil), this.dirs[id]...);
+        sort.Slice(children, func(i int, j int) bool {
+            if (children[i].CreateTimestamp != children[j].CreateTimestamp) {
+                return children[i].CreateTimestamp < children[j].CreateTimestamp;
+            }
+
+            return children[i].Id < children[j].Id;
+        });
+
+        var names map[string]bool = make(map[string]bool);
+        for _, child := range(children) {
+            _, ok := names[child.Name];
+            if (!ok) {
+                names[child.Name] = true;
+                continue;
+            }
+
+            var problem *FsckProblem = report.add(FSCK_DUPLICATE_NAME, child.Id,
+                    fmt.Sprintf("Another dirent in directory (%s) is already named '%s'.", string(id), child.Name));
+
+            if (options.Repair) {
+                child.Name = child.Name + "." + string(child.Id);
+                this.cache.CacheDirentPut(child);
+                problem.Repaired = true;
+            }
+
+            names[child.Name] = true;
+        }
+    }
+
+    // Owners and groups.
+    for _, id := range(ids) {
+        var direntInfo *dirent.Dirent = this.fat[id];
+
+        _, ok := this.users[direntInfo.Owner];
+        if (!ok) {
+            var problem *FsckProblem = report.add(FSCK_BAD_OWNER, id,
+                    fmt.Sprintf("Owner (%d) does not exist.", int(direntInfo.Owner)));
+
+            if (options.Repair) {
+                direntInfo.Owner = identity.ROOT_USER_ID;
+                this.cache.CacheDirentPut(direntInfo);
+                problem.Repaired = true;
+            }
+        }
+
+        _, ok = this.groups[direntInfo.Group];
+        if (!ok) {
+            var problem *FsckProblem = report.add(FSCK_BAD_GROUP, id,
+                    fmt.Sprintf("Group (%d) does not exist.", int(direntInfo.Group)));
+
+            if (options.Repair) {
+                direntInfo.Group = identity.ROOT_GROUP_ID;
+                this.cache.CacheDirentPut(direntInfo);
+                problem.Repaired = true;
+            }
+        }
+    }
+
+    return nil;
+}
+
+// Get (or make) /lost+found.
+// The caller must hold the write lock.
+func (this *Driver) getLostAndFound() (dirent.Id, error) {
+    for _, direntInfo := range(this.fat) {
+        if (direntInfo.Parent == dirent.ROOT_ID && direntInfo.Id != dirent.ROOT_ID && direntInfo.Name == LOST_AND_FOUND_NAME) {
+            if (direntInfo.IsFile) {
+                return dirent.EMPTY_ID, errors.Errorf("/%s is a file.", LOST_AND_FOUND_NAME);
+            }
+
+            return direntInfo.Id, nil;
+        }
+    }
+
+    var lostAndFound *dirent.Dirent = dirent.NewDir(this.getNewDirentId(), LOST_AND_FOUND_NAME, dirent.ROOT_ID,
+            identity.ROOT_USER_ID, identity.ROOT_GROUP_ID, time.Now().Unix());
+    this.fat[lostAndFound.Id] = lostAndFound;
+    this.cache.CacheDirentPut(lostAndFound);
+
+    return lostAndFound.Id, nil;
+}
+
+// Compare the data objects against the files.
+// Returns the files that have no object.
+func (this *Driver) fsckObjects(report *FsckReport, options FsckOptions, files []*dirent.Dirent) (map[dirent.Id]bool, error) {
+    var missing map[dirent.Id]bool = make(map[dirent.Id]bool);
+
+    objectIds, err := this.connector.ListData("");
+    if (err != nil) {
+        return nil, errors.Wrap(err, "Failed to list data objects");
+    }
+
+    var objects map[dirent.Id]bool = make(map[dirent.Id]bool, len(objectIds));
+    for _, id := range(objectIds) {
+        objects[id] = true;
+    }
+
+    var fileIds map[dirent.Id]bool = make(map[dirent.Id]bool, len(files));
+    for _, file := range(files) {
+        fileIds[file.Id] = true;
+
+        _, ok := objects[file.Id];
+        if (!ok) {
+            missing[file.Id] = true;
+            report.add(FSCK_MISSING_OBJECT, file.Id, "File has no data object.");
+        }
+    }
+
+    sort.Slice(objectIds, func(i int, j int) bool {
+        return objectIds[i] < objectIds[j];
+    });
+
+    for _, id := range(objectIds) {
+        _, ok := fileIds[id];
+        if (ok) {
+            continue;
+        }
+
+        var problem *FsckProblem = report.add(FSCK_UNREFERENCED_OBJECT, id, "No file refers to this data object.");
+        if (!options.Repair) {
+            continue;
+        }
+
+        auditable, canQuarantine := this.connector.(connector.Auditable);
+        if (options.DeleteUnreferenced) {
+            err = this.connector.RemoveFile(&dirent.Dirent{Id: id});
+        } else if (canQuarantine) {
+            err = auditable.QuarantineData(id);
+        } else {
+            err = errors.New("This connector cannot quarantine objects.");
+        }
+
+        if (err != nil) {
+            problem.Message = fmt.Sprintf("%s Repair failed: %v", problem.Message, err);
+            continue;
+        }
+
+        problem.Repaired = true;
+    }
+
+    return missing, nil;
+}
+
+// Re-read every file (that has an object) and check its size and md5.
+// Files without an md5 (see dirent.Dirent) only get their size checked, and are given their md5 when repairing.
+func (this *Driver) fsckData(report *FsckReport, options FsckOptions, files []*dirent.Dirent, missing map[dirent.Id]bool) {
+    for _, file := range(files) {
+        _, ok := missing[file.Id];
+        if (ok) {
+            continue;
+        }
+
+        size, md5String, err := this.fsckReadFile(file);
+        report.FilesChecked++;
+
+        if (err != nil) {
+            report.add(FSCK_READ_ERROR, file.Id, fmt.Sprintf("%v", err));
+            continue;
+        }
+
+        if (size != file.Size) {
+            report.add(FSCK_SIZE_MISMATCH, file.Id, fmt.Sprintf("Expected size: %d, Found: %d.", file.Size, size));
+        }
+
+        if (file.Md5 != "" && md5String != file.Md5) {
+            report.add(FSCK_MD5_MISMATCH, file.Id, fmt.Sprintf("Expected md5: %s, Found: %s.", file.Md5, md5String));
+        }
+
+        if (file.Md5 == "" && size == file.Size && options.Repair) {
+            this.lock.Lock();
+            currentInfo, ok := this.fat[file.Id];
+            if (ok && currentInfo.Md5 == "") {
+                currentInfo.Md5 = md5String;
+                this.cache.CacheDirentPut(currentInfo);
+            }
+            this.lock.Unlock();
+        }
+    }
+}
+
+// Returns: (size, md5 hash (hex), error).
+func (this *Driver) fsckReadFile(file *dirent.Dirent) (uint64, string, error) {
+    this.fileLocks.Lock(file.Id);
+    defer this.fileLocks.Unlock(file.Id);
+
+    this.lock.RLock();
+    fileCipher, err := this.fileCipher(file);
+    this.lock.RUnlock();
+
+    if (err != nil) {
+        return 0, "", errors.WithStack(err);
+    }
+
+    return this.hashFileData(file, fileCipher);
+}
@@ -0,0 +1,236 @@
+package driver;
+
+import (
+    "bytes"
+    "fmt"
+    "testing"
+    "time"
+
+    "github.com/eriq-augustine/elfs/connector/memory"
+    "github.com/eriq-augustine/elfs/dirent"
+    "github.com/eriq-augustine/elfs/identity"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+    TEST_BAD_USER_ID = identity.UserId(999)
+    TEST_BAD_GROUP_ID = identity.GroupId(999)
+)
+
+// The dirents (and objects) that were broken on purpose.
+type fsckTestDamage struct {
+    orphan dirent.Id
+    // The smallest id in the cycle.
+    cycle dirent.Id
+    // The newer of the two dirents with the same name.
+    duplicate dirent.Id
+    badOwner dirent.Id
+    badGroup dirent.Id
+    unreferenced dirent.Id
+    missing dirent.Id
+    badMd5 dirent.Id
+}
+
+func newFsckTestDir(fsDriver *Driver, name string, parent dirent.Id, timestamp int64) *dirent.Dirent {
+    var dir *dirent.Dirent = dirent.NewDir(fsDriver.getNewDirentId(), name, parent,
+            identity.ROOT_USER_ID, identity.ROOT_GROUP_ID, timestamp);
+    fsDriver.fat[dir.Id] = dir;
+    return dir;
+}
+
+// Break a filesystem in every way that fsck knows about (once each).
+func damageTestFilesystem(t *testing.T, fsDriver *Driver) *fsckTestDamage {
+    var damage fsckTestDamage;
+    var ids map[string]dirent.Id = make(map[string]dirent.Id);
+
+    for _, name := range([]string{"unreferenced", "missing", "bad-md5", "intact"}) {
+        id, err := fsDriver.PutPath(identity.ROOT_USER_ID, "/" + name, bytes.NewReader(util.RandomBytes(TEST_FILE_SIZE)));
+        if (err != nil) {
+            t.Fatalf("Failed to put %s: %+v", name, err);
+        }
+
+        ids[name] = id;
+    }
+
+    damage.unreferenced = ids["unreferenced"];
+    damage.missing = ids["missing"];
+    damage.badMd5 = ids["bad-md5"];
+
+    err := fsDriver.connector.RemoveFile(&dirent.Dirent{Id: damage.missing});
+    if (err != nil) {
+        t.Fatalf("Failed to remove object: %+v", err);
+    }
+
+    var now int64 = time.Now().Unix();
+
+    fsDriver.lock.Lock();
+    defer fsDriver.lock.Unlock();
+
+    delete(fsDriver.fat, damage.unreferenced);
+    fsDriver.fat[damage.badMd5].Md5 = "00000000000000000000000000000000";
+
+    damage.orphan = newFsckTestDir(fsDriver, "orphan", dirent.NewId(), now).Id;
+
+    var first *dirent.Dirent = newFsckTestDir(fsDriver, "cycle-a", dirent.ROOT_ID, now);
+    var second *dirent.Dirent = newFsckTestDir(fsDriver, "cycle-b", first.Id, now);
+    first.Parent = second.Id;
+    damage.cycle = first.Id;
+    if (second.Id < first.Id) {
+        damage.cycle = second.Id;
+    }
+
+    newFsckTestDir(fsDriver, "dup", dirent.ROOT_ID, now - 10);
+    damage.duplicate = newFsckTestDir(fsDriver, "dup", dirent.ROOT_ID, now).Id;
+
+    var badOwner *dirent.Dirent = newFsckTestDir(fsDriver, "bad-owner", dirent.ROOT_ID, now);
+    badOwner.Owner = TEST_BAD_USER_ID;
+    damage.badOwner = badOwner.Id;
+
+    var badGroup *dirent.Dirent = newFsckTestDir(fsDriver, "bad-group", dirent.ROOT_ID, now);
+    badGroup.Group = TEST_BAD_GROUP_ID;
+    damage.badGroup = badGroup.Id;
+
+    fsDriver.dirs = dirent.BuildDirs(fsDriver.fat);
+
+    return &damage;
+}
+
+// Check that |report| has exactly the problems in |expected| (type: id), and which are repaired.
+func checkFsckReport(report *FsckReport, expected map[string]dirent.Id, repaired map[string]bool) error {
+    var found map[string]bool = make(map[string]bool);
+
+    for _, problem := range(report.Problems) {
+        id, ok := expected[problem.Type];
+        if (!ok || id != problem.Id || found[problem.Type]) {
+            return fmt.Errorf("Unexpected problem: %+v", problem);
+        }
+
+        if (problem.Repaired != repaired[problem.Type]) {
+            return fmt.Errorf("Problem was repaired: %v, expected: %v: %+v", problem.Repaired, repaired[problem.Type], problem);
+        }
+
+        found[problem.Type] = true;
+    }
+
+    for problemType, _ := range(expected) {
+        if (!found[problemType]) {
+            return fmt.Errorf("Problem was not found: %s (%s).", problemType, string(expected[problemType]));
+        }
+    }
+
+    return nil;
+}
+
+func TestFsck(t *testing.T) {
+    fsDriver, name, key, iv := newTestDriver(t);
+    defer memory.RemoveStore(name);
+
+    var damage *fsckTestDamage = damageTestFilesystem(t, fsDriver);
+
+    // Problems with file data cannot be repaired.
+    var unrepairable map[string]dirent.Id = map[string]dirent.Id{
+        FSCK_MISSING_OBJECT: damage.missing,
+        FSCK_MD5_MISMATCH: damage.badMd5,
+    };
+
+    var expected map[string]dirent.Id = map[string]dirent.Id{
+        FSCK_ORPHAN: damage.orphan,
+        FSCK_CYCLE: damage.cycle,
+        FSCK_DUPLICATE_NAME: damage.duplicate,
+        FSCK_BAD_OWNER: damage.badOwner,
+        FSCK_BAD_GROUP: damage.badGroup,
+        FSCK_UNREFERENCED_OBJECT: damage.unreferenced,
+    };
+
+    var repaired map[string]bool = make(map[string]bool);
+    for problemType, id := range(unrepairable) {
+        expected[problemType] = id;
+    }
+
+    // Only reporting does not change anything.
+    for i := 0; i < 2; i++ {
+        report, err := fsDriver.Fsck(identity.ROOT_USER_ID, FsckOptions{VerifyData: true});
+        if (err == nil) {
+            err = checkFsckReport(report, expected, repaired);
+        }
+
+        if (err != nil) {
+            fsDriver.Close();
+            t.Fatalf("Bad check (round %d): %+v", i, err);
+        }
+    }
+
+    for problemType, _ := range(expected) {
+        _, ok := unrepairable[problemType];
+        repaired[problemType] = !ok;
+    }
+
+    report, err := fsDriver.Fsck(identity.ROOT_USER_ID, FsckOptions{VerifyData: true, Repair: true});
+    if (err == nil) {
+        err = checkFsckReport(report, expected, repaired);
+    }
+
+    fsDriver.Close();
+    if (err != nil) {
+        t.Fatalf("Bad repair: %+v", err);
+    }
+
+    // The repairs were written out.
+    fsDriver = openTestDriver(t, name, key, iv, false);
+    defer fsDriver.Close();
+
+    report, err = fsDriver.Fsck(identity.ROOT_USER_ID, FsckOptions{VerifyData: true});
+    if (err == nil) {
+        err = checkFsckReport(report, unrepairable, make(map[string]bool));
+    }
+
+    if (err != nil) {
+        t.Fatalf("Bad check after repair: %+v", err);
+    }
+
+    var paths map[string]dirent.Id = map[string]dirent.Id{
+        "/" + LOST_AND_FOUND_NAME + "/orphan": damage.orphan,
+        "/dup." + string(damage.duplicate): damage.duplicate,
+    };
+
+    for path, id := range(paths) {
+        direntInfo, err := fsDriver.ResolvePath(identity.ROOT_USER_ID, path);
+        if (err != nil || direntInfo.Id != id) {
+            t.Fatalf("Repaired dirent is not at %s: %+v", path, err);
+        }
+    }
+
+    lostAndFound, err := fsDriver.ResolvePath(identity.ROOT_USER_ID, "/" + LOST_AND_FOUND_NAME);
+    if (err != nil || fsDriver.fat[damage.cycle].Parent != lostAndFound.Id) {
+        t.Fatalf("The cycle was not broken into /%s: %+v", LOST_AND_FOUND_NAME, err);
+    }
+
+    if (fsDriver.fat[damage.badOwner].Owner != identity.ROOT_USER_ID || fsDriver.fat[damage.badGroup].Group != identity.ROOT_GROUP_ID) {
+        t.Fatalf("Bad owner or group was not given to root.");
+    }
+
+    objectIds, err := fsDriver.connector.ListData("");
+    if (err != nil) {
+        t.Fatalf("Failed to list objects: %+v", err);
+    }
+
+    for _, id := range(objectIds) {
+        if (id == damage.unreferenced) {
+            t.Fatalf("The unreferenced object was not moved out of the data.");
+        }
+    }
+
+    if (fsDriver.fat[damage.badMd5].Md5 == "" || len(objectIds) != 2) {
+        t.Fatalf("Repair changed file data (objects: %v).", objectIds);
+    }
+}
+
+func TestFsckNotRoot(t *testing.T) {
+    fsDriver, name, _, _ := newTestDriver(t);
+    defer closeTestDriver(t, fsDriver, name);
+
+    _, err := fsDriver.Fsck(identity.UserId(1), FsckOptions{});
+    if (err == nil) {
+        t.Fatalf("A user other than root checked the filesystem.");
+    }
+}
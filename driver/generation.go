@@ -0,0 +1,396 @@
+package driver;
+
+// Generations of the metadata tables.
+// A checkpoint (see journal.go) writes the full tables as a new generation (eg fat_000000000007),
+// and then replaces the root pointer: a small object that says which generation is current.
+// Replacing a single object is atomic in every connector, so a checkpoint either fully happens or it does not.
+//
+// The root also remembers the generation before the current one,
+// which is kept (along with the journal segments after it) until the next checkpoint.
+// When the metadata is read, the current generation is tried first, then the previous one, and then the shadows.
+// Nothing is lost by reading the previous generation (its segments get replayed), but the shadows may be behind.
+// A generation written right after the master key changes has no previous generation (it would be under the old key).
+//
+// The tables from before generations ("fat", "users", and "groups") are generation 0.
+
+import (
+   "encoding/json"
+   "fmt"
+   "io/ioutil"
+   "os"
+   "sort"
+   "strconv"
+   "strings"
+
+   "github.com/pkg/errors"
+)
+
+const (
+   METADATA_ROOT_ID = "metadata_root"
+   // Enough digits that generation ids sort the same way as their generations.
+   GENERATION_DIGITS = 12
+   LEGACY_GENERATION = 0
+   NO_GENERATION = -1
+   NO_SEQUENCE = -1
+)
+
+type metadataRoot struct {
+   Generation int
+   // The last journal segment that the generation includes.
+   Sequence int
+   // NO_GENERATION if there is none.
+   PreviousGeneration int
+   PreviousSequence int
+}
+
+// A copy of the metadata tables to try and read.
+type metadataSource struct {
+   // For messages.
+   name string
+   // NO_GENERATION for the shadows.
+   generation int
+   fatId string
+   usersId string
+   groupsId string
+   // All the tables of a generation (other than the legacy one) are written at the same sequence.
+   checkVersions bool
+   // The sequence that the root says the generation is at, NO_SEQUENCE if not known.
+   sequence int
+}
+
+func generationId(table string, generation int) string {
+   if (generation == LEGACY_GENERATION) {
+      return table;
+   }
+
+   return fmt.Sprintf("%s_%0*d", table, GENERATION_DIGITS, generation);
+}
+
+func generationSource(generation int, sequence int) *metadataSource {
+   return &metadataSource{
+      name: fmt.Sprintf("generation %d", generation),
+      generation: generation,
+      fatId: generationId(FAT_ID, generation),
+      usersId: generationId(USERS_ID, generation),
+      groupsId: generationId(GROUPS_ID, generation),
+      checkVersions: (generation != LEGACY_GENERATION),
+      sequence: sequence,
+   };
+}
+
+func shadowSource() *metadataSource {
+   return &metadataSource{
+      name: "shadow copies",
+      generation: NO_GENERATION,
+      fatId: FAT_ID + "_" + SHADOW_SUFFIX,
+      usersId: USERS_ID + "_" + SHADOW_SUFFIX,
+      groupsId: GROUPS_ID + "_" + SHADOW_SUFFIX,
+      checkVersions: false,
+      sequence: NO_SEQUENCE,
+   };
+}
+
+// Get the copies of the metadata to try (in order).
+// Also gives back the error from reading the root, if it exists but could not be read.
+func (this *Driver) metadataSources() ([]*metadataSource, error) {
+   var sources []*metadataSource = make([]*metadataSource, 0);
+
+   root, rootErr := this.readRoot();
+   if (rootErr == nil) {
+      sources = append(sources, generationSource(root.Generation, root.Sequence));
+      if (root.PreviousGeneration != NO_GENERATION) {
+         sources = append(sources, generationSource(root.PreviousGeneration, root.PreviousSequence));
+      }
+   } else if (os.IsNotExist(errors.Cause(rootErr))) {
+      // From before generations (or a new filesystem).
+      rootErr = nil;
+      sources = append(sources, generationSource(LEGACY_GENERATION, NO_SEQUENCE));
+   } else {
+      // Without the root, try every generation there is (newest first).
+      generations, err := this.listGenerations();
+      if (err != nil) {
+         return nil, errors.Wrap(err, rootErr.Error());
+      }
+
+      for i := len(generations) - 1; i >= 0; i-- {
+         sources = append(sources, generationSource(generations[i], NO_SEQUENCE));
+      }
+   }
+
+   sources = append(sources, shadowSource());
+   return sources, rootErr;
+}
+
+// Read the first copy of the metadata that works, and replay the journal on it.
+func (this *Driver) readMetadata() error {
+   sources, firstErr := this.metadataSources();
+   if (sources == nil) {
+      return errors.WithStack(firstErr);
+   }
+
+   var rootExists bool = (firstErr != nil || sources[0].generation != LEGACY_GENERATION);
+
+   for _, source := range(sources) {
+      err := this.readSource(source);
+      if (err == nil) {
+         if (firstErr != nil) {
+            this.metadataFallback = errors.Wrapf(firstErr, "Read the metadata from the %s instead", source.name);
+         }
+
+         return errors.WithStack(this.replayJournal());
+      }
+
+      if (firstErr == nil) {
+         firstErr = err;
+      }
+   }
+
+   // Without a root, there may just not be a filesystem yet (and the error will say so).
+   if (!rootExists) {
+      return errors.WithStack(firstErr);
+   }
+
+   return errors.Errorf("Could not read any copy of the metadata. The first failure was: %v", firstErr);
+}
+
+func (this *Driver) readSource(source *metadataSource) error {
+   this.legacyMetadata = false;
+
+   err := this.readFat(source.fatId);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   err = this.readUsers(source.usersId);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   err = this.readGroups(source.groupsId);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   if (source.checkVersions) {
+      if (this.usersVersion != this.fatVersion || this.groupsVersion != this.fatVersion ||
+            (source.sequence != NO_SEQUENCE && this.fatVersion != source.sequence)) {
+         return errors.Errorf("The tables of %s are at different versions (fat: %d, users: %d, groups: %d, root: %d).",
+               source.name, this.fatVersion, this.usersVersion, this.groupsVersion, source.sequence);
+      }
+   }
+
+   this.generation = source.generation;
+   this.generationSequence = this.fatVersion;
+   if (this.usersVersion < this.generationSequence) {
+      this.generationSequence = this.usersVersion;
+   }
+
+   if (this.groupsVersion < this.generationSequence) {
+      this.generationSequence = this.groupsVersion;
+   }
+
+   if (source.generation == NO_GENERATION) {
+      this.generationSequence = NO_SEQUENCE;
+   }
+
+   return nil;
+}
+
+// Write the full tables as a new generation, and make it the current one.
+// Then remove everything that neither it nor the previous generation needs.
+// If the master key just changed (|keyChanged|), the previous generation and the journal are under the old key,
+// so there is no previous generation and everything that came before this one is removed.
+func (this *Driver) commitGeneration(snapshot *metadataSnapshot, keyChanged bool) error {
+   sequences, err := this.listJournal();
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   // There may be segments that were never read (eg if the metadata came from a rekey),
+   // and they must not be replayed on top of these tables.
+   for _, sequence := range(sequences) {
+      if (sequence > this.journalSequence) {
+         this.journalSequence = sequence;
+      }
+   }
+
+   generations, err := this.listGenerations();
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   // Never write over a generation that is already there, someone may be pointing at it.
+   var next int = this.generation + 1;
+   if (next <= LEGACY_GENERATION) {
+      next = LEGACY_GENERATION + 1;
+   }
+
+   for _, generation := range(generations) {
+      if (generation >= next) {
+         next = generation + 1;
+      }
+   }
+
+   var source *metadataSource = generationSource(next, this.journalSequence);
+   err = this.writeTables(source, snapshot);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   var root metadataRoot = metadataRoot{
+      Generation: next,
+      Sequence: this.journalSequence,
+      PreviousGeneration: this.generation,
+      PreviousSequence: this.generationSequence,
+   };
+
+   if (keyChanged) {
+      root.PreviousGeneration = NO_GENERATION;
+      root.PreviousSequence = NO_SEQUENCE;
+   }
+
+   err = this.writeRoot(&root);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   this.generation = root.Generation;
+   this.generationSequence = root.Sequence;
+   this.fatVersion = root.Sequence;
+   this.usersVersion = root.Sequence;
+   this.groupsVersion = root.Sequence;
+   this.journalSegments = 0;
+
+   var keepAfter int = root.Sequence;
+   if (root.PreviousGeneration != NO_GENERATION) {
+      keepAfter = root.PreviousSequence;
+   }
+
+   var oldSequences []int = make([]int, 0, len(sequences));
+   for _, sequence := range(sequences) {
+      if (sequence <= keepAfter) {
+         oldSequences = append(oldSequences, sequence);
+      }
+   }
+
+   err = this.removeJournal(oldSequences);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   for _, generation := range(generations) {
+      if (generation == root.Generation || generation == root.PreviousGeneration) {
+         continue;
+      }
+
+      err = this.removeGeneration(generation);
+      if (err != nil) {
+         return errors.WithStack(err);
+      }
+   }
+
+   return nil;
+}
+
+func (this *Driver) writeTables(source *metadataSource, snapshot *metadataSnapshot) error {
+   err := this.writeFat(source.fatId, snapshot);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   err = this.writeUsers(source.usersId, snapshot);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   return errors.WithStack(this.writeGroups(source.groupsId, snapshot));
+}
+
+func (this *Driver) removeGeneration(generation int) error {
+   var source *metadataSource = generationSource(generation, NO_SEQUENCE);
+
+   for _, metadataId := range([]string{source.fatId, source.usersId, source.groupsId}) {
+      err := this.connector.RemoveMetadataFile(metadataId);
+      if (err != nil && !os.IsNotExist(errors.Cause(err))) {
+         return errors.Wrap(err, metadataId);
+      }
+   }
+
+   return nil;
+}
+
+func (this *Driver) readRoot() (*metadataRoot, error) {
+   reader, err := this.connector.GetMetadataReader(METADATA_ROOT_ID, this.metadataCipher, nil);
+   if (err != nil) {
+      return nil, errors.Wrap(err, METADATA_ROOT_ID);
+   }
+   defer reader.Close();
+
+   data, err := ioutil.ReadAll(reader);
+   if (err != nil) {
+      return nil, errors.Wrap(err, METADATA_ROOT_ID);
+   }
+
+   var root metadataRoot;
+   err = json.Unmarshal(data, &root);
+   if (err != nil) {
+      return nil, errors.Wrap(err, METADATA_ROOT_ID);
+   }
+
+   return &root, nil;
+}
+
+func (this *Driver) writeRoot(root *metadataRoot) error {
+   data, err := json.Marshal(root);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   writer, err := this.connector.GetMetadataWriter(METADATA_ROOT_ID, this.metadataCipher);
+   if (err != nil) {
+      return errors.Wrap(err, METADATA_ROOT_ID);
+   }
+
+   _, err = writer.Write(data);
+   if (err != nil) {
+      writer.Abort();
+      return errors.Wrap(err, METADATA_ROOT_ID);
+   }
+
+   return errors.Wrap(writer.Close(), METADATA_ROOT_ID);
+}
+
+// Get every generation that has any tables in storage (in order).
+func (this *Driver) listGenerations() ([]int, error) {
+   metadataIds, err := this.connector.ListMetadata();
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   var found map[int]bool = make(map[int]bool);
+   for _, metadataId := range(metadataIds) {
+      for _, table := range([]string{FAT_ID, USERS_ID, GROUPS_ID}) {
+         if (metadataId == table) {
+            found[LEGACY_GENERATION] = true;
+            continue;
+         }
+
+         if (!strings.HasPrefix(metadataId, table + "_")) {
+            continue;
+         }
+
+         generation, err := strconv.Atoi(strings.TrimPrefix(metadataId, table + "_"));
+         if (err == nil && generation > LEGACY_GENERATION) {
+            found[generation] = true;
+         }
+      }
+   }
+
+   var generations []int = make([]int, 0, len(found));
+   for generation, _ := range(found) {
+      generations = append(generations, generation);
+   }
+
+   sort.Ints(generations);
+   return generations, nil;
+}
@@ -0,0 +1,162 @@
+package driver;
+
+// When the current generation cannot be read, the metadata falls back to the previous generation and then the shadows.
+
+import (
+   "crypto/aes"
+   "testing"
+
+   "github.com/eriq-augustine/elfs/connector/memory"
+   "github.com/eriq-augustine/elfs/identity"
+   "github.com/eriq-augustine/elfs/util"
+)
+
+var testGenerationPaths []string = []string{"/a", "/b", "/c"};
+
+// A filesystem with generation 2 (current), generation 1 (previous), and shadows.
+// "/a" and "/b" are in generation 2 (but only in the journal after generation 1), and "/c" is only in the journal after generation 2.
+func newTestGenerations(t *testing.T) (string, []byte, []byte) {
+   fsDriver, name, key, iv := newTestDriver(t);
+
+   for i, path := range(testGenerationPaths) {
+      _, err := fsDriver.MkdirAll(identity.ROOT_USER_ID, path);
+      if (err == nil) {
+         err = fsDriver.SyncToDisk(path == "/b");
+      }
+
+      if (err != nil) {
+         fsDriver.Close();
+         memory.RemoveStore(name);
+         t.Fatalf("Failed to sync %d: %+v", i, err);
+      }
+   }
+
+   root, err := fsDriver.readRoot();
+   fsDriver.Close();
+
+   if (err != nil || root.Generation != 2 || root.PreviousGeneration != 1) {
+      memory.RemoveStore(name);
+      t.Fatalf("Unexpected generations (%+v): %+v", root, err);
+   }
+
+   // Loading writes the shadows.
+   openTestDriver(t, name, key, iv, false).Close();
+
+   return name, key, iv;
+}
+
+// Replace a metadata object with one that will not decrypt.
+func corruptTestMetadata(t *testing.T, fsDriver *Driver, metadataId string) {
+   otherCipher, err := aes.NewCipher(util.GenAESKey());
+   if (err != nil) {
+      t.Fatalf("Failed to make cipher: %+v", err);
+   }
+
+   writer, err := fsDriver.connector.GetMetadataWriter(metadataId, otherCipher);
+   if (err == nil) {
+      _, err = writer.Write([]byte("not the metadata"));
+      if (err == nil) {
+         err = writer.Close();
+      }
+   }
+
+   if (err != nil) {
+      t.Fatalf("Failed to corrupt %s: %+v", metadataId, err);
+   }
+}
+
+type generationTestCase struct {
+   name string
+   // Metadata objects to replace with ones that will not decrypt.
+   corrupt []string
+   remove []string
+   // The generation that should load (NO_GENERATION for the shadows).
+   generation int
+   fallback bool
+}
+
+func TestGenerationFallback(t *testing.T) {
+   var testCases []generationTestCase = []generationTestCase{
+      {"intact", nil, nil, 2, false},
+      {"segments in the current generation removed", nil, []string{journalId(2), journalId(3)}, 2, false},
+      {"current fat corrupt", []string{generationId(FAT_ID, 2)}, nil, 1, true},
+      {"current groups removed", nil, []string{generationId(GROUPS_ID, 2)}, 1, true},
+      {"current and previous corrupt", []string{generationId(USERS_ID, 2), generationId(FAT_ID, 1)}, nil, NO_GENERATION, true},
+      {"current removed and previous corrupt", []string{generationId(GROUPS_ID, 1)}, []string{generationId(FAT_ID, 2), generationId(USERS_ID, 2), generationId(GROUPS_ID, 2)}, NO_GENERATION, true},
+      {"root corrupt", []string{METADATA_ROOT_ID}, nil, 2, true},
+      {"root and current corrupt", []string{METADATA_ROOT_ID, generationId(FAT_ID, 2)}, nil, 1, true},
+   };
+
+   for _, testCase := range(testCases) {
+      name, key, iv := newTestGenerations(t);
+
+      fsDriver := openTestDriver(t, name, key, iv, false);
+      for _, metadataId := range(testCase.corrupt) {
+         corruptTestMetadata(t, fsDriver, metadataId);
+      }
+
+      for _, metadataId := range(testCase.remove) {
+         err := fsDriver.connector.RemoveMetadataFile(metadataId);
+         if (err != nil) {
+            t.Fatalf("%s: failed to remove %s: %+v", testCase.name, metadataId, err);
+         }
+      }
+      fsDriver.Close();
+
+      fsDriver = openTestDriver(t, name, key, iv, false);
+
+      if (fsDriver.generation != testCase.generation) {
+         t.Errorf("%s: loaded generation %d, expected %d.", testCase.name, fsDriver.generation, testCase.generation);
+      }
+
+      if ((fsDriver.MetadataFallback() != nil) != testCase.fallback) {
+         t.Errorf("%s: bad fallback: %v.", testCase.name, fsDriver.MetadataFallback());
+      }
+
+      // Nothing is lost, whichever copy loaded.
+      for _, path := range(testGenerationPaths) {
+         if (!hasTestPath(fsDriver, path)) {
+            t.Errorf("%s: lost %s.", testCase.name, path);
+         }
+      }
+
+      // The next checkpoint gets back to a current generation that reads.
+      err := fsDriver.SyncToDisk(true);
+      fsDriver.Close();
+
+      if (err != nil) {
+         t.Fatalf("%s: failed to checkpoint: %+v", testCase.name, err);
+      }
+
+      fsDriver = openTestDriver(t, name, key, iv, false);
+      if (fsDriver.MetadataFallback() != nil || fsDriver.generation == NO_GENERATION || !hasTestPath(fsDriver, "/c")) {
+         t.Errorf("%s: bad load after the checkpoint: %v.", testCase.name, fsDriver.MetadataFallback());
+      }
+
+      closeTestDriver(t, fsDriver, name);
+   }
+}
+
+// Without any copy that reads, the filesystem does not load.
+func TestGenerationNoCopies(t *testing.T) {
+   name, key, iv := newTestGenerations(t);
+   defer memory.RemoveStore(name);
+
+   fsDriver := openTestDriver(t, name, key, iv, false);
+   for _, metadataId := range([]string{generationId(FAT_ID, 2), generationId(FAT_ID, 1), shadowSource().fatId}) {
+      corruptTestMetadata(t, fsDriver, metadataId);
+   }
+   fsDriver.Close();
+
+   fsConnector, err := memory.NewMemoryConnector(name, 0, false);
+   if (err != nil) {
+      t.Fatalf("Failed to open memory store: %+v", err);
+   }
+   defer fsConnector.Close();
+
+   fsDriver, err = NewDriverWithConnector(key, iv, fsConnector);
+   if (err == nil) {
+      fsDriver.Close();
+      t.Fatalf("Loaded without a copy of the metadata that reads.");
+   }
+}
@@ -3,16 +3,43 @@ package driver;
 // Operations dealing with groups in the filesystem.
 
 import (
+    "fmt"
+
     "github.com/pkg/errors"
 
     "github.com/eriq-augustine/elfs/identity"
 )
 
+// Get a copy of all the groups.
 func (this *Driver) GetGroups() map[identity.GroupId]*identity.Group {
-    return this.groups;
+    this.lock.RLock();
+    defer this.lock.RUnlock();
+
+    var groups map[identity.GroupId]*identity.Group = make(map[identity.GroupId]*identity.Group, len(this.groups));
+    for id, group := range(this.groups) {
+        groups[id] = group.Clone();
+    }
+
+    return groups;
+}
+
+// Get a copy of a single group.
+func (this *Driver) GetGroup(groupId identity.GroupId) (*identity.Group, error) {
+    this.lock.RLock();
+    defer this.lock.RUnlock();
+
+    group, ok := this.groups[groupId];
+    if (!ok) {
+        return nil, errors.WithStack(NewDoesntExistError(fmt.Sprintf("group %d", int(groupId))));
+    }
+
+    return group.Clone(), nil;
 }
 
 func (this *Driver) AddGroup(contextUser identity.UserId, name string) (identity.GroupId, error) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
     if (name == "") {
         return identity.EMPTY_GROUP_ID, errors.WithStack(NewIllegalOperationError("Cannot create group with no name."));
     }
@@ -32,6 +59,9 @@ func (this *Driver) AddGroup(contextUser identity.UserId, name string) (identity
 }
 
 func (this *Driver) DeleteGroup(contextUser identity.UserId, groupId identity.GroupId) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
     groupInfo, ok := this.groups[groupId];
     if (!ok) {
         return errors.WithStack(NewIllegalOperationError("Cannot remove unknown group."));
@@ -56,6 +86,9 @@ func (this *Driver) DeleteGroup(contextUser identity.UserId, groupId identity.Gr
 }
 
 func (this *Driver) JoinGroup(contextUser identity.UserId, targetUser identity.UserId, groupId identity.GroupId) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
     groupInfo, ok := this.groups[groupId];
     if (!ok) {
         return errors.WithStack(NewIllegalOperationError("Cannot join an unknown group."));
@@ -82,6 +115,9 @@ func (this *Driver) JoinGroup(contextUser identity.UserId, targetUser identity.U
 }
 
 func (this *Driver) KickUser(contextUser identity.UserId, targetUser identity.UserId, groupId identity.GroupId) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
     groupInfo, ok := this.groups[groupId];
     if (!ok) {
         return errors.WithStack(NewIllegalOperationError("Cannot kick from an unknown group."));
@@ -119,6 +155,9 @@ func (this *Driver) KickUser(contextUser identity.UserId, targetUser identity.Us
 
 // Promote a user to be the owner of a group.
 func (this *Driver) PromoteUser(contextUser identity.UserId, targetUser identity.UserId, groupId identity.GroupId) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
     groupInfo, ok := this.groups[groupId];
     if (!ok) {
         return errors.WithStack(NewIllegalOperationError("Cannot promote in unknown group."));
@@ -0,0 +1,423 @@
+package driver;
+
+// Looking at (and replacing) the metadata tables directly, for debugging (see bin/elfs-meta).
+// An inspector reads the metadata as it is in storage without loading a filesystem,
+// so it works even when the filesystem would not load, and it never writes anything
+// (not even the local cache, which loading a filesystem would replay and clear).
+
+import (
+   "fmt"
+   "os"
+   "reflect"
+   "strconv"
+
+   "github.com/pkg/errors"
+
+   "github.com/eriq-augustine/elfs/connector"
+   "github.com/eriq-augustine/elfs/dirent"
+   "github.com/eriq-augustine/elfs/identity"
+)
+
+const (
+   // The metadata that loading the filesystem would read (with the journal replayed, but not the local cache).
+   METADATA_SOURCE_CURRENT = "current"
+   // The generation before the current one (only the current and previous generations are kept).
+   METADATA_SOURCE_PREVIOUS = "previous"
+   METADATA_SOURCE_SHADOW = "shadow"
+   // The local cache of changes that have not made it into storage yet (see cache.MetadataCache).
+   METADATA_SOURCE_CACHE = "cache"
+   // Any other source is the number of a generation (see generation.go).
+)
+
+// A full copy of the metadata tables.
+type MetadataDump struct {
+   // Where the tables came from, eg "generation 3".
+   Source string
+   // The version of each table (always 0 in the local cache).
+   FatVersion int
+   UsersVersion int
+   GroupsVersion int
+   // In the local cache, nil entries are deletes.
+   Fat map[dirent.Id]*dirent.Dirent
+   Users map[identity.UserId]*identity.User
+   Groups map[identity.GroupId]*identity.Group
+}
+
+// What metadata there is in storage.
+type MetadataGenerations struct {
+   // NO_GENERATION and NO_SEQUENCE if there is no root (or it could not be read).
+   Current int
+   CurrentSequence int
+   Previous int
+   PreviousSequence int
+   // Why the root could not be read (nil if it was, or if there is none).
+   RootError error
+   // Every generation that has any tables in storage.
+   Stored []int
+   // The sequence numbers of the journal segments.
+   Journal []int
+}
+
+type MetadataInspector struct {
+   // Never loaded (or synced), just used for its connector, cipher, and legacy IVs.
+   driver *Driver
+}
+
+// The inspector takes ownership of the connector.
+func NewMetadataInspector(key []byte, iv []byte, fsConnector connector.Connector) (*MetadataInspector, error) {
+   driver, err := newDriver(key, iv, fsConnector);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   return &MetadataInspector{driver}, nil;
+}
+
+// Unlike Driver.Close(), nothing gets written.
+func (this *MetadataInspector) Close() {
+   this.driver.cache.Close();
+   this.driver.connector.Close();
+}
+
+func (this *MetadataInspector) Generations() (*MetadataGenerations, error) {
+   var generations MetadataGenerations = MetadataGenerations{
+      Current: NO_GENERATION,
+      CurrentSequence: NO_SEQUENCE,
+      Previous: NO_GENERATION,
+      PreviousSequence: NO_SEQUENCE,
+      RootError: nil,
+   };
+
+   root, err := this.driver.readRoot();
+   if (err == nil) {
+      generations.Current = root.Generation;
+      generations.CurrentSequence = root.Sequence;
+      generations.Previous = root.PreviousGeneration;
+      generations.PreviousSequence = root.PreviousSequence;
+   } else if (!os.IsNotExist(errors.Cause(err))) {
+      generations.RootError = err;
+   }
+
+   generations.Stored, err = this.driver.listGenerations();
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   generations.Journal, err = this.driver.listJournal();
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   return &generations, nil;
+}
+
+// Read the tables from |source| (a METADATA_SOURCE_* constant or the number of a generation).
+// A generation is given as it is stored (without the journal), even if its tables are at different versions.
+func (this *MetadataInspector) Dump(source string) (*MetadataDump, error) {
+   if (source == METADATA_SOURCE_CACHE) {
+      return this.dumpCache(), nil;
+   }
+
+   var name string;
+   var err error;
+
+   if (source == METADATA_SOURCE_CURRENT) {
+      this.driver.metadataFallback = nil;
+      err = this.driver.readMetadata();
+      if (err == nil) {
+         name = fmt.Sprintf("generation %d, with the journal replayed up to %d", this.driver.generation, this.driver.journalSequence);
+         if (this.driver.generation == NO_GENERATION) {
+            name = fmt.Sprintf("shadow copies, with the journal replayed up to %d", this.driver.journalSequence);
+         }
+      }
+   } else {
+      var metadataSource *metadataSource;
+
+      if (source == METADATA_SOURCE_SHADOW) {
+         metadataSource = shadowSource();
+      } else {
+         generation, parseErr := strconv.Atoi(source);
+         if (source == METADATA_SOURCE_PREVIOUS) {
+            generation, parseErr = this.previousGeneration();
+            if (parseErr != nil) {
+               return nil, errors.WithStack(parseErr);
+            }
+         } else if (parseErr != nil || generation < LEGACY_GENERATION) {
+            return nil, errors.Errorf("Unknown metadata source: [%s]. Expecting '%s', '%s', '%s', '%s', or a generation.",
+                  source, METADATA_SOURCE_CURRENT, METADATA_SOURCE_PREVIOUS, METADATA_SOURCE_SHADOW, METADATA_SOURCE_CACHE);
+         }
+
+         metadataSource = generationSource(generation, NO_SEQUENCE);
+         metadataSource.checkVersions = false;
+      }
+
+      name = metadataSource.name;
+      err = this.driver.readSource(metadataSource);
+   }
+
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   var snapshot *metadataSnapshot = this.driver.snapshotMetadata();
+
+   var dump MetadataDump = MetadataDump{
+      Source: name,
+      FatVersion: this.driver.fatVersion,
+      UsersVersion: this.driver.usersVersion,
+      GroupsVersion: this.driver.groupsVersion,
+      Fat: snapshot.fat,
+      Users: snapshot.users,
+      Groups: snapshot.groups,
+   };
+
+   return &dump, nil;
+}
+
+func (this *MetadataInspector) previousGeneration() (int, error) {
+   root, err := this.driver.readRoot();
+   if (err != nil) {
+      return NO_GENERATION, errors.Wrap(err, "Cannot find the previous generation without the root");
+   }
+
+   if (root.PreviousGeneration == NO_GENERATION) {
+      return NO_GENERATION, errors.Errorf("Generation %d is the first one, there is no previous generation.", root.Generation);
+   }
+
+   return root.PreviousGeneration, nil;
+}
+
+// Why the last dump of METADATA_SOURCE_CURRENT did not come from the current generation (nil if it did).
+func (this *MetadataInspector) MetadataFallback() error {
+   return this.driver.metadataFallback;
+}
+
+func (this *MetadataInspector) dumpCache() *MetadataDump {
+   var dump MetadataDump = MetadataDump{
+      Source: "local cache",
+      FatVersion: 0,
+      UsersVersion: 0,
+      GroupsVersion: 0,
+      Fat: make(map[dirent.Id]*dirent.Dirent),
+      Users: make(map[identity.UserId]*identity.User),
+      Groups: make(map[identity.GroupId]*identity.Group),
+   };
+
+   // Nothing else is using this cache, so its maps can be read without its lock.
+   for id, entry := range(this.driver.cache.GetFat()) {
+      if (entry != nil) {
+         entry = entry.Clone();
+      }
+      dump.Fat[id] = entry;
+   }
+
+   for id, entry := range(this.driver.cache.GetUsers()) {
+      if (entry != nil) {
+         entry = entry.Clone();
+      }
+      dump.Users[id] = entry;
+   }
+
+   for id, entry := range(this.driver.cache.GetGroups()) {
+      if (entry != nil) {
+         entry = entry.Clone();
+      }
+      dump.Groups[id] = entry;
+   }
+
+   return &dump;
+}
+
+// Replace all the metadata with |dump| (eg an edited dump from a MetadataInspector).
+// Only what is different gets changed, and it goes through the cache and journal like any other change.
+// Then it is all committed as a new generation (and shadows),
+// so the previous generation is the metadata from before the import.
+// Only root may do this, and the filesystem should not be mounted anywhere else.
+// Returns the number of entries that were changed.
+func (this *Driver) ImportMetadata(contextUser identity.UserId, dump *MetadataDump) (int, error) {
+   if (contextUser != identity.ROOT_USER_ID) {
+      return 0, errors.WithStack(NewPermissionsError("Only root can import metadata."));
+   }
+
+   err := validateDump(dump);
+   if (err != nil) {
+      return 0, errors.WithStack(err);
+   }
+
+   this.lock.Lock();
+   changes, err := this.importMetadataLocked(dump);
+   this.dirs = dirent.BuildDirs(this.fat);
+   this.lock.Unlock();
+
+   if (err != nil) {
+      return changes, errors.WithStack(err);
+   }
+
+   err = this.SyncToDisk(true);
+   if (err != nil) {
+      return changes, errors.WithStack(err);
+   }
+
+   this.syncLock.Lock();
+   defer this.syncLock.Unlock();
+
+   return changes, errors.WithStack(this.writeMetadata(true, this.snapshotMetadata()));
+}
+
+// The caller must hold the write lock.
+func (this *Driver) importMetadataLocked(dump *MetadataDump) (int, error) {
+   var changes int = 0;
+
+   for id, entry := range(dump.Fat) {
+      if (reflect.DeepEqual(this.fat[id], entry)) {
+         continue;
+      }
+
+      this.fat[id] = entry.Clone();
+      changes++;
+
+      err := this.cache.CacheDirentPut(this.fat[id].Clone());
+      if (err != nil) {
+         return changes, errors.WithStack(err);
+      }
+   }
+
+   for id, entry := range(this.fat) {
+      _, ok := dump.Fat[id];
+      if (ok) {
+         continue;
+      }
+
+      delete(this.fat, id);
+      changes++;
+
+      err := this.cache.CacheDirentDelete(entry);
+      if (err != nil) {
+         return changes, errors.WithStack(err);
+      }
+   }
+
+   for id, entry := range(dump.Users) {
+      if (reflect.DeepEqual(this.users[id], entry)) {
+         continue;
+      }
+
+      this.users[id] = entry.Clone();
+      changes++;
+
+      err := this.cache.CacheUserPut(this.users[id].Clone());
+      if (err != nil) {
+         return changes, errors.WithStack(err);
+      }
+   }
+
+   for id, entry := range(this.users) {
+      _, ok := dump.Users[id];
+      if (ok) {
+         continue;
+      }
+
+      delete(this.users, id);
+      changes++;
+
+      err := this.cache.CacheUserDelete(entry);
+      if (err != nil) {
+         return changes, errors.WithStack(err);
+      }
+   }
+
+   for id, entry := range(dump.Groups) {
+      if (reflect.DeepEqual(this.groups[id], entry)) {
+         continue;
+      }
+
+      this.groups[id] = entry.Clone();
+      changes++;
+
+      err := this.cache.CacheGroupPut(this.groups[id].Clone());
+      if (err != nil) {
+         return changes, errors.WithStack(err);
+      }
+   }
+
+   for id, entry := range(this.groups) {
+      _, ok := dump.Groups[id];
+      if (ok) {
+         continue;
+      }
+
+      delete(this.groups, id);
+      changes++;
+
+      err := this.cache.CacheGroupDelete(entry);
+      if (err != nil) {
+         return changes, errors.WithStack(err);
+      }
+   }
+
+   return changes, nil;
+}
+
+// Make sure that a dump is complete and points to itself, so that it can be loaded as a filesystem.
+// Anything deeper (eg cycles or duplicate names) is left for fsck.
+func validateDump(dump *MetadataDump) error {
+   for id, entry := range(dump.Users) {
+      if (entry == nil || entry.Id != id) {
+         return errors.Errorf("User %d is empty or has the wrong id.", id);
+      }
+
+      _, ok := dump.Groups[entry.Usergroup];
+      if (!ok) {
+         return errors.Errorf("The usergroup (%d) of user %d does not exist.", entry.Usergroup, id);
+      }
+   }
+
+   for id, entry := range(dump.Groups) {
+      if (entry == nil || entry.Id != id) {
+         return errors.Errorf("Group %d is empty or has the wrong id.", id);
+      }
+
+      _, ok := dump.Users[entry.Owner];
+      if (!ok) {
+         return errors.Errorf("The owner (%d) of group %d does not exist.", entry.Owner, id);
+      }
+   }
+
+   _, ok := dump.Users[identity.ROOT_USER_ID];
+   if (!ok) {
+      return errors.New("There is no root user.");
+   }
+
+   _, ok = dump.Groups[identity.ROOT_GROUP_ID];
+   if (!ok) {
+      return errors.New("There is no root group.");
+   }
+
+   root, ok := dump.Fat[dirent.ROOT_ID];
+   if (!ok || root == nil || root.IsFile || root.Parent != dirent.ROOT_ID) {
+      return errors.New("There is no root directory.");
+   }
+
+   for id, entry := range(dump.Fat) {
+      if (entry == nil || entry.Id != id) {
+         return errors.Errorf("Dirent [%s] is empty or has the wrong id.", string(id));
+      }
+
+      parent, ok := dump.Fat[entry.Parent];
+      if (!ok || parent == nil || parent.IsFile) {
+         return errors.Errorf("The parent ([%s]) of dirent [%s] is not a directory.", string(entry.Parent), string(id));
+      }
+
+      _, ok = dump.Users[entry.Owner];
+      if (!ok) {
+         return errors.Errorf("The owner (%d) of dirent [%s] does not exist.", entry.Owner, string(id));
+      }
+
+      _, ok = dump.Groups[entry.Group];
+      if (!ok) {
+         return errors.Errorf("The group (%d) of dirent [%s] does not exist.", entry.Group, string(id));
+      }
+   }
+
+   return nil;
+}
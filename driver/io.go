@@ -3,12 +3,15 @@ package driver;
 // IO operations that specificially deal with single files.
 
 import (
+    "crypto/aes"
+    "crypto/cipher"
     "fmt"
     "io"
     "time"
 
     "github.com/pkg/errors"
 
+    "github.com/eriq-augustine/elfs/cipherio"
     "github.com/eriq-augustine/elfs/connector"
     "github.com/eriq-augustine/elfs/dirent"
     "github.com/eriq-augustine/elfs/identity"
@@ -16,15 +19,22 @@ import (
 )
 
 func (this *Driver) GetDirent(userId identity.UserId, direntId dirent.Id) (*dirent.Dirent, error) {
+    this.lock.RLock();
+    defer this.lock.RUnlock();
+
     direntInfo, _, err := this.getUserAndDirent(userId, direntId, true, false, false, false, false);
     if (err != nil) {
         return nil, errors.WithStack(err);
     }
 
-    return direntInfo, nil;
+    return direntInfo.Clone(), nil;
 }
 
+// Get a snapshot of the children of a directory.
 func (this *Driver) List(userId identity.UserId, direntId dirent.Id) ([]*dirent.Dirent, error) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
     direntInfo, _, err := this.getUserAndDirent(userId, direntId, true, false, true, false, true);
     if (err != nil) {
         return nil, errors.WithStack(err);
@@ -35,10 +45,17 @@ func (this *Driver) List(userId identity.UserId, direntId dirent.Id) ([]*dirent.
     direntInfo.AccessCount++;
     this.cache.CacheDirentPut(direntInfo);
 
-    return this.dirs[direntId], nil;
+    return cloneDirents(this.dirs[direntId]), nil;
 }
 
 func (this *Driver) MakeDir(userId identity.UserId, name string, parentId dirent.Id) (dirent.Id, error) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    return this.makeDir(userId, name, parentId);
+}
+
+func (this *Driver) makeDir(userId identity.UserId, name string, parentId dirent.Id) (dirent.Id, error) {
     if (name == "") {
         return dirent.EMPTY_ID, errors.WithStack(NewIllegalOperationError("Cannot make a dir with no name."));
     }
@@ -65,6 +82,13 @@ func (this *Driver) MakeDir(userId identity.UserId, name string, parentId dirent
 }
 
 func (this *Driver) Move(userId identity.UserId, targetId dirent.Id, newParentId dirent.Id) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    return this.move(userId, targetId, newParentId);
+}
+
+func (this *Driver) move(userId identity.UserId, targetId dirent.Id, newParentId dirent.Id) error {
     targetInfo, _, err := this.getUserAndDirent(userId, targetId, false, true, false, false, false);
     if (err != nil) {
         return errors.WithStack(err);
@@ -90,146 +114,403 @@ func (this *Driver) Move(userId identity.UserId, targetId dirent.Id, newParentId
     return nil;
 }
 
+// Write a file (creating it if it does not exist).
+// The driver is not locked while the data is being written to the connector,
+// so the metadata is checked again before the write is committed.
 func (this *Driver) Put(
         userId identity.UserId,
         name string, clearbytes io.Reader,
         parentId dirent.Id) (dirent.Id, error) {
-    if (name == "") {
-        return dirent.EMPTY_ID, NewIllegalOperationError("Cannot put a file with no name.");
+    // Consider all parts of this operation happening at this timestamp.
+    var operationTimestamp int64 = time.Now().Unix();
+
+    this.lock.Lock();
+    fileInfo, newFile, err := this.preparePut(userId, name, parentId, operationTimestamp);
+    this.lock.Unlock();
+
+    if (err != nil) {
+        return dirent.EMPTY_ID, errors.WithStack(err);
     }
 
-    parentInfo, user, err := this.getUserAndDirent(userId, parentId, false, false, false, false, false);
+    this.fileLocks.Lock(fileInfo.Id);
+    defer this.fileLocks.Unlock(fileInfo.Id);
+
+    // Every full write gets a fresh data key.
+    // It is only wrapped once the write is committed, in case the master key changes in the meantime.
+    var fileKey []byte = util.GenAESKey();
+    fileCipher, err := aes.NewCipher(fileKey);
     if (err != nil) {
         return dirent.EMPTY_ID, errors.WithStack(err);
     }
 
-    // Consider all parts of this operation happening at this timestamp.
-    var operationTimestamp int64 = time.Now().Unix();
+    fileSize, md5String, err := connector.Write(this.connector, fileInfo, fileCipher, clearbytes);
+    if (err != nil) {
+        return dirent.EMPTY_ID, err;
+    }
+
+    // Update metadata.
+    // Note that some of the data is available before the write,
+    // but we only want to update the metatdata if the write goes through.
+    fileInfo.ModTimestamp = operationTimestamp;
+    fileInfo.AccessTimestamp = operationTimestamp;
+    fileInfo.Size = fileSize;
+    fileInfo.Md5 = md5String;
+
+    this.lock.Lock();
+    err = this.commitPut(fileInfo, fileKey, newFile);
+    this.lock.Unlock();
 
-    fileInfo, err := this.FetchChildByName(userId, parentId, name);
     if (err != nil) {
+        // Things changed while we were writing.
+        // The object for a new file is orphaned, but an existing file's object is still the one in the FAT
+        // (and if the file was removed, its object is removed once we let go of the file's lock).
+        if (newFile) {
+            this.connector.RemoveFile(fileInfo);
+        }
+
         return dirent.EMPTY_ID, errors.WithStack(err);
     }
 
-    var newFile bool;
-    var permissions dirent.Permissions = dirent.EMPTY_PERMISSIONS;
+    return fileInfo.Id, nil;
+}
+
+// Check that a put is allowed and get the dirent that will be written.
+// For a new file, this is a new dirent that is not yet in the FAT.
+// For an existing file, this is a copy of the current dirent.
+// The caller must hold the write lock.
+func (this *Driver) preparePut(
+        userId identity.UserId, name string, parentId dirent.Id,
+        operationTimestamp int64) (*dirent.Dirent, bool, error) {
+    if (name == "") {
+        return nil, false, NewIllegalOperationError("Cannot put a file with no name.");
+    }
+
+    parentInfo, user, err := this.getUserAndDirent(userId, parentId, false, false, false, false, false);
+    if (err != nil) {
+        return nil, false, errors.WithStack(err);
+    }
+
+    fileInfo, err := this.fetchChildByName(userId, parentId, name);
+    if (err != nil) {
+        return nil, false, errors.WithStack(err);
+    }
 
     // Create or update?
     if (fileInfo == nil) {
         // Create
-        newFile = true;
-        permissions = dirent.DEFAULT_FILE_PERMISSIONS;
-
         parentGroup, ok := this.groups[parentInfo.Group];
         if (!ok) {
-            return dirent.EMPTY_ID, errors.Errorf("Unable to find the group (%d) for dirent (%s).", int(parentInfo.Group), string(parentId));
+            return nil, false, errors.Errorf("Unable to find the group (%d) for dirent (%s).", int(parentInfo.Group), string(parentId));
         }
 
         if (!parentInfo.CanWrite(user, parentGroup)) {
-            return dirent.EMPTY_ID, NewPermissionsError(fmt.Sprintf("User (%s) cannot write to the parent (%s).", string(userId), string(parentId)));
+            return nil, false, NewPermissionsError(fmt.Sprintf("User (%d) cannot write to the parent (%s).", int(userId), string(parentId)));
         }
 
         fileInfo = dirent.NewFile(this.getNewDirentId(), name, parentId, userId, user.Usergroup, operationTimestamp);
-    } else {
-        // Update
-        newFile = false;
-        permissions = fileInfo.Permissions;
+        fileInfo.CipherVersion = cipherio.CURRENT_CIPHER_VERSION;
+        fileInfo.StorageClass = this.storageClassFor(parentId);
+        return fileInfo, true, nil;
+    }
 
-        fileGroup, ok := this.groups[fileInfo.Group];
-        if (!ok) {
-            return dirent.EMPTY_ID, errors.Errorf("Unable to find the group (%d) for dirent (%s).", int(fileInfo.Group), string(fileInfo.Id));
-        }
+    // Update
+    fileGroup, ok := this.groups[fileInfo.Group];
+    if (!ok) {
+        return nil, false, errors.Errorf("Unable to find the group (%d) for dirent (%s).", int(fileInfo.Group), string(fileInfo.Id));
+    }
 
-        if (!fileInfo.CanWrite(user, fileGroup)) {
-            return dirent.EMPTY_ID, NewPermissionsError(fmt.Sprintf("User (%s) cannot write to the parent (%s).", string(userId), string(parentId)));
-        }
+    if (!fileInfo.CanWrite(user, fileGroup)) {
+        return nil, false, NewPermissionsError(fmt.Sprintf("User (%d) cannot write to the parent (%s).", int(userId), string(parentId)));
+    }
 
-        if (!fileInfo.IsFile) {
-            return dirent.EMPTY_ID, errors.WithStack(NewIllegalOperationError("Put cannot write a directory, do you mean to MakeDir()?"));
-        }
+    if (!fileInfo.IsFile) {
+        return nil, false, errors.WithStack(NewIllegalOperationError("Put cannot write a directory, do you mean to MakeDir()?"));
+    }
 
-        if (parentId != fileInfo.Parent) {
-            return dirent.EMPTY_ID, NewIllegalOperationError("Put cannot change a file's directory, use Move() instead.");
-        }
+    if (parentId != fileInfo.Parent) {
+        return nil, false, NewIllegalOperationError("Put cannot change a file's directory, use Move() instead.");
     }
 
-    fileSize, md5String, err := connector.Write(this.connector, fileInfo, this.blockCipher, clearbytes);
+    // The whole file is getting rewritten, so it needs a fresh IV (and can move to the current format).
+    fileInfo = fileInfo.Clone();
+    fileInfo.IV = util.GenIV();
+    fileInfo.ChunkIVs = nil;
+    fileInfo.CipherVersion = cipherio.CURRENT_CIPHER_VERSION;
+    fileInfo.StorageClass = this.storageClassFor(parentId);
+
+    return fileInfo, false, nil;
+}
+
+// Put the result of a put into the metadata.
+// The caller must hold the write lock.
+func (this *Driver) commitPut(fileInfo *dirent.Dirent, fileKey []byte, newFile bool) error {
+    wrappedKey, err := this.wrapFileKey(fileInfo.Id, fileKey);
     if (err != nil) {
-        return dirent.EMPTY_ID, err;
+        return errors.WithStack(err);
     }
+    fileInfo.Key = wrappedKey;
 
-    // Update metadata.
-    // Note that some of the data is available before the write,
-    // but we only want to update the metatdata if the write goes through.
-    fileInfo.ModTimestamp = operationTimestamp;
-    fileInfo.AccessTimestamp = operationTimestamp;
-    fileInfo.AccessCount++;
-    fileInfo.Size = fileSize;
-    fileInfo.Md5 = md5String;
-    fileInfo.Parent = parentId;
-    fileInfo.Permissions = permissions;
+    if (!newFile) {
+        currentInfo, ok := this.fat[fileInfo.Id];
+        if (!ok) {
+            return errors.WithStack(NewDoesntExistError(fmt.Sprintf("File (%s) was removed during a write.", string(fileInfo.Id))));
+        }
 
-    // If this file is new, we need to make sure it is in that memory-FAT.
-    this.fat[fileInfo.Id] = fileInfo;
+        currentInfo.ModTimestamp = fileInfo.ModTimestamp;
+        currentInfo.AccessTimestamp = fileInfo.AccessTimestamp;
+        currentInfo.AccessCount++;
+        currentInfo.Size = fileInfo.Size;
+        currentInfo.Md5 = fileInfo.Md5;
+        currentInfo.IV = fileInfo.IV;
+        currentInfo.ChunkIVs = fileInfo.ChunkIVs;
+        currentInfo.CipherVersion = fileInfo.CipherVersion;
+        currentInfo.Key = fileInfo.Key;
+        currentInfo.StorageClass = fileInfo.StorageClass;
+
+        this.cache.CacheDirentPut(currentInfo);
+        return nil;
+    }
 
-    // Update the directory tree if this is a new file.
-    if (newFile) {
-        this.dirs[parentId] = append(this.dirs[parentId], fileInfo);
+    parentInfo, ok := this.fat[fileInfo.Parent];
+    if (!ok || parentInfo.IsFile) {
+        return errors.WithStack(NewDoesntExistError(fmt.Sprintf("Parent (%s) was removed during a write.", string(fileInfo.Parent))));
     }
 
+    for _, child := range(this.dirs[fileInfo.Parent]) {
+        if (child.Name == fileInfo.Name) {
+            return errors.WithStack(NewIllegalOperationError("Dirent was created during a write: " + fileInfo.Name));
+        }
+    }
+
+    fileInfo.AccessCount++;
+
+    this.fat[fileInfo.Id] = fileInfo;
+    this.dirs[fileInfo.Parent] = append(this.dirs[fileInfo.Parent], fileInfo);
+
     this.cache.CacheDirentPut(fileInfo);
 
-    return fileInfo.Id, nil;
+    return nil;
 }
 
+// The file's read lock is held until the reader is closed,
+// so the file will not be rewritten out from under the reader.
+// Close the reader before writing to the same file.
 func (this *Driver) Read(userId identity.UserId, fileId dirent.Id) (util.ReadSeekCloser, error) {
-    fileInfo, _, err := this.getUserAndDirent(userId, fileId, true, false, false, true, false);
+    this.fileLocks.RLock(fileId);
+
+    this.lock.RLock();
+    fileInfo, fileCipher, err := this.getFileForIO(userId, fileId, true, false);
+    this.lock.RUnlock();
+
     if (err != nil) {
+        this.fileLocks.RUnlock(fileId);
         return nil, errors.WithStack(err);
     }
 
-    reader, err := this.connector.GetCipherReader(fileInfo, this.blockCipher);
+    reader, err := this.connector.GetCipherReader(fileInfo, fileCipher);
     if (err != nil) {
+        this.fileLocks.RUnlock(fileId);
         return nil, err;
     }
 
     // Update metadata.
-    fileInfo.AccessTimestamp = time.Now().Unix();
-    fileInfo.AccessCount++;
-    this.cache.CacheDirentPut(fileInfo);
+    this.lock.Lock();
+    this.touch(fileId);
+    this.lock.Unlock();
+
+    return &lockedReader{reader, this.fileLocks, fileId, false}, nil;
+}
+
+// A reader that holds its file's read lock until it is closed.
+type lockedReader struct {
+    util.ReadSeekCloser
+    fileLocks *fileLockMap
+    fileId dirent.Id
+    closed bool
+}
+
+func (this *lockedReader) Close() error {
+    if (this.closed) {
+        return nil;
+    }
+
+    this.closed = true;
+    defer this.fileLocks.RUnlock(this.fileId);
 
-    return reader, nil;
+    return this.ReadSeekCloser.Close();
+}
+
+// Write |data| into a file starting at |offset|.
+// Only the chunks of the file that are touched get rewritten.
+// Writing past the end of the file will fill the gap with zeros.
+func (this *Driver) WriteAt(userId identity.UserId, fileId dirent.Id, data []byte, offset int64) (int, error) {
+    var writeSize int = 0;
+
+    err := this.editFile(userId, fileId, func(editor *cipherio.ChunkEditor) error {
+        var err error;
+        writeSize, err = editor.WriteAt(data, offset);
+        return err;
+    });
+
+    if (err != nil) {
+        return 0, errors.WithStack(err);
+    }
+
+    return writeSize, nil;
+}
+
+// Change the size of a file.
+// Growing a file will fill it with zeros.
+func (this *Driver) Truncate(userId identity.UserId, fileId dirent.Id, size uint64) error {
+    return errors.WithStack(this.editFile(userId, fileId, func(editor *cipherio.ChunkEditor) error {
+        return editor.Truncate(int64(size));
+    }));
+}
+
+// Do a random-access edit on an existing file.
+// The connector only makes the edit visible once the whole edit is written (see cipherio.ChunkWriter).
+// Getting the new md5 would mean reading the whole file, so it is just cleared (see dirent.Dirent).
+func (this *Driver) editFile(userId identity.UserId, fileId dirent.Id, edit func(*cipherio.ChunkEditor) error) error {
+    // Hold the file's lock the entire time so we see the IVs from any previous edit.
+    this.fileLocks.Lock(fileId);
+    defer this.fileLocks.Unlock(fileId);
+
+    this.lock.RLock();
+    fileInfo, fileCipher, err := this.getFileForIO(userId, fileId, false, true);
+    this.lock.RUnlock();
+
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    reader, err := this.connector.GetCipherReader(fileInfo, fileCipher);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+    defer reader.Close();
+
+    writer, err := this.connector.GetChunkWriter(fileInfo);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    editor, err := cipherio.NewChunkEditor(reader, writer, connector.FileStreamParams(fileInfo, fileCipher), int64(fileInfo.Size));
+    if (err != nil) {
+        writer.Abort();
+        return errors.WithStack(err);
+    }
+
+    err = edit(editor);
+    if (err != nil) {
+        editor.Abort();
+        return errors.WithStack(err);
+    }
+
+    err = editor.Close();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    fileInfo.Size = editor.GetFileSize();
+    fileInfo.ChunkIVs = editor.GetChunkIVs();
+
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    currentInfo, ok := this.fat[fileId];
+    if (!ok) {
+        return errors.WithStack(NewDoesntExistError(fmt.Sprintf("File (%s) was removed during a write.", string(fileId))));
+    }
+
+    var operationTimestamp int64 = time.Now().Unix();
+
+    currentInfo.ModTimestamp = operationTimestamp;
+    currentInfo.AccessTimestamp = operationTimestamp;
+    currentInfo.AccessCount++;
+    currentInfo.Size = fileInfo.Size;
+    currentInfo.Md5 = "";
+    currentInfo.ChunkIVs = fileInfo.ChunkIVs;
+
+    this.cache.CacheDirentPut(currentInfo);
+
+    return nil;
+}
+
+// Get a copy of a file's dirent and the cipher for its data,
+// after checking that the user can read/write it.
+// The caller must hold at least the read lock.
+func (this *Driver) getFileForIO(userId identity.UserId, fileId dirent.Id,
+        read bool, write bool) (*dirent.Dirent, cipher.Block, error) {
+    fileInfo, _, err := this.getUserAndDirent(userId, fileId, read, write, false, true, false);
+    if (err != nil) {
+        return nil, nil, errors.WithStack(err);
+    }
+
+    fileCipher, err := this.fileCipher(fileInfo);
+    if (err != nil) {
+        return nil, nil, errors.WithStack(err);
+    }
+
+    return fileInfo.Clone(), fileCipher, nil;
 }
 
 func (this *Driver) RemoveDir(userId identity.UserId, dirId dirent.Id) error {
-    dirInfo, user, err := this.getUserAndDirent(userId, dirId, false, true, false, false, true);
+    this.lock.Lock();
+    removedFiles, err := this.checkedRemoveDir(userId, dirId);
+    this.lock.Unlock();
+
     if (err != nil) {
         return errors.WithStack(err);
     }
 
+    return errors.WithStack(this.removeFileObjects(removedFiles));
+}
+
+// Remove a directory (and everything under it) from the metadata.
+// Returns all the files that were removed (whose objects need to be removed).
+// The caller must hold the write lock.
+func (this *Driver) checkedRemoveDir(userId identity.UserId, dirId dirent.Id) ([]*dirent.Dirent, error) {
+    dirInfo, user, err := this.getUserAndDirent(userId, dirId, false, true, false, false, true);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
     group, ok := this.groups[dirInfo.Group];
     if (!ok) {
-        return errors.WithStack(NewIllegalOperationError("Unable to find a dirent's group."));
+        return nil, errors.WithStack(NewIllegalOperationError("Unable to find a dirent's group."));
     }
 
     err = this.checkRecusiveWritePermissions(user, group, dirInfo);
     if (err != nil) {
-        return errors.WithStack(err);
+        return nil, errors.WithStack(err);
     }
 
-    return errors.WithStack(this.removeDir(dirInfo));
+    return this.removeDir(dirInfo), nil;
 }
 
 func (this *Driver) RemoveFile(userId identity.UserId, fileId dirent.Id) error {
+    this.lock.Lock();
     fileInfo, _, err := this.getUserAndDirent(userId, fileId, false, true, false, true, false);
+    if (err == nil) {
+        this.removeFile(fileInfo);
+    }
+    this.lock.Unlock();
+
     if (err != nil) {
         return errors.WithStack(err);
     }
 
-    return errors.WithStack(this.removeFile(fileInfo));
+    return errors.WithStack(this.removeFileObjects([]*dirent.Dirent{fileInfo}));
 }
 
 func (this *Driver) Rename(userId identity.UserId, targetId dirent.Id, newName string) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    return this.rename(userId, targetId, newName);
+}
+
+func (this *Driver) rename(userId identity.UserId, targetId dirent.Id, newName string) error {
     if (newName == "") {
         return errors.WithStack(NewIllegalOperationError("Cannot rename to an empty name."));
     }
@@ -251,6 +532,9 @@ func (this *Driver) Rename(userId identity.UserId, targetId dirent.Id, newName s
 }
 
 func (this *Driver) ChangeOwner(userId identity.UserId, direntId dirent.Id, newOwnerId identity.UserId) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
     direntInfo, _, err := this.getUserAndDirent(userId, direntId, false, false, false, false, false);
     if (err != nil) {
         return errors.WithStack(err);
@@ -276,6 +560,9 @@ func (this *Driver) ChangeOwner(userId identity.UserId, direntId dirent.Id, newO
 }
 
 func (this *Driver) ChangeGroup(userId identity.UserId, direntId dirent.Id, newGroupId identity.GroupId) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
     direntInfo, _, err := this.getUserAndDirent(userId, direntId, false, false, false, false, false);
     if (err != nil) {
         return errors.WithStack(err);
@@ -301,6 +588,9 @@ func (this *Driver) ChangeGroup(userId identity.UserId, direntId dirent.Id, newG
 }
 
 func (this *Driver) ChangePermissions(userId identity.UserId, direntId dirent.Id, perms dirent.Permissions) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
     direntInfo, _, err := this.getUserAndDirent(userId, direntId, false, false, false, false, false);
     if (err != nil) {
         return errors.WithStack(err);
@@ -320,7 +610,44 @@ func (this *Driver) ChangePermissions(userId identity.UserId, direntId dirent.Id
     return nil;
 }
 
+// Set the storage class for files put into a dir (and the dirs under it that do not have their own).
+// An empty class goes back to using the parent's.
+// Only files that are put after this use the new class, existing files keep theirs until they are rewritten.
+// What classes are allowed is up to the connector (e.g. see s3.ValidOverrideStorageClass()).
+func (this *Driver) SetStorageClass(userId identity.UserId, dirId dirent.Id, storageClass string) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    dirInfo, _, err := this.getUserAndDirent(userId, dirId, false, true, false, false, true);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    if (storageClass == dirInfo.StorageClass) {
+        return nil;
+    }
+
+    dirInfo.StorageClass = storageClass;
+    this.cache.CacheDirentPut(dirInfo);
+
+    return nil;
+}
+
+// Get a child by name.
+// Returns nil (with no error) if there is no such child or the user cannot read it.
 func (this *Driver) FetchChildByName(userId identity.UserId, parentId dirent.Id, name string) (*dirent.Dirent, error) {
+    this.lock.RLock();
+    defer this.lock.RUnlock();
+
+    child, err := this.fetchChildByName(userId, parentId, name);
+    if (err != nil || child == nil) {
+        return nil, err;
+    }
+
+    return child.Clone(), nil;
+}
+
+func (this *Driver) fetchChildByName(userId identity.UserId, parentId dirent.Id, name string) (*dirent.Dirent, error) {
     _, user, err := this.getUserAndDirent(userId, parentId, true, false, true, false, true);
     if (err != nil) {
         return nil, errors.WithStack(err);
@@ -343,3 +670,16 @@ func (this *Driver) FetchChildByName(userId identity.UserId, parentId dirent.Id,
 
     return nil, nil;
 }
+
+// Update the access metadata for a dirent (if it still exists).
+// The caller must hold the write lock.
+func (this *Driver) touch(direntId dirent.Id) {
+    direntInfo, ok := this.fat[direntId];
+    if (!ok) {
+        return;
+    }
+
+    direntInfo.AccessTimestamp = time.Now().Unix();
+    direntInfo.AccessCount++;
+    this.cache.CacheDirentPut(direntInfo);
+}
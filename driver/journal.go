@@ -0,0 +1,230 @@
+package driver;
+
+// The metadata journal.
+// Instead of writing out the full metadata tables on every sync,
+// only the entries that changed (the ones in the cache) are written, as the next numbered segment.
+// Every JOURNAL_SEGMENTS_PER_CHECKPOINT segments, the journal is compacted into a checkpoint:
+// the full tables are written (as a new generation, see generation.go),
+// and the segments that neither it nor the previous generation needs are removed.
+//
+// The version of each table is the sequence number of the last segment that it includes,
+// so only later segments get replayed on it.
+// This keeps a checkpoint that only got some of the tables written (or some of the segments removed) safe to read.
+
+import (
+   "fmt"
+   "sort"
+   "strconv"
+   "strings"
+
+   "github.com/pkg/errors"
+
+   "github.com/eriq-augustine/elfs/cache"
+   "github.com/eriq-augustine/elfs/metadata"
+)
+
+const (
+   JOURNAL_ID_PREFIX = "journal_"
+   // Enough digits that segment ids sort the same way as their sequence numbers.
+   JOURNAL_SEQUENCE_DIGITS = 12
+   JOURNAL_SEGMENTS_PER_CHECKPOINT = 32
+)
+
+func journalId(sequence int) string {
+   return fmt.Sprintf("%s%0*d", JOURNAL_ID_PREFIX, JOURNAL_SEQUENCE_DIGITS, sequence);
+}
+
+// Get the sequence numbers of all the segments in storage (in order).
+func (this *Driver) listJournal() ([]int, error) {
+   metadataIds, err := this.connector.ListMetadata();
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   var sequences []int = make([]int, 0);
+   for _, metadataId := range(metadataIds) {
+      if (!strings.HasPrefix(metadataId, JOURNAL_ID_PREFIX)) {
+         continue;
+      }
+
+      sequence, err := strconv.Atoi(strings.TrimPrefix(metadataId, JOURNAL_ID_PREFIX));
+      if (err != nil) {
+         continue;
+      }
+
+      sequences = append(sequences, sequence);
+   }
+
+   sort.Ints(sequences);
+   return sequences, nil;
+}
+
+// Get a copy of everything that changed since the last sync (and the cache generation that it goes up to).
+func (this *Driver) snapshotJournal() (*metadata.JournalSegment, uint64) {
+   this.lock.RLock();
+   defer this.lock.RUnlock();
+
+   var changes *cache.ChangedIds = this.cache.GetChangedIds();
+   var segment *metadata.JournalSegment = metadata.NewJournalSegment(0);
+
+   for _, id := range(changes.Fat) {
+      segment.Fat[id] = nil;
+      entry, ok := this.fat[id];
+      if (ok) {
+         segment.Fat[id] = entry.Clone();
+      }
+   }
+
+   for _, id := range(changes.Users) {
+      segment.Users[id] = nil;
+      entry, ok := this.users[id];
+      if (ok) {
+         segment.Users[id] = entry.Clone();
+      }
+   }
+
+   for _, id := range(changes.Groups) {
+      segment.Groups[id] = nil;
+      entry, ok := this.groups[id];
+      if (ok) {
+         segment.Groups[id] = entry.Clone();
+      }
+   }
+
+   return segment, changes.Generation;
+}
+
+// Write |segment| as the next segment in the journal.
+// The caller must hold the sync lock.
+func (this *Driver) appendJournal(segment *metadata.JournalSegment) error {
+   // Sequence numbers are never reused, even if the write fails.
+   this.journalSequence++;
+   segment.Sequence = this.journalSequence;
+
+   var metadataId string = journalId(segment.Sequence);
+
+   writer, err := this.connector.GetMetadataWriter(metadataId, this.metadataCipher);
+   if (err != nil) {
+      return errors.Wrap(err, metadataId);
+   }
+
+   err = metadata.WriteJournalSegment(segment, writer);
+   if (err == nil) {
+      err = writer.Close();
+   } else {
+      writer.Abort();
+   }
+
+   // Do not leave a partial segment behind to be replayed.
+   if (err != nil) {
+      this.connector.RemoveMetadataFile(metadataId);
+      return errors.Wrap(err, metadataId);
+   }
+
+   this.journalSegments++;
+   return nil;
+}
+
+// Replay every segment that is newer than the tables that were just read.
+func (this *Driver) replayJournal() error {
+   sequences, err := this.listJournal();
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   // Every table includes the segments up to |oldest|, and no table includes any after |this.journalSequence|.
+   var oldest int = this.fatVersion;
+   this.journalSequence = this.fatVersion;
+   for _, version := range([]int{this.usersVersion, this.groupsVersion}) {
+      if (version < oldest) {
+         oldest = version;
+      }
+
+      if (version > this.journalSequence) {
+         this.journalSequence = version;
+      }
+   }
+
+   this.journalSegments = 0;
+
+   for _, sequence := range(sequences) {
+      // Already in every table (left over from a checkpoint that was cut short).
+      if (sequence <= oldest) {
+         continue;
+      }
+
+      var metadataId string = journalId(sequence);
+
+      reader, err := this.connector.GetMetadataReader(metadataId, this.metadataCipher, nil);
+      if (err != nil) {
+         return errors.Wrap(err, metadataId);
+      }
+
+      // Metadata takes ownership of reader.
+      segment, err := metadata.ReadJournalSegment(reader);
+      if (err != nil) {
+         return errors.Wrap(err, metadataId);
+      }
+
+      if (segment.Sequence != sequence) {
+         return errors.Errorf("Journal segment %s claims to be segment %d.", metadataId, segment.Sequence);
+      }
+
+      this.applyJournal(segment);
+
+      if (sequence > this.journalSequence) {
+         this.journalSequence = sequence;
+      }
+
+      this.journalSegments++;
+   }
+
+   return nil;
+}
+
+// Apply a segment to each table that does not already include it.
+// Nil values represent removals.
+func (this *Driver) applyJournal(segment *metadata.JournalSegment) {
+   if (segment.Sequence > this.fatVersion) {
+      for id, entry := range(segment.Fat) {
+         if (entry == nil) {
+            delete(this.fat, id);
+         } else {
+            this.fat[id] = entry;
+         }
+      }
+   }
+
+   if (segment.Sequence > this.usersVersion) {
+      for id, entry := range(segment.Users) {
+         if (entry == nil) {
+            delete(this.users, id);
+         } else {
+            this.users[id] = entry;
+         }
+      }
+   }
+
+   if (segment.Sequence > this.groupsVersion) {
+      for id, entry := range(segment.Groups) {
+         if (entry == nil) {
+            delete(this.groups, id);
+         } else {
+            this.groups[id] = entry;
+         }
+      }
+   }
+}
+
+// Remove segments (that are now in a checkpoint).
+// Oldest first, so an interrupted removal only ever leaves the newest segments.
+func (this *Driver) removeJournal(sequences []int) error {
+   for _, sequence := range(sequences) {
+      err := this.connector.RemoveMetadataFile(journalId(sequence));
+      if (err != nil) {
+         return errors.Wrap(err, journalId(sequence));
+      }
+   }
+
+   return nil;
+}
@@ -0,0 +1,218 @@
+package driver;
+
+// The journal is replayed on top of the tables, and only the segments that a table does not already include are applied to it.
+
+import (
+   "testing"
+   "time"
+
+   "github.com/eriq-augustine/elfs/connector/memory"
+   "github.com/eriq-augustine/elfs/dirent"
+   "github.com/eriq-augustine/elfs/identity"
+   "github.com/eriq-augustine/elfs/metadata"
+)
+
+const (
+   TEST_GROUP_ID = identity.GroupId(77)
+)
+
+// Write |segment| at its own sequence (without touching the driver's journal sequence).
+func writeTestSegment(t *testing.T, fsDriver *Driver, segment *metadata.JournalSegment) {
+   var metadataId string = journalId(segment.Sequence);
+
+   writer, err := fsDriver.connector.GetMetadataWriter(metadataId, fsDriver.metadataCipher);
+   if (err != nil) {
+      t.Fatalf("Failed to get writer for %s: %+v", metadataId, err);
+   }
+
+   err = metadata.WriteJournalSegment(segment, writer);
+   if (err == nil) {
+      err = writer.Close();
+   }
+
+   if (err != nil) {
+      t.Fatalf("Failed to write %s: %+v", metadataId, err);
+   }
+}
+
+func newTestDir(name string) *dirent.Dirent {
+   return dirent.NewDir(dirent.NewId(), name, dirent.ROOT_ID, identity.ROOT_USER_ID, identity.ROOT_GROUP_ID, time.Now().Unix());
+}
+
+func hasTestPath(fsDriver *Driver, path string) bool {
+   _, err := fsDriver.ResolvePath(identity.ROOT_USER_ID, path);
+   return err == nil;
+}
+
+// Segments written after a checkpoint are replayed on top of it when the filesystem loads,
+// and the next checkpoint includes them.
+func TestJournalReplay(t *testing.T) {
+   fsDriver, name, key, iv := newTestDriver(t);
+   defer memory.RemoveStore(name);
+
+   for _, path := range([]string{"/a", "/b"}) {
+      _, err := fsDriver.MkdirAll(identity.ROOT_USER_ID, path);
+      if (err == nil) {
+         err = fsDriver.SyncToDisk(false);
+      }
+
+      if (err != nil) {
+         fsDriver.Close();
+         t.Fatalf("Failed to sync %s: %+v", path, err);
+      }
+   }
+
+   root, err := fsDriver.readRoot();
+   if (err != nil) {
+      fsDriver.Close();
+      t.Fatalf("Failed to read root: %+v", err);
+   }
+   fsDriver.Close();
+
+   fsDriver = openTestDriver(t, name, key, iv, false);
+
+   if (fsDriver.generation != root.Generation || fsDriver.fatVersion != root.Sequence) {
+      fsDriver.Close();
+      t.Fatalf("Did not load the checkpoint (generation %d at %d, expected %d at %d).",
+            fsDriver.generation, fsDriver.fatVersion, root.Generation, root.Sequence);
+   }
+
+   if (fsDriver.journalSegments != 2 || fsDriver.journalSequence != root.Sequence + 2) {
+      fsDriver.Close();
+      t.Fatalf("Replayed %d segments up to %d, expected 2 up to %d.", fsDriver.journalSegments, fsDriver.journalSequence, root.Sequence + 2);
+   }
+
+   if (!hasTestPath(fsDriver, "/a") || !hasTestPath(fsDriver, "/b")) {
+      fsDriver.Close();
+      t.Fatalf("The journal was not replayed.");
+   }
+
+   err = fsDriver.SyncToDisk(true);
+   if (err != nil) {
+      fsDriver.Close();
+      t.Fatalf("Failed to checkpoint: %+v", err);
+   }
+
+   newRoot, err := fsDriver.readRoot();
+   fsDriver.Close();
+
+   if (err != nil || newRoot.Sequence != root.Sequence + 2 || newRoot.PreviousGeneration != root.Generation) {
+      t.Fatalf("The checkpoint does not include the replayed segments (%+v): %+v", newRoot, err);
+   }
+
+   fsDriver = openTestDriver(t, name, key, iv, false);
+   defer fsDriver.Close();
+
+   if (fsDriver.journalSegments != 0 || !hasTestPath(fsDriver, "/a") || !hasTestPath(fsDriver, "/b")) {
+      t.Fatalf("Bad load after the checkpoint (replayed %d segments).", fsDriver.journalSegments);
+   }
+}
+
+// A segment that the tables already include is not applied again, even if it is still in storage.
+func TestJournalSkipsIncludedSegments(t *testing.T) {
+   fsDriver, name, key, iv := newTestDriver(t);
+   defer memory.RemoveStore(name);
+
+   root, err := fsDriver.readRoot();
+   if (err != nil) {
+      fsDriver.Close();
+      t.Fatalf("Failed to read root: %+v", err);
+   }
+
+   var stale *dirent.Dirent = newTestDir("stale");
+   var fresh *dirent.Dirent = newTestDir("fresh");
+
+   var included *metadata.JournalSegment = metadata.NewJournalSegment(root.Sequence);
+   included.Fat[stale.Id] = stale;
+   writeTestSegment(t, fsDriver, included);
+
+   var next *metadata.JournalSegment = metadata.NewJournalSegment(root.Sequence + 1);
+   next.Fat[fresh.Id] = fresh;
+   writeTestSegment(t, fsDriver, next);
+
+   fsDriver.Close();
+
+   fsDriver = openTestDriver(t, name, key, iv, false);
+   defer fsDriver.Close();
+
+   if (hasTestPath(fsDriver, "/stale")) {
+      t.Fatalf("A segment that the checkpoint includes was replayed.");
+   }
+
+   if (!hasTestPath(fsDriver, "/fresh") || fsDriver.journalSequence != root.Sequence + 1) {
+      t.Fatalf("The segment after the checkpoint was not replayed (at %d).", fsDriver.journalSequence);
+   }
+}
+
+// Tables from before generations are written one at a time, so a checkpoint may have only written some of them.
+// Each table only gets the segments that it does not include.
+func TestJournalPartialCheckpoint(t *testing.T) {
+   fsDriver, name, key, iv := newTestDriver(t);
+   defer memory.RemoveStore(name);
+
+   var snapshot *metadataSnapshot = fsDriver.snapshotMetadata();
+   var sequence int = fsDriver.journalSequence;
+
+   var removed *dirent.Dirent = newTestDir("removed");
+   var group *identity.Group = &identity.Group{
+      Id: TEST_GROUP_ID,
+      Name: "journaled",
+      IsUsergroup: false,
+      Owner: identity.ROOT_USER_ID,
+      Members: map[identity.UserId]bool{identity.ROOT_USER_ID: true},
+   };
+
+   var segment *metadata.JournalSegment = metadata.NewJournalSegment(sequence + 1);
+   segment.Fat[removed.Id] = removed;
+   segment.Groups[group.Id] = group;
+
+   // Only the fat got written at the segment's sequence (without the dir).
+   var err error;
+   var tables []func() error = []func() error{
+      func() error { return fsDriver.writeFatCore(FAT_ID, snapshot.fat, sequence + 1); },
+      func() error { return fsDriver.writeUsersCore(USERS_ID, snapshot.users, sequence); },
+      func() error { return fsDriver.writeGroupsCore(GROUPS_ID, snapshot.groups, sequence); },
+   };
+
+   for _, writeTable := range(tables) {
+      err = writeTable();
+      if (err != nil) {
+         fsDriver.Close();
+         t.Fatalf("Failed to write legacy tables: %+v", err);
+      }
+   }
+
+   writeTestSegment(t, fsDriver, segment);
+
+   // Leave only the legacy tables.
+   err = fsDriver.connector.RemoveMetadataFile(METADATA_ROOT_ID);
+   if (err == nil) {
+      err = fsDriver.removeGeneration(fsDriver.generation);
+   }
+
+   if (err != nil) {
+      fsDriver.Close();
+      t.Fatalf("Failed to remove generation: %+v", err);
+   }
+   fsDriver.Close();
+
+   fsDriver = openTestDriver(t, name, key, iv, false);
+   defer fsDriver.Close();
+
+   if (fsDriver.generation != LEGACY_GENERATION) {
+      t.Fatalf("Did not load the legacy tables (loaded generation %d).", fsDriver.generation);
+   }
+
+   if (hasTestPath(fsDriver, "/removed")) {
+      t.Fatalf("The segment was applied to the fat, which already includes it.");
+   }
+
+   _, ok := fsDriver.groups[TEST_GROUP_ID];
+   if (!ok) {
+      t.Fatalf("The segment was not applied to the groups, which do not include it.");
+   }
+
+   if (!hasTestPath(fsDriver, "/")) {
+      t.Fatalf("Lost the root dir.");
+   }
+}
@@ -0,0 +1,304 @@
+package driver;
+
+// Per-file data keys.
+// Each file's data is encrypted with its own random key, which is kept in the FAT wrapped by the master key.
+// So changing the master key only means rewriting the metadata, not every file.
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "fmt"
+    "io/ioutil"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/dirent"
+    "github.com/eriq-augustine/elfs/identity"
+    "github.com/eriq-augustine/elfs/keyring"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+// Change the master key.
+// All the file keys get re-wrapped and all the metadata gets rewritten with the new key,
+// file data is not touched.
+// Files from before per-file keys are encrypted directly with the master key,
+// so a filesystem that still has any must be rekeyed instead (see Rekey()).
+// The driver stays usable during the rotation, only metadata syncs wait for it.
+// Filesystems with a key header need the header rewritten too, see RotateKeyWithHeader().
+func (this *Driver) RotateKey(contextUser identity.UserId, newKey []byte) error {
+    hasHeader, err := keyring.Exists(this.connector);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    if (hasHeader) {
+        return errors.WithStack(NewIllegalOperationError("The master key is in a key header, the header must be rotated with it."));
+    }
+
+    return errors.WithStack(this.rotateKey(contextUser, newKey, nil));
+}
+
+// Rotate the master key (see RotateKey()) and replace the key header.
+// |header| should already hold |newKey|.
+// Before any metadata is written under the new key, |header|'s slots are added to the current header as pending slots,
+// and the old slots are only replaced once all the metadata is written.
+// So whichever key the metadata ends up under, a passphrase in the header can open it (see UnlockKeyHeader()).
+func (this *Driver) RotateKeyWithHeader(contextUser identity.UserId, newKey []byte, header *keyring.KeyHeader) error {
+    return errors.WithStack(this.rotateKey(contextUser, newKey, header));
+}
+
+func (this *Driver) rotateKey(contextUser identity.UserId, newKey []byte, header *keyring.KeyHeader) error {
+    if (contextUser != identity.ROOT_USER_ID) {
+        return errors.WithStack(NewPermissionsError("Only root can rotate the master key."));
+    }
+
+    newBlockCipher, err := aes.NewCipher(newKey);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    // Nothing else writes metadata during the rotation,
+    // but the driver is only locked to take a snapshot and to switch keys (never for IO).
+    this.syncLock.Lock();
+    defer this.syncLock.Unlock();
+
+    this.lock.RLock();
+    var legacyFiles int = this.countLegacyFiles();
+    this.lock.RUnlock();
+
+    if (legacyFiles > 0) {
+        return errors.WithStack(NewIllegalOperationError(fmt.Sprintf(
+                "%d files are from before per-file keys and are encrypted directly with the master key, " +
+                "so they would still be readable with the old key. Use elfs-rekey to change the key instead.", legacyFiles)));
+    }
+
+    // Get all pending changes on disk (and out of the cache) under the old key first,
+    // so the cache only holds the changes made during the rotation.
+    err = this.syncJournal();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    var oldBlockCipher cipher.Block = this.blockCipher;
+
+    var snapshot *metadataSnapshot = this.snapshotMetadata();
+    newWrappedKeys, err := rewrapFileKeys(snapshot.fat, oldBlockCipher, newBlockCipher);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    for id, wrappedKey := range(newWrappedKeys) {
+        snapshot.fat[id].Key = wrappedKey;
+    }
+
+    var oldHeader *keyring.KeyHeader = nil;
+    if (header != nil) {
+        oldHeader, err = keyring.Read(this.connector);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+
+        oldHeader.PendingSlots = header.Slots;
+        err = oldHeader.Write(this.connector);
+        if (err != nil) {
+            return errors.Wrap(err, "Failed to add the pending key slots");
+        }
+
+        oldHeader.PendingSlots = nil;
+    }
+
+    // Nothing under the old key is kept around (see commitGeneration()).
+    this.metadataCipher = newBlockCipher;
+    err = this.commitGeneration(snapshot, true);
+    if (err == nil) {
+        err = this.writeMetadata(true, snapshot);
+    }
+
+    if (err == nil && header != nil) {
+        err = header.Write(this.connector);
+    }
+
+    if (err != nil) {
+        // The driver is still on the old key, so try to put the old metadata back.
+        this.metadataCipher = oldBlockCipher;
+
+        restoreErr := this.commitGeneration(this.snapshotMetadata(), true);
+        if (restoreErr == nil && oldHeader != nil) {
+            restoreErr = oldHeader.Write(this.connector);
+        }
+
+        if (restoreErr != nil) {
+            return errors.Wrapf(err, "Failed to rotate key, and failed to restore the metadata (%v)", restoreErr);
+        }
+
+        return errors.Wrap(err, "Failed to rotate key");
+    }
+
+    // Switch to the new key.
+    // Files may have been changed or put since the snapshot, so every file key gets re-wrapped again.
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    newWrappedKeys, err = rewrapFileKeys(this.fat, oldBlockCipher, newBlockCipher);
+    if (err != nil) {
+        return errors.Wrap(err, "The metadata was rotated to the new key, but the driver could not switch to it");
+    }
+
+    for id, wrappedKey := range(newWrappedKeys) {
+        this.fat[id].Key = wrappedKey;
+    }
+
+    this.key = append([]byte(nil), newKey...);
+    this.blockCipher = newBlockCipher;
+
+    // Anything that was changed during the rotation is still in the cache (and now has its new key).
+    return errors.WithStack(this.cache.SetBlockCipher(newBlockCipher));
+}
+
+// Files from before per-file keys have no key of their own.
+// The caller must hold at least the read lock.
+func (this *Driver) countLegacyFiles() int {
+    var count int = 0;
+    for _, fileInfo := range(this.fat) {
+        if (fileInfo.IsFile && len(fileInfo.Key) == 0) {
+            count++;
+        }
+    }
+
+    return count;
+}
+
+// Get every file's key wrapped by |newCipher| instead of |oldCipher|.
+func rewrapFileKeys(fat map[dirent.Id]*dirent.Dirent, oldCipher cipher.Block, newCipher cipher.Block) (map[dirent.Id][]byte, error) {
+    var wrappedKeys map[dirent.Id][]byte = make(map[dirent.Id][]byte);
+    for id, fileInfo := range(fat) {
+        if (!fileInfo.IsFile) {
+            continue;
+        }
+
+        if (len(fileInfo.Key) == 0) {
+            return nil, errors.Errorf("File (%s) has no key of its own.", string(id));
+        }
+
+        fileKey, err := util.UnwrapKey(oldCipher, fileInfo.Key, []byte(id));
+        if (err != nil) {
+            return nil, errors.Wrapf(err, "Bad key for file (%s)", string(id));
+        }
+
+        wrappedKeys[id], err = util.WrapKey(newCipher, fileKey, []byte(id));
+        if (err != nil) {
+            return nil, errors.WithStack(err);
+        }
+    }
+
+    return wrappedKeys, nil;
+}
+
+// Read the key header and unlock the master key with |passphrase|.
+// If a rotation was interrupted (the header still has pending slots, see RotateKeyWithHeader()),
+// it is first finished (or undone) depending on which key the metadata is under.
+// Returns: (header, master key, slot id, error).
+func UnlockKeyHeader(fsConnector connector.Connector, passphrase []byte) (*keyring.KeyHeader, []byte, int, error) {
+    header, err := keyring.Read(fsConnector);
+    if (err != nil) {
+        return nil, nil, -1, errors.WithStack(err);
+    }
+
+    if (len(header.PendingSlots) > 0) {
+        err = finishKeyRotation(fsConnector, header, passphrase);
+        if (err != nil) {
+            return nil, nil, -1, errors.WithStack(err);
+        }
+    }
+
+    masterKey, slotId, err := header.Unlock(passphrase);
+    if (err != nil) {
+        return nil, nil, -1, errors.WithStack(err);
+    }
+
+    return header, masterKey, slotId, nil;
+}
+
+// Keep the slots (pending or current) for the key that the metadata is under, and drop the others.
+// Nothing is changed unless a key that |passphrase| opens can actually read the metadata.
+func finishKeyRotation(fsConnector connector.Connector, header *keyring.KeyHeader, passphrase []byte) error {
+    pendingKey, _, err := header.UnlockPending(passphrase);
+    if (err == nil && keyReadsMetadata(fsConnector, pendingKey)) {
+        header.Slots = header.PendingSlots;
+        header.PendingSlots = nil;
+        return errors.Wrap(header.Write(fsConnector), "Failed to finish an interrupted key rotation");
+    }
+
+    oldKey, _, err := header.Unlock(passphrase);
+    if (err == nil && keyReadsMetadata(fsConnector, oldKey)) {
+        header.PendingSlots = nil;
+        return errors.Wrap(header.Write(fsConnector), "Failed to undo an interrupted key rotation");
+    }
+
+    return errors.New("A key rotation was interrupted, and the metadata cannot be read with any key that this passphrase opens.");
+}
+
+// Check if the metadata root (which every rotation writes) can be read with |key|.
+func keyReadsMetadata(fsConnector connector.Connector, key []byte) bool {
+    blockCipher, err := aes.NewCipher(key);
+    if (err != nil) {
+        return false;
+    }
+
+    reader, err := fsConnector.GetMetadataReader(METADATA_ROOT_ID, blockCipher, nil);
+    if (err != nil) {
+        return false;
+    }
+    defer reader.Close();
+
+    _, err = ioutil.ReadAll(reader);
+    return (err == nil);
+}
+
+// Get the cipher for a file's data.
+// The caller must hold at least the read lock.
+func (this *Driver) fileCipher(fileInfo *dirent.Dirent) (cipher.Block, error) {
+    if (len(fileInfo.Key) == 0) {
+        return this.blockCipher, nil;
+    }
+
+    fileKey, err := this.unwrapFileKey(fileInfo);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    blockCipher, err := aes.NewCipher(fileKey);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    return blockCipher, nil;
+}
+
+// Get a file's (unwrapped) data key.
+// Files without their own key use the master key.
+// The caller must hold at least the read lock.
+func (this *Driver) unwrapFileKey(fileInfo *dirent.Dirent) ([]byte, error) {
+    if (len(fileInfo.Key) == 0) {
+        return append([]byte(nil), this.key...), nil;
+    }
+
+    fileKey, err := util.UnwrapKey(this.blockCipher, fileInfo.Key, []byte(fileInfo.Id));
+    if (err != nil) {
+        return nil, errors.Wrapf(err, "Bad key for file (%s)", string(fileInfo.Id));
+    }
+
+    return fileKey, nil;
+}
+
+// Wrap a file's data key with the master key.
+// The caller must hold at least the read lock.
+func (this *Driver) wrapFileKey(fileId dirent.Id, fileKey []byte) ([]byte, error) {
+    wrappedKey, err := util.WrapKey(this.blockCipher, fileKey, []byte(fileId));
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    return wrappedKey, nil;
+}
@@ -0,0 +1,260 @@
+package driver;
+
+import (
+    "bytes"
+    "fmt"
+    "testing"
+
+    "github.com/eriq-augustine/elfs/connector/memory"
+    "github.com/eriq-augustine/elfs/identity"
+    "github.com/eriq-augustine/elfs/keyring"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+// After the master key changes, nothing under the old key is left in the metadata,
+// and the filesystem opens with the new key (and not the old one).
+func TestRotateKeyDropsOldMetadata(t *testing.T) {
+    fsDriver, name, key, iv := newTestDriver(t);
+    defer memory.RemoveStore(name);
+
+    var content []byte = util.RandomBytes(TEST_FILE_SIZE);
+    _, err := fsDriver.PutPath(identity.ROOT_USER_ID, "/file.bin", bytes.NewReader(content));
+    if (err != nil) {
+        fsDriver.Close();
+        t.Fatalf("Failed to put file: %+v", err);
+    }
+
+    // Get a previous generation and some journal segments under the old key.
+    for i := 0; i < 3; i++ {
+        _, err = fsDriver.MkdirAll(identity.ROOT_USER_ID, "/dir/" + util.RandomString(4));
+        if (err == nil) {
+            err = fsDriver.SyncToDisk(i == 0);
+        }
+
+        if (err != nil) {
+            fsDriver.Close();
+            t.Fatalf("Failed to sync: %+v", err);
+        }
+    }
+
+    var newKey []byte = util.GenAESKey();
+    err = fsDriver.RotateKey(identity.ROOT_USER_ID, newKey);
+    if (err != nil) {
+        fsDriver.Close();
+        t.Fatalf("Failed to rotate key: %+v", err);
+    }
+
+    root, err := fsDriver.readRoot();
+    if (err != nil) {
+        fsDriver.Close();
+        t.Fatalf("Failed to read root: %+v", err);
+    }
+
+    generations, err := fsDriver.listGenerations();
+    if (err != nil) {
+        fsDriver.Close();
+        t.Fatalf("Failed to list generations: %+v", err);
+    }
+
+    sequences, err := fsDriver.listJournal();
+    if (err != nil) {
+        fsDriver.Close();
+        t.Fatalf("Failed to list journal: %+v", err);
+    }
+
+    fsDriver.Close();
+
+    if (root.PreviousGeneration != NO_GENERATION) {
+        t.Fatalf("Root still points at a generation under the old key (%d).", root.PreviousGeneration);
+    }
+
+    if (len(generations) != 1 || generations[0] != root.Generation) {
+        t.Fatalf("Generations under the old key are left: %v (current is %d).", generations, root.Generation);
+    }
+
+    if (len(sequences) != 0) {
+        t.Fatalf("Journal segments under the old key are left: %v.", sequences);
+    }
+
+    fsConnector, err := memory.NewMemoryConnector(name, 0, false);
+    if (err != nil) {
+        t.Fatalf("Failed to open memory store: %+v", err);
+    }
+
+    oldDriver, err := NewDriverWithConnector(key, iv, fsConnector);
+    if (err == nil) {
+        oldDriver.Close();
+        t.Fatalf("The metadata can still be read with the old key.");
+    }
+    fsConnector.Close();
+
+    fsDriver = openTestDriver(t, name, newKey, iv, false);
+    defer fsDriver.Close();
+
+    data, err := readTestPath(fsDriver, "/file.bin");
+    if (err != nil || !bytes.Equal(data, content)) {
+        t.Fatalf("Failed to read file with the new key: %+v", err);
+    }
+}
+
+// A rotation that is interrupted (leaving pending slots in the key header) is finished or undone on the next unlock,
+// depending on which key the metadata is under.
+func TestInterruptedKeyRotation(t *testing.T) {
+    fsDriver, name, key, iv := newTestDriver(t);
+    defer memory.RemoveStore(name);
+    defer fsDriver.Close();
+
+    var oldPass []byte = []byte("old pass");
+    var newPass []byte = []byte("new pass");
+
+    oldHeader, err := keyring.NewKeyHeader(key, iv, oldPass);
+    if (err == nil) {
+        err = oldHeader.Write(fsDriver.connector);
+    }
+
+    if (err != nil) {
+        t.Fatalf("Failed to write key header: %+v", err);
+    }
+
+    var newKey []byte = util.GenAESKey();
+    newHeader, err := keyring.NewKeyHeader(newKey, iv, newPass);
+    if (err != nil) {
+        t.Fatalf("Failed to make key header: %+v", err);
+    }
+
+    // Interrupted before any metadata was written under the new key.
+    oldHeader.PendingSlots = newHeader.Slots;
+    err = oldHeader.Write(fsDriver.connector);
+    if (err != nil) {
+        t.Fatalf("Failed to write key header: %+v", err);
+    }
+
+    _, _, _, err = UnlockKeyHeader(fsDriver.connector, newPass);
+    if (err == nil) {
+        t.Fatalf("The new key was unlocked before the metadata was under it.");
+    }
+
+    header, unlockedKey, _, err := UnlockKeyHeader(fsDriver.connector, oldPass);
+    if (err != nil || !bytes.Equal(unlockedKey, key) || len(header.PendingSlots) != 0) {
+        t.Fatalf("Failed to undo the rotation: %+v", err);
+    }
+
+    // Interrupted after all the metadata was written under the new key.
+    err = fsDriver.RotateKeyWithHeader(identity.ROOT_USER_ID, newKey, newHeader);
+    if (err != nil) {
+        t.Fatalf("Failed to rotate key: %+v", err);
+    }
+
+    oldHeader.PendingSlots = newHeader.Slots;
+    err = oldHeader.Write(fsDriver.connector);
+    if (err != nil) {
+        t.Fatalf("Failed to write key header: %+v", err);
+    }
+
+    _, _, _, err = UnlockKeyHeader(fsDriver.connector, oldPass);
+    if (err == nil) {
+        t.Fatalf("The old key was unlocked after the metadata was under the new one.");
+    }
+
+    header, unlockedKey, _, err = UnlockKeyHeader(fsDriver.connector, newPass);
+    if (err != nil || !bytes.Equal(unlockedKey, newKey) || len(header.PendingSlots) != 0) {
+        t.Fatalf("Failed to finish the rotation: %+v", err);
+    }
+
+    header, err = keyring.Read(fsDriver.connector);
+    if (err != nil) {
+        t.Fatalf("Failed to read key header: %+v", err);
+    }
+
+    _, _, err = header.Unlock(oldPass);
+    if (err == nil || len(header.PendingSlots) != 0) {
+        t.Fatalf("The old slot was not retired.");
+    }
+}
+
+// Files from before per-file keys would still be readable with the old key, so they stop a rotation.
+func TestRotateKeyLegacyFiles(t *testing.T) {
+    fsDriver, name, key, iv := newTestDriver(t);
+    defer memory.RemoveStore(name);
+
+    fileId, err := fsDriver.PutPath(identity.ROOT_USER_ID, "/legacy.bin", bytes.NewReader(util.RandomBytes(TEST_FILE_SIZE)));
+    if (err != nil) {
+        fsDriver.Close();
+        t.Fatalf("Failed to put file: %+v", err);
+    }
+
+    fsDriver.lock.Lock();
+    fsDriver.fat[fileId].Key = nil;
+    fsDriver.lock.Unlock();
+
+    err = fsDriver.RotateKey(identity.ROOT_USER_ID, util.GenAESKey());
+    fsDriver.Close();
+
+    if (err == nil) {
+        t.Fatalf("Rotated the key with a legacy file.");
+    }
+
+    // Nothing changed.
+    fsDriver = openTestDriver(t, name, key, iv, false);
+    fsDriver.Close();
+}
+
+// Files can be put and read while the key is rotated, and they all read with the new key afterwards.
+func TestRotateKeyConcurrentPuts(t *testing.T) {
+    fsDriver, name, _, iv := newTestDriver(t);
+    defer memory.RemoveStore(name);
+
+    var contents map[string][]byte = make(map[string][]byte);
+    var errs chan error = make(chan error, 1);
+    var done chan bool = make(chan bool);
+
+    go func() {
+        defer close(done);
+
+        for i := 0; i < TEST_ROUNDS * 4; i++ {
+            var path string = "/file_" + util.RandomString(8);
+            var content []byte = util.RandomBytes(TEST_EDIT_SIZE);
+
+            _, err := fsDriver.PutPath(identity.ROOT_USER_ID, path, bytes.NewReader(content));
+            if (err == nil) {
+                var data []byte;
+                data, err = readTestPath(fsDriver, path);
+                if (err == nil && !bytes.Equal(data, content)) {
+                    err = fmt.Errorf("Read of (%s) does not match what was put.", path);
+                }
+            }
+
+            if (err != nil) {
+                errs <- err;
+                return;
+            }
+
+            contents[path] = content;
+        }
+    }();
+
+    var newKey []byte = util.GenAESKey();
+    err := fsDriver.RotateKey(identity.ROOT_USER_ID, newKey);
+    <-done;
+    close(errs);
+
+    for putErr := range(errs) {
+        fsDriver.Close();
+        t.Fatalf("Failed to put during the rotation: %+v", putErr);
+    }
+
+    fsDriver.Close();
+    if (err != nil) {
+        t.Fatalf("Failed to rotate key: %+v", err);
+    }
+
+    fsDriver = openTestDriver(t, name, newKey, iv, false);
+    defer fsDriver.Close();
+
+    for path, content := range(contents) {
+        data, err := readTestPath(fsDriver, path);
+        if (err != nil || !bytes.Equal(data, content)) {
+            t.Fatalf("Failed to read (%s) with the new key: %+v", path, err);
+        }
+    }
+}
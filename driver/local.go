@@ -4,8 +4,6 @@ package driver;
 // This treats a directory as if it was a partition.
 
 import (
-   "os"
-
    "github.com/pkg/errors"
 
    "github.com/eriq-augustine/elfs/connector/local"
@@ -17,16 +15,5 @@ func NewLocalDriver(key []byte, iv []byte, path string, force bool) (*Driver, er
       return nil, errors.Wrap(err, "Failed to get local connector.");
    }
 
-   driver, err := newDriver(key, iv, connector);
-   if (err != nil) {
-      return nil, errors.WithStack(err);
-   }
-
-   // Try to init the filesystem from any existing metadata.
-   err = driver.SyncFromDisk();
-   if (err != nil && errors.Cause(err) != nil && !os.IsNotExist(errors.Cause(err))) {
-      return nil, errors.WithStack(err);
-   }
-
-   return driver, nil;
+   return NewDriverWithConnector(key, iv, connector);
 }
@@ -0,0 +1,79 @@
+package driver;
+
+// Locks that are held while doing IO on the backing object of a single file.
+// Anything that changes the object holds the write lock,
+// and readers hold the read lock for as long as they are open (see Driver.Read()).
+// Locks are created on demand and cleaned up when nobody is using them.
+
+import (
+   "sync"
+
+   "github.com/eriq-augustine/elfs/dirent"
+)
+
+type fileLockMap struct {
+   lock *sync.Mutex
+   locks map[dirent.Id]*fileLock
+}
+
+type fileLock struct {
+   lock *sync.RWMutex
+   // The number of goroutines holding or waiting on this lock.
+   refs int
+}
+
+func newFileLockMap() *fileLockMap {
+   return &fileLockMap{
+      lock: &sync.Mutex{},
+      locks: make(map[dirent.Id]*fileLock),
+   };
+}
+
+func (this *fileLockMap) Lock(id dirent.Id) {
+   this.acquire(id).lock.Lock();
+}
+
+func (this *fileLockMap) Unlock(id dirent.Id) {
+   this.release(id).lock.Unlock();
+}
+
+func (this *fileLockMap) RLock(id dirent.Id) {
+   this.acquire(id).lock.RLock();
+}
+
+func (this *fileLockMap) RUnlock(id dirent.Id) {
+   this.release(id).lock.RUnlock();
+}
+
+// Get the lock for a file (making it if necessary) and count the caller as a user.
+func (this *fileLockMap) acquire(id dirent.Id) *fileLock {
+   this.lock.Lock();
+   defer this.lock.Unlock();
+
+   entry, ok := this.locks[id];
+   if (!ok) {
+      entry = &fileLock{&sync.RWMutex{}, 0};
+      this.locks[id] = entry;
+   }
+   entry.refs++;
+
+   return entry;
+}
+
+// Stop counting the caller as a user of a file's lock (the caller still needs to unlock it).
+func (this *fileLockMap) release(id dirent.Id) *fileLock {
+   this.lock.Lock();
+   defer this.lock.Unlock();
+
+   entry, ok := this.locks[id];
+   if (!ok) {
+      panic("Unlock of unlocked file: " + string(id));
+   }
+
+   entry.refs--;
+   if (entry.refs == 0) {
+      delete(this.locks, id);
+   }
+
+   return entry;
+}
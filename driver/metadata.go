@@ -24,7 +24,49 @@ const (
    IV_OFFSET_FAT = 500
 )
 
+// A consistent copy of all the metadata tables.
+// Metadata is written out from a snapshot so the driver's lock is not held during connector IO.
+type metadataSnapshot struct {
+   fat map[dirent.Id]*dirent.Dirent
+   users map[identity.UserId]*identity.User
+   groups map[identity.GroupId]*identity.Group
+   // The cache's generation at the time of the snapshot.
+   cacheGeneration uint64
+}
+
+func (this *Driver) snapshotMetadata() *metadataSnapshot {
+   this.lock.RLock();
+   defer this.lock.RUnlock();
+
+   return this.snapshotMetadataLocked();
+}
+
+// The caller must hold at least the read lock.
+func (this *Driver) snapshotMetadataLocked() *metadataSnapshot {
+   var snapshot metadataSnapshot = metadataSnapshot{
+      fat: make(map[dirent.Id]*dirent.Dirent, len(this.fat)),
+      users: make(map[identity.UserId]*identity.User, len(this.users)),
+      groups: make(map[identity.GroupId]*identity.Group, len(this.groups)),
+      cacheGeneration: this.cache.GetGeneration(),
+   };
+
+   for id, entry := range(this.fat) {
+      snapshot.fat[id] = entry.Clone();
+   }
+
+   for id, entry := range(this.users) {
+      snapshot.users[id] = entry.Clone();
+   }
+
+   for id, entry := range(this.groups) {
+      snapshot.groups[id] = entry.Clone();
+   }
+
+   return &snapshot;
+}
+
 // Make a copy of the IV and increment it enough.
+// These IVs are only used to read legacy metadata.
 func (this *Driver) initIVs() {
    this.fatIV = append([]byte(nil), this.iv...);
    util.IncrementBytesByCount(this.fatIV, IV_OFFSET_FAT);
@@ -40,19 +82,21 @@ func (this *Driver) initIVs() {
 }
 
 // Read the full fat into memory.
-func (this *Driver) readFat() error {
-   reader, err := this.connector.GetMetadataReader(FAT_ID, this.blockCipher, this.fatIV);
+func (this *Driver) readFat(metadataId string) error {
+   reader, err := this.connector.GetMetadataReader(metadataId, this.metadataCipher, this.fatIV);
    if (err != nil) {
-      return errors.WithStack(err);
+      return errors.Wrap(err, metadataId);
    }
 
+   this.legacyMetadata = this.legacyMetadata || reader.IsLegacy();
+
    // Clear the existing fat.
    this.fat = make(map[dirent.Id]*dirent.Dirent);
 
    // Metadata takes ownership of reader.
    version, err := metadata.ReadFat(this.fat, reader);
    if (err != nil) {
-      return errors.WithStack(err);
+      return errors.Wrap(err, metadataId);
    }
 
    this.fatVersion = version;
@@ -61,18 +105,20 @@ func (this *Driver) readFat() error {
 }
 
 // Read the full group listing into memory.
-func (this *Driver) readGroups() error {
-   reader, err := this.connector.GetMetadataReader(GROUPS_ID, this.blockCipher, this.groupsIV);
+func (this *Driver) readGroups(metadataId string) error {
+   reader, err := this.connector.GetMetadataReader(metadataId, this.metadataCipher, this.groupsIV);
    if (err != nil) {
-      return errors.WithStack(err);
+      return errors.Wrap(err, metadataId);
    }
 
+   this.legacyMetadata = this.legacyMetadata || reader.IsLegacy();
+
    this.groups = make(map[identity.GroupId]*identity.Group);
 
    // Metadata takes ownership of reader.
    version, err := metadata.ReadGroups(this.groups, reader);
    if (err != nil) {
-      return errors.WithStack(err);
+      return errors.Wrap(err, metadataId);
    }
 
    this.groupsVersion = version;
@@ -81,18 +127,20 @@ func (this *Driver) readGroups() error {
 }
 
 // Read the full user listing into memory.
-func (this *Driver) readUsers() error {
-   reader, err := this.connector.GetMetadataReader(USERS_ID, this.blockCipher, this.usersIV);
+func (this *Driver) readUsers(metadataId string) error {
+   reader, err := this.connector.GetMetadataReader(metadataId, this.metadataCipher, this.usersIV);
    if (err != nil) {
-      return errors.WithStack(err);
+      return errors.Wrap(err, metadataId);
    }
 
+   this.legacyMetadata = this.legacyMetadata || reader.IsLegacy();
+
    this.users = make(map[identity.UserId]*identity.User);
 
    // Metadata takes ownership of reader.
    version, err := metadata.ReadUsers(this.users, reader);
    if (err != nil) {
-      return errors.WithStack(err);
+      return errors.Wrap(err, metadataId);
    }
 
    this.usersVersion = version;
@@ -100,66 +148,31 @@ func (this *Driver) readUsers() error {
    return nil;
 }
 
-// Write the full fat to disk.
-func (this *Driver) writeFat(shadow bool) error {
-   this.fatVersion++;
-
-   var id string = FAT_ID;
-   if (shadow) {
-      id = id + "_" + SHADOW_SUFFIX;
-   }
-
-   err := this.writeFatCore(id, this.fatIV);
-   if (err != nil) {
-      return errors.WithStack(err);
-   }
-
-   return nil;
+// Write the full fat to disk (as |metadataId|), at the current journal sequence.
+func (this *Driver) writeFat(metadataId string, snapshot *metadataSnapshot) error {
+   return errors.Wrap(this.writeFatCore(metadataId, snapshot.fat, this.journalSequence), metadataId);
 }
 
-// Write the full group listing to disk.
-func (this *Driver) writeGroups(shadow bool) error {
-   this.groupsVersion++;
-
-   var id string = GROUPS_ID;
-   if (shadow) {
-      id = id + "_" + SHADOW_SUFFIX;
-   }
-
-   err := this.writeGroupsCore(id, this.groupsIV);
-   if (err != nil) {
-      return errors.WithStack(err);
-   }
-
-   return nil;
+// Write the full group listing to disk (as |metadataId|), at the current journal sequence.
+func (this *Driver) writeGroups(metadataId string, snapshot *metadataSnapshot) error {
+   return errors.Wrap(this.writeGroupsCore(metadataId, snapshot.groups, this.journalSequence), metadataId);
 }
 
-// Write the full user listing to disk.
-func (this *Driver) writeUsers(shadow bool) error {
-   this.usersVersion++;
-
-   var id string = USERS_ID;
-   if (shadow) {
-      id = id + "_" + SHADOW_SUFFIX;
-   }
-
-   err := this.writeUsersCore(id, this.usersIV);
-   if (err != nil) {
-      return errors.WithStack(err);
-   }
-
-   return nil;
+// Write the full user listing to disk (as |metadataId|), at the current journal sequence.
+func (this *Driver) writeUsers(metadataId string, snapshot *metadataSnapshot) error {
+   return errors.Wrap(this.writeUsersCore(metadataId, snapshot.users, this.journalSequence), metadataId);
 }
 
 // The actual FAT write.
-func (this *Driver) writeFatCore(metadataId string, iv []byte) error {
-   writer, err := this.connector.GetMetadataWriter(metadataId, this.blockCipher, iv);
+func (this *Driver) writeFatCore(metadataId string, fat map[dirent.Id]*dirent.Dirent, version int) error {
+   writer, err := this.connector.GetMetadataWriter(metadataId, this.metadataCipher);
    if (err != nil) {
       return errors.WithStack(err);
    }
 
-   err = metadata.WriteFat(this.fat, this.fatVersion, writer);
+   err = metadata.WriteFat(fat, version, this.metadataEncoding, writer);
    if (err != nil) {
+      writer.Abort();
       return errors.WithStack(err);
    }
 
@@ -167,14 +180,15 @@ func (this *Driver) writeFatCore(metadataId string, iv []byte) error {
 }
 
 // The actual groups write.
-func (this *Driver) writeGroupsCore(metadataId string, iv []byte) error {
-   writer, err := this.connector.GetMetadataWriter(metadataId, this.blockCipher, iv);
+func (this *Driver) writeGroupsCore(metadataId string, groups map[identity.GroupId]*identity.Group, version int) error {
+   writer, err := this.connector.GetMetadataWriter(metadataId, this.metadataCipher);
    if (err != nil) {
       return errors.WithStack(err);
    }
 
-   err = metadata.WriteGroups(this.groups, this.groupsVersion, writer);
+   err = metadata.WriteGroups(groups, version, this.metadataEncoding, writer);
    if (err != nil) {
+      writer.Abort();
       return errors.WithStack(err);
    }
 
@@ -182,14 +196,15 @@ func (this *Driver) writeGroupsCore(metadataId string, iv []byte) error {
 }
 
 // The actual users write.
-func (this *Driver) writeUsersCore(metadataId string, iv []byte) error {
-   writer, err := this.connector.GetMetadataWriter(metadataId, this.blockCipher, iv);
+func (this *Driver) writeUsersCore(metadataId string, users map[identity.UserId]*identity.User, version int) error {
+   writer, err := this.connector.GetMetadataWriter(metadataId, this.metadataCipher);
    if (err != nil) {
       return errors.WithStack(err);
    }
 
-   err = metadata.WriteUsers(this.users, this.usersVersion, writer);
+   err = metadata.WriteUsers(users, version, this.metadataEncoding, writer);
    if (err != nil) {
+      writer.Abort();
       return errors.WithStack(err);
    }
 
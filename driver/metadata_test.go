@@ -0,0 +1,121 @@
+package driver;
+
+import (
+   "bytes"
+   "io/ioutil"
+   "path/filepath"
+   "testing"
+
+   "github.com/eriq-augustine/elfs/cipherio"
+   "github.com/eriq-augustine/elfs/connector/memory"
+   "github.com/eriq-augustine/elfs/identity"
+   "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+   // Tables in the format from before the envelope (see metadata/testdata).
+   TEST_LEGACY_FIXTURES = "../metadata/testdata/format_2"
+)
+
+type closingBuffer struct {
+   bytes.Buffer
+}
+
+func (this *closingBuffer) Close() error {
+   return nil;
+}
+
+// Legacy tables (no envelope, and fixed IVs) get rewritten with envelopes as soon as they are loaded.
+func TestLegacyMetadataUpgrade(t *testing.T) {
+   var name string = "drivertest-" + util.RandomString(8);
+   var key []byte = util.GenAESKey();
+   var iv []byte = util.GenIV();
+   defer memory.RemoveStore(name);
+
+   fsConnector, err := memory.NewMemoryConnector(name, 0, false);
+   if (err != nil) {
+      t.Fatalf("Failed to open memory store: %+v", err);
+   }
+
+   fsDriver, err := newDriver(key, iv, fsConnector);
+   if (err != nil) {
+      fsConnector.Close();
+      t.Fatalf("Failed to make driver: %+v", err);
+   }
+
+   var legacyIVs map[string][]byte = map[string][]byte{
+      FAT_ID: fsDriver.fatIV,
+      USERS_ID: fsDriver.usersIV,
+      GROUPS_ID: fsDriver.groupsIV,
+   };
+
+   for table, legacyIV := range(legacyIVs) {
+      cleartext, err := ioutil.ReadFile(filepath.Join(TEST_LEGACY_FIXTURES, table));
+      if (err != nil) {
+         t.Fatalf("Failed to read fixture: %+v", err);
+      }
+
+      var params cipherio.StreamParams = cipherio.StreamParams{
+         BlockCipher: fsDriver.blockCipher,
+         IV: legacyIV,
+         Version: cipherio.CIPHER_VERSION_LEGACY,
+      };
+
+      var buffer closingBuffer;
+      writer, err := cipherio.NewCipherWriter(&buffer, params);
+      if (err == nil) {
+         _, err = writer.Write(cleartext);
+         if (err == nil) {
+            err = writer.Close();
+         }
+      }
+
+      if (err == nil) {
+         err = fsConnector.WriteAdminObject(table, buffer.Bytes());
+      }
+
+      if (err != nil) {
+         t.Fatalf("Failed to write legacy %s: %+v", table, err);
+      }
+   }
+
+   fsDriver.cache.Close();
+   fsConnector.Close();
+
+   fsDriver = openTestDriver(t, name, key, iv, false);
+
+   root, err := fsDriver.readRoot();
+   if (err != nil) {
+      fsDriver.Close();
+      t.Fatalf("The legacy tables were not upgraded to a generation: %+v", err);
+   }
+
+   for table, _ := range(legacyIVs) {
+      data, err := fsDriver.connector.ReadAdminObject(generationId(table, root.Generation));
+      if (err != nil || !bytes.HasPrefix(data, []byte(cipherio.METADATA_MAGIC))) {
+         fsDriver.Close();
+         t.Fatalf("%s was not rewritten with an envelope: %+v", table, err);
+      }
+   }
+
+   _, err = fsDriver.ResolvePath(identity.ROOT_USER_ID, "/docs/notes.txt");
+   fsDriver.Close();
+
+   if (err != nil || fsDriver.legacyMetadata) {
+      t.Fatalf("Bad legacy tables after upgrade: %+v", err);
+   }
+
+   // Loads from the upgraded tables (without upgrading again).
+   fsDriver = openTestDriver(t, name, key, iv, false);
+   defer fsDriver.Close();
+
+   if (fsDriver.generation != root.Generation || fsDriver.MetadataFallback() != nil) {
+      t.Fatalf("Did not load the upgraded tables (loaded generation %d, upgraded %d): %v.",
+            fsDriver.generation, root.Generation, fsDriver.MetadataFallback());
+   }
+
+   _, err = fsDriver.ResolvePath(identity.ROOT_USER_ID, "/docs/notes.txt");
+   if (err != nil) {
+      t.Fatalf("Lost a file after upgrade: %+v", err);
+   }
+}
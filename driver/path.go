@@ -0,0 +1,321 @@
+package driver;
+
+// Operations that refer to dirents by path (eg "/a/b/c") instead of by id.
+// Every directory walked through must be traversable (executable) by the user.
+// The unexported helpers here expect the caller to hold the driver lock.
+
+import (
+    "fmt"
+    "io"
+    "strings"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/dirent"
+    "github.com/eriq-augustine/elfs/identity"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+// Get the dirent at a path.
+// Only the directories along the path need to be traversable,
+// the target itself does not need to be readable.
+func (this *Driver) ResolvePath(userId identity.UserId, path string) (*dirent.Dirent, error) {
+    this.lock.RLock();
+    defer this.lock.RUnlock();
+
+    direntInfo, err := this.resolvePath(userId, path);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    return direntInfo.Clone(), nil;
+}
+
+func (this *Driver) PutPath(userId identity.UserId, path string, clearbytes io.Reader) (dirent.Id, error) {
+    this.lock.RLock();
+    parentInfo, name, err := this.resolveParent(userId, path);
+    this.lock.RUnlock();
+
+    if (err != nil) {
+        return dirent.EMPTY_ID, errors.WithStack(err);
+    }
+
+    return this.Put(userId, name, clearbytes, parentInfo.Id);
+}
+
+func (this *Driver) ReadPath(userId identity.UserId, path string) (util.ReadSeekCloser, error) {
+    fileInfo, err := this.ResolvePath(userId, path);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    return this.Read(userId, fileInfo.Id);
+}
+
+// Make a directory and any missing parents.
+// It is not an error if the directory already exists.
+func (this *Driver) MkdirAll(userId identity.UserId, path string) (dirent.Id, error) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    parts, err := splitPath(path);
+    if (err != nil) {
+        return dirent.EMPTY_ID, errors.WithStack(err);
+    }
+
+    var currentId dirent.Id = dirent.ROOT_ID;
+    for i, name := range(parts) {
+        child, err := this.lookupChild(userId, currentId, name);
+        if (err != nil) {
+            return dirent.EMPTY_ID, errors.Wrap(err, path);
+        }
+
+        if (child == nil) {
+            currentId, err = this.makeDir(userId, name, currentId);
+            if (err != nil) {
+                return dirent.EMPTY_ID, errors.Wrap(err, path);
+            }
+
+            continue;
+        }
+
+        if (child.IsFile) {
+            return dirent.EMPTY_ID, errors.WithStack(NewIllegalOperationError(
+                    fmt.Sprintf("Path component (%s) of (%s) is a file.", joinPath(parts[0:i + 1]), path)));
+        }
+
+        currentId = child.Id;
+    }
+
+    return currentId, nil;
+}
+
+// Remove the dirent at a path.
+// Non-empty directories will only be removed if |recursive| is set.
+func (this *Driver) RemovePath(userId identity.UserId, path string, recursive bool) error {
+    this.lock.Lock();
+    removedFiles, err := this.removePath(userId, path, recursive);
+    this.lock.Unlock();
+
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    return errors.WithStack(this.removeFileObjects(removedFiles));
+}
+
+func (this *Driver) removePath(userId identity.UserId, path string, recursive bool) ([]*dirent.Dirent, error) {
+    direntInfo, err := this.resolvePath(userId, path);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    if (direntInfo.Id == dirent.ROOT_ID) {
+        return nil, errors.WithStack(NewIllegalOperationError("Cannot remove the root directory."));
+    }
+
+    if (direntInfo.IsFile) {
+        _, _, err = this.getUserAndDirent(userId, direntInfo.Id, false, true, false, true, false);
+        if (err != nil) {
+            return nil, errors.WithStack(err);
+        }
+
+        this.removeFile(direntInfo);
+        return []*dirent.Dirent{direntInfo}, nil;
+    }
+
+    if (!recursive && len(this.dirs[direntInfo.Id]) > 0) {
+        return nil, errors.WithStack(NewIllegalOperationError("Directory is not empty: " + path));
+    }
+
+    return this.checkedRemoveDir(userId, direntInfo.Id);
+}
+
+// Move (and possibly rename) the dirent at |sourcePath|.
+// If |destPath| is an existing directory, then the source will be moved inside of it.
+// Otherwise, the source will be moved into the parent of |destPath| and take its name.
+// Existing dirents will not be overwritten.
+func (this *Driver) MovePath(userId identity.UserId, sourcePath string, destPath string) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
+    sourceInfo, err := this.resolvePath(userId, sourcePath);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    if (sourceInfo.Id == dirent.ROOT_ID) {
+        return errors.WithStack(NewIllegalOperationError("Cannot move the root directory."));
+    }
+
+    var newParentId dirent.Id;
+    var newName string;
+
+    destInfo, err := this.resolvePath(userId, destPath);
+    if (err != nil && !isDoesntExist(err)) {
+        return errors.WithStack(err);
+    }
+
+    if (destInfo != nil) {
+        if (destInfo.IsFile) {
+            return errors.WithStack(NewIllegalOperationError("Destination already exists: " + destPath));
+        }
+
+        newParentId = destInfo.Id;
+        newName = sourceInfo.Name;
+    } else {
+        parentInfo, name, err := this.resolveParent(userId, destPath);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+
+        newParentId = parentInfo.Id;
+        newName = name;
+    }
+
+    // Don't let a directory get moved inside of itself.
+    var ancestorId dirent.Id = newParentId;
+    for (ancestorId != dirent.ROOT_ID) {
+        if (ancestorId == sourceInfo.Id) {
+            return errors.WithStack(NewIllegalOperationError("Cannot move a directory inside of itself: " + sourcePath));
+        }
+
+        ancestorInfo, ok := this.fat[ancestorId];
+        if (!ok) {
+            return errors.WithStack(NewDoesntExistError(string(ancestorId)));
+        }
+
+        ancestorId = ancestorInfo.Parent;
+    }
+
+    // Make sure we will not collide with an existing name.
+    for _, child := range(this.dirs[newParentId]) {
+        if (child.Name == newName && child.Id != sourceInfo.Id) {
+            return errors.WithStack(NewIllegalOperationError("Destination already exists: " + destPath));
+        }
+    }
+
+    if (sourceInfo.Parent != newParentId) {
+        err = this.move(userId, sourceInfo.Id, newParentId);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+    }
+
+    if (sourceInfo.Name != newName) {
+        err = this.rename(userId, sourceInfo.Id, newName);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+    }
+
+    return nil;
+}
+
+func (this *Driver) resolvePath(userId identity.UserId, path string) (*dirent.Dirent, error) {
+    parts, err := splitPath(path);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    direntInfo, err := this.walkPath(userId, parts);
+    if (err != nil) {
+        return nil, errors.Wrap(err, path);
+    }
+
+    return direntInfo, nil;
+}
+
+// Get the parent directory for a path and the last part of the path.
+// The parent must exist, but the last part does not need to.
+func (this *Driver) resolveParent(userId identity.UserId, path string) (*dirent.Dirent, string, error) {
+    parts, err := splitPath(path);
+    if (err != nil) {
+        return nil, "", errors.WithStack(err);
+    }
+
+    if (len(parts) == 0) {
+        return nil, "", errors.WithStack(NewIllegalOperationError("Path has no parent: " + path));
+    }
+
+    parentInfo, err := this.walkPath(userId, parts[0:len(parts) - 1]);
+    if (err != nil) {
+        return nil, "", errors.Wrap(err, path);
+    }
+
+    if (parentInfo.IsFile) {
+        return nil, "", errors.WithStack(NewIllegalOperationError("Parent is not a directory: " + path));
+    }
+
+    return parentInfo, parts[len(parts) - 1], nil;
+}
+
+// Walk down from root following each name in |parts|.
+func (this *Driver) walkPath(userId identity.UserId, parts []string) (*dirent.Dirent, error) {
+    currentInfo, ok := this.fat[dirent.ROOT_ID];
+    if (!ok) {
+        return nil, errors.WithStack(NewDoesntExistError("root"));
+    }
+
+    for i, name := range(parts) {
+        child, err := this.lookupChild(userId, currentInfo.Id, name);
+        if (err != nil) {
+            return nil, errors.WithStack(err);
+        }
+
+        if (child == nil) {
+            return nil, errors.WithStack(NewDoesntExistError(joinPath(parts[0:i + 1])));
+        }
+
+        currentInfo = child;
+    }
+
+    return currentInfo, nil;
+}
+
+// Find a child by name, the parent must be a directory the user can traverse.
+// Returns nil (with no error) if there is no such child.
+func (this *Driver) lookupChild(userId identity.UserId, parentId dirent.Id, name string) (*dirent.Dirent, error) {
+    _, _, err := this.getUserAndDirent(userId, parentId, false, false, true, false, true);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    for _, child := range(this.dirs[parentId]) {
+        if (child.Name == name) {
+            return child, nil;
+        }
+    }
+
+    return nil, nil;
+}
+
+// Break a path into its non-empty components.
+// Both "/a/b" and "a/b/" are treated the same.
+// "." and ".." are not allowed, since they could never be the name of a dirent (and we only ever walk down).
+func splitPath(path string) ([]string, error) {
+    var parts []string = make([]string, 0);
+
+    for _, part := range(strings.Split(path, dirent.FILE_SEPARATOR)) {
+        if (part == "") {
+            continue;
+        }
+
+        if (part == "." || part == "..") {
+            return nil, errors.WithStack(NewIllegalOperationError(fmt.Sprintf("Path (%s) has a relative component (%s).", path, part)));
+        }
+
+        parts = append(parts, part);
+    }
+
+    return parts, nil;
+}
+
+func joinPath(parts []string) string {
+    return dirent.FILE_SEPARATOR + strings.Join(parts, dirent.FILE_SEPARATOR);
+}
+
+func isDoesntExist(err error) bool {
+    _, ok := errors.Cause(err).(*DoesntExistError);
+    return ok;
+}
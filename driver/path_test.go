@@ -0,0 +1,48 @@
+package driver;
+
+import (
+    "bytes"
+    "testing"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/identity"
+)
+
+// "." and ".." are refused in every path, and empty components are skipped.
+func TestRelativePaths(t *testing.T) {
+    fsDriver, name, _, _ := newTestDriver(t);
+    defer closeTestDriver(t, fsDriver, name);
+
+    dirId, err := fsDriver.MkdirAll(identity.ROOT_USER_ID, "//a/b/");
+    if (err != nil) {
+        t.Fatalf("Failed to make dirs: %+v", err);
+    }
+
+    dirInfo, err := fsDriver.ResolvePath(identity.ROOT_USER_ID, "a//b");
+    if (err != nil || dirInfo.Id != dirId) {
+        t.Fatalf("Failed to resolve a path with empty components: %+v", err);
+    }
+
+    for _, path := range([]string{"/a/./b", "/a/b/..", "/a/../a/b", ".", "..", "/a/b/."}) {
+        _, err = fsDriver.ResolvePath(identity.ROOT_USER_ID, path);
+        if (!isIllegalOperation(err)) {
+            t.Fatalf("Resolving (%s) should be illegal, got: %v", path, err);
+        }
+
+        _, err = fsDriver.MkdirAll(identity.ROOT_USER_ID, path + "/c");
+        if (!isIllegalOperation(err)) {
+            t.Fatalf("Making (%s) should be illegal, got: %v", path + "/c", err);
+        }
+
+        _, err = fsDriver.PutPath(identity.ROOT_USER_ID, path + "/file.txt", bytes.NewReader([]byte("data")));
+        if (!isIllegalOperation(err)) {
+            t.Fatalf("Putting (%s) should be illegal, got: %v", path + "/file.txt", err);
+        }
+    }
+}
+
+func isIllegalOperation(err error) bool {
+    _, ok := errors.Cause(err).(*IllegalOperationError);
+    return ok;
+}
@@ -0,0 +1,510 @@
+package driver;
+
+// Offline re-encryption of an entire filesystem under a new master key.
+// Unlike RotateKey() (which only re-wraps the file keys), every file gets a new data key and is re-encrypted,
+// so nothing that the old master key could open is left behind.
+//
+// Every file is copied to a new object (under a new dirent id), so its old object is intact until the very end.
+// Progress is kept in a journal (a metadata object encrypted with the new master key),
+// so an interrupted rekey can be picked up again by running it with the same new key:
+//  1. Copy - Each file is read with its old key and written to its new id with a new data key.
+//            New ids are derived from the old ones (with a salt from the journal),
+//            so a file copied after the last journal flush just gets copied again to the same place.
+//  2. Commit - The full new metadata is put in the journal, and then written out under the new key.
+//              From here on, the journal is the source of truth for the metadata.
+//  3. Verify - Every new file is read back and checked against the md5 in its dirent.
+//  4. Cleanup - The old objects and any metadata under the old key are removed,
+//               then the journal (and any pending key header, see keyring.PENDING_KEY_HEADER_ID).
+// A file whose content does not match the md5 in its dirent stops the rekey before anything is committed
+// (fsck reports these files).
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/json"
+    "fmt"
+    "os"
+
+    "github.com/pkg/errors"
+
+    "github.com/eriq-augustine/elfs/cipherio"
+    "github.com/eriq-augustine/elfs/connector"
+    "github.com/eriq-augustine/elfs/dirent"
+    "github.com/eriq-augustine/elfs/identity"
+    "github.com/eriq-augustine/elfs/keyring"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+    REKEY_JOURNAL_ID = "rekey_journal"
+    // Flush the journal after this many files have been copied.
+    REKEY_JOURNAL_INTERVAL = 100
+    REKEY_SALT_LENGTH = 32
+
+    REKEY_PHASE_COPY = 0
+    REKEY_PHASE_COMMITTED = 1
+)
+
+type rekeyJournal struct {
+    Phase int
+    // Used to derive the new file ids.
+    Salt []byte
+    // Copied files, keyed by their old id.
+    Files map[dirent.Id]*rekeyedFile
+    // The new metadata (only once committed).
+    Fat map[dirent.Id]*dirent.Dirent
+    Users map[identity.UserId]*identity.User
+    Groups map[identity.GroupId]*identity.Group
+}
+
+type rekeyedFile struct {
+    NewId dirent.Id
+    // Wrapped by the new master key.
+    Key []byte
+    IV []byte
+    CipherVersion int
+    Size uint64
+    // Of the content that was copied.
+    Md5 string
+}
+
+type RekeyReport struct {
+    // Files copied in this run.
+    FilesCopied int
+    // Files that were copied in an earlier (interrupted) run.
+    FilesResumed int
+}
+
+// Re-encrypt an entire filesystem under |newKey| (see above).
+// The filesystem must not be in use by anything else.
+// If |newHeader| is not nil, it will replace the key header (it should hold |newKey|).
+// This takes ownership of the connector, and closes it when done.
+func Rekey(fsConnector connector.Connector, oldKey []byte, iv []byte,
+        newKey []byte, newHeader *keyring.KeyHeader) (*RekeyReport, error) {
+    newBlockCipher, err := aes.NewCipher(newKey);
+    if (err != nil) {
+        fsConnector.Close();
+        return nil, errors.WithStack(err);
+    }
+
+    journal, err := readRekeyJournal(fsConnector, newBlockCipher);
+    if (err != nil) {
+        fsConnector.Close();
+        return nil, errors.Wrap(err, "Failed to read the rekey journal (is this the same new key as the interrupted rekey?)");
+    }
+
+    var fsDriver *Driver;
+    var report RekeyReport = RekeyReport{};
+
+    if (journal != nil && journal.Phase == REKEY_PHASE_COMMITTED) {
+        // The metadata tables may only be partly written, so the metadata comes from the journal.
+        fsDriver, err = newDriver(newKey, iv, fsConnector);
+        if (err != nil) {
+            fsConnector.Close();
+            return nil, errors.WithStack(err);
+        }
+        defer fsDriver.Close();
+
+        fsDriver.lock.Lock();
+        defer fsDriver.lock.Unlock();
+
+        fsDriver.fat = journal.Fat;
+        fsDriver.users = journal.Users;
+        fsDriver.groups = journal.Groups;
+        fsDriver.dirs = dirent.BuildDirs(fsDriver.fat);
+
+        report.FilesResumed = len(journal.Files);
+    } else {
+        fsDriver, err = NewDriverWithConnector(oldKey, iv, fsConnector);
+        if (err != nil) {
+            fsConnector.Close();
+            return nil, errors.WithStack(err);
+        }
+        defer fsDriver.Close();
+
+        fsDriver.lock.Lock();
+        defer fsDriver.lock.Unlock();
+
+        // Nothing can be left in the cache under the old key.
+        if (!fsDriver.cache.IsEmpty()) {
+            var snapshot *metadataSnapshot = fsDriver.snapshotMetadataLocked();
+
+            err = fsDriver.writeMetadata(false, snapshot);
+            if (err != nil) {
+                return nil, errors.Wrap(err, "Failed to flush the cache");
+            }
+
+            fsDriver.cache.Clear();
+        }
+
+        if (journal == nil) {
+            journal = &rekeyJournal{
+                Phase: REKEY_PHASE_COPY,
+                Salt: util.RandomBytes(REKEY_SALT_LENGTH),
+                Files: make(map[dirent.Id]*rekeyedFile),
+            };
+        }
+
+        err = fsDriver.rekeyCopy(journal, newBlockCipher, &report);
+        if (err != nil) {
+            return nil, errors.Wrap(err, "Failed to copy files");
+        }
+
+        err = fsDriver.rekeyCommit(journal, newKey, newBlockCipher);
+        if (err != nil) {
+            return nil, errors.Wrap(err, "Failed to commit new metadata");
+        }
+    }
+
+    err = fsDriver.writeRekeyedMetadata(newHeader);
+    if (err != nil) {
+        return nil, errors.Wrap(err, "Failed to write new metadata");
+    }
+
+    err = fsDriver.rekeyVerify(journal);
+    if (err != nil) {
+        return nil, errors.Wrap(err, "Failed to verify files");
+    }
+
+    err = fsDriver.rekeyCleanup(journal, newHeader != nil);
+    if (err != nil) {
+        return nil, errors.Wrap(err, "Failed to clean up old files");
+    }
+
+    return &report, nil;
+}
+
+// Copy every file that is not already in the journal.
+// The caller must hold the write lock.
+func (this *Driver) rekeyCopy(journal *rekeyJournal, newBlockCipher cipher.Block, report *RekeyReport) error {
+    var sinceFlush int = 0;
+
+    for id, fileInfo := range(this.fat) {
+        if (!fileInfo.IsFile) {
+            continue;
+        }
+
+        _, ok := journal.Files[id];
+        if (ok) {
+            report.FilesResumed++;
+            continue;
+        }
+
+        var newId dirent.Id = rekeyFileId(journal.Salt, id);
+        _, ok = this.fat[newId];
+        if (ok) {
+            return errors.Errorf("New id (%s) for file (%s) is already in use.", string(newId), string(id));
+        }
+
+        entry, err := this.rekeyFile(fileInfo, newId, newBlockCipher);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+
+        // The copy is left for the next run to write over.
+        if (fileInfo.Md5 != "" && fileInfo.Md5 != entry.Md5) {
+            return errors.Errorf("File (%s) does not match its md5. Expected: %s, Found: %s.", string(id), fileInfo.Md5, entry.Md5);
+        }
+
+        journal.Files[id] = entry;
+        report.FilesCopied++;
+
+        sinceFlush++;
+        if (sinceFlush >= REKEY_JOURNAL_INTERVAL) {
+            err = writeRekeyJournal(this.connector, newBlockCipher, journal);
+            if (err != nil) {
+                return errors.WithStack(err);
+            }
+
+            sinceFlush = 0;
+        }
+    }
+
+    return errors.WithStack(writeRekeyJournal(this.connector, newBlockCipher, journal));
+}
+
+// Copy a single file to |newId| with a new data key.
+// The caller must hold the write lock.
+func (this *Driver) rekeyFile(fileInfo *dirent.Dirent, newId dirent.Id, newBlockCipher cipher.Block) (*rekeyedFile, error) {
+    oldCipher, err := this.fileCipher(fileInfo);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    reader, err := this.connector.GetCipherReader(fileInfo, oldCipher);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+    defer reader.Close();
+
+    var fileKey []byte = util.GenAESKey();
+    fileCipher, err := aes.NewCipher(fileKey);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    var newInfo *dirent.Dirent = fileInfo.Clone();
+    newInfo.Id = newId;
+    newInfo.IV = util.GenIV();
+    newInfo.ChunkIVs = nil;
+    newInfo.CipherVersion = cipherio.CURRENT_CIPHER_VERSION;
+    newInfo.Key = nil;
+
+    size, md5String, err := connector.Write(this.connector, newInfo, fileCipher, reader);
+    if (err != nil) {
+        return nil, errors.Wrapf(err, "Failed to copy file (%s)", string(fileInfo.Id));
+    }
+
+    if (size != fileInfo.Size) {
+        return nil, errors.Errorf("Copy of file (%s) has the wrong size. Expected: %d, Found: %d.", string(fileInfo.Id), fileInfo.Size, size);
+    }
+
+    wrappedKey, err := util.WrapKey(newBlockCipher, fileKey, []byte(newId));
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    var entry rekeyedFile = rekeyedFile{
+        NewId: newId,
+        Key: wrappedKey,
+        IV: newInfo.IV,
+        CipherVersion: newInfo.CipherVersion,
+        Size: size,
+        Md5: md5String,
+    };
+
+    return &entry, nil;
+}
+
+// Build the new metadata, put it in the journal, and start using it.
+// The caller must hold the write lock.
+func (this *Driver) rekeyCommit(journal *rekeyJournal, newKey []byte, newBlockCipher cipher.Block) error {
+    var newFat map[dirent.Id]*dirent.Dirent = make(map[dirent.Id]*dirent.Dirent, len(this.fat));
+
+    for id, direntInfo := range(this.fat) {
+        if (!direntInfo.IsFile) {
+            newFat[id] = direntInfo.Clone();
+            continue;
+        }
+
+        entry, ok := journal.Files[id];
+        if (!ok) {
+            return errors.Errorf("File (%s) was never copied.", string(id));
+        }
+
+        var newInfo *dirent.Dirent = direntInfo.Clone();
+        newInfo.Id = entry.NewId;
+        newInfo.Key = entry.Key;
+        newInfo.IV = entry.IV;
+        newInfo.ChunkIVs = nil;
+        newInfo.CipherVersion = entry.CipherVersion;
+        newInfo.Size = entry.Size;
+        newInfo.Md5 = entry.Md5;
+
+        newFat[newInfo.Id] = newInfo;
+    }
+
+    journal.Phase = REKEY_PHASE_COMMITTED;
+    journal.Fat = newFat;
+    journal.Users = this.users;
+    journal.Groups = this.groups;
+
+    err := writeRekeyJournal(this.connector, newBlockCipher, journal);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    this.fat = newFat;
+    this.dirs = dirent.BuildDirs(this.fat);
+    this.key = append([]byte(nil), newKey...);
+    this.blockCipher = newBlockCipher;
+    this.metadataCipher = newBlockCipher;
+
+    return nil;
+}
+
+// Write all the metadata (and key header) under the current key.
+// The caller must hold the write lock.
+func (this *Driver) writeRekeyedMetadata(newHeader *keyring.KeyHeader) error {
+    var snapshot *metadataSnapshot = this.snapshotMetadataLocked();
+
+    // Nothing under the old key is kept around (see commitGeneration()).
+    err := this.commitGeneration(snapshot, true);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    err = this.writeMetadata(true, snapshot);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    // Anything left in the cache is already in the new metadata.
+    this.cache.ClearGeneration(snapshot.cacheGeneration);
+
+    err = this.cache.SetBlockCipher(this.blockCipher);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    if (newHeader != nil) {
+        err = newHeader.Write(this.connector);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+    }
+
+    return nil;
+}
+
+// Read back every copied file and check it against the md5 in its dirent.
+// The caller must hold the write lock.
+func (this *Driver) rekeyVerify(journal *rekeyJournal) error {
+    var failures []string = make([]string, 0);
+
+    for oldId, entry := range(journal.Files) {
+        fileInfo, ok := this.fat[entry.NewId];
+        if (!ok) {
+            return errors.Errorf("Copy (%s) of file (%s) is not in the new metadata.", string(entry.NewId), string(oldId));
+        }
+
+        md5String, err := this.fileMd5(fileInfo);
+        if (err != nil) {
+            failures = append(failures, fmt.Sprintf("%s: %v", string(fileInfo.Id), err));
+            continue;
+        }
+
+        if (md5String != fileInfo.Md5 || md5String != entry.Md5) {
+            failures = append(failures, fmt.Sprintf("%s: expected md5 %s, found %s", string(fileInfo.Id), fileInfo.Md5, md5String));
+        }
+    }
+
+    if (len(failures) > 0) {
+        return errors.Errorf("%d files failed verification (the old objects have been kept): %v", len(failures), failures);
+    }
+
+    return nil;
+}
+
+// Remove the old objects, anything left in the metadata under the old key, and then the journal.
+// The journal goes last, so an interrupted cleanup is run again.
+// Objects that are already gone (from an earlier run) are skipped.
+// The caller must hold the write lock.
+func (this *Driver) rekeyCleanup(journal *rekeyJournal, removePendingHeader bool) error {
+    for oldId, _ := range(journal.Files) {
+        err := this.connector.RemoveFile(&dirent.Dirent{Id: oldId});
+        if (err != nil && !os.IsNotExist(errors.Cause(err))) {
+            return errors.WithStack(err);
+        }
+    }
+
+    err := this.removeOldKeyMetadata();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    if (removePendingHeader) {
+        err = keyring.RemoveObject(this.connector, keyring.PENDING_KEY_HEADER_ID);
+        if (err != nil && !os.IsNotExist(errors.Cause(err))) {
+            return errors.WithStack(err);
+        }
+    }
+
+    return errors.WithStack(this.connector.RemoveMetadataFile(REKEY_JOURNAL_ID));
+}
+
+// Remove every generation other than the current one and every journal segment,
+// and write the shadows again, so no copy of the metadata under the old key is left.
+// The current generation was written under the new key (see writeRekeyedMetadata()).
+// The caller must hold the write lock.
+func (this *Driver) removeOldKeyMetadata() error {
+    generations, err := this.listGenerations();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    for _, generation := range(generations) {
+        if (generation == this.generation) {
+            continue;
+        }
+
+        err = this.removeGeneration(generation);
+        if (err != nil) {
+            return errors.WithStack(err);
+        }
+    }
+
+    sequences, err := this.listJournal();
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    err = this.removeJournal(sequences);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    return errors.WithStack(this.writeMetadata(true, this.snapshotMetadataLocked()));
+}
+
+// The caller must hold at least the read lock.
+func (this *Driver) fileMd5(fileInfo *dirent.Dirent) (string, error) {
+    fileCipher, err := this.fileCipher(fileInfo);
+    if (err != nil) {
+        return "", errors.WithStack(err);
+    }
+
+    _, md5String, err := this.hashFileData(fileInfo, fileCipher);
+    return md5String, errors.WithStack(err);
+}
+
+// Derive the new id for a file.
+func rekeyFileId(salt []byte, oldId dirent.Id) dirent.Id {
+    var mac = hmac.New(sha256.New, salt);
+    mac.Write([]byte(oldId));
+
+    var id []byte = mac.Sum(nil)[0:dirent.ID_LENGTH];
+    for i, val := range(id) {
+        id[i] = util.RANDOM_CHARS[int(val) % len(util.RANDOM_CHARS)];
+    }
+
+    return dirent.Id(id);
+}
+
+// Returns nil (with no error) if there is no journal.
+func readRekeyJournal(fsConnector connector.Connector, blockCipher cipher.Block) (*rekeyJournal, error) {
+    reader, err := fsConnector.GetMetadataReader(REKEY_JOURNAL_ID, blockCipher, nil);
+    if (err != nil) {
+        if (os.IsNotExist(errors.Cause(err))) {
+            return nil, nil;
+        }
+
+        return nil, errors.WithStack(err);
+    }
+    defer reader.Close();
+
+    var journal rekeyJournal;
+    err = json.NewDecoder(reader).Decode(&journal);
+    if (err != nil) {
+        return nil, errors.WithStack(err);
+    }
+
+    return &journal, nil;
+}
+
+func writeRekeyJournal(fsConnector connector.Connector, blockCipher cipher.Block, journal *rekeyJournal) error {
+    writer, err := fsConnector.GetMetadataWriter(REKEY_JOURNAL_ID, blockCipher);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    err = json.NewEncoder(writer).Encode(journal);
+    if (err != nil) {
+        writer.Abort();
+        return errors.WithStack(err);
+    }
+
+    return errors.WithStack(writer.Close());
+}
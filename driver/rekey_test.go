@@ -0,0 +1,148 @@
+package driver;
+
+import (
+    "bytes"
+    "testing"
+
+    "github.com/eriq-augustine/elfs/connector/memory"
+    "github.com/eriq-augustine/elfs/identity"
+    "github.com/eriq-augustine/elfs/util"
+)
+
+// A filesystem with a few files, and some metadata history (generations and journal segments).
+// Returns the driver, the store name, the key, the iv, and the content of each file (by path).
+func newTestRekeyDriver(t *testing.T) (*Driver, string, []byte, []byte, map[string][]byte) {
+    fsDriver, name, key, iv := newTestDriver(t);
+    var contents map[string][]byte = make(map[string][]byte);
+
+    for i := 0; i < 3; i++ {
+        var path string = "/file_" + util.RandomString(4);
+        contents[path] = util.RandomBytes(TEST_FILE_SIZE);
+
+        _, err := fsDriver.PutPath(identity.ROOT_USER_ID, path, bytes.NewReader(contents[path]));
+        if (err == nil) {
+            err = fsDriver.SyncToDisk(i == 0);
+        }
+
+        if (err != nil) {
+            closeTestDriver(t, fsDriver, name);
+            t.Fatalf("Failed to put file: %+v", err);
+        }
+    }
+
+    return fsDriver, name, key, iv, contents;
+}
+
+func rekeyTestStore(t *testing.T, name string, key []byte, iv []byte, newKey []byte) error {
+    fsConnector, err := memory.NewMemoryConnector(name, 0, false);
+    if (err != nil) {
+        t.Fatalf("Failed to open memory store: %+v", err);
+    }
+
+    _, err = Rekey(fsConnector, key, iv, newKey, nil);
+    return err;
+}
+
+// After a rekey, the files read under the new key, and nothing under the old key is left.
+func TestRekey(t *testing.T) {
+    fsDriver, name, key, iv, contents := newTestRekeyDriver(t);
+    defer memory.RemoveStore(name);
+    fsDriver.Close();
+
+    var newKey []byte = util.GenAESKey();
+    err := rekeyTestStore(t, name, key, iv, newKey);
+    if (err != nil) {
+        t.Fatalf("Failed to rekey: %+v", err);
+    }
+
+    fsConnector, err := memory.NewMemoryConnector(name, 0, false);
+    if (err != nil) {
+        t.Fatalf("Failed to open memory store: %+v", err);
+    }
+
+    oldDriver, err := NewDriverWithConnector(key, iv, fsConnector);
+    if (err == nil) {
+        oldDriver.Close();
+        t.Fatalf("The metadata can still be read with the old key.");
+    }
+    fsConnector.Close();
+
+    fsDriver = openTestDriver(t, name, newKey, iv, false);
+    defer fsDriver.Close();
+
+    for path, content := range(contents) {
+        data, err := readTestPath(fsDriver, path);
+        if (err != nil || !bytes.Equal(data, content)) {
+            t.Fatalf("Failed to read (%s) after rekey: %+v", path, err);
+        }
+    }
+
+    metadataIds, err := fsDriver.connector.ListMetadata();
+    if (err != nil) {
+        t.Fatalf("Failed to list metadata: %+v", err);
+    }
+
+    var expected map[string]bool = map[string]bool{
+        METADATA_ROOT_ID: true,
+        generationId(FAT_ID, fsDriver.generation): true,
+        generationId(USERS_ID, fsDriver.generation): true,
+        generationId(GROUPS_ID, fsDriver.generation): true,
+        shadowSource().fatId: true,
+        shadowSource().usersId: true,
+        shadowSource().groupsId: true,
+    };
+
+    for _, metadataId := range(metadataIds) {
+        if (!expected[metadataId]) {
+            t.Fatalf("Metadata (%s) is left after the rekey.", metadataId);
+        }
+    }
+}
+
+// A file that does not match its md5 stops the rekey, and the filesystem is left as it was.
+func TestRekeyMd5Mismatch(t *testing.T) {
+    fsDriver, name, key, iv, contents := newTestRekeyDriver(t);
+    defer memory.RemoveStore(name);
+
+    var path string;
+    for path, _ = range(contents) {
+        break;
+    }
+
+    fileInfo, err := fsDriver.ResolvePath(identity.ROOT_USER_ID, path);
+    if (err != nil) {
+        fsDriver.Close();
+        t.Fatalf("Failed to get file: %+v", err);
+    }
+
+    fsDriver.lock.Lock();
+    fsDriver.fat[fileInfo.Id].Md5 = "d41d8cd98f00b204e9800998ecf8427e";
+    fsDriver.cache.CacheDirentPut(fsDriver.fat[fileInfo.Id]);
+    fsDriver.lock.Unlock();
+
+    err = fsDriver.SyncToDisk(true);
+    fsDriver.Close();
+    if (err != nil) {
+        t.Fatalf("Failed to sync: %+v", err);
+    }
+
+    err = rekeyTestStore(t, name, key, iv, util.GenAESKey());
+    if (err == nil) {
+        t.Fatalf("Rekey should fail on a file that does not match its md5.");
+    }
+
+    fsDriver = openTestDriver(t, name, key, iv, false);
+    defer fsDriver.Close();
+
+    for path, content := range(contents) {
+        data, err := readTestPath(fsDriver, path);
+        if (err != nil || !bytes.Equal(data, content)) {
+            t.Fatalf("Failed to read (%s) with the old key: %+v", path, err);
+        }
+    }
+
+    _, err = fsDriver.GetDirent(identity.ROOT_USER_ID, fileInfo.Id);
+    if (err != nil) {
+        t.Fatalf("File is gone after a failed rekey: %+v", err);
+    }
+}
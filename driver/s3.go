@@ -1,8 +1,6 @@
 package driver;
 
 import (
-   "os"
-
    "github.com/pkg/errors"
 
    "github.com/eriq-augustine/elfs/connector/s3"
@@ -14,16 +12,5 @@ func NewS3Driver(key []byte, iv []byte, bucket string, credentialsPath string, a
       return nil, errors.WithStack(err);
    }
 
-   driver, err := newDriver(key, iv, connector);
-   if (err != nil) {
-      return nil, errors.WithStack(err);
-   }
-
-   // Try to init the filesystem from any existing metadata.
-   err = driver.SyncFromDisk();
-   if (err != nil && errors.Cause(err) != nil && !os.IsNotExist(errors.Cause(err))) {
-      return nil, errors.WithStack(err);
-   }
-
-   return driver, nil;
+   return NewDriverWithConnector(key, iv, connector);
 }
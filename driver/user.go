@@ -9,6 +9,9 @@ import (
 )
 
 func (this *Driver) AddUser(contextUser identity.UserId, name string, weakhash string) (identity.UserId, error) {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
     if (contextUser != identity.ROOT_USER_ID) {
         return identity.EMPTY_USER_ID, errors.WithStack(NewIllegalOperationError("Only root can add users."));
     }
@@ -47,11 +50,36 @@ func (this *Driver) AddUser(contextUser identity.UserId, name string, weakhash s
     return newUser.Id, nil;
 }
 
+// Get a copy of all the users.
 func (this *Driver) GetUsers() map[identity.UserId]*identity.User {
-    return this.users;
+    this.lock.RLock();
+    defer this.lock.RUnlock();
+
+    var users map[identity.UserId]*identity.User = make(map[identity.UserId]*identity.User, len(this.users));
+    for id, user := range(this.users) {
+        users[id] = user.Clone();
+    }
+
+    return users;
 }
 
 func (this *Driver) RemoveUser(contextUser identity.UserId, targetId identity.UserId) error {
+    err := this.removeUser(contextUser, targetId);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    // Because this can cause a lot of cache churn (if this user owned a lot),
+    // sync the cache.
+    this.SyncToDisk(true);
+
+    return nil;
+}
+
+func (this *Driver) removeUser(contextUser identity.UserId, targetId identity.UserId) error {
+    this.lock.Lock();
+    defer this.lock.Unlock();
+
     if (contextUser != identity.ROOT_USER_ID) {
         return errors.WithStack(NewIllegalOperationError("Only root can delete users."));
     }
@@ -81,21 +109,21 @@ func (this *Driver) RemoveUser(contextUser identity.UserId, targetId identity.Us
     this.cache.CacheGroupDelete(targetUsergroup);
     this.cache.CacheUserDelete(targetUser);
 
-    // Because this can cause a lot of cache churn (if this user owned a lot),
-    // sync the cache.
-    this.SyncToDisk(true);
-
     return nil;
 }
 
 func (this *Driver) UserAuth(name string, weakhash string) (*identity.User, error) {
     var targetUser *identity.User = nil;
+
+    // Hashing is slow, so don't hold the lock while checking the password.
+    this.lock.RLock();
     for _, userInfo := range(this.users) {
         if (userInfo.Name == name) {
-            targetUser = userInfo;
+            targetUser = userInfo.Clone();
             break;
         }
     }
+    this.lock.RUnlock();
 
     if (targetUser == nil) {
         return nil, errors.WithStack(NewAuthError("Cannot find user to auth"));
@@ -3,7 +3,11 @@ package driver;
 // Simple utilties.
 
 import (
+    "crypto/cipher"
+    "crypto/md5"
+    "encoding/hex"
     "fmt"
+    "io"
     "math/rand"
 
     "github.com/pkg/errors"
@@ -61,19 +65,20 @@ func (this *Driver) getNewGroupId() identity.GroupId {
 // Recursivley remove all dirents.
 // Go depth first (while hitting all files along the way).
 // Does not perform any permission checks.
-func (this *Driver) removeDir(dir *dirent.Dirent) error {
+// Only the metadata is removed, the removed files are returned so their objects can be removed
+// (see removeFileObjects()).
+func (this *Driver) removeDir(dir *dirent.Dirent) []*dirent.Dirent {
+    var removedFiles []*dirent.Dirent = make([]*dirent.Dirent, 0);
+
     // First remove all children (recursively).
-    for _, child := range(this.dirs[dir.Id]) {
+    // Removing children modifies the dir structure, so iterate over a copy.
+    var children []*dirent.Dirent = append([]*dirent.Dirent(nil), this.dirs[dir.Id]...);
+    for _, child := range(children) {
         if (child.IsFile) {
-            err := this.removeFile(child);
-            if (err != nil) {
-                return errors.Wrap(err, string(dir.Id));
-            }
+            this.removeFile(child);
+            removedFiles = append(removedFiles, child);
         } else {
-            err := this.removeDir(child);
-            if (err != nil) {
-                return errors.Wrap(err, string(dir.Id));
-            }
+            removedFiles = append(removedFiles, this.removeDir(child)...);
         }
     }
 
@@ -88,25 +93,66 @@ func (this *Driver) removeDir(dir *dirent.Dirent) error {
     // Remove the entry from dirs (as a parent).
     delete(this.dirs, dir.Id);
 
-    return nil;
+    return removedFiles;
 }
 
+// Remove a file from the metadata.
 // Does not perform any permission checks.
-func (this *Driver) removeFile(file *dirent.Dirent) error {
-    // Remove from fat first, just incase disk remove fails.
+func (this *Driver) removeFile(file *dirent.Dirent) {
     delete(this.fat, file.Id);
 
     this.cache.CacheDirentDelete(file);
 
     // Remove from the dir structure.
     dirent.RemoveChild(this.dirs, file);
+}
 
-    return errors.Wrap(this.connector.RemoveFile(file), string(file.Id));
+// Remove the backing objects for files that have already been removed from the metadata.
+// Must be called without holding the driver lock.
+func (this *Driver) removeFileObjects(files []*dirent.Dirent) error {
+    for _, file := range(files) {
+        this.fileLocks.Lock(file.Id);
+        err := this.connector.RemoveFile(file);
+        this.fileLocks.Unlock(file.Id);
+
+        if (err != nil) {
+            return errors.Wrap(err, string(file.Id));
+        }
+    }
+
+    return nil;
+}
+
+// Read all of a file's data.
+// Returns: (size, md5 hash (hex), error).
+func (this *Driver) hashFileData(fileInfo *dirent.Dirent, fileCipher cipher.Block) (uint64, string, error) {
+    reader, err := this.connector.GetCipherReader(fileInfo, fileCipher);
+    if (err != nil) {
+        return 0, "", errors.WithStack(err);
+    }
+    defer reader.Close();
+
+    var hash = md5.New();
+    size, err := io.Copy(hash, reader);
+    if (err != nil) {
+        return 0, "", errors.WithStack(err);
+    }
+
+    return uint64(size), hex.EncodeToString(hash.Sum(nil)), nil;
+}
+
+func cloneDirents(dirents []*dirent.Dirent) []*dirent.Dirent {
+    var clones []*dirent.Dirent = make([]*dirent.Dirent, 0, len(dirents));
+    for _, direntInfo := range(dirents) {
+        clones = append(clones, direntInfo.Clone());
+    }
+
+    return clones;
 }
 
 func (this *Driver) checkRecusiveWritePermissions(user *identity.User, group *identity.Group, direntInfo *dirent.Dirent) error {
     if (!direntInfo.CanWrite(user, group)) {
-        return NewPermissionsError(fmt.Sprintf("User (%s) cannot write dirent (%s).", string(user.Id), string(direntInfo.Id)));
+        return NewPermissionsError(fmt.Sprintf("User (%d) cannot write dirent (%s).", int(user.Id), string(direntInfo.Id)));
     }
 
     if (!direntInfo.IsFile) {
@@ -133,7 +179,7 @@ func (this *Driver) getUserAndDirent(
 
     user, ok := this.users[userId];
     if (!ok) {
-        return nil, nil, errors.WithStack(NewDoesntExistError(string(userId)));
+        return nil, nil, errors.WithStack(NewDoesntExistError(fmt.Sprintf("user %d", int(userId))));
     }
 
     direntGroup, ok := this.groups[direntInfo.Group];
@@ -142,15 +188,15 @@ func (this *Driver) getUserAndDirent(
     }
 
     if (needRead && !direntInfo.CanRead(user, direntGroup)) {
-        return nil, nil, NewPermissionsError(fmt.Sprintf("User (%s) cannot read dirent (%s).", string(userId), string(direntId)));
+        return nil, nil, NewPermissionsError(fmt.Sprintf("User (%d) cannot read dirent (%s).", int(userId), string(direntId)));
     }
 
     if (needWrite && !direntInfo.CanWrite(user, direntGroup)) {
-        return nil, nil, NewPermissionsError(fmt.Sprintf("User (%s) cannot write dirent (%s).", string(userId), string(direntId)));
+        return nil, nil, NewPermissionsError(fmt.Sprintf("User (%d) cannot write dirent (%s).", int(userId), string(direntId)));
     }
 
     if (needExecute && !direntInfo.CanExecute(user, direntGroup)) {
-        return nil, nil, NewPermissionsError(fmt.Sprintf("User (%s) cannot execute dirent (%s).", string(userId), string(direntId)));
+        return nil, nil, NewPermissionsError(fmt.Sprintf("User (%d) cannot execute dirent (%s).", int(userId), string(direntId)));
     }
 
     if (needFile && !direntInfo.IsFile) {
@@ -163,3 +209,25 @@ func (this *Driver) getUserAndDirent(
 
     return direntInfo, user, nil;
 }
+
+// Get the storage class for files put into a dir: the class of the closest dir (starting with this one) that has one.
+// The caller must hold at least the read lock.
+func (this *Driver) storageClassFor(dirId dirent.Id) string {
+    var currentId dirent.Id = dirId;
+    for {
+        dirInfo, ok := this.fat[currentId];
+        if (!ok) {
+            return "";
+        }
+
+        if (dirInfo.StorageClass != "") {
+            return dirInfo.StorageClass;
+        }
+
+        if (currentId == dirent.ROOT_ID) {
+            return "";
+        }
+
+        currentId = dirInfo.Parent;
+    }
+}
@@ -50,3 +50,15 @@ func NewGroup(id GroupId, name string, owner UserId, isUsergroup bool) *Group {
 func (this *Group) HasMember(targetUser UserId) bool {
     return this.Members[targetUser];
 }
+
+// Get a deep copy of this group.
+func (this *Group) Clone() *Group {
+    var clone Group = *this;
+
+    clone.Members = make(map[UserId]bool, len(this.Members));
+    for userId, isMember := range(this.Members) {
+        clone.Members[userId] = isMember;
+    }
+
+    return &clone;
+}
@@ -47,3 +47,8 @@ func (this *User) Auth(weakhash string) bool {
     err := bcrypt.CompareHashAndPassword([]byte(this.Passhash), []byte(weakhash));
     return err == nil;
 }
+
+func (this *User) Clone() *User {
+    var clone User = *this;
+    return &clone;
+}
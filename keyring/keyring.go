@@ -0,0 +1,306 @@
+package keyring;
+
+// Key slots for the master key (like a LUKS header).
+// The master key (and base IV) of a filesystem are kept in a small unencrypted admin object, the key header.
+// The master key is wrapped by one or more slots, and each slot derives its key from a passphrase with scrypt.
+// Any slot's passphrase can unlock the master key,
+// and slots can be added, removed, or given a new passphrase without touching the rest of the filesystem.
+
+import (
+   "crypto/aes"
+   "encoding/json"
+   "fmt"
+   "os"
+
+   "github.com/pkg/errors"
+   "golang.org/x/crypto/scrypt"
+
+   "github.com/eriq-augustine/elfs/connector"
+   "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+   KEY_HEADER_ID = "keyheader"
+   // A header for a new master key that is not in use yet (eg during a rekey).
+   PENDING_KEY_HEADER_ID = "keyheader_pending"
+   KEY_HEADER_MAGIC = "ELFSKEYS"
+   KEY_HEADER_VERSION = 1
+   MAX_SLOTS = 8
+
+   // Costs for new slots (~32MB of memory per unlock).
+   SCRYPT_N = 1 << 15
+   SCRYPT_R = 8
+   SCRYPT_P = 1
+   SALT_LENGTH = 32
+
+   // The most that a slot may ask for, since a header is read before anything in it can be trusted.
+   MAX_SCRYPT_N = 1 << 20
+   MAX_SCRYPT_R = 16
+   MAX_SCRYPT_P = 16
+   // scrypt needs 128 * N * r bytes.
+   MAX_SCRYPT_MEMORY = 1 << 30
+)
+
+type KeyHeader struct {
+   Magic string
+   Version int
+   // The filesystem's base IV.
+   // This is not secret, it is only kept here so a passphrase is all that is needed to mount.
+   // It is tied to every slot (see KeySlot.additionalData()), so it cannot be swapped out.
+   IV []byte
+   Slots []*KeySlot
+   // Slots for a new master key that is being rotated in.
+   // Until the rotation finishes, the metadata may be under either key.
+   PendingSlots []*KeySlot
+}
+
+type KeySlot struct {
+   Id int
+   Salt []byte
+   // scrypt costs, kept per slot so they can be raised for new slots.
+   N int
+   R int
+   P int
+   // The master key wrapped with the key derived from the passphrase.
+   WrappedKey []byte
+}
+
+// Get a new header with a single slot (0) for |passphrase|.
+func NewKeyHeader(masterKey []byte, iv []byte, passphrase []byte) (*KeyHeader, error) {
+   var header KeyHeader = KeyHeader{
+      Magic: KEY_HEADER_MAGIC,
+      Version: KEY_HEADER_VERSION,
+      IV: append([]byte(nil), iv...),
+      Slots: make([]*KeySlot, 0, 1),
+   };
+
+   _, err := header.AddSlot(masterKey, passphrase);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   return &header, nil;
+}
+
+// Check if a filesystem has a key header.
+func Exists(fsConnector connector.Connector) (bool, error) {
+   return ObjectExists(fsConnector, KEY_HEADER_ID);
+}
+
+func ObjectExists(fsConnector connector.Connector, objectId string) (bool, error) {
+   _, err := fsConnector.ReadAdminObject(objectId);
+   if (err != nil) {
+      if (os.IsNotExist(errors.Cause(err))) {
+         return false, nil;
+      }
+
+      return false, errors.WithStack(err);
+   }
+
+   return true, nil;
+}
+
+func Read(fsConnector connector.Connector) (*KeyHeader, error) {
+   return ReadObject(fsConnector, KEY_HEADER_ID);
+}
+
+// Read a header kept under a different id (eg PENDING_KEY_HEADER_ID).
+func ReadObject(fsConnector connector.Connector, objectId string) (*KeyHeader, error) {
+   data, err := fsConnector.ReadAdminObject(objectId);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   var header KeyHeader;
+   err = json.Unmarshal(data, &header);
+   if (err != nil) {
+      return nil, errors.Wrap(err, "Failed to parse key header");
+   }
+
+   if (header.Magic != KEY_HEADER_MAGIC) {
+      return nil, errors.New("Key header has a bad magic value.");
+   }
+
+   if (header.Version != KEY_HEADER_VERSION) {
+      return nil, errors.Errorf("Unknown key header version. Expected: %d, Found: %d.", KEY_HEADER_VERSION, header.Version);
+   }
+
+   return &header, nil;
+}
+
+func (this *KeyHeader) Write(fsConnector connector.Connector) error {
+   return errors.WithStack(this.WriteObject(fsConnector, KEY_HEADER_ID));
+}
+
+func (this *KeyHeader) WriteObject(fsConnector connector.Connector, objectId string) error {
+   data, err := json.Marshal(this);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   return errors.WithStack(fsConnector.WriteAdminObject(objectId, data));
+}
+
+// Admin objects are kept with the metadata, so they are removed the same way.
+func RemoveObject(fsConnector connector.Connector, objectId string) error {
+   return errors.WithStack(fsConnector.RemoveMetadataFile(objectId));
+}
+
+// Get the master key using the first slot that |passphrase| opens.
+// Returns: (master key, slot id, error).
+func (this *KeyHeader) Unlock(passphrase []byte) ([]byte, int, error) {
+   for _, slot := range(this.Slots) {
+      masterKey, err := slot.unwrap(passphrase, this.IV);
+      if (err == nil) {
+         return masterKey, slot.Id, nil;
+      }
+   }
+
+   return nil, -1, errors.New("The passphrase does not match any key slot.");
+}
+
+// Get the new master key (of an unfinished rotation) using the first pending slot that |passphrase| opens.
+// Returns: (master key, slot id, error).
+func (this *KeyHeader) UnlockPending(passphrase []byte) ([]byte, int, error) {
+   for _, slot := range(this.PendingSlots) {
+      masterKey, err := slot.unwrap(passphrase, this.IV);
+      if (err == nil) {
+         return masterKey, slot.Id, nil;
+      }
+   }
+
+   return nil, -1, errors.New("The passphrase does not match any pending key slot.");
+}
+
+// Add a slot that wraps |masterKey| with |passphrase|.
+// Returns the new slot's id.
+func (this *KeyHeader) AddSlot(masterKey []byte, passphrase []byte) (int, error) {
+   if (len(this.Slots) >= MAX_SLOTS) {
+      return -1, errors.Errorf("All %d key slots are in use.", MAX_SLOTS);
+   }
+
+   // Use the lowest free id.
+   var slotId int = 0;
+   for (this.getSlot(slotId) != nil) {
+      slotId++;
+   }
+
+   slot, err := newKeySlot(slotId, masterKey, this.IV, passphrase);
+   if (err != nil) {
+      return -1, errors.WithStack(err);
+   }
+
+   this.Slots = append(this.Slots, slot);
+   return slotId, nil;
+}
+
+// The last slot cannot be removed, since that would lose the master key.
+func (this *KeyHeader) RemoveSlot(slotId int) error {
+   if (this.getSlot(slotId) == nil) {
+      return errors.Errorf("No such key slot: %d.", slotId);
+   }
+
+   if (len(this.Slots) == 1) {
+      return errors.New("Cannot remove the last key slot.");
+   }
+
+   for i, slot := range(this.Slots) {
+      if (slot.Id == slotId) {
+         this.Slots = append(this.Slots[0:i], this.Slots[i + 1:]...);
+         break;
+      }
+   }
+
+   return nil;
+}
+
+// Give a slot a new passphrase (with a fresh salt).
+func (this *KeyHeader) ChangePassphrase(slotId int, masterKey []byte, passphrase []byte) error {
+   for i, slot := range(this.Slots) {
+      if (slot.Id != slotId) {
+         continue;
+      }
+
+      newSlot, err := newKeySlot(slotId, masterKey, this.IV, passphrase);
+      if (err != nil) {
+         return errors.WithStack(err);
+      }
+
+      this.Slots[i] = newSlot;
+      return nil;
+   }
+
+   return errors.Errorf("No such key slot: %d.", slotId);
+}
+
+func (this *KeyHeader) getSlot(slotId int) *KeySlot {
+   for _, slot := range(this.Slots) {
+      if (slot.Id == slotId) {
+         return slot;
+      }
+   }
+
+   return nil;
+}
+
+func newKeySlot(slotId int, masterKey []byte, iv []byte, passphrase []byte) (*KeySlot, error) {
+   var slot KeySlot = KeySlot{
+      Id: slotId,
+      Salt: util.RandomBytes(SALT_LENGTH),
+      N: SCRYPT_N,
+      R: SCRYPT_R,
+      P: SCRYPT_P,
+      WrappedKey: nil,
+   };
+
+   slotKey, err := slot.deriveKey(passphrase);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   blockCipher, err := aes.NewCipher(slotKey);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   slot.WrappedKey, err = util.WrapKey(blockCipher, masterKey, slot.additionalData(iv));
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   return &slot, nil;
+}
+
+func (this *KeySlot) unwrap(passphrase []byte, iv []byte) ([]byte, error) {
+   slotKey, err := this.deriveKey(passphrase);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   blockCipher, err := aes.NewCipher(slotKey);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   return util.UnwrapKey(blockCipher, this.WrappedKey, this.additionalData(iv));
+}
+
+func (this *KeySlot) deriveKey(passphrase []byte) ([]byte, error) {
+   if (this.N > MAX_SCRYPT_N || this.R > MAX_SCRYPT_R || this.P > MAX_SCRYPT_P ||
+         this.R < 1 || this.N > MAX_SCRYPT_MEMORY / (128 * this.R)) {
+      return nil, errors.Errorf("Slot %d asks for scrypt costs (N: %d, r: %d, p: %d) over the limit (N: %d, r: %d, p: %d, memory: %d).",
+            this.Id, this.N, this.R, this.P, MAX_SCRYPT_N, MAX_SCRYPT_R, MAX_SCRYPT_P, MAX_SCRYPT_MEMORY);
+   }
+
+   slotKey, err := scrypt.Key(passphrase, this.Salt, this.N, this.R, this.P, util.AES_KEY_LENGTH);
+   if (err != nil) {
+      return nil, errors.Wrapf(err, "Failed to derive key for slot %d", this.Id);
+   }
+
+   return slotKey, nil;
+}
+
+// Tie the wrapped key to its slot, its scrypt costs, and the header's IV.
+func (this *KeySlot) additionalData(iv []byte) []byte {
+   return []byte(fmt.Sprintf("%s:%d:%d:%d:%d:%x", KEY_HEADER_MAGIC, this.Id, this.N, this.R, this.P, iv));
+}
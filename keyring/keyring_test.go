@@ -0,0 +1,138 @@
+package keyring;
+
+import (
+   "bytes"
+   "io/ioutil"
+   "os"
+   "path/filepath"
+   "testing"
+
+   "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+   TEST_PASSPHRASE = "correct horse"
+)
+
+func newTestHeader(t *testing.T) (*KeyHeader, []byte) {
+   var masterKey []byte = util.GenAESKey();
+
+   header, err := NewKeyHeader(masterKey, util.GenIV(), []byte(TEST_PASSPHRASE));
+   if (err != nil) {
+      t.Fatalf("Failed to make header: %+v", err);
+   }
+
+   return header, masterKey;
+}
+
+func TestUnlock(t *testing.T) {
+   header, masterKey := newTestHeader(t);
+
+   unlockedKey, slotId, err := header.Unlock([]byte(TEST_PASSPHRASE));
+   if (err != nil || slotId != 0 || !bytes.Equal(unlockedKey, masterKey)) {
+      t.Fatalf("Failed to unlock (slot %d): %+v", slotId, err);
+   }
+
+   _, _, err = header.Unlock([]byte("wrong"));
+   if (err == nil) {
+      t.Fatalf("Unlocked with the wrong passphrase.");
+   }
+}
+
+// A slot does not open if anything it is tied to is changed.
+func TestSlotTiedToHeader(t *testing.T) {
+   var changes map[string]func(header *KeyHeader) = map[string]func(header *KeyHeader){
+      "iv": func(header *KeyHeader) {
+         header.IV = util.GenIV();
+      },
+      "id": func(header *KeyHeader) {
+         header.Slots[0].Id = 1;
+      },
+      "n": func(header *KeyHeader) {
+         header.Slots[0].N = SCRYPT_N / 2;
+      },
+      "r": func(header *KeyHeader) {
+         header.Slots[0].R = SCRYPT_R / 2;
+      },
+      "p": func(header *KeyHeader) {
+         header.Slots[0].P = SCRYPT_P + 1;
+      },
+   };
+
+   for name, change := range(changes) {
+      header, _ := newTestHeader(t);
+      change(header);
+
+      _, _, err := header.Unlock([]byte(TEST_PASSPHRASE));
+      if (err == nil) {
+         t.Fatalf("Unlocked after changing the %s.", name);
+      }
+   }
+}
+
+// Costs over the limits are refused before any work is done.
+func TestScryptLimits(t *testing.T) {
+   var changes map[string]func(slot *KeySlot) = map[string]func(slot *KeySlot){
+      "n": func(slot *KeySlot) {
+         slot.N = MAX_SCRYPT_N * 2;
+      },
+      "r": func(slot *KeySlot) {
+         slot.R = MAX_SCRYPT_R + 1;
+      },
+      "p": func(slot *KeySlot) {
+         slot.P = MAX_SCRYPT_P + 1;
+      },
+      "memory": func(slot *KeySlot) {
+         slot.N = MAX_SCRYPT_N;
+         slot.R = MAX_SCRYPT_R;
+      },
+   };
+
+   for name, change := range(changes) {
+      header, _ := newTestHeader(t);
+      change(header.Slots[0]);
+
+      _, err := header.Slots[0].deriveKey([]byte(TEST_PASSPHRASE));
+      if (err == nil) {
+         t.Fatalf("Derived a key with %s over the limit.", name);
+      }
+   }
+}
+
+// A key file holds the same passphrase as the prompt, so a trailing newline is not part of it.
+func TestKeyFileNewline(t *testing.T) {
+   dir, err := ioutil.TempDir("", "elfs-keyring-test-");
+   if (err != nil) {
+      t.Fatalf("Failed to make temp dir: %+v", err);
+   }
+   defer os.RemoveAll(dir);
+
+   var contents map[string]string = map[string]string{
+      TEST_PASSPHRASE: TEST_PASSPHRASE,
+      TEST_PASSPHRASE + "\n": TEST_PASSPHRASE,
+      TEST_PASSPHRASE + "\r\n": TEST_PASSPHRASE,
+      TEST_PASSPHRASE + "\n\n": TEST_PASSPHRASE + "\n",
+   };
+
+   for content, expected := range(contents) {
+      var path string = filepath.Join(dir, "key");
+      err = ioutil.WriteFile(path, []byte(content), 0600);
+      if (err != nil) {
+         t.Fatalf("Failed to write key file: %+v", err);
+      }
+
+      passphrase, err := GetPassphrase(path, "", false);
+      if (err != nil || string(passphrase) != expected) {
+         t.Fatalf("Key file [%q] gave passphrase [%q], expected [%q]: %v", content, passphrase, expected, err);
+      }
+   }
+
+   err = ioutil.WriteFile(filepath.Join(dir, "empty"), []byte("\n"), 0600);
+   if (err == nil) {
+      _, err = GetPassphrase(filepath.Join(dir, "empty"), "", false);
+   }
+
+   if (err == nil) {
+      t.Fatalf("A key file with only a newline should be empty.");
+   }
+}
@@ -0,0 +1,86 @@
+package keyring;
+
+// Getting passphrases from the user.
+
+import (
+   "bytes"
+   "fmt"
+   "io/ioutil"
+   "os"
+
+   "github.com/pkg/errors"
+   "golang.org/x/crypto/ssh/terminal"
+)
+
+// Get a passphrase from a key file, or prompt for one if there is no key file.
+// The contents of a key file are used as-is, except for a single trailing newline
+// (so a key file holds the same passphrase that would be typed at the prompt).
+// When prompting, |confirm| will ask for the passphrase twice.
+func GetPassphrase(keyFile string, prompt string, confirm bool) ([]byte, error) {
+   if (keyFile != "") {
+      passphrase, err := ioutil.ReadFile(keyFile);
+      if (err != nil) {
+         return nil, errors.Wrap(err, "Failed to read key file");
+      }
+
+      passphrase = trimNewline(passphrase);
+      if (len(passphrase) == 0) {
+         return nil, errors.New("Key file is empty: " + keyFile);
+      }
+
+      return passphrase, nil;
+   }
+
+   passphrase, err := readPassphrase(prompt);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   if (len(passphrase) == 0) {
+      return nil, errors.New("Empty passphrase.");
+   }
+
+   if (confirm) {
+      again, err := readPassphrase("Confirm " + prompt);
+      if (err != nil) {
+         return nil, errors.WithStack(err);
+      }
+
+      if (!bytes.Equal(passphrase, again)) {
+         return nil, errors.New("Passphrases do not match.");
+      }
+   }
+
+   return passphrase, nil;
+}
+
+// Prompt on stderr (so stdout can still be piped) and read without echo.
+func readPassphrase(prompt string) ([]byte, error) {
+   var fd int = int(os.Stdin.Fd());
+   if (!terminal.IsTerminal(fd)) {
+      return nil, errors.New("No key file given and stdin is not a terminal to prompt for a passphrase.");
+   }
+
+   fmt.Fprintf(os.Stderr, "%s: ", prompt);
+   passphrase, err := terminal.ReadPassword(fd);
+   fmt.Fprintln(os.Stderr, "");
+
+   if (err != nil) {
+      return nil, errors.Wrap(err, "Failed to read passphrase");
+   }
+
+   return passphrase, nil;
+}
+
+// Remove a single trailing newline ("\n" or "\r\n").
+func trimNewline(data []byte) []byte {
+   if (bytes.HasSuffix(data, []byte("\r\n"))) {
+      return data[0:len(data) - 2];
+   }
+
+   if (bytes.HasSuffix(data, []byte("\n"))) {
+      return data[0:len(data) - 1];
+   }
+
+   return data;
+}
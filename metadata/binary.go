@@ -0,0 +1,456 @@
+package metadata;
+
+// The binary codec for metadata entries (see encoding.go).
+// Each field is written as a key (the field number and its wire type) followed by its value,
+// where numbers are varints (zig-zagged if they can be negative) and everything else is length-prefixed bytes.
+// Fields with a zero value are not written at all.
+// A delete (a nil entry, which only the cache has) is written as just its id and a deleted field.
+//
+// Field numbers are never reused (new fields just get the next number),
+// and fields that are not known are skipped, so an entry is always readable by a codec that is older or newer.
+
+import (
+   "encoding/binary"
+   "sort"
+
+   "github.com/pkg/errors"
+
+   "github.com/eriq-augustine/elfs/dirent"
+   "github.com/eriq-augustine/elfs/identity"
+)
+
+const (
+   BINARY_WIRE_VARINT = 0
+   BINARY_WIRE_BYTES = 2
+)
+
+// Dirent fields.
+const (
+   BINARY_DIRENT_ID = 1
+   BINARY_DIRENT_IS_FILE = 2
+   BINARY_DIRENT_IV = 3
+   BINARY_DIRENT_OWNER = 4
+   BINARY_DIRENT_GROUP = 5
+   BINARY_DIRENT_NAME = 6
+   BINARY_DIRENT_CREATE_TIMESTAMP = 7
+   BINARY_DIRENT_MOD_TIMESTAMP = 8
+   BINARY_DIRENT_ACCESS_TIMESTAMP = 9
+   BINARY_DIRENT_ACCESS_COUNT = 10
+   BINARY_DIRENT_PERMISSIONS = 11
+   BINARY_DIRENT_SIZE = 12
+   BINARY_DIRENT_MD5 = 13
+   BINARY_DIRENT_PARENT = 14
+   // Each chunk IV is its own field (BINARY_CHUNK_*).
+   BINARY_DIRENT_CHUNK_IV = 15
+   BINARY_DIRENT_CIPHER_VERSION = 16
+   BINARY_DIRENT_KEY = 17
+   BINARY_DIRENT_STORAGE_CLASS = 18
+   BINARY_DIRENT_DELETED = 19
+
+   BINARY_CHUNK_INDEX = 1
+   BINARY_CHUNK_IV = 2
+)
+
+// User fields.
+const (
+   BINARY_USER_ID = 1
+   BINARY_USER_PASSHASH = 2
+   BINARY_USER_NAME = 3
+   BINARY_USER_USERGROUP = 4
+   BINARY_USER_DELETED = 5
+)
+
+// Group fields.
+const (
+   BINARY_GROUP_ID = 1
+   BINARY_GROUP_NAME = 2
+   BINARY_GROUP_IS_USERGROUP = 3
+   BINARY_GROUP_OWNER = 4
+   // Each member is its own field (BINARY_MEMBER_*).
+   BINARY_GROUP_MEMBER = 5
+   BINARY_GROUP_DELETED = 6
+
+   BINARY_MEMBER_ID = 1
+   BINARY_MEMBER_IS_MEMBER = 2
+)
+
+type binaryWriter struct {
+   data []byte
+}
+
+func (this *binaryWriter) key(field int, wireType int) {
+   this.data = appendUvarint(this.data, uint64(field << 3 | wireType));
+}
+
+func (this *binaryWriter) writeUint(field int, value uint64) {
+   if (value == 0) {
+      return;
+   }
+
+   this.key(field, BINARY_WIRE_VARINT);
+   this.data = appendUvarint(this.data, value);
+}
+
+func (this *binaryWriter) writeInt(field int, value int64) {
+   if (value == 0) {
+      return;
+   }
+
+   this.key(field, BINARY_WIRE_VARINT);
+   this.data = appendVarint(this.data, value);
+}
+
+func (this *binaryWriter) writeBool(field int, value bool) {
+   if (value) {
+      this.writeUint(field, 1);
+   }
+}
+
+func (this *binaryWriter) writeBytes(field int, value []byte) {
+   if (len(value) == 0) {
+      return;
+   }
+
+   this.key(field, BINARY_WIRE_BYTES);
+   this.data = appendUvarint(this.data, uint64(len(value)));
+   this.data = append(this.data, value...);
+}
+
+func (this *binaryWriter) writeString(field int, value string) {
+   this.writeBytes(field, []byte(value));
+}
+
+// Always written (even if empty), since it may be one of many.
+func (this *binaryWriter) writeMessage(field int, message *binaryWriter) {
+   this.key(field, BINARY_WIRE_BYTES);
+   this.data = appendUvarint(this.data, uint64(len(message.data)));
+   this.data = append(this.data, message.data...);
+}
+
+type binaryField struct {
+   number int
+   // Only for varints.
+   value uint64
+   // Only for bytes.
+   data []byte
+}
+
+func (this *binaryField) int() int64 {
+   // Undo the zig-zag.
+   return int64(this.value >> 1) ^ -int64(this.value & 1);
+}
+
+func (this *binaryField) bool() bool {
+   return this.value != 0;
+}
+
+func (this *binaryField) bytes() []byte {
+   return append([]byte(nil), this.data...);
+}
+
+// Call |handle| on every field in |data| (in order).
+func readBinaryFields(data []byte, handle func(*binaryField) error) error {
+   for (len(data) > 0) {
+      key, size := binary.Uvarint(data);
+      if (size <= 0) {
+         return errors.New("Bad binary field key.");
+      }
+      data = data[size:];
+
+      var field binaryField = binaryField{number: int(key >> 3)};
+
+      switch (key & 0x07) {
+         case BINARY_WIRE_VARINT:
+            field.value, size = binary.Uvarint(data);
+            if (size <= 0) {
+               return errors.Errorf("Bad varint in binary field %d.", field.number);
+            }
+            data = data[size:];
+         case BINARY_WIRE_BYTES:
+            length, size := binary.Uvarint(data);
+            if (size <= 0 || length > uint64(len(data) - size)) {
+               return errors.Errorf("Bad length of binary field %d.", field.number);
+            }
+            field.data = data[size:size + int(length)];
+            data = data[size + int(length):];
+         default:
+            return errors.Errorf("Unknown wire type (%d) for binary field %d.", key & 0x07, field.number);
+      }
+
+      err := handle(&field);
+      if (err != nil) {
+         return errors.WithStack(err);
+      }
+   }
+
+   return nil;
+}
+
+func encodeBinaryDirent(id dirent.Id, entry *dirent.Dirent) []byte {
+   var writer binaryWriter = binaryWriter{};
+
+   if (entry == nil) {
+      writer.writeString(BINARY_DIRENT_ID, string(id));
+      writer.writeBool(BINARY_DIRENT_DELETED, true);
+      return writer.data;
+   }
+
+   writer.writeString(BINARY_DIRENT_ID, string(entry.Id));
+   writer.writeBool(BINARY_DIRENT_IS_FILE, entry.IsFile);
+   writer.writeBytes(BINARY_DIRENT_IV, entry.IV);
+   writer.writeInt(BINARY_DIRENT_OWNER, int64(entry.Owner));
+   writer.writeInt(BINARY_DIRENT_GROUP, int64(entry.Group));
+   writer.writeString(BINARY_DIRENT_NAME, entry.Name);
+   writer.writeInt(BINARY_DIRENT_CREATE_TIMESTAMP, entry.CreateTimestamp);
+   writer.writeInt(BINARY_DIRENT_MOD_TIMESTAMP, entry.ModTimestamp);
+   writer.writeInt(BINARY_DIRENT_ACCESS_TIMESTAMP, entry.AccessTimestamp);
+   writer.writeUint(BINARY_DIRENT_ACCESS_COUNT, uint64(entry.AccessCount));
+   writer.writeUint(BINARY_DIRENT_PERMISSIONS, uint64(entry.Permissions));
+   writer.writeUint(BINARY_DIRENT_SIZE, entry.Size);
+   writer.writeString(BINARY_DIRENT_MD5, entry.Md5);
+   writer.writeString(BINARY_DIRENT_PARENT, string(entry.Parent));
+
+   var indexes []int64 = make([]int64, 0, len(entry.ChunkIVs));
+   for index, _ := range(entry.ChunkIVs) {
+      indexes = append(indexes, index);
+   }
+   sort.Slice(indexes, func(i int, j int) bool { return indexes[i] < indexes[j]; });
+
+   for _, index := range(indexes) {
+      var chunk binaryWriter = binaryWriter{};
+      chunk.writeInt(BINARY_CHUNK_INDEX, index);
+      chunk.writeBytes(BINARY_CHUNK_IV, entry.ChunkIVs[index]);
+      writer.writeMessage(BINARY_DIRENT_CHUNK_IV, &chunk);
+   }
+
+   writer.writeInt(BINARY_DIRENT_CIPHER_VERSION, int64(entry.CipherVersion));
+   writer.writeBytes(BINARY_DIRENT_KEY, entry.Key);
+   writer.writeString(BINARY_DIRENT_STORAGE_CLASS, entry.StorageClass);
+
+   return writer.data;
+}
+
+// Gives back a nil entry for a delete.
+func decodeBinaryDirent(data []byte) (dirent.Id, *dirent.Dirent, error) {
+   var entry dirent.Dirent = dirent.Dirent{};
+   var deleted bool = false;
+
+   err := readBinaryFields(data, func(field *binaryField) error {
+      switch (field.number) {
+         case BINARY_DIRENT_ID:
+            entry.Id = dirent.Id(field.data);
+         case BINARY_DIRENT_IS_FILE:
+            entry.IsFile = field.bool();
+         case BINARY_DIRENT_IV:
+            entry.IV = field.bytes();
+         case BINARY_DIRENT_OWNER:
+            entry.Owner = identity.UserId(field.int());
+         case BINARY_DIRENT_GROUP:
+            entry.Group = identity.GroupId(field.int());
+         case BINARY_DIRENT_NAME:
+            entry.Name = string(field.data);
+         case BINARY_DIRENT_CREATE_TIMESTAMP:
+            entry.CreateTimestamp = field.int();
+         case BINARY_DIRENT_MOD_TIMESTAMP:
+            entry.ModTimestamp = field.int();
+         case BINARY_DIRENT_ACCESS_TIMESTAMP:
+            entry.AccessTimestamp = field.int();
+         case BINARY_DIRENT_ACCESS_COUNT:
+            entry.AccessCount = uint(field.value);
+         case BINARY_DIRENT_PERMISSIONS:
+            entry.Permissions = dirent.Permissions(field.value);
+         case BINARY_DIRENT_SIZE:
+            entry.Size = field.value;
+         case BINARY_DIRENT_MD5:
+            entry.Md5 = string(field.data);
+         case BINARY_DIRENT_PARENT:
+            entry.Parent = dirent.Id(field.data);
+         case BINARY_DIRENT_CHUNK_IV:
+            var index int64 = 0;
+            var iv []byte = nil;
+
+            err := readBinaryFields(field.data, func(chunkField *binaryField) error {
+               if (chunkField.number == BINARY_CHUNK_INDEX) {
+                  index = chunkField.int();
+               } else if (chunkField.number == BINARY_CHUNK_IV) {
+                  iv = chunkField.bytes();
+               }
+
+               return nil;
+            });
+
+            if (err != nil) {
+               return errors.WithStack(err);
+            }
+
+            if (entry.ChunkIVs == nil) {
+               entry.ChunkIVs = make(map[int64][]byte);
+            }
+            entry.ChunkIVs[index] = iv;
+         case BINARY_DIRENT_CIPHER_VERSION:
+            entry.CipherVersion = int(field.int());
+         case BINARY_DIRENT_KEY:
+            entry.Key = field.bytes();
+         case BINARY_DIRENT_STORAGE_CLASS:
+            entry.StorageClass = string(field.data);
+         case BINARY_DIRENT_DELETED:
+            deleted = field.bool();
+      }
+
+      return nil;
+   });
+
+   if (err != nil) {
+      return "", nil, errors.WithStack(err);
+   }
+
+   if (deleted) {
+      return entry.Id, nil, nil;
+   }
+
+   return entry.Id, &entry, nil;
+}
+
+func encodeBinaryUser(id identity.UserId, entry *identity.User) []byte {
+   var writer binaryWriter = binaryWriter{};
+
+   if (entry == nil) {
+      writer.writeInt(BINARY_USER_ID, int64(id));
+      writer.writeBool(BINARY_USER_DELETED, true);
+      return writer.data;
+   }
+
+   writer.writeInt(BINARY_USER_ID, int64(entry.Id));
+   writer.writeString(BINARY_USER_PASSHASH, entry.Passhash);
+   writer.writeString(BINARY_USER_NAME, entry.Name);
+   writer.writeInt(BINARY_USER_USERGROUP, int64(entry.Usergroup));
+
+   return writer.data;
+}
+
+// Gives back a nil entry for a delete.
+func decodeBinaryUser(data []byte) (identity.UserId, *identity.User, error) {
+   var entry identity.User = identity.User{};
+   var deleted bool = false;
+
+   err := readBinaryFields(data, func(field *binaryField) error {
+      switch (field.number) {
+         case BINARY_USER_ID:
+            entry.Id = identity.UserId(field.int());
+         case BINARY_USER_PASSHASH:
+            entry.Passhash = string(field.data);
+         case BINARY_USER_NAME:
+            entry.Name = string(field.data);
+         case BINARY_USER_USERGROUP:
+            entry.Usergroup = identity.GroupId(field.int());
+         case BINARY_USER_DELETED:
+            deleted = field.bool();
+      }
+
+      return nil;
+   });
+
+   if (err != nil) {
+      return 0, nil, errors.WithStack(err);
+   }
+
+   if (deleted) {
+      return entry.Id, nil, nil;
+   }
+
+   return entry.Id, &entry, nil;
+}
+
+func encodeBinaryGroup(id identity.GroupId, entry *identity.Group) []byte {
+   var writer binaryWriter = binaryWriter{};
+
+   if (entry == nil) {
+      writer.writeInt(BINARY_GROUP_ID, int64(id));
+      writer.writeBool(BINARY_GROUP_DELETED, true);
+      return writer.data;
+   }
+
+   writer.writeInt(BINARY_GROUP_ID, int64(entry.Id));
+   writer.writeString(BINARY_GROUP_NAME, entry.Name);
+   writer.writeBool(BINARY_GROUP_IS_USERGROUP, entry.IsUsergroup);
+   writer.writeInt(BINARY_GROUP_OWNER, int64(entry.Owner));
+
+   var members []int = make([]int, 0, len(entry.Members));
+   for member, _ := range(entry.Members) {
+      members = append(members, int(member));
+   }
+   sort.Ints(members);
+
+   for _, member := range(members) {
+      var memberWriter binaryWriter = binaryWriter{};
+      memberWriter.writeInt(BINARY_MEMBER_ID, int64(member));
+      memberWriter.writeBool(BINARY_MEMBER_IS_MEMBER, entry.Members[identity.UserId(member)]);
+      writer.writeMessage(BINARY_GROUP_MEMBER, &memberWriter);
+   }
+
+   return writer.data;
+}
+
+// Gives back a nil entry for a delete.
+func decodeBinaryGroup(data []byte) (identity.GroupId, *identity.Group, error) {
+   var entry identity.Group = identity.Group{
+      Members: make(map[identity.UserId]bool),
+   };
+   var deleted bool = false;
+
+   err := readBinaryFields(data, func(field *binaryField) error {
+      switch (field.number) {
+         case BINARY_GROUP_ID:
+            entry.Id = identity.GroupId(field.int());
+         case BINARY_GROUP_NAME:
+            entry.Name = string(field.data);
+         case BINARY_GROUP_IS_USERGROUP:
+            entry.IsUsergroup = field.bool();
+         case BINARY_GROUP_OWNER:
+            entry.Owner = identity.UserId(field.int());
+         case BINARY_GROUP_MEMBER:
+            var member identity.UserId = 0;
+            var isMember bool = false;
+
+            err := readBinaryFields(field.data, func(memberField *binaryField) error {
+               if (memberField.number == BINARY_MEMBER_ID) {
+                  member = identity.UserId(memberField.int());
+               } else if (memberField.number == BINARY_MEMBER_IS_MEMBER) {
+                  isMember = memberField.bool();
+               }
+
+               return nil;
+            });
+
+            if (err != nil) {
+               return errors.WithStack(err);
+            }
+
+            entry.Members[member] = isMember;
+         case BINARY_GROUP_DELETED:
+            deleted = field.bool();
+      }
+
+      return nil;
+   });
+
+   if (err != nil) {
+      return 0, nil, errors.WithStack(err);
+   }
+
+   if (deleted) {
+      return entry.Id, nil, nil;
+   }
+
+   return entry.Id, &entry, nil;
+}
+
+func appendUvarint(data []byte, value uint64) []byte {
+   var buffer []byte = make([]byte, binary.MaxVarintLen64);
+   return append(data, buffer[:binary.PutUvarint(buffer, value)]...);
+}
+
+func appendVarint(data []byte, value int64) []byte {
+   var buffer []byte = make([]byte, binary.MaxVarintLen64);
+   return append(data, buffer[:binary.PutVarint(buffer, value)]...);
+}
@@ -0,0 +1,186 @@
+package metadata;
+
+// How the entries of a metadata table are written (since format 3).
+// Entries are either JSON lines (easy to read when debugging), or length-prefixed binary (see binary.go).
+// Either can be compressed (before it is encrypted).
+// The encoding is in the header of each table, so tables in any encoding can always be read.
+
+import (
+   "bufio"
+   "compress/flate"
+   "encoding/binary"
+   "fmt"
+   "io"
+   "io/ioutil"
+   "strings"
+
+   "github.com/pkg/errors"
+)
+
+const (
+   CODEC_JSON = "json"
+   CODEC_BINARY = "binary"
+
+   COMPRESSION_NONE = ""
+   COMPRESSION_DEFLATE = "deflate"
+
+   ENCODING_SEPARATOR = "+"
+)
+
+// Encodings are written as the codec, and then the compression (if any), eg "binary+deflate".
+type Encoding struct {
+   Codec string
+   Compression string
+}
+
+var DEFAULT_ENCODING Encoding = Encoding{CODEC_BINARY, COMPRESSION_NONE};
+var JSON_ENCODING Encoding = Encoding{CODEC_JSON, COMPRESSION_NONE};
+
+func ParseEncoding(text string) (Encoding, error) {
+   var parts []string = strings.SplitN(text, ENCODING_SEPARATOR, 2);
+
+   var encoding Encoding = Encoding{parts[0], COMPRESSION_NONE};
+   if (len(parts) == 2) {
+      encoding.Compression = parts[1];
+   }
+
+   if (encoding.Codec != CODEC_JSON && encoding.Codec != CODEC_BINARY) {
+      return Encoding{}, errors.Errorf("Unknown metadata codec: [%s].", encoding.Codec);
+   }
+
+   if (encoding.Compression != COMPRESSION_NONE && encoding.Compression != COMPRESSION_DEFLATE) {
+      return Encoding{}, errors.Errorf("Unknown metadata compression: [%s].", encoding.Compression);
+   }
+
+   return encoding, nil;
+}
+
+func (this Encoding) String() string {
+   if (this.Compression == COMPRESSION_NONE) {
+      return this.Codec;
+   }
+
+   return this.Codec + ENCODING_SEPARATOR + this.Compression;
+}
+
+// Reads the entries of one table (after its header).
+// Compressed entries are read straight from the shared reader (flate never reads past the end of its stream),
+// so the next table in the same stream is left for the next reader.
+type entryReader struct {
+   codec string
+   // Only set when compressed.
+   decompressor io.ReadCloser
+   reader *bufio.Reader
+}
+
+func newEntryReader(reader *bufio.Reader, encoding Encoding) *entryReader {
+   var entries entryReader = entryReader{
+      codec: encoding.Codec,
+      decompressor: nil,
+      reader: reader,
+   };
+
+   if (encoding.Compression == COMPRESSION_DEFLATE) {
+      entries.decompressor = flate.NewReader(reader);
+      entries.reader = bufio.NewReader(entries.decompressor);
+   }
+
+   return &entries;
+}
+
+// The raw bytes of the next entry (for the codec to decode).
+func (this *entryReader) next() ([]byte, error) {
+   if (this.codec == CODEC_JSON) {
+      line, err := readLine(this.reader);
+      if (err != nil) {
+         return nil, errors.WithStack(err);
+      }
+
+      return []byte(line), nil;
+   }
+
+   size, err := binary.ReadUvarint(this.reader);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   if (size > MAX_ENTRY_SIZE) {
+      return nil, errors.Errorf("Entry is too large (%d bytes, the most is %d).", size, MAX_ENTRY_SIZE);
+   }
+
+   var entry []byte = make([]byte, size);
+   _, err = io.ReadFull(this.reader, entry);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   return entry, nil;
+}
+
+// Read to the end of the table (so the next one can be read).
+func (this *entryReader) finish() error {
+   if (this.decompressor == nil) {
+      return nil;
+   }
+
+   _, err := io.Copy(ioutil.Discard, this.reader);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   return errors.WithStack(this.decompressor.Close());
+}
+
+// Writes the entries of one table (after its header).
+type entryWriter struct {
+   codec string
+   // Only set when compressed.
+   compressor *flate.Writer
+   writer io.Writer
+}
+
+func newEntryWriter(writer io.Writer, encoding Encoding) (*entryWriter, error) {
+   var entries entryWriter = entryWriter{
+      codec: encoding.Codec,
+      compressor: nil,
+      writer: writer,
+   };
+
+   if (encoding.Compression == COMPRESSION_DEFLATE) {
+      compressor, err := flate.NewWriter(writer, flate.DefaultCompression);
+      if (err != nil) {
+         return nil, errors.WithStack(err);
+      }
+
+      entries.compressor = compressor;
+      entries.writer = compressor;
+   }
+
+   return &entries, nil;
+}
+
+func (this *entryWriter) write(entry []byte) error {
+   if (this.codec == CODEC_JSON) {
+      _, err := this.writer.Write([]byte(fmt.Sprintf("%s\n", string(entry))));
+      return errors.WithStack(err);
+   }
+
+   var size []byte = make([]byte, binary.MaxVarintLen64);
+   _, err := this.writer.Write(size[:binary.PutUvarint(size, uint64(len(entry)))]);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   _, err = this.writer.Write(entry);
+   return errors.WithStack(err);
+}
+
+// End the table.
+// The underlying writer is not closed.
+func (this *entryWriter) finish() error {
+   if (this.compressor == nil) {
+      return nil;
+   }
+
+   return errors.WithStack(this.compressor.Close());
+}
@@ -0,0 +1,187 @@
+package metadata;
+
+// Every encoding must read back exactly what it wrote.
+
+import (
+   "bytes"
+   "crypto/aes"
+   "reflect"
+   "testing"
+
+   "github.com/eriq-augustine/elfs/cipherio"
+   "github.com/eriq-augustine/elfs/dirent"
+   "github.com/eriq-augustine/elfs/identity"
+   "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+   TEST_TABLE_VERSION = 4
+   TEST_METADATA_ID = "encoding_test"
+)
+
+var TEST_ENCODINGS []Encoding = []Encoding{
+   Encoding{CODEC_JSON, COMPRESSION_NONE},
+   Encoding{CODEC_JSON, COMPRESSION_DEFLATE},
+   Encoding{CODEC_BINARY, COMPRESSION_NONE},
+   Encoding{CODEC_BINARY, COMPRESSION_DEFLATE},
+};
+
+// All three tables are written into the same stream (like a cache or shadow is),
+// so each table must also leave the stream where the next one starts.
+func TestEncodingRoundTrip(test *testing.T) {
+   for _, encoding := range(TEST_ENCODINGS) {
+      fat, users, groups := testTables();
+
+      blockCipher, err := aes.NewCipher(util.GenAESKey());
+      if (err != nil) {
+         test.Fatalf("Failed to make cipher: %+v", err);
+      }
+
+      var buffer closingBuffer;
+
+      writer, err := cipherio.NewMetadataWriter(&buffer, blockCipher, TEST_METADATA_ID);
+      if (err != nil) {
+         test.Fatalf("%s: failed to make writer: %+v", encoding, err);
+      }
+
+      err = WriteFat(fat, TEST_TABLE_VERSION, encoding, writer);
+      if (err != nil) {
+         test.Fatalf("%s: failed to write fat: %+v", encoding, err);
+      }
+
+      err = WriteUsers(users, TEST_TABLE_VERSION + 1, encoding, writer);
+      if (err != nil) {
+         test.Fatalf("%s: failed to write users: %+v", encoding, err);
+      }
+
+      err = WriteGroups(groups, TEST_TABLE_VERSION + 2, encoding, writer);
+      if (err != nil) {
+         test.Fatalf("%s: failed to write groups: %+v", encoding, err);
+      }
+
+      err = writer.Close();
+      if (err != nil) {
+         test.Fatalf("%s: failed to close writer: %+v", encoding, err);
+      }
+
+      var ciphertext []byte = buffer.Bytes();
+      cipherReader, err := cipherio.NewMetadataReader(&closingReader{bytes.NewReader(ciphertext)},
+            blockCipher, nil, TEST_METADATA_ID, int64(len(ciphertext)));
+      if (err != nil) {
+         test.Fatalf("%s: failed to make reader: %+v", encoding, err);
+      }
+      var reader = NewReader(cipherReader);
+
+      var readFat map[dirent.Id]*dirent.Dirent = make(map[dirent.Id]*dirent.Dirent);
+      version, err := ReadFatWithReader(readFat, reader);
+      if (err != nil || version != TEST_TABLE_VERSION) {
+         test.Fatalf("%s: failed to read fat (version %d): %+v", encoding, version, err);
+      }
+
+      var readUsers map[identity.UserId]*identity.User = make(map[identity.UserId]*identity.User);
+      version, err = ReadUsersWithReader(readUsers, reader);
+      if (err != nil || version != TEST_TABLE_VERSION + 1) {
+         test.Fatalf("%s: failed to read users (version %d): %+v", encoding, version, err);
+      }
+
+      var readGroups map[identity.GroupId]*identity.Group = make(map[identity.GroupId]*identity.Group);
+      version, err = ReadGroupsWithReader(readGroups, reader);
+      if (err != nil || version != TEST_TABLE_VERSION + 2) {
+         test.Fatalf("%s: failed to read groups (version %d): %+v", encoding, version, err);
+      }
+
+      if (!reflect.DeepEqual(fat, readFat)) {
+         test.Fatalf("%s: fat does not match.\nWrote: %+v\nRead: %+v", encoding, fat, readFat);
+      }
+
+      if (!reflect.DeepEqual(users, readUsers)) {
+         test.Fatalf("%s: users do not match.\nWrote: %+v\nRead: %+v", encoding, users, readUsers);
+      }
+
+      if (!reflect.DeepEqual(groups, readGroups)) {
+         test.Fatalf("%s: groups do not match.\nWrote: %+v\nRead: %+v", encoding, groups, readGroups);
+      }
+
+      err = cipherReader.Close();
+      if (err != nil) {
+         test.Fatalf("%s: failed to close reader: %+v", encoding, err);
+      }
+   }
+}
+
+func TestParseEncoding(test *testing.T) {
+   for _, encoding := range(TEST_ENCODINGS) {
+      parsed, err := ParseEncoding(encoding.String());
+      if (err != nil || parsed != encoding) {
+         test.Fatalf("%s: parsed as %v (%v).", encoding, parsed, err);
+      }
+   }
+
+   for _, text := range([]string{"", "xml", "json+gzip"}) {
+      _, err := ParseEncoding(text);
+      if (err == nil) {
+         test.Fatalf("Encoding [%s] should not parse.", text);
+      }
+   }
+}
+
+// Tables with every field set, and a tombstone (nil entry) in each.
+func testTables() (map[dirent.Id]*dirent.Dirent, map[identity.UserId]*identity.User, map[identity.GroupId]*identity.Group) {
+   var root *dirent.Dirent = dirent.NewDir(dirent.ROOT_ID, dirent.ROOT_NAME, dirent.ROOT_ID,
+         identity.ROOT_USER_ID, identity.ROOT_GROUP_ID, 1000);
+   root.StorageClass = "STANDARD_IA";
+
+   var file *dirent.Dirent = dirent.NewFile(dirent.NewId(), "file.bin", root.Id,
+         identity.ROOT_USER_ID, identity.ROOT_GROUP_ID, 2000);
+   file.Size = 1 << 33;
+   file.Md5 = "d41d8cd98f00b204e9800998ecf8427e";
+   file.AccessCount = 7;
+   file.CipherVersion = 1;
+   file.Key = util.GenAESKey();
+   file.ChunkIVs = map[int64][]byte{0: util.GenIV(), 3: util.GenIV()};
+   file.Permissions = dirent.PERM_UR | dirent.PERM_OR;
+
+   var fat map[dirent.Id]*dirent.Dirent = map[dirent.Id]*dirent.Dirent{
+      root.Id: root,
+      file.Id: file,
+      dirent.NewId(): nil,
+   };
+
+   var rootUser *identity.User = &identity.User{
+      Id: identity.ROOT_USER_ID,
+      Passhash: "$2a$10$hash",
+      Name: identity.ROOT_NAME,
+      Usergroup: identity.ROOT_GROUP_ID,
+   };
+   var users map[identity.UserId]*identity.User = map[identity.UserId]*identity.User{
+      rootUser.Id: rootUser,
+      identity.UserId(-5): nil,
+   };
+
+   var group *identity.Group = identity.NewGroup(identity.GroupId(3), "staff", identity.ROOT_USER_ID, false);
+   group.Members[identity.UserId(4)] = true;
+   var groups map[identity.GroupId]*identity.Group = map[identity.GroupId]*identity.Group{
+      group.Id: group,
+      identity.GroupId(9): nil,
+   };
+
+   return fat, users, groups;
+}
+
+// A buffer that a CipherWriter can own.
+type closingBuffer struct {
+   bytes.Buffer
+}
+
+func (this *closingBuffer) Close() error {
+   return nil;
+}
+
+// A reader that a MetadataReader can own.
+type closingReader struct {
+   *bytes.Reader
+}
+
+func (this *closingReader) Close() error {
+   return nil;
+}
@@ -5,7 +5,6 @@ package metadata;
 import (
    "bufio"
    "encoding/json"
-   "fmt"
    "io"
 
    "github.com/pkg/errors"
@@ -20,7 +19,7 @@ import (
 // This function will not clear the given fat.
 // However, the reader WILL be closed.
 func ReadFat(fat map[dirent.Id]*dirent.Dirent, reader util.ReadSeekCloser) (int, error) {
-   version, err := ReadFatWithScanner(fat, bufio.NewScanner(reader));
+   version, err := ReadFatWithReader(fat, NewReader(reader));
    if (err != nil) {
       return 0, errors.WithStack(err);
    }
@@ -28,61 +27,110 @@ func ReadFat(fat map[dirent.Id]*dirent.Dirent, reader util.ReadSeekCloser) (int,
    return version, errors.WithStack(reader.Close());
 }
 
-// Same as the other read, but we will read directly from a scanner
+// Same as the other read, but we will read directly from a reader
 // owned by someone else.
 // This is expecially useful if there are multiple
 // sections of metadata written to the same file.
-func ReadFatWithScanner(fat map[dirent.Id]*dirent.Dirent, scanner *bufio.Scanner) (int, error) {
-   size, version, err := scanMetadata(scanner);
+func ReadFatWithReader(fat map[dirent.Id]*dirent.Dirent, reader *bufio.Reader) (int, error) {
+   header, err := readHeader(reader);
    if (err != nil) {
       return 0, errors.WithStack(err);
    }
 
-   // Read all the dirents.
-   for i := 0; i < size; i++ {
-      var entry dirent.Dirent;
-
-      if (!scanner.Scan()) {
-         err = scanner.Err();
+   var entries *entryReader = newEntryReader(reader, header.encoding);
 
-         if (err == nil) {
-            return 0, errors.Wrapf(io.EOF, "Early end of FAT. Only read %d of %d entries.", i , size);
+   // Read all the dirents.
+   for i := 0; i < header.size; i++ {
+      data, err := entries.next();
+      if (err != nil) {
+         if (errors.Cause(err) == io.EOF) {
+            return 0, errors.Wrapf(io.EOF, "Early end of FAT. Only read %d of %d entries.", i , header.size);
          } else {
-            return 0, errors.Wrapf(err, "Bad scan on FAT entry %d.", i);
+            return 0, errors.Wrapf(err, "Bad read on FAT entry %d.", i);
          }
       }
 
-      err = json.Unmarshal(scanner.Bytes(), &entry);
+      data, err = migrateEntry(TABLE_FAT, header.encoding.Codec, header.formatVersion, data);
+      if (err != nil) {
+         return 0, errors.Wrapf(err, "Failed to migrate the dirent at index %d.", i);
+      }
+
+      id, entry, err := decodeDirent(header.encoding.Codec, data);
       if (err != nil) {
-         return 0, errors.Wrapf(err, "Error unmarshaling the dirent at index %d (%s).", i, string(scanner.Bytes()));
+         return 0, errors.Wrapf(err, "Error decoding the dirent at index %d (%q).", i, string(data));
       }
 
-      fat[entry.Id] = &entry;
+      fat[id] = entry;
    }
 
-   return version, nil;
+   return header.version, errors.WithStack(entries.finish());
 }
 
 // Write a full fat.
 // This function will not close the given writer.
-func WriteFat(fat map[dirent.Id]*dirent.Dirent, version int, writer *cipherio.CipherWriter) error {
-   err := writeMetadata(writer, len(fat), version);
+func WriteFat(fat map[dirent.Id]*dirent.Dirent, version int, encoding Encoding, writer *cipherio.CipherWriter) error {
+   err := writeHeader(writer, len(fat), version, encoding);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   entries, err := newEntryWriter(writer, encoding);
    if (err != nil) {
       return errors.WithStack(err);
    }
 
    // Write all the dirents.
    for i, entry := range(fat) {
-      line, err := json.Marshal(entry);
+      data, err := encodeDirent(encoding.Codec, i, entry);
       if (err != nil) {
          return errors.Wrapf(err, "Failed to marshal FAT entry %v.", i);
       }
 
-      _, err = writer.Write([]byte(fmt.Sprintf("%s\n", string(line))));
+      err = entries.write(data);
       if (err != nil) {
          return errors.Wrapf(err, "Failed to write FAT entry %v.", i);
       }
    }
 
-   return nil;
+   return errors.WithStack(entries.finish());
+}
+
+// A dirent as JSON.
+// A delete (a nil entry, which only the cache has) is written as just its id and Deleted.
+type jsonDirent struct {
+   *dirent.Dirent
+   Deleted bool `json:",omitempty"`
+}
+
+func encodeDirent(codec string, id dirent.Id, entry *dirent.Dirent) ([]byte, error) {
+   if (codec == CODEC_BINARY) {
+      return encodeBinaryDirent(id, entry), nil;
+   }
+
+   if (entry == nil) {
+      data, err := json.Marshal(jsonDirent{&dirent.Dirent{Id: id}, true});
+      return data, errors.WithStack(err);
+   }
+
+   data, err := json.Marshal(entry);
+   return data, errors.WithStack(err);
+}
+
+// Gives back a nil entry for a delete.
+func decodeDirent(codec string, data []byte) (dirent.Id, *dirent.Dirent, error) {
+   if (codec == CODEC_BINARY) {
+      return decodeBinaryDirent(data);
+   }
+
+   var entry jsonDirent = jsonDirent{&dirent.Dirent{}, false};
+   err := json.Unmarshal(data, &entry);
+   if (err != nil) {
+      return "", nil, errors.WithStack(err);
+   }
+
+   if (entry.Deleted) {
+      return entry.Id, nil, nil;
+   }
+
+   return entry.Id, entry.Dirent, nil;
 }
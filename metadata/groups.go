@@ -5,7 +5,6 @@ package metadata;
 import (
     "bufio"
     "encoding/json"
-    "fmt"
     "io"
 
     "github.com/pkg/errors"
@@ -19,7 +18,7 @@ import (
 // This function will not clear the given groups.
 // However, the reader WILL be closed.
 func ReadGroups(groups map[identity.GroupId]*identity.Group, reader util.ReadSeekCloser) (int, error) {
-    version, err := ReadGroupsWithScanner(groups, bufio.NewScanner(reader));
+    version, err := ReadGroupsWithReader(groups, NewReader(reader));
     if (err != nil) {
         return 0, errors.WithStack(err);
     }
@@ -27,61 +26,110 @@ func ReadGroups(groups map[identity.GroupId]*identity.Group, reader util.ReadSee
     return version, errors.WithStack(reader.Close());
 }
 
-// Same as the other read, but we will read directly from a deocder
+// Same as the other read, but we will read directly from a reader
 // owned by someone else.
 // This is expecially useful if there are multiple
 // sections of metadata written to the same file.
-func ReadGroupsWithScanner(groups map[identity.GroupId]*identity.Group, scanner *bufio.Scanner) (int, error) {
-    size, version, err := scanMetadata(scanner);
+func ReadGroupsWithReader(groups map[identity.GroupId]*identity.Group, reader *bufio.Reader) (int, error) {
+    header, err := readHeader(reader);
     if (err != nil) {
         return 0, errors.WithStack(err);
     }
 
-    // Read all the groups.
-    for i := 0; i < size; i++ {
-        var entry identity.Group;
-
-        if (!scanner.Scan()) {
-            err = scanner.Err();
+    var entries *entryReader = newEntryReader(reader, header.encoding);
 
-            if (err == nil) {
-                return 0, errors.Wrapf(io.EOF, "Early end of Groups. Only read %d of %d entries.", i , size);
+    // Read all the groups.
+    for i := 0; i < header.size; i++ {
+        data, err := entries.next();
+        if (err != nil) {
+            if (errors.Cause(err) == io.EOF) {
+                return 0, errors.Wrapf(io.EOF, "Early end of Groups. Only read %d of %d entries.", i , header.size);
             } else {
-                return 0, errors.Wrapf(err, "Bad scan on Groups entry %d.", i);
+                return 0, errors.Wrapf(err, "Bad read on Groups entry %d.", i);
             }
         }
 
-        err = json.Unmarshal(scanner.Bytes(), &entry);
+        data, err = migrateEntry(TABLE_GROUPS, header.encoding.Codec, header.formatVersion, data);
+        if (err != nil) {
+            return 0, errors.Wrapf(err, "Failed to migrate the group at index %d.", i);
+        }
+
+        id, entry, err := decodeGroup(header.encoding.Codec, data);
         if (err != nil) {
-            return 0, errors.Wrapf(err, "Error unmarshaling the group at index %d (%s).", i, string(scanner.Bytes()));
+            return 0, errors.Wrapf(err, "Error decoding the group at index %d (%q).", i, string(data));
         }
 
-        groups[entry.Id] = &entry;
+        groups[id] = entry;
     }
 
-    return version, nil;
+    return header.version, errors.WithStack(entries.finish());
 }
 
 // Write all groups.
 // This function will not close the given writer.
-func WriteGroups(groups map[identity.GroupId]*identity.Group, version int, writer *cipherio.CipherWriter) error {
-    err := writeMetadata(writer, len(groups), version);
+func WriteGroups(groups map[identity.GroupId]*identity.Group, version int, encoding Encoding, writer *cipherio.CipherWriter) error {
+    err := writeHeader(writer, len(groups), version, encoding);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    entries, err := newEntryWriter(writer, encoding);
     if (err != nil) {
         return errors.WithStack(err);
     }
 
     // Write all the groups.
     for i, entry := range(groups) {
-        line, err := json.Marshal(entry);
+        data, err := encodeGroup(encoding.Codec, i, entry);
         if (err != nil) {
             return errors.Wrapf(err, "Failed to marshal Group entry %d.", i);
         }
 
-        _, err = writer.Write([]byte(fmt.Sprintf("%s\n", string(line))));
+        err = entries.write(data);
         if (err != nil) {
             return errors.Wrapf(err, "Failed to write Group entry %d.", i);
         }
     }
 
-    return nil;
+    return errors.WithStack(entries.finish());
+}
+
+// A group as JSON.
+// A delete (a nil entry, which only the cache has) is written as just its id and Deleted.
+type jsonGroup struct {
+    *identity.Group
+    Deleted bool `json:",omitempty"`
+}
+
+func encodeGroup(codec string, id identity.GroupId, entry *identity.Group) ([]byte, error) {
+    if (codec == CODEC_BINARY) {
+        return encodeBinaryGroup(id, entry), nil;
+    }
+
+    if (entry == nil) {
+        data, err := json.Marshal(jsonGroup{&identity.Group{Id: id}, true});
+        return data, errors.WithStack(err);
+    }
+
+    data, err := json.Marshal(entry);
+    return data, errors.WithStack(err);
+}
+
+// Gives back a nil entry for a delete.
+func decodeGroup(codec string, data []byte) (identity.GroupId, *identity.Group, error) {
+    if (codec == CODEC_BINARY) {
+        return decodeBinaryGroup(data);
+    }
+
+    var entry jsonGroup = jsonGroup{&identity.Group{}, false};
+    err := json.Unmarshal(data, &entry);
+    if (err != nil) {
+        return 0, nil, errors.WithStack(err);
+    }
+
+    if (entry.Deleted) {
+        return entry.Id, nil, nil;
+    }
+
+    return entry.Id, entry.Group, nil;
 }
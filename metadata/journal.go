@@ -0,0 +1,216 @@
+package metadata;
+
+// Read and write segments of the metadata journal.
+// A segment holds every entry that changed in the fat, users, and groups since the segment before it.
+// Each line is one entry, and an entry without a value is a removal.
+// Segments are small and short-lived, so they are always JSON.
+
+import (
+   "bufio"
+   "encoding/json"
+   "fmt"
+   "io"
+   "strconv"
+
+   "github.com/pkg/errors"
+
+   "github.com/eriq-augustine/elfs/cipherio"
+   "github.com/eriq-augustine/elfs/dirent"
+   "github.com/eriq-augustine/elfs/identity"
+   "github.com/eriq-augustine/elfs/util"
+)
+
+const (
+   JOURNAL_TABLE_FAT = TABLE_FAT
+   JOURNAL_TABLE_USERS = TABLE_USERS
+   JOURNAL_TABLE_GROUPS = TABLE_GROUPS
+)
+
+// Nil values represent removals (just like in the MetadataCache).
+type JournalSegment struct {
+   Sequence int
+   Fat map[dirent.Id]*dirent.Dirent
+   Users map[identity.UserId]*identity.User
+   Groups map[identity.GroupId]*identity.Group
+}
+
+type journalEntry struct {
+   Table string
+   Id string
+   Value json.RawMessage `json:",omitempty"`
+}
+
+func NewJournalSegment(sequence int) *JournalSegment {
+   return &JournalSegment{
+      Sequence: sequence,
+      Fat: make(map[dirent.Id]*dirent.Dirent),
+      Users: make(map[identity.UserId]*identity.User),
+      Groups: make(map[identity.GroupId]*identity.Group),
+   };
+}
+
+func (this *JournalSegment) Size() int {
+   return len(this.Fat) + len(this.Users) + len(this.Groups);
+}
+
+// Read a full segment.
+// The reader WILL be closed.
+func ReadJournalSegment(reader util.ReadSeekCloser) (*JournalSegment, error) {
+   var bufferedReader *bufio.Reader = NewReader(reader);
+
+   header, err := readHeader(bufferedReader);
+   if (err != nil) {
+      reader.Close();
+      return nil, errors.WithStack(err);
+   }
+
+   if (header.encoding.Codec != CODEC_JSON) {
+      reader.Close();
+      return nil, errors.Errorf("Journal segments can only be JSON, found: [%s].", header.encoding.String());
+   }
+
+   var segment *JournalSegment = NewJournalSegment(header.version);
+   var entries *entryReader = newEntryReader(bufferedReader, header.encoding);
+
+   for i := 0; i < header.size; i++ {
+      line, err := entries.next();
+      if (err != nil) {
+         reader.Close();
+
+         if (errors.Cause(err) == io.EOF) {
+            return nil, errors.Wrapf(io.EOF, "Early end of journal segment. Only read %d of %d entries.", i, header.size);
+         } else {
+            return nil, errors.Wrapf(err, "Bad read on journal entry %d.", i);
+         }
+      }
+
+      err = segment.addEntry(line, header.formatVersion);
+      if (err != nil) {
+         reader.Close();
+         return nil, errors.Wrapf(err, "Bad journal entry at index %d (%s).", i, string(line));
+      }
+   }
+
+   err = entries.finish();
+   if (err != nil) {
+      reader.Close();
+      return nil, errors.WithStack(err);
+   }
+
+   return segment, errors.WithStack(reader.Close());
+}
+
+// Write a full segment.
+// This function will not close the given writer.
+func WriteJournalSegment(segment *JournalSegment, writer *cipherio.CipherWriter) error {
+   err := writeHeader(writer, segment.Size(), segment.Sequence, JSON_ENCODING);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   for id, entry := range(segment.Fat) {
+      err = writeJournalEntry(writer, JOURNAL_TABLE_FAT, string(id), entry, entry == nil);
+      if (err != nil) {
+         return errors.WithStack(err);
+      }
+   }
+
+   for id, entry := range(segment.Users) {
+      err = writeJournalEntry(writer, JOURNAL_TABLE_USERS, strconv.Itoa(int(id)), entry, entry == nil);
+      if (err != nil) {
+         return errors.WithStack(err);
+      }
+   }
+
+   for id, entry := range(segment.Groups) {
+      err = writeJournalEntry(writer, JOURNAL_TABLE_GROUPS, strconv.Itoa(int(id)), entry, entry == nil);
+      if (err != nil) {
+         return errors.WithStack(err);
+      }
+   }
+
+   return nil;
+}
+
+// |removed| is separate from |value| since a typed nil is not a nil interface.
+func writeJournalEntry(writer io.Writer, table string, id string, value interface{}, removed bool) error {
+   var entry journalEntry = journalEntry{
+      Table: table,
+      Id: id,
+   };
+
+   if (!removed) {
+      data, err := json.Marshal(value);
+      if (err != nil) {
+         return errors.Wrapf(err, "Failed to marshal journal entry %s/%s.", table, id);
+      }
+
+      entry.Value = data;
+   }
+
+   line, err := json.Marshal(&entry);
+   if (err != nil) {
+      return errors.Wrapf(err, "Failed to marshal journal entry %s/%s.", table, id);
+   }
+
+   _, err = writer.Write([]byte(fmt.Sprintf("%s\n", string(line))));
+   if (err != nil) {
+      return errors.Wrapf(err, "Failed to write journal entry %s/%s.", table, id);
+   }
+
+   return nil;
+}
+
+// Values are migrated on their own (as entries of their table).
+func (this *JournalSegment) addEntry(line []byte, formatVersion int) error {
+   var entry journalEntry;
+   err := json.Unmarshal(line, &entry);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   if (entry.Value != nil) {
+      entry.Value, err = migrateEntry(entry.Table, CODEC_JSON, formatVersion, entry.Value);
+      if (err != nil) {
+         return errors.WithStack(err);
+      }
+   }
+
+   if (entry.Table == JOURNAL_TABLE_FAT) {
+      var value *dirent.Dirent = nil;
+      if (entry.Value != nil) {
+         value = &dirent.Dirent{};
+         err = json.Unmarshal(entry.Value, value);
+      }
+
+      this.Fat[dirent.Id(entry.Id)] = value;
+      return errors.WithStack(err);
+   }
+
+   numericId, err := strconv.Atoi(entry.Id);
+   if (err != nil) {
+      return errors.WithStack(err);
+   }
+
+   if (entry.Table == JOURNAL_TABLE_USERS) {
+      var value *identity.User = nil;
+      if (entry.Value != nil) {
+         value = &identity.User{};
+         err = json.Unmarshal(entry.Value, value);
+      }
+
+      this.Users[identity.UserId(numericId)] = value;
+      return errors.WithStack(err);
+   } else if (entry.Table == JOURNAL_TABLE_GROUPS) {
+      var value *identity.Group = nil;
+      if (entry.Value != nil) {
+         value = &identity.Group{};
+         err = json.Unmarshal(entry.Value, value);
+      }
+
+      this.Groups[identity.GroupId(numericId)] = value;
+      return errors.WithStack(err);
+   }
+
+   return errors.Errorf("Unknown journal table: [%s].", entry.Table);
+}
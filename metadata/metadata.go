@@ -6,67 +6,132 @@ import (
    "bufio"
    "fmt"
    "io"
+   "strconv"
+   "strings"
 
    "github.com/pkg/errors"
-
-   "github.com/eriq-augustine/elfs/util"
 )
 
 const (
    // If we have file systems in the wild, we will need to make sure we
    // are looking at consistent structure.
-   FORMAT_VERSION = 2
+   // Older formats are migrated as they are read (see migrate.go).
+   FORMAT_VERSION = 3
+
+   // The first format with the encoding in the header (see encoding.go).
+   // Before that, entries were always JSON lines.
+   ENCODING_FORMAT_VERSION = 3
+
+   TABLE_FAT = "fat"
+   TABLE_USERS = "users"
+   TABLE_GROUPS = "groups"
+
+   // Dirents for large files that have been partially rewritten can have a lot of chunk IVs,
+   // so allow entries (and JSON lines) that are very long.
+   // This is just a sanity check on sizes read from storage.
+   MAX_ENTRY_SIZE = 16 * 1024 * 1024
 )
 
-// Scan the metadata elements of the metadata file.
-// Verify the version and return the size and version.
+// The metadata elements of a metadata file.
 // Note that the version is the metadata version, not the
 // format version.
-func scanMetadata(scanner *bufio.Scanner) (int, int, error) {
-   var formatVersion int;
-   var size int;
-   var version int;
+type metadataHeader struct {
+   formatVersion int
+   size int
+   version int
+   encoding Encoding
+}
+
+// Get a reader that can be shared by several tables written to the same stream (see the *WithReader functions).
+func NewReader(reader io.Reader) *bufio.Reader {
+   return bufio.NewReader(reader);
+}
+
+// Read the metadata elements of the metadata file.
+// Verify the format version.
+// Entries in an older format need to be migrated (see migrateEntry()).
+func readHeader(reader *bufio.Reader) (*metadataHeader, error) {
+   var header metadataHeader = metadataHeader{encoding: JSON_ENCODING};
    var err error;
 
-   formatVersion, err = util.ScanInt(scanner);
+   header.formatVersion, err = readInt(reader);
    if (err != nil) {
-      return 0, 0, errors.WithStack(err);
+      return nil, errors.WithStack(err);
    }
 
-   if (formatVersion != FORMAT_VERSION) {
-      return 0, 0, errors.Errorf(
-            "Mismatch in FAT format version. Expected: %d, Found: %d", FORMAT_VERSION, formatVersion);
+   err = checkFormatVersion(header.formatVersion);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
    }
 
-   size, err = util.ScanInt(scanner);
+   header.size, err = readInt(reader);
    if (err != nil) {
-      return 0, 0, errors.WithStack(err);
+      return nil, errors.WithStack(err);
    }
 
-   version, err = util.ScanInt(scanner);
+   header.version, err = readInt(reader);
    if (err != nil) {
-      return 0, 0, errors.WithStack(err);
+      return nil, errors.WithStack(err);
+   }
+
+   if (header.formatVersion >= ENCODING_FORMAT_VERSION) {
+      line, err := readLine(reader);
+      if (err != nil) {
+         return nil, errors.WithStack(err);
+      }
+
+      header.encoding, err = ParseEncoding(line);
+      if (err != nil) {
+         return nil, errors.WithStack(err);
+      }
    }
 
-   return size, version, nil;
+   return &header, nil;
 }
 
 // Write the metadata elements of the metadata file.
-func writeMetadata(writer io.Writer, size int, version int) (error) {
-   _, err := writer.Write([]byte(fmt.Sprintf("%d\n", FORMAT_VERSION)));
-   if (err != nil) {
-      return errors.WithStack(err);
+func writeHeader(writer io.Writer, size int, version int, encoding Encoding) (error) {
+   _, err := writer.Write([]byte(fmt.Sprintf("%d\n%d\n%d\n%s\n", FORMAT_VERSION, size, version, encoding.String())));
+   return errors.WithStack(err);
+}
+
+// Read a full line (without the newline).
+// The last line does not need a newline.
+func readLine(reader *bufio.Reader) (string, error) {
+   var line strings.Builder;
+
+   for {
+      fragment, isPrefix, err := reader.ReadLine();
+      if (err != nil) {
+         // A failed read (eg the wrong key) should not look like the end of the data.
+         if (err == io.EOF) {
+            return "", io.EOF;
+         }
+
+         return "", errors.WithStack(err);
+      }
+
+      if (line.Len() + len(fragment) > MAX_ENTRY_SIZE) {
+         return "", errors.Errorf("Line is too long (the most is %d bytes).", MAX_ENTRY_SIZE);
+      }
+
+      line.Write(fragment);
+      if (!isPrefix) {
+         return line.String(), nil;
+      }
    }
+}
 
-   _, err = writer.Write([]byte(fmt.Sprintf("%d\n", size)));
+func readInt(reader *bufio.Reader) (int, error) {
+   line, err := readLine(reader);
    if (err != nil) {
-      return errors.WithStack(err);
+      return 0, errors.WithStack(err);
    }
 
-   _, err = writer.Write([]byte(fmt.Sprintf("%d\n", version)));
+   value, err := strconv.Atoi(line);
    if (err != nil) {
-      return errors.WithStack(err);
+      return 0, errors.Wrapf(err, "Failed to read int from '%s'.", line);
    }
 
-   return nil;
+   return value, nil;
 }
@@ -0,0 +1,85 @@
+package metadata;
+
+// Migrations bring metadata that was written in an older format up to FORMAT_VERSION as it is read.
+// Each migration takes a single entry from format N to N+1, and they are chained to get from any older format.
+// Metadata is only ever written in the current format,
+// so rewriting all of it (see driver.Driver.UpgradeMetadata()) finishes an upgrade.
+//
+// Metadata in a newer format than FORMAT_VERSION is never read,
+// since anything written back would silently drop whatever the newer format added.
+//
+// Every format that can still be read has fixtures in testdata/format_<version>.
+
+import (
+   "github.com/pkg/errors"
+)
+
+const (
+   // The oldest format that can be read.
+   MIN_FORMAT_VERSION = 2
+)
+
+// Upgrade a single entry (as it was written, in |codec|) of |table| (a TABLE_* constant)
+// from the format before this migration's.
+type Migration func(table string, codec string, entry []byte) ([]byte, error)
+
+// Migrations by the format they upgrade from.
+var migrations map[int]Migration = make(map[int]Migration);
+
+func init() {
+   // Format 3 added the encoding to the header (see encoding.go).
+   // Format 2 entries are all JSON, and JSON entries did not change.
+   registerMigration(2, func(table string, codec string, entry []byte) ([]byte, error) {
+      return entry, nil;
+   });
+}
+
+// Add the migration from format |from| to |from| + 1.
+// Should only be called from init().
+func registerMigration(from int, migration Migration) {
+   _, exists := migrations[from];
+   if (exists) {
+      panic(errors.Errorf("Two migrations from metadata format %d.", from));
+   }
+
+   migrations[from] = migration;
+}
+
+// Make sure that metadata in |formatVersion| can be read.
+func checkFormatVersion(formatVersion int) error {
+   if (formatVersion > FORMAT_VERSION) {
+      return errors.Errorf(
+            "Metadata is in format %d, but this version of elfs only knows formats up to %d. " +
+            "Refusing to read it, since writing it back would downgrade it. Upgrade elfs instead.",
+            formatVersion, FORMAT_VERSION);
+   }
+
+   if (formatVersion < MIN_FORMAT_VERSION) {
+      return errors.Errorf("Metadata is in format %d, which is older than any format that can be read (%d).",
+            formatVersion, MIN_FORMAT_VERSION);
+   }
+
+   for version := formatVersion; version < FORMAT_VERSION; version++ {
+      _, exists := migrations[version];
+      if (!exists) {
+         return errors.Errorf("No migration for metadata from format %d to %d.", version, version + 1);
+      }
+   }
+
+   return nil;
+}
+
+// Bring an entry of |table| (in |codec|) from |formatVersion| up to the current format.
+// |formatVersion| must have already been checked (see checkFormatVersion()).
+func migrateEntry(table string, codec string, formatVersion int, entry []byte) ([]byte, error) {
+   var err error;
+
+   for version := formatVersion; version < FORMAT_VERSION; version++ {
+      entry, err = migrations[version](table, codec, entry);
+      if (err != nil) {
+         return nil, errors.Wrapf(err, "Failed to migrate %s entry from format %d to %d.", table, version, version + 1);
+      }
+   }
+
+   return entry, nil;
+}
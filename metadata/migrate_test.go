@@ -0,0 +1,193 @@
+package metadata;
+
+// Every format in testdata must still read, and (after migration) read the same as every other format.
+
+import (
+   "fmt"
+   "os"
+   "path/filepath"
+   "reflect"
+   "testing"
+
+   "github.com/eriq-augustine/elfs/dirent"
+   "github.com/eriq-augustine/elfs/identity"
+)
+
+const (
+   TESTDATA_DIR = "testdata"
+)
+
+// The fixtures all hold the same tables.
+const (
+   FIXTURE_FAT_SIZE = 5
+   FIXTURE_USERS_SIZE = 2
+   FIXTURE_GROUPS_SIZE = 2
+   FIXTURE_NOTES_ID = dirent.Id("f1f1f1f1f1f1f1f1f1f1f1f1f1f1f1f1")
+   FIXTURE_REMOVED_ID = dirent.Id("a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0")
+   // The format 2 fixtures were written by the original writer (see testdata/README.md),
+   // which had no cipher versions, per-file keys, chunk IVs, or storage classes.
+   FIXTURE_LEGACY_FORMAT = 2
+)
+
+type fixtureTables struct {
+   fat map[dirent.Id]*dirent.Dirent
+   users map[identity.UserId]*identity.User
+   groups map[identity.GroupId]*identity.Group
+   journal *JournalSegment
+}
+
+func TestFixturesRead(test *testing.T) {
+   for version := MIN_FORMAT_VERSION; version <= FORMAT_VERSION; version++ {
+      tables := readFixtures(test, version);
+
+      if (len(tables.fat) != FIXTURE_FAT_SIZE || len(tables.users) != FIXTURE_USERS_SIZE || len(tables.groups) != FIXTURE_GROUPS_SIZE) {
+         test.Fatalf("Format %d: wrong table sizes (fat: %d, users: %d, groups: %d).",
+               version, len(tables.fat), len(tables.users), len(tables.groups));
+      }
+
+      root, ok := tables.fat[dirent.ROOT_ID];
+      if (!ok || root == nil || root.IsFile) {
+         test.Fatalf("Format %d: no root dir.", version);
+      }
+
+      notes, ok := tables.fat[FIXTURE_NOTES_ID];
+      if (!ok || notes == nil || notes.Name != "notes.txt" || notes.Size != 12) {
+         test.Fatalf("Format %d: bad notes.txt: %+v.", version, notes);
+      }
+
+      if (version == FIXTURE_LEGACY_FORMAT) {
+         for id, entry := range(tables.fat) {
+            if (!reflect.DeepEqual(entry, legacyDirent(entry))) {
+               test.Fatalf("Format %d: %s is not a legacy entry: %+v.", version, id, entry);
+            }
+         }
+      } else if (len(notes.Key) == 0 || notes.CipherVersion == 0) {
+         test.Fatalf("Format %d: notes.txt has no key or cipher version: %+v.", version, notes);
+      }
+
+      if (!tables.groups[identity.ROOT_GROUP_ID].Members[identity.ROOT_USER_ID]) {
+         test.Fatalf("Format %d: root is not in the root group.", version);
+      }
+
+      // The journal holds a change, removals, and a user.
+      if (tables.journal.Fat[FIXTURE_NOTES_ID] == nil || tables.journal.Fat[FIXTURE_NOTES_ID].Size != 20) {
+         test.Fatalf("Format %d: bad journal change: %+v.", version, tables.journal.Fat[FIXTURE_NOTES_ID]);
+      }
+
+      removed, ok := tables.journal.Fat[FIXTURE_REMOVED_ID];
+      if (!ok || removed != nil) {
+         test.Fatalf("Format %d: journal removal was not read as a removal.", version);
+      }
+   }
+}
+
+// Older formats are migrated into the same tables that the current format holds
+// (less anything that the legacy fixtures could not have held).
+func TestFixturesMigrate(test *testing.T) {
+   for version := MIN_FORMAT_VERSION; version < FORMAT_VERSION; version++ {
+      expected := readFixtures(test, FORMAT_VERSION);
+      tables := readFixtures(test, version);
+
+      if (version == FIXTURE_LEGACY_FORMAT) {
+         legacyFat(expected.fat);
+         legacyFat(expected.journal.Fat);
+      }
+
+      if (!reflect.DeepEqual(expected.fat, tables.fat)) {
+         test.Fatalf("Format %d: fat does not match format %d after migration.", version, FORMAT_VERSION);
+      }
+
+      if (!reflect.DeepEqual(expected.users, tables.users)) {
+         test.Fatalf("Format %d: users do not match format %d after migration.", version, FORMAT_VERSION);
+      }
+
+      if (!reflect.DeepEqual(expected.groups, tables.groups)) {
+         test.Fatalf("Format %d: groups do not match format %d after migration.", version, FORMAT_VERSION);
+      }
+
+      if (!reflect.DeepEqual(expected.journal.Fat, tables.journal.Fat) ||
+            !reflect.DeepEqual(expected.journal.Users, tables.journal.Users) ||
+            !reflect.DeepEqual(expected.journal.Groups, tables.journal.Groups)) {
+         test.Fatalf("Format %d: journal does not match format %d after migration.", version, FORMAT_VERSION);
+      }
+   }
+}
+
+func TestCheckFormatVersion(test *testing.T) {
+   for version := MIN_FORMAT_VERSION; version <= FORMAT_VERSION; version++ {
+      err := checkFormatVersion(version);
+      if (err != nil) {
+         test.Fatalf("Format %d should be readable: %v", version, err);
+      }
+   }
+
+   if (checkFormatVersion(FORMAT_VERSION + 1) == nil) {
+      test.Fatalf("A newer format should be refused.");
+   }
+
+   if (checkFormatVersion(MIN_FORMAT_VERSION - 1) == nil) {
+      test.Fatalf("A format older than the oldest should be refused.");
+   }
+}
+
+// A copy of |entry| with only the fields that the original writer had.
+func legacyDirent(entry *dirent.Dirent) *dirent.Dirent {
+   if (entry == nil) {
+      return nil;
+   }
+
+   var legacy dirent.Dirent = *entry;
+   legacy.ChunkIVs = nil;
+   legacy.CipherVersion = 0;
+   legacy.Key = nil;
+   legacy.StorageClass = "";
+
+   return &legacy;
+}
+
+func legacyFat(fat map[dirent.Id]*dirent.Dirent) {
+   for id, entry := range(fat) {
+      fat[id] = legacyDirent(entry);
+   }
+}
+
+func readFixtures(test *testing.T, version int) *fixtureTables {
+   var dir string = filepath.Join(TESTDATA_DIR, fmt.Sprintf("format_%d", version));
+   var tables fixtureTables = fixtureTables{
+      fat: make(map[dirent.Id]*dirent.Dirent),
+      users: make(map[identity.UserId]*identity.User),
+      groups: make(map[identity.GroupId]*identity.Group),
+      journal: nil,
+   };
+
+   _, err := ReadFat(tables.fat, openFixture(test, dir, TABLE_FAT));
+   if (err != nil) {
+      test.Fatalf("Format %d: failed to read fat: %+v", version, err);
+   }
+
+   _, err = ReadUsers(tables.users, openFixture(test, dir, TABLE_USERS));
+   if (err != nil) {
+      test.Fatalf("Format %d: failed to read users: %+v", version, err);
+   }
+
+   _, err = ReadGroups(tables.groups, openFixture(test, dir, TABLE_GROUPS));
+   if (err != nil) {
+      test.Fatalf("Format %d: failed to read groups: %+v", version, err);
+   }
+
+   tables.journal, err = ReadJournalSegment(openFixture(test, dir, "journal"));
+   if (err != nil) {
+      test.Fatalf("Format %d: failed to read journal: %+v", version, err);
+   }
+
+   return &tables;
+}
+
+func openFixture(test *testing.T, dir string, name string) *os.File {
+   file, err := os.Open(filepath.Join(dir, name));
+   if (err != nil) {
+      test.Fatalf("Missing fixture: %v", err);
+   }
+
+   return file;
+}
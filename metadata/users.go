@@ -5,7 +5,6 @@ package metadata;
 import (
     "bufio"
     "encoding/json"
-    "fmt"
     "io"
 
     "github.com/pkg/errors"
@@ -19,64 +18,118 @@ import (
 // This function will not clear the given users.
 // However, the reader WILL be closed.
 func ReadUsers(users map[identity.UserId]*identity.User, reader util.ReadSeekCloser) (int, error) {
-    version, err := ReadUsersWithScanner(users, bufio.NewScanner(reader));
+    version, err := ReadUsersWithReader(users, NewReader(reader));
     if (err != nil) {
         return 0, errors.WithStack(err);
     }
 
     return version, errors.WithStack(reader.Close());
 }
-func ReadUsersWithScanner(users map[identity.UserId]*identity.User, scanner *bufio.Scanner) (int, error) {
-    size, version, err := scanMetadata(scanner);
+
+// Same as the other read, but we will read directly from a reader
+// owned by someone else.
+// This is expecially useful if there are multiple
+// sections of metadata written to the same file.
+func ReadUsersWithReader(users map[identity.UserId]*identity.User, reader *bufio.Reader) (int, error) {
+    header, err := readHeader(reader);
     if (err != nil) {
         return 0, errors.WithStack(err);
     }
 
-    // Read all the users.
-    for i := 0; i < size; i++ {
-        var entry identity.User;
-
-        if (!scanner.Scan()) {
-            err = scanner.Err();
+    var entries *entryReader = newEntryReader(reader, header.encoding);
 
-            if (err == nil) {
-                return 0, errors.Wrapf(io.EOF, "Early end of Users. Only read %d of %d entries.", i , size);
+    // Read all the users.
+    for i := 0; i < header.size; i++ {
+        data, err := entries.next();
+        if (err != nil) {
+            if (errors.Cause(err) == io.EOF) {
+                return 0, errors.Wrapf(io.EOF, "Early end of Users. Only read %d of %d entries.", i , header.size);
             } else {
-                return 0, errors.Wrapf(err, "Bad scan on Users entry %d.", i);
+                return 0, errors.Wrapf(err, "Bad read on Users entry %d.", i);
             }
         }
 
-        err = json.Unmarshal(scanner.Bytes(), &entry);
+        data, err = migrateEntry(TABLE_USERS, header.encoding.Codec, header.formatVersion, data);
+        if (err != nil) {
+            return 0, errors.Wrapf(err, "Failed to migrate the user at index %d.", i);
+        }
+
+        id, entry, err := decodeUser(header.encoding.Codec, data);
         if (err != nil) {
-            return 0, errors.Wrapf(err, "Error unmarshaling the user at index %d (%s).", i, string(scanner.Bytes()));
+            return 0, errors.Wrapf(err, "Error decoding the user at index %d (%q).", i, string(data));
         }
 
-        users[entry.Id] = &entry;
+        users[id] = entry;
     }
 
-    return version, nil;
+    return header.version, errors.WithStack(entries.finish());
 }
 
 // Write all users.
 // This function will not close the given writer.
-func WriteUsers(users map[identity.UserId]*identity.User, version int, writer *cipherio.CipherWriter) error {
-    err := writeMetadata(writer, len(users), version);
+func WriteUsers(users map[identity.UserId]*identity.User, version int, encoding Encoding, writer *cipherio.CipherWriter) error {
+    err := writeHeader(writer, len(users), version, encoding);
+    if (err != nil) {
+        return errors.WithStack(err);
+    }
+
+    entries, err := newEntryWriter(writer, encoding);
     if (err != nil) {
         return errors.WithStack(err);
     }
 
     // Write all the users.
     for i, entry := range(users) {
-        line, err := json.Marshal(entry);
+        data, err := encodeUser(encoding.Codec, i, entry);
         if (err != nil) {
             return errors.Wrapf(err, "Failed to marshal User entry %d.", i);
         }
 
-        _, err = writer.Write([]byte(fmt.Sprintf("%s\n", string(line))));
+        err = entries.write(data);
         if (err != nil) {
             return errors.Wrapf(err, "Failed to write User entry %d.", i);
         }
     }
 
-    return nil;
+    return errors.WithStack(entries.finish());
+}
+
+// A user as JSON.
+// A delete (a nil entry, which only the cache has) is written as just its id and Deleted.
+type jsonUser struct {
+    *identity.User
+    Deleted bool `json:",omitempty"`
+}
+
+func encodeUser(codec string, id identity.UserId, entry *identity.User) ([]byte, error) {
+    if (codec == CODEC_BINARY) {
+        return encodeBinaryUser(id, entry), nil;
+    }
+
+    if (entry == nil) {
+        data, err := json.Marshal(jsonUser{&identity.User{Id: id}, true});
+        return data, errors.WithStack(err);
+    }
+
+    data, err := json.Marshal(entry);
+    return data, errors.WithStack(err);
+}
+
+// Gives back a nil entry for a delete.
+func decodeUser(codec string, data []byte) (identity.UserId, *identity.User, error) {
+    if (codec == CODEC_BINARY) {
+        return decodeBinaryUser(data);
+    }
+
+    var entry jsonUser = jsonUser{&identity.User{}, false};
+    err := json.Unmarshal(data, &entry);
+    if (err != nil) {
+        return 0, nil, errors.WithStack(err);
+    }
+
+    if (entry.Deleted) {
+        return entry.Id, nil, nil;
+    }
+
+    return entry.Id, entry.User, nil;
 }
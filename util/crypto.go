@@ -44,6 +44,40 @@ func Weakhash(username string, password string) string {
    return SHA256Hex(saltedData);
 }
 
+// Wrap (encrypt) a key with a key-encryption key.
+// The wrapped key is: IV | sealed key.
+// |additionalData| ties the wrapped key to its owner (eg a dirent id),
+// so wrapped keys cannot be swapped around.
+func WrapKey(kek cipher.Block, key []byte, additionalData []byte) ([]byte, error) {
+   gcm, err := cipher.NewGCM(kek);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   var wrappedKey []byte = make([]byte, 0, IV_LENGTH + len(key) + gcm.Overhead());
+   wrappedKey = append(wrappedKey, GenIV()...);
+
+   return gcm.Seal(wrappedKey, wrappedKey[0:IV_LENGTH], key, additionalData), nil;
+}
+
+func UnwrapKey(kek cipher.Block, wrappedKey []byte, additionalData []byte) ([]byte, error) {
+   gcm, err := cipher.NewGCM(kek);
+   if (err != nil) {
+      return nil, errors.WithStack(err);
+   }
+
+   if (len(wrappedKey) < IV_LENGTH + gcm.Overhead()) {
+      return nil, errors.Errorf("Wrapped key is too short: %d bytes.", len(wrappedKey));
+   }
+
+   key, err := gcm.Open(nil, wrappedKey[0:IV_LENGTH], wrappedKey[IV_LENGTH:], additionalData);
+   if (err != nil) {
+      return nil, errors.Wrap(err, "Failed to unwrap key");
+   }
+
+   return key, nil;
+}
+
 // One-off encryption and decryption.
 // This is not meant for huge chunks of data.
 func Encrypt(key []byte, iv []byte, cleartext []byte) ([]byte, error) {
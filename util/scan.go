@@ -11,6 +11,11 @@ import (
 // Will Scan() the scanner once and read the contents as a string.
 func ScanInt(scanner *bufio.Scanner) (int, error) {
    if (!scanner.Scan()) {
+      // A failed read (eg the wrong key) should not look like the end of the data.
+      if (scanner.Err() != nil) {
+         return 0, errors.WithStack(scanner.Err());
+      }
+
       return 0, io.EOF;
    }
 